@@ -0,0 +1,118 @@
+package dvara
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/facebookgo/stats"
+)
+
+// AdaptiveLimiter is a PoolLimiter which lets the number of concurrent server
+// operations float between Min and Max depending on their latency. It uses
+// additive increase and multiplicative decrease: the limit grows by one after
+// a limit worth of operations complete within Target, and is multiplied by
+// Backoff when one doesn't. So a degraded server gets fewer concurrent
+// operations instead of a growing queue.
+type AdaptiveLimiter struct {
+	// Min and Max bound the limit, which starts at Max.
+	Min uint
+	Max uint
+
+	// Target is the latency above which an operation is considered slow.
+	Target time.Duration
+
+	// Backoff is the factor the limit is multiplied by when an operation is
+	// slow or fails, between 0 and 1.
+	Backoff float64
+
+	// Stats is optional and receives the adjustments of the limit.
+	Stats stats.Client
+
+	// Changed is optional and called when the limit changes, typically
+	// Pool.LimitChanged.
+	Changed func()
+
+	mutex        sync.Mutex
+	once         sync.Once
+	limit        float64
+	sinceBackoff uint
+	current      uint32
+}
+
+func (a *AdaptiveLimiter) init() {
+	if a.Min == 0 {
+		a.Min = 1
+	}
+	if a.Max < a.Min {
+		a.Max = a.Min
+	}
+	if a.Backoff <= 0 || a.Backoff >= 1 {
+		a.Backoff = 0.9
+	}
+	a.limit = float64(a.Max)
+	a.sinceBackoff = a.Max
+	atomic.StoreUint32(&a.current, uint32(a.Max))
+}
+
+// Limit returns the current limit.
+func (a *AdaptiveLimiter) Limit() uint {
+	a.once.Do(a.init)
+	return uint(atomic.LoadUint32(&a.current))
+}
+
+// Observe records the latency of an operation and whether it succeeded, and
+// adjusts the limit accordingly.
+func (a *AdaptiveLimiter) Observe(latency time.Duration, ok bool) {
+	a.once.Do(a.init)
+	a.mutex.Lock()
+
+	a.sinceBackoff++
+	previous := uint(a.limit)
+	if ok && latency <= a.Target {
+		a.limit += 1 / a.limit
+		if a.limit > float64(a.Max) {
+			a.limit = float64(a.Max)
+		}
+	} else if a.sinceBackoff >= previous {
+		// operations already in flight when we backed off are likely to be slow
+		// too, so we wait for them before backing off again
+		a.limit *= a.Backoff
+		if a.limit < float64(a.Min) {
+			a.limit = float64(a.Min)
+		}
+		a.sinceBackoff = 0
+	}
+
+	limit := uint(a.limit)
+	if limit == previous {
+		a.mutex.Unlock()
+		return
+	}
+	atomic.StoreUint32(&a.current, uint32(limit))
+	a.mutex.Unlock()
+
+	if limit > previous {
+		stats.BumpSum(a.Stats, "adaptive.increase", 1)
+	} else {
+		stats.BumpSum(a.Stats, "adaptive.decrease", 1)
+	}
+	stats.BumpAvg(a.Stats, "adaptive.limit", float64(limit))
+	if a.Changed != nil {
+		a.Changed()
+	}
+}
+
+// MinLimiter limits a Pool to the lowest of several limits.
+type MinLimiter []PoolLimiter
+
+// Limit returns the lowest limit.
+func (m MinLimiter) Limit() uint {
+	var min uint
+	for i, l := range m {
+		if v := l.Limit(); i == 0 || v < min {
+			min = v
+		}
+	}
+	return min
+}
@@ -0,0 +1,69 @@
+package dvara
+
+import (
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestAdaptiveLimiterBackoff(t *testing.T) {
+	t.Parallel()
+	var changed int
+	a := AdaptiveLimiter{
+		Min:     2,
+		Max:     10,
+		Target:  10 * time.Millisecond,
+		Backoff: 0.5,
+		Changed: func() { changed++ },
+	}
+	ensure.DeepEqual(t, a.Limit(), uint(10))
+
+	// a slow message backs off, the ones in flight with it don't
+	a.Observe(time.Second, true)
+	ensure.DeepEqual(t, a.Limit(), uint(5))
+	for i := 0; i < 4; i++ {
+		a.Observe(time.Second, true)
+	}
+	ensure.DeepEqual(t, a.Limit(), uint(5))
+
+	// failures back off too, down to the minimum
+	a.Observe(0, false)
+	ensure.DeepEqual(t, a.Limit(), uint(2))
+	a.Observe(0, false)
+	a.Observe(0, false)
+	ensure.DeepEqual(t, a.Limit(), uint(2))
+	ensure.DeepEqual(t, changed, 2)
+}
+
+func TestAdaptiveLimiterIncrease(t *testing.T) {
+	t.Parallel()
+	a := AdaptiveLimiter{
+		Min:     1,
+		Max:     4,
+		Target:  10 * time.Millisecond,
+		Backoff: 0.5,
+	}
+	a.Observe(time.Second, true)
+	ensure.DeepEqual(t, a.Limit(), uint(2))
+
+	// grows by about one every limit fast messages
+	a.Observe(time.Millisecond, true)
+	a.Observe(time.Millisecond, true)
+	ensure.DeepEqual(t, a.Limit(), uint(2))
+	a.Observe(time.Millisecond, true)
+	ensure.DeepEqual(t, a.Limit(), uint(3))
+	for i := 0; i < 10; i++ {
+		a.Observe(time.Millisecond, true)
+	}
+	ensure.DeepEqual(t, a.Limit(), uint(4))
+}
+
+func TestMinLimiter(t *testing.T) {
+	t.Parallel()
+	a := &AdaptiveLimiter{Max: 5}
+	b := &budgetShare{limit: 3}
+	ensure.DeepEqual(t, MinLimiter{a, b}.Limit(), uint(3))
+	b.setLimit(8)
+	ensure.DeepEqual(t, MinLimiter{a, b}.Limit(), uint(5))
+}
@@ -0,0 +1,158 @@
+package dvara
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+
+	corelog "github.com/intercom/gocore/log"
+)
+
+// AdminServer exposes runtime information about the proxies over HTTP.
+type AdminServer struct {
+	QueryShapeStats  *QueryShapeStats  `inject:""`
+	ConnectionBudget *ConnectionBudget `inject:""`
+	CursorTracker    *CursorTracker    `inject:""`
+	ReadOnly         *ReadOnly         `inject:""`
+	Drivers          *Drivers          `inject:""`
+	StateManager     *StateManager     `inject:""`
+
+	// Addr is the address the admin server listens on. If empty the admin
+	// server is not started.
+	Addr string
+
+	listener net.Listener
+	mux      *http.ServeMux
+}
+
+// Start starts serving admin requests.
+func (a *AdminServer) Start() error {
+	a.mux = http.NewServeMux()
+	a.mux.HandleFunc("/query_shapes", a.queryShapes)
+	a.mux.HandleFunc("/connection_budget", a.connectionBudget)
+	a.mux.HandleFunc("/cursors", a.cursors)
+	a.mux.HandleFunc("/read_only", a.readOnly)
+	a.mux.HandleFunc("/drivers", a.drivers)
+
+	if a.Addr == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", a.Addr)
+	if err != nil {
+		return err
+	}
+	a.listener = l
+	go func() {
+		if err := http.Serve(l, a.mux); err != nil {
+			corelog.LogInfoMessage("admin server stopped", "reason", err)
+		}
+	}()
+	return nil
+}
+
+// Stop stops serving admin requests.
+func (a *AdminServer) Stop() error {
+	if a.listener == nil {
+		return nil
+	}
+	return a.listener.Close()
+}
+
+// ServeHTTP dispatches an admin request.
+func (a *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+// queryShapes lists the most expensive query shapes. The number of shapes is
+// controlled by the "top" parameter. A DELETE resets the aggregates.
+func (a *AdminServer) queryShapes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		top := defaultTopQueryShapes
+		if v := r.FormValue("top"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, "invalid top: "+v, http.StatusBadRequest)
+				return
+			}
+			top = n
+		}
+		writeJSON(w, a.QueryShapeStats.Top(top))
+	case "DELETE":
+		a.QueryShapeStats.Reset()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// connectionBudget lists the current share of the budget of each member.
+func (a *AdminServer) connectionBudget(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.ConnectionBudget.Limits())
+}
+
+// cursors lists the number of cursors each client has open.
+func (a *AdminServer) cursors(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.CursorTracker.Open())
+}
+
+// readOnly shows the read only mode. It is switched with a POST of the
+// "enabled" parameter, for the listener given by the "listener" parameter or
+// process wide if there is none.
+func (a *AdminServer) readOnly(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, "invalid enabled: "+r.FormValue("enabled"), http.StatusBadRequest)
+			return
+		}
+		if listener := r.FormValue("listener"); listener != "" {
+			if !a.knownListener(listener, enabled) {
+				http.Error(w, "unknown listener: "+listener, http.StatusBadRequest)
+				return
+			}
+			a.ReadOnly.SetListener(listener, enabled)
+		} else {
+			a.ReadOnly.Set(enabled)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, a.ReadOnly.Status())
+}
+
+// knownListener returns true if the proxy address is the one of a running
+// proxy. Listeners in read only mode may be switched off once their proxy is
+// gone.
+func (a *AdminServer) knownListener(proxyAddr string, enabled bool) bool {
+	for _, addr := range a.StateManager.ProxyMembers() {
+		if addr == proxyAddr {
+			return true
+		}
+	}
+	if enabled {
+		return false
+	}
+	for _, addr := range a.ReadOnly.Status().Listeners {
+		if addr == proxyAddr {
+			return true
+		}
+	}
+	return false
+}
+
+// drivers lists the number of connected clients by application and driver.
+func (a *AdminServer) drivers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.Drivers.Clients())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		corelog.LogError("error", err)
+	}
+}
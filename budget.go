@@ -0,0 +1,160 @@
+package dvara
+
+import (
+	"sync"
+	"sync/atomic"
+
+	corelog "github.com/intercom/gocore/log"
+)
+
+// PoolLimiter dynamically limits the number of resources a Pool allocates, in
+// addition to its Max. Pool.LimitChanged must be called when the limit grows
+// for waiting Acquire calls to be woken up.
+type PoolLimiter interface {
+	Limit() uint
+}
+
+// ConnectionBudget is a process wide limit on server connections, shared by
+// the pools of all members. Each member is guaranteed a minimum and the rest is
+// split by weights depending on the member's state.
+type ConnectionBudget struct {
+	// Total is the number of server connections shared by all members. Zero
+	// disables the budget.
+	Total uint
+
+	// MinPerMember is the number of connections guaranteed to each member.
+	MinPerMember uint
+
+	// PrimaryWeight and SecondaryWeight are the relative weights used to split
+	// the connections above the minimums. For example with one primary, two
+	// secondaries and weights of 3 and 1 the primary gets 60%.
+	PrimaryWeight   float64
+	SecondaryWeight float64
+
+	mutex   sync.Mutex
+	members map[string]*budgetShare
+	states  map[string]ReplicaState
+}
+
+// Enabled returns true if the budget is configured.
+func (b *ConnectionBudget) Enabled() bool {
+	return b != nil && b.Total > 0
+}
+
+// Join adds the member's pool to the budget, setting its Limiter or combining
+// it with an existing one. It must be called before the pool is used.
+func (b *ConnectionBudget) Join(addr string, pool *Pool) {
+	if !b.Enabled() {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.members == nil {
+		b.members = make(map[string]*budgetShare)
+	}
+	share := &budgetShare{pool: pool}
+	if pool.Limiter != nil {
+		pool.Limiter = MinLimiter{pool.Limiter, share}
+	} else {
+		pool.Limiter = share
+	}
+	b.members[addr] = share
+	b.rebalance()
+}
+
+// Leave removes the member's pool from the budget, freeing its share for the
+// others.
+func (b *ConnectionBudget) Leave(addr string, pool *Pool) {
+	if !b.Enabled() {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	// a new proxy for the same member may have already joined
+	if share, ok := b.members[addr]; !ok || share.pool != pool {
+		return
+	}
+	delete(b.members, addr)
+	b.rebalance()
+}
+
+// SetStates updates the state of the members and rebalances their shares.
+func (b *ConnectionBudget) SetStates(states map[string]ReplicaState) {
+	if !b.Enabled() {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.states = states
+	b.rebalance()
+}
+
+// Limits returns the current limit of each member.
+func (b *ConnectionBudget) Limits() map[string]uint {
+	limits := make(map[string]uint)
+	if !b.Enabled() {
+		return limits
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for addr, share := range b.members {
+		limits[addr] = share.Limit()
+	}
+	return limits
+}
+
+func (b *ConnectionBudget) weight(addr string) float64 {
+	w := b.SecondaryWeight
+	if b.states[addr] == ReplicaStatePrimary {
+		w = b.PrimaryWeight
+	}
+	if w <= 0 {
+		return 1
+	}
+	return w
+}
+
+// rebalance recomputes the share of each member. It must be called with the
+// mutex held.
+func (b *ConnectionBudget) rebalance() {
+	n := uint(len(b.members))
+	if n == 0 {
+		return
+	}
+
+	min := b.MinPerMember
+	if min*n > b.Total {
+		min = b.Total / n
+	}
+	rest := b.Total - min*n
+
+	var total float64
+	for addr := range b.members {
+		total += b.weight(addr)
+	}
+	for addr, share := range b.members {
+		limit := min + uint(float64(rest)*b.weight(addr)/total)
+		if limit == 0 {
+			limit = 1
+		}
+		if old := share.setLimit(limit); old != limit {
+			corelog.LogInfoMessage("connection budget rebalanced",
+				"member", addr, "limit", limit, "previous", old)
+			share.pool.LimitChanged()
+		}
+	}
+}
+
+// budgetShare is the part of the budget allocated to one member.
+type budgetShare struct {
+	pool  *Pool
+	limit uint32
+}
+
+func (s *budgetShare) Limit() uint {
+	return uint(atomic.LoadUint32(&s.limit))
+}
+
+func (s *budgetShare) setLimit(limit uint) uint {
+	return uint(atomic.SwapUint32(&s.limit, uint32(limit)))
+}
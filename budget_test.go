@@ -0,0 +1,101 @@
+package dvara
+
+import (
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/stats"
+)
+
+func newBudgetPool() *Pool {
+	var cm resourceMaker
+	return &Pool{
+		New:           cm.New,
+		Max:           100,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+}
+
+func TestConnectionBudgetRebalance(t *testing.T) {
+	t.Parallel()
+	b := ConnectionBudget{
+		Total:           100,
+		MinPerMember:    10,
+		PrimaryWeight:   3,
+		SecondaryWeight: 1,
+	}
+	b.SetStates(map[string]ReplicaState{
+		"a": ReplicaStatePrimary,
+		"b": ReplicaStateSecondary,
+		"c": ReplicaStateSecondary,
+	})
+	pa, pb, pc := newBudgetPool(), newBudgetPool(), newBudgetPool()
+	b.Join("a", pa)
+	b.Join("b", pb)
+	b.Join("c", pc)
+	ensure.DeepEqual(t, b.Limits(), map[string]uint{"a": 52, "b": 24, "c": 24})
+
+	// a stale proxy leaving doesn't affect the current one
+	b.Leave("c", newBudgetPool())
+	ensure.DeepEqual(t, len(b.Limits()), 3)
+
+	b.Leave("c", pc)
+	ensure.DeepEqual(t, b.Limits(), map[string]uint{"a": 70, "b": 30})
+
+	// failover
+	b.SetStates(map[string]ReplicaState{
+		"a": ReplicaStateSecondary,
+		"b": ReplicaStatePrimary,
+	})
+	ensure.DeepEqual(t, b.Limits(), map[string]uint{"a": 30, "b": 70})
+	ensure.Nil(t, pa.Close())
+	ensure.Nil(t, pb.Close())
+	ensure.Nil(t, pc.Close())
+}
+
+func TestConnectionBudgetDisabled(t *testing.T) {
+	t.Parallel()
+	var b *ConnectionBudget
+	p := newBudgetPool()
+	b.Join("a", p)
+	ensure.True(t, p.Limiter == nil)
+	ensure.DeepEqual(t, b.Limits(), map[string]uint{})
+}
+
+func TestPoolLimitChanged(t *testing.T) {
+	t.Parallel()
+	statsDone := make(chan struct{})
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			if key == "acquire.waiting" {
+				close(statsDone)
+			}
+		},
+	}
+
+	b := ConnectionBudget{Total: 1}
+	p := newBudgetPool()
+	p.Stats = hc
+	b.Join("a", p)
+
+	r, err := p.Acquire()
+	ensure.Nil(t, err)
+
+	// over the budget, waits until it grows
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r, err := p.Acquire()
+		ensure.Nil(t, err)
+		p.Release(r)
+	}()
+	<-statsDone
+	b.Total = 2
+	b.SetStates(nil)
+	<-done
+
+	p.Release(r)
+	ensure.Nil(t, p.Close())
+}
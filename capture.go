@@ -0,0 +1,540 @@
+package dvara
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	corelog "github.com/intercom/gocore/log"
+)
+
+// A capture file starts with captureMagic and is followed by a sequence of
+// records. Each record is made of a fixed size header:
+//
+//	timestamp int64  unix nanoseconds
+//	conn      uint32 connection identifier, unique within a process
+//	kind      byte   one of the capture record kinds below
+//	length    uint32 payload length
+//
+// followed by the payload. For open records the payload is the client
+// address, for message records it is the entire wire message. All integers
+// are little-endian, like the rest of the wire protocol.
+const (
+	captureMagic        = "DVARACAP1\n"
+	captureRecordHeader = 8 + 4 + 1 + 4
+)
+
+// CaptureKind identifies the type of a capture record.
+type CaptureKind byte
+
+// The capture record kinds.
+const (
+	CaptureOpen    = CaptureKind('o') // a client connected
+	CaptureClose   = CaptureKind('c') // a client disconnected
+	CaptureRequest = CaptureKind('q') // a message from the client
+	CaptureReply   = CaptureKind('r') // a message to the client
+)
+
+var (
+	errBadCaptureMagic = errors.New("dvara: not a capture file")
+
+	// maxCapturePayload guards against reading garbage as a huge payload.
+	maxCapturePayload = uint32(64 * 1024 * 1024)
+)
+
+// CaptureRecord is a single entry in a capture file.
+type CaptureRecord struct {
+	Time    time.Time
+	Conn    uint32
+	Kind    CaptureKind
+	Payload []byte
+}
+
+// Header returns the wire header of a message record.
+func (r *CaptureRecord) Header() *messageHeader {
+	if len(r.Payload) < headerLen {
+		return nil
+	}
+	var h messageHeader
+	h.FromWire(r.Payload)
+	return &h
+}
+
+func (r *CaptureRecord) writeTo(w io.Writer) (int, error) {
+	var h [captureRecordHeader]byte
+	binary.LittleEndian.PutUint64(h[0:], uint64(r.Time.UnixNano()))
+	binary.LittleEndian.PutUint32(h[8:], r.Conn)
+	h[12] = byte(r.Kind)
+	binary.LittleEndian.PutUint32(h[13:], uint32(len(r.Payload)))
+	n, err := w.Write(h[:])
+	if err != nil {
+		return n, err
+	}
+	m, err := w.Write(r.Payload)
+	return n + m, err
+}
+
+// CaptureReader reads records from a capture file.
+type CaptureReader struct {
+	r *bufio.Reader
+}
+
+// NewCaptureReader checks the capture file header and returns a reader for
+// the records.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != captureMagic {
+		return nil, errBadCaptureMagic
+	}
+	return &CaptureReader{r: br}, nil
+}
+
+// Next returns the next record, or io.EOF at the end of the capture.
+func (c *CaptureReader) Next() (*CaptureRecord, error) {
+	var h [captureRecordHeader]byte
+	if _, err := io.ReadFull(c.r, h[:]); err != nil {
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(h[13:])
+	if length > maxCapturePayload {
+		return nil, fmt.Errorf("dvara: capture record too large: %d", length)
+	}
+	r := &CaptureRecord{
+		Time:    time.Unix(0, int64(binary.LittleEndian.Uint64(h[0:]))),
+		Conn:    binary.LittleEndian.Uint32(h[8:]),
+		Kind:    CaptureKind(h[12]),
+		Payload: make([]byte, length),
+	}
+	if _, err := io.ReadFull(c.r, r.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return r, nil
+}
+
+// CaptureFilter selects the traffic that gets captured. Empty fields match
+// everything.
+type CaptureFilter struct {
+	// ClientNets restricts the capture to clients within these networks.
+	ClientNets []*net.IPNet
+
+	// Namespaces are glob patterns like "prod.*" matched against the
+	// "db.collection" a request targets.
+	Namespaces []string
+
+	// OpCodes restricts the capture to these request op codes.
+	OpCodes []OpCode
+}
+
+// MatchClient returns true if connections from ip should be captured.
+func (f *CaptureFilter) MatchClient(ip net.IP) bool {
+	if len(f.ClientNets) == 0 {
+		return true
+	}
+	for _, n := range f.ClientNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchRequest returns true if the request message should be captured.
+func (f *CaptureFilter) MatchRequest(msg []byte) bool {
+	if len(msg) < headerLen {
+		return false
+	}
+	if len(f.OpCodes) > 0 {
+		op := OpCode(getInt32(msg, 12))
+		found := false
+		for _, o := range f.OpCodes {
+			if o == op {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.Namespaces) > 0 {
+		ns := requestNamespace(msg)
+		for _, pattern := range f.Namespaces {
+			if ok, _ := path.Match(pattern, ns); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Capture records client traffic to a file for later inspection or replay.
+type Capture struct {
+	// Path of the capture file. Capturing is disabled if empty.
+	Path string
+
+	// MaxFileSize is the size after which the capture file is rotated. Zero
+	// means no rotation.
+	MaxFileSize int64
+
+	// MaxFiles is the number of rotated files kept around, named Path.1 (the
+	// most recent) to Path.MaxFiles.
+	MaxFiles uint
+
+	// Filter selects the captured traffic.
+	Filter CaptureFilter
+
+	mutex   sync.Mutex
+	file    *os.File
+	w       *bufio.Writer
+	size    int64
+	nextID  uint32
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// Enabled returns true if traffic should be captured.
+func (c *Capture) Enabled() bool {
+	return c != nil && c.Path != ""
+}
+
+// Start opens the capture file.
+func (c *Capture) Start() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if err := c.open(); err != nil {
+		return err
+	}
+	c.stop = make(chan struct{})
+	c.stopped = make(chan struct{})
+	go c.flushLoop()
+	return nil
+}
+
+// Stop flushes and closes the capture file.
+func (c *Capture) Stop() error {
+	if !c.Enabled() || c.stop == nil {
+		return nil
+	}
+	close(c.stop)
+	<-c.stopped
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closeFile()
+}
+
+func (c *Capture) flushLoop() {
+	defer close(c.stopped)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.mutex.Lock()
+			if c.w != nil {
+				if err := c.w.Flush(); err != nil {
+					corelog.LogError("error", err)
+				}
+			}
+			c.mutex.Unlock()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *Capture) open() error {
+	f, err := os.OpenFile(c.Path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	c.file = f
+	c.w = bufio.NewWriter(f)
+	n, err := c.w.WriteString(captureMagic)
+	c.size = int64(n)
+	return err
+}
+
+func (c *Capture) closeFile() error {
+	if c.file == nil {
+		return nil
+	}
+	err := c.w.Flush()
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+	c.file = nil
+	c.w = nil
+	return err
+}
+
+// rotate shifts the existing files by one and starts a new capture file.
+func (c *Capture) rotate() error {
+	if err := c.closeFile(); err != nil {
+		return err
+	}
+	if c.MaxFiles == 0 {
+		if err := os.Remove(c.Path); err != nil {
+			return err
+		}
+	} else {
+		for i := c.MaxFiles - 1; i > 0; i-- {
+			from := fmt.Sprintf("%s.%d", c.Path, i)
+			if _, err := os.Stat(from); err == nil {
+				if err := os.Rename(from, fmt.Sprintf("%s.%d", c.Path, i+1)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := os.Rename(c.Path, c.Path+".1"); err != nil {
+			return err
+		}
+	}
+	return c.open()
+}
+
+func (c *Capture) write(r *CaptureRecord) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.w == nil {
+		return
+	}
+	size := int64(captureRecordHeader + len(r.Payload))
+	if c.MaxFileSize > 0 && c.size+size > c.MaxFileSize && c.size > int64(len(captureMagic)) {
+		if err := c.rotate(); err != nil {
+			corelog.LogError("error", err)
+			return
+		}
+	}
+	n, err := r.writeTo(c.w)
+	c.size += int64(n)
+	if err != nil {
+		corelog.LogError("error", err)
+	}
+}
+
+// Wrap returns a net.Conn which captures the traffic of the given client
+// connection, or the connection itself if it isn't selected for capture.
+func (c *Capture) Wrap(conn net.Conn) net.Conn {
+	if !c.Enabled() {
+		return conn
+	}
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if ok && !c.Filter.MatchClient(addr.IP) {
+		return conn
+	}
+	cc := &captureConn{
+		Conn:      conn,
+		capture:   c,
+		id:        atomic.AddUint32(&c.nextID, 1),
+		requested: make(map[int32]bool),
+	}
+	c.write(&CaptureRecord{
+		Time:    time.Now(),
+		Conn:    cc.id,
+		Kind:    CaptureOpen,
+		Payload: []byte(conn.RemoteAddr().String()),
+	})
+	return cc
+}
+
+// captureConn reassembles the messages flowing over a client connection and
+// writes them to the capture.
+type captureConn struct {
+	net.Conn
+	capture *Capture
+	id      uint32
+	in      frameAssembler
+	out     frameAssembler
+
+	// requested holds the ids of captured requests, replies are only captured
+	// if their request was. The value tells if the request is an exhaust query.
+	requestedMutex sync.Mutex
+	requested      map[int32]bool
+	closeOnce      sync.Once
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.in.feed(b[:n], c.request)
+	return n, err
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.out.feed(b[:n], c.reply)
+	return n, err
+}
+
+func (c *captureConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.capture.write(&CaptureRecord{Time: time.Now(), Conn: c.id, Kind: CaptureClose})
+	})
+	return c.Conn.Close()
+}
+
+func (c *captureConn) request(msg []byte) {
+	if !c.capture.Filter.MatchRequest(msg) {
+		return
+	}
+	// requests without replies would never be forgotten
+	if expectsReply(msg) {
+		c.requestedMutex.Lock()
+		c.requested[getInt32(msg, 4)] = isExhaustQuery(msg)
+		c.requestedMutex.Unlock()
+	}
+	c.capture.write(&CaptureRecord{Time: time.Now(), Conn: c.id, Kind: CaptureRequest, Payload: msg})
+}
+
+func (c *captureConn) reply(msg []byte) {
+	responseTo := getInt32(msg, 8)
+	c.requestedMutex.Lock()
+	exhaust, found := c.requested[responseTo]
+	if found {
+		// Exhaust cursors get many replies to the same request, so the request
+		// stays around until the cursor is done.
+		if !exhaust || len(msg) < headerLen+12 || getInt64(msg, headerLen+4) == 0 {
+			delete(c.requested, responseTo)
+		}
+	}
+	c.requestedMutex.Unlock()
+	if !found {
+		return
+	}
+	c.capture.write(&CaptureRecord{Time: time.Now(), Conn: c.id, Kind: CaptureReply, Payload: msg})
+}
+
+// queryExhaust is the OpQuery flag requesting the server to stream all the
+// results without waiting for getMores.
+const queryExhaust = 1 << 6
+
+// isExhaustQuery returns true if msg is an OpQuery with the Exhaust flag set.
+func isExhaustQuery(msg []byte) bool {
+	return len(msg) >= headerLen+4 &&
+		OpCode(getInt32(msg, 12)) == OpQuery &&
+		getInt32(msg, headerLen)&queryExhaust != 0
+}
+
+// frameAssembler splits a byte stream into wire protocol messages.
+type frameAssembler struct {
+	buf    []byte
+	broken bool
+}
+
+// feed appends b to the pending bytes and calls emit with every complete
+// message.
+func (f *frameAssembler) feed(b []byte, emit func([]byte)) {
+	if f.broken {
+		return
+	}
+	f.buf = append(f.buf, b...)
+	for len(f.buf) >= 4 {
+		length := int(getInt32(f.buf, 0))
+		if length < headerLen {
+			// Not a message we understand, give up on this stream.
+			f.buf = nil
+			f.broken = true
+			return
+		}
+		if len(f.buf) < length {
+			return
+		}
+		msg := make([]byte, length)
+		copy(msg, f.buf)
+		emit(msg)
+		f.buf = f.buf[:copy(f.buf, f.buf[length:])]
+	}
+}
+
+var opCodesByName = map[string]OpCode{}
+
+func init() {
+	for _, c := range []OpCode{OpReply, OpMessage, OpUpdate, OpInsert, Reserved, OpQuery, OpGetMore, OpDelete, OpKillCursors, OpMsg} {
+		opCodesByName[c.String()] = c
+	}
+}
+
+// ParseOpCode returns the OpCode for a name as returned by OpCode.String.
+func ParseOpCode(name string) (OpCode, error) {
+	if c, ok := opCodesByName[strings.ToUpper(name)]; ok {
+		return c, nil
+	}
+	return 0, fmt.Errorf("dvara: unknown op code %q", name)
+}
+
+// ParseCIDRs parses a comma separated list of networks in CIDR notation. Bare
+// IP addresses are treated as single host networks.
+func ParseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("dvara: invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// NewCaptureFilter builds a CaptureFilter from comma separated lists of
+// client networks, namespace patterns and op code names.
+func NewCaptureFilter(clients, namespaces, opCodes string) (CaptureFilter, error) {
+	var f CaptureFilter
+	var err error
+	if f.ClientNets, err = ParseCIDRs(clients); err != nil {
+		return f, err
+	}
+	for _, ns := range strings.Split(namespaces, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			if _, err := path.Match(ns, ""); err != nil {
+				return f, fmt.Errorf("dvara: invalid namespace pattern %q", ns)
+			}
+			f.Namespaces = append(f.Namespaces, ns)
+		}
+	}
+	for _, name := range strings.Split(opCodes, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			c, err := ParseOpCode(name)
+			if err != nil {
+				return f, err
+			}
+			f.OpCodes = append(f.OpCodes, c)
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,207 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// fakeConn is a net.Conn reading from a buffer and writing to another.
+type fakeConn struct {
+	net.Conn
+	in     io.Reader
+	out    bytes.Buffer
+	remote net.Addr
+}
+
+func (f *fakeConn) Read(b []byte) (int, error)  { return f.in.Read(b) }
+func (f *fakeConn) Write(b []byte) (int, error) { return f.out.Write(b) }
+func (f *fakeConn) Close() error                { return nil }
+func (f *fakeConn) RemoteAddr() net.Addr        { return f.remote }
+
+func (f *fakeConn) SetDeadline(time.Time) error      { return nil }
+func (f *fakeConn) SetReadDeadline(time.Time) error  { return nil }
+func (f *fakeConn) SetWriteDeadline(time.Time) error { return nil }
+
+var fakeClientAddr = &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 4242}
+
+// fakeQuery builds an entire OpQuery message.
+func fakeQuery(requestID int32, flags int32, ns string, doc interface{}) []byte {
+	b := addHeader(nil, int(OpQuery))
+	b = addInt32(b, flags)
+	b = addCString(b, ns)
+	b = addInt32(b, 0)
+	b = addInt32(b, 0)
+	b, err := addBSON(b, doc)
+	if err != nil {
+		panic(err)
+	}
+	setInt32(b, 0, int32(len(b)))
+	setInt32(b, 4, requestID)
+	return b
+}
+
+// fakeReplyTo builds an entire single document OpReply message.
+func fakeReplyTo(requestID int32, doc interface{}) []byte {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(fakeSingleDocReply(doc)); err != nil {
+		panic(err)
+	}
+	b := buf.Bytes()
+	setInt32(b, 8, requestID)
+	return b
+}
+
+func readCapture(t *testing.T, name string) []*CaptureRecord {
+	f, err := os.Open(name)
+	ensure.Nil(t, err)
+	defer f.Close()
+	r, err := NewCaptureReader(f)
+	ensure.Nil(t, err)
+	var records []*CaptureRecord
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return records
+		}
+		ensure.Nil(t, err)
+		records = append(records, rec)
+	}
+}
+
+func TestCaptureConn(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "dvara-capture")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Capture{Path: filepath.Join(dir, "capture")}
+	ensure.Nil(t, c.Start())
+
+	query := fakeQuery(7, 0, "test.users", bson.M{"name": "bob"})
+	reply := fakeReplyTo(7, bson.M{"name": "bob"})
+	fc := &fakeConn{in: bytes.NewReader(query), remote: fakeClientAddr}
+	conn := c.Wrap(fc)
+
+	// read the request in odd sized chunks to exercise reassembly
+	buf := make([]byte, 5)
+	for {
+		if _, err := conn.Read(buf); err == io.EOF {
+			break
+		}
+	}
+	_, err = conn.Write(reply[:10])
+	ensure.Nil(t, err)
+	_, err = conn.Write(reply[10:])
+	ensure.Nil(t, err)
+	ensure.Nil(t, conn.Close())
+	ensure.Nil(t, c.Stop())
+
+	records := readCapture(t, c.Path)
+	ensure.DeepEqual(t, len(records), 4)
+	ensure.DeepEqual(t, records[0].Kind, CaptureOpen)
+	ensure.DeepEqual(t, string(records[0].Payload), fakeClientAddr.String())
+	ensure.DeepEqual(t, records[1].Kind, CaptureRequest)
+	ensure.DeepEqual(t, records[1].Payload, query)
+	ensure.DeepEqual(t, records[2].Kind, CaptureReply)
+	ensure.DeepEqual(t, records[2].Payload, reply)
+	ensure.DeepEqual(t, records[3].Kind, CaptureClose)
+	ensure.DeepEqual(t, records[1].Conn, records[0].Conn)
+}
+
+func TestCaptureConnUnanswered(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "dvara-capture")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Capture{Path: filepath.Join(dir, "capture")}
+	ensure.Nil(t, c.Start())
+	defer c.Stop()
+
+	// requests getting no reply are captured without waiting for one
+	query := fakeQuery(7, 0, "test.users", bson.M{"name": "bob"})
+	msg := append(fakeInsert("test.users", bson.M{"name": "bob"}), query...)
+	conn := c.Wrap(&fakeConn{in: bytes.NewReader(msg), remote: fakeClientAddr})
+	_, err = ioutil.ReadAll(conn)
+	ensure.Nil(t, err)
+	cc := conn.(*captureConn)
+	cc.requestedMutex.Lock()
+	ensure.DeepEqual(t, len(cc.requested), 1)
+	cc.requestedMutex.Unlock()
+	ensure.Nil(t, conn.Close())
+}
+
+func TestCaptureFilter(t *testing.T) {
+	t.Parallel()
+	f, err := NewCaptureFilter("10.1.0.0/16, 192.168.0.1", "prod.*", "QUERY")
+	ensure.Nil(t, err)
+
+	ensure.True(t, f.MatchClient(net.ParseIP("10.1.200.1")))
+	ensure.True(t, f.MatchClient(net.ParseIP("192.168.0.1")))
+	ensure.False(t, f.MatchClient(net.ParseIP("192.168.0.2")))
+
+	ensure.True(t, f.MatchRequest(fakeQuery(1, 0, "prod.users", bson.M{})))
+	ensure.True(t, f.MatchRequest(fakeQuery(1, 0, "prod.$cmd", bson.D{{Name: "count", Value: "users"}})))
+	ensure.False(t, f.MatchRequest(fakeQuery(1, 0, "test.users", bson.M{})))
+
+	insert := fakeQuery(1, 0, "prod.users", bson.M{})
+	setInt32(insert, 12, int32(OpInsert))
+	ensure.False(t, f.MatchRequest(insert))
+
+	_, err = NewCaptureFilter("", "", "BOGUS")
+	ensure.NotNil(t, err)
+	_, err = NewCaptureFilter("10.0.0.300", "", "")
+	ensure.NotNil(t, err)
+}
+
+func TestRequestNamespaceOpMsg(t *testing.T) {
+	t.Parallel()
+	doc, err := bson.Marshal(bson.D{{Name: "find", Value: "users"}, {Name: "$db", Value: "prod"}})
+	ensure.Nil(t, err)
+	msg := addHeader(nil, int(OpMsg))
+	msg = addInt32(msg, 0)
+	msg = append(msg, 0)
+	msg = append(msg, doc...)
+	setInt32(msg, 0, int32(len(msg)))
+	ensure.DeepEqual(t, requestNamespace(msg), "prod.users")
+}
+
+func TestCaptureRotation(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "dvara-capture")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	query := fakeQuery(1, 0, "test.users", bson.M{})
+	c := Capture{
+		Path:        filepath.Join(dir, "capture"),
+		MaxFileSize: int64(len(captureMagic) + 2*(captureRecordHeader+len(query))),
+		MaxFiles:    2,
+	}
+	ensure.Nil(t, c.Start())
+	for i := 0; i < 7; i++ {
+		c.write(&CaptureRecord{Kind: CaptureRequest, Payload: query})
+	}
+	ensure.Nil(t, c.Stop())
+
+	ensure.DeepEqual(t, len(readCapture(t, c.Path)), 1)
+	ensure.DeepEqual(t, len(readCapture(t, c.Path+".1")), 2)
+	ensure.DeepEqual(t, len(readCapture(t, c.Path+".2")), 2)
+	_, err = os.Stat(c.Path + ".3")
+	ensure.True(t, os.IsNotExist(err))
+}
+
+func TestCaptureReaderBadMagic(t *testing.T) {
+	t.Parallel()
+	_, err := NewCaptureReader(bytes.NewReader([]byte("not a capture file")))
+	ensure.DeepEqual(t, err, errBadCaptureMagic)
+}
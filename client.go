@@ -0,0 +1,116 @@
+package dvara
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// proxyClient is a client connection being served by a proxy. Waiting for its
+// next message is interrupted, with a read deadline, when the proxy stops.
+type proxyClient struct {
+	conn net.Conn
+
+	mutex   sync.Mutex
+	idle    bool
+	stopped bool
+
+	// the cursors the client has open, nil unless tracked
+	cursors *Cursors
+
+	// the client's awaitData and exhaust cursors
+	stream cursorStream
+
+	// the current request, when it had to be read before being proxied
+	request requestBuffer
+
+	// the client's authentication at the proxy
+	auth clientAuth
+
+	// the driver metadata of its first isMaster, nil if it sent none
+	identified bool
+	driver     *clientDriver
+
+	// the header of the last message, reused for every message
+	header messageHeader
+	wire   [headerLen]byte
+}
+
+// readHeader reads the header of the next message, waiting for up to timeout.
+// It also returns whether the proxy was stopped in the meantime.
+func (c *proxyClient) readHeader(timeout time.Duration) (*messageHeader, bool, error) {
+	c.mutex.Lock()
+	if c.stopped {
+		c.mutex.Unlock()
+		return nil, true, errNormalClose
+	}
+	c.idle = true
+	c.request.reset()
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	c.mutex.Unlock()
+
+	_, err := io.ReadFull(c.conn, c.wire[:])
+
+	c.mutex.Lock()
+	c.idle = false
+	stopped := c.stopped
+	c.mutex.Unlock()
+
+	if err != nil {
+		return nil, stopped, err
+	}
+	c.header.FromWire(c.wire[:])
+	return &c.header, stopped, nil
+}
+
+// stop interrupts the client if it is waiting for its next message, and
+// prevents it from waiting again.
+func (c *proxyClient) stop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stopped = true
+	if c.idle {
+		c.conn.SetReadDeadline(timeInPast)
+	}
+}
+
+// clientRegistry holds the clients of a proxy.
+type clientRegistry struct {
+	mutex   sync.Mutex
+	stopped bool
+	clients map[*proxyClient]struct{}
+}
+
+// add registers a new client connection.
+func (r *clientRegistry) add(conn net.Conn) *proxyClient {
+	c := &proxyClient{conn: conn}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.stopped {
+		c.stopped = true
+		return c
+	}
+	if r.clients == nil {
+		r.clients = make(map[*proxyClient]struct{})
+	}
+	r.clients[c] = struct{}{}
+	return c
+}
+
+// remove unregisters a client.
+func (r *clientRegistry) remove(c *proxyClient) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.clients, c)
+}
+
+// stop stops all current and future clients.
+func (r *clientRegistry) stop() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stopped = true
+	for c := range r.clients {
+		c.stop()
+	}
+}
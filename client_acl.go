@@ -0,0 +1,112 @@
+package dvara
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var errInvalidClientOption = errors.New("dvara: invalid client rule option")
+
+// ClientRule allows or denies the clients within its networks, and limits
+// their connections to each member.
+type ClientRule struct {
+	Name string
+	Nets []*net.IPNet
+
+	// Deny rejects the connections of the clients.
+	Deny bool
+
+	// MaxPerClient overrides ReplicaSet.MaxPerClientConnections for each of
+	// the clients, unless zero.
+	MaxPerClient uint
+
+	// MaxConnections limits the connections of all the clients together.
+	// Zero means no limit.
+	MaxConnections uint
+}
+
+// Match returns true if the client IP is within the rule's networks.
+func (r *ClientRule) Match(ip net.IP) bool {
+	for _, n := range r.Nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseClientRules parses semicolon separated rules, each a name, comma
+// separated client networks and space separated options among "allow",
+// "deny", "max_per_client=N" and "max=N", for example
+// "office=192.168.0.0/16 deny;batch=10.1.0.0/16 max_per_client=500". A final
+// "all=0.0.0.0/0,::/0 deny" rule only allows the networks of earlier rules.
+func ParseClientRules(list string) ([]ClientRule, error) {
+	var rules []ClientRule
+	for _, s := range strings.Split(list, ";") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		i := strings.Index(s, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("dvara: invalid client rule %q", s)
+		}
+		fields := strings.Fields(s[i+1:])
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("dvara: client rule %q without networks", s)
+		}
+		nets, err := ParseCIDRs(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		rule := ClientRule{Name: strings.TrimSpace(s[:i]), Nets: nets}
+		for _, option := range fields[1:] {
+			if err := rule.parseOption(option); err != nil {
+				return nil, fmt.Errorf("dvara: invalid option %q of client rule %s", option, rule.Name)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r *ClientRule) parseOption(option string) error {
+	switch option {
+	case "allow":
+		r.Deny = false
+		return nil
+	case "deny":
+		r.Deny = true
+		return nil
+	}
+	i := strings.Index(option, "=")
+	if i <= 0 {
+		return errInvalidClientOption
+	}
+	n, err := strconv.ParseUint(option[i+1:], 10, 32)
+	if err != nil || n == 0 {
+		return errInvalidClientOption
+	}
+	switch option[:i] {
+	case "max_per_client":
+		r.MaxPerClient = uint(n)
+	case "max":
+		r.MaxConnections = uint(n)
+	default:
+		return errInvalidClientOption
+	}
+	return nil
+}
+
+// clientRule returns the first rule the client IP matches, nil if none.
+func (r *ReplicaSet) clientRule(ip net.IP) *ClientRule {
+	for i := range r.ClientRules {
+		if r.ClientRules[i].Match(ip) {
+			return &r.ClientRules[i]
+		}
+	}
+	return nil
+}
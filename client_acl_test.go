@@ -0,0 +1,130 @@
+package dvara
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestParseClientRules(t *testing.T) {
+	t.Parallel()
+	rules, err := ParseClientRules(" office=192.168.0.0/16 deny ; batch=10.1.0.0/16,10.2.0.0/16 max_per_client=500 max=2000;all=0.0.0.0/0 allow")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(rules), 3)
+	ensure.DeepEqual(t, rules[0].Name, "office")
+	ensure.True(t, rules[0].Deny)
+	ensure.DeepEqual(t, rules[1].Name, "batch")
+	ensure.DeepEqual(t, len(rules[1].Nets), 2)
+	ensure.DeepEqual(t, rules[1].MaxPerClient, uint(500))
+	ensure.DeepEqual(t, rules[1].MaxConnections, uint(2000))
+	ensure.False(t, rules[2].Deny)
+
+	r := &ReplicaSet{ClientRules: rules}
+	ensure.DeepEqual(t, r.clientRule(net.ParseIP("10.2.0.1")).Name, "batch")
+	ensure.DeepEqual(t, r.clientRule(net.ParseIP("192.168.1.1")).Name, "office")
+	ensure.True(t, r.clientRule(net.ParseIP("::1")) == nil)
+
+	for _, list := range []string{
+		"office",
+		"office=",
+		"office=192.168.0.300",
+		"office=192.168.0.0/16 block",
+		"batch=10.1.0.0/16 max=0",
+		"batch=10.1.0.0/16 max_per_client=many",
+		"batch=10.1.0.0/16 min=1",
+	} {
+		_, err := ParseClientRules(list)
+		ensure.NotNil(t, err, list)
+	}
+}
+
+func TestMaxPerClientConnectionsRules(t *testing.T) {
+	t.Parallel()
+	batch := &ClientRule{Name: "batch", MaxPerClient: 3, MaxConnections: 4}
+	m := newMaxPerClientConnections(1)
+
+	// clients without a rule get the default limit
+	ensure.DeepEqual(t, m.inc("10.0.0.1", nil), connectionsAvailable)
+	ensure.DeepEqual(t, m.inc("10.0.0.1", nil), clientConnectionsFull)
+
+	// the rule overrides it, and limits its clients together
+	for i := 0; i < 3; i++ {
+		ensure.DeepEqual(t, m.inc("10.1.0.1", batch), connectionsAvailable)
+	}
+	ensure.DeepEqual(t, m.inc("10.1.0.1", batch), clientConnectionsFull)
+	ensure.DeepEqual(t, m.inc("10.1.0.2", batch), connectionsAvailable)
+	ensure.DeepEqual(t, m.inc("10.1.0.2", batch), ruleConnectionsFull)
+
+	// closed connections free both
+	m.dec("10.1.0.1", batch)
+	ensure.DeepEqual(t, m.inc("10.1.0.2", batch), connectionsAvailable)
+	m.dec("10.1.0.2", batch)
+	m.dec("10.1.0.2", batch)
+	m.dec("10.1.0.1", batch)
+	m.dec("10.1.0.1", batch)
+	m.dec("10.0.0.1", nil)
+	ensure.DeepEqual(t, len(m.counts), 0)
+	ensure.DeepEqual(t, len(m.ruleCounts), 0)
+}
+
+func TestClientRuleDenied(t *testing.T) {
+	t.Parallel()
+	rules, err := ParseClientRules("office=10.1.0.0/16 deny")
+	ensure.Nil(t, err)
+	hc := newCounterClient()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{MessageTimeout: time.Minute, ClientRules: rules},
+		stats:      hc,
+	}
+	p.maxPerClientConnections = newMaxPerClientConnections(10)
+
+	conn := &fakeConn{
+		in:     bytes.NewReader(fakeQuery(1, 0, "admin.$cmd", bson.D{{Name: "isMaster", Value: 1}})),
+		remote: fakeClientAddr,
+	}
+	p.wg.Add(1)
+	p.clientServeLoop(conn)
+	reply := replyDocument(t, conn.out.Bytes())
+	ensure.DeepEqual(t, reply["code"], codeUnauthorized)
+	ensure.StringContains(t, reply["errmsg"].(string), "office")
+	ensure.DeepEqual(t, hc.count("client.rejected.rule.office.denied"), float64(1))
+	ensure.DeepEqual(t, len(p.maxPerClientConnections.counts), 0)
+}
+
+func TestRejectClientBounded(t *testing.T) {
+	t.Parallel()
+	hc := newCounterClient()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{MessageTimeout: time.Minute},
+		stats:      hc,
+	}
+	e := newProxyError(codeUnauthorized, "dvara: denied")
+
+	// silent clients are not waited for as long as the MessageTimeout
+	client, server := net.Pipe()
+	defer client.Close()
+	start := time.Now()
+	p.rejectClient(server, e)
+	ensure.True(t, time.Since(start) < 2*rejectTimeout)
+
+	// past maxRejecting clients are closed without reading their message
+	p.ReplicaSet.rejecting = maxRejecting
+	conn := &fakeConn{
+		in:     bytes.NewReader(fakeQuery(1, 0, "admin.$cmd", bson.D{{Name: "isMaster", Value: 1}})),
+		remote: fakeClientAddr,
+	}
+	p.rejectClient(conn, e)
+	ensure.DeepEqual(t, conn.out.Len(), 0)
+	ensure.DeepEqual(t, hc.count("client.rejected.closed"), float64(1))
+	ensure.DeepEqual(t, p.ReplicaSet.rejecting, int32(maxRejecting))
+
+	p.ReplicaSet.rejecting = 0
+	conn.in = bytes.NewReader(fakeQuery(1, 0, "admin.$cmd", bson.D{{Name: "isMaster", Value: 1}}))
+	p.rejectClient(conn, e)
+	ensure.DeepEqual(t, replyDocument(t, conn.out.Bytes())["code"], codeUnauthorized)
+	ensure.DeepEqual(t, p.ReplicaSet.rejecting, int32(0))
+}
@@ -0,0 +1,321 @@
+package dvara
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// preAuthCommands are the commands clients may run before authenticating,
+// they're needed to connect and carry no data.
+var preAuthCommands = map[string]bool{
+	"isMaster":  true,
+	"ismaster":  true,
+	"hello":     true,
+	"buildInfo": true,
+	"buildinfo": true,
+	"ping":      true,
+}
+
+var errUnsupportedAuth = errors.New("only SCRAM-SHA-1 and SCRAM-SHA-256 are supported")
+
+// clientAuth is the authentication state of a client.
+type clientAuth struct {
+	// user is the authenticated user, nil until the client authenticates
+	user *User
+	// generation is the generation of the users user was looked up in
+	generation uint32
+
+	// the ongoing SCRAM conversation
+	scram          *scramServer
+	scramDB        string
+	conversationID int32
+	step           int
+	skipEmpty      bool
+}
+
+// authorize handles the message with the given header when clients must
+// authenticate at the proxy. Authentication commands are answered by the
+// proxy itself, and messages of unauthenticated clients are rejected. It
+// returns true if the message should be proxied.
+func (p *Proxy) authorize(h *messageHeader, c *proxyClient, lastError *LastError) (bool, error) {
+	users := p.ReplicaSet.UserStore
+	if !users.Enabled() {
+		return true, nil
+	}
+	p.checkUser(c)
+	if h.OpCode != OpQuery && h.OpCode != OpMsg {
+		if c.auth.user != nil {
+			return true, nil
+		}
+		return false, p.rejectUnauthorized(h, c, lastError, "")
+	}
+
+	msg, err := c.request.read(h, c.conn)
+	if err != nil {
+		return false, err
+	}
+	var name string
+	var cmd bson.D
+	if isCommandRequest(msg) {
+		name, cmd = requestCommand(msg)
+	}
+	switch name {
+	case "saslStart", "saslContinue", "authenticate", "getnonce", "logout":
+		c.conn.SetDeadline(time.Now().Add(p.ReplicaSet.MessageTimeout))
+		_, err := c.conn.Write(commandReply(msg, p.authCommand(c, name, commandDB(msg, cmd), cmd)))
+		return false, err
+	}
+	if c.auth.user != nil {
+		return true, nil
+	}
+	if preAuthCommands[name] {
+		// the server would authenticate its connection, which is shared
+		if hasKey(cmd, "speculativeAuthenticate") {
+			if c.request.msg, err = withoutCommandField(msg, "speculativeAuthenticate"); err != nil {
+				return false, err
+			}
+			h.MessageLength = int32(len(c.request.msg))
+		}
+		return true, nil
+	}
+	return false, p.rejectUnauthorized(h, c, lastError, name)
+}
+
+// rejectUnauthorized fails a message of an unauthenticated client.
+func (p *Proxy) rejectUnauthorized(h *messageHeader, c *proxyClient, lastError *LastError, name string) error {
+	stats.BumpSum(p.stats, "auth.rejected", 1)
+	what := "operation " + h.OpCode.String()
+	if name != "" {
+		what = "command " + name
+	}
+	e := newProxyError(codeUnauthorized, "dvara: %s requires authentication", what)
+	return p.rejectMessage(h, c, lastError, e)
+}
+
+// authCommand runs an authentication command on the database and returns
+// its reply.
+func (p *Proxy) authCommand(c *proxyClient, name, db string, cmd bson.D) bson.D {
+	users := p.ReplicaSet.UserStore
+	switch name {
+	case "logout":
+		c.auth = clientAuth{}
+		return bson.D{{Name: "ok", Value: 1}}
+	case "saslStart":
+		mechanism, _ := lookup(cmd, "mechanism").(string)
+		scram, err := newScramServer(mechanism, func(user string) *ScramCredentials {
+			if u := users.Lookup(db, user); u != nil {
+				return u.Credentials[mechanism]
+			}
+			return nil
+		})
+		if err != nil {
+			return p.authFailed(c, db, "", err)
+		}
+		options, _ := asDoc(lookup(cmd, "options"))
+		c.auth.scram = scram
+		c.auth.scramDB = db
+		c.auth.conversationID++
+		c.auth.step = 1
+		c.auth.skipEmpty = lookup(options, "skipEmptyExchange") == true
+		reply, err := scram.first(saslPayload(cmd))
+		if err != nil {
+			return p.authFailed(c, db, scram.user, err)
+		}
+		return c.auth.saslReply(false, reply)
+	case "saslContinue":
+		scram := c.auth.scram
+		if scram == nil || !sameConversation(lookup(cmd, "conversationId"), c.auth.conversationID) || db != c.auth.scramDB {
+			return p.authFailed(c, db, "", errScramAuthFailed)
+		}
+		c.auth.step++
+		if c.auth.step > 2 {
+			// the empty exchange once the client verified the server
+			c.auth.scram = nil
+			return c.auth.saslReply(true, "")
+		}
+		reply, err := scram.final(saslPayload(cmd))
+		if err != nil {
+			return p.authFailed(c, db, scram.user, err)
+		}
+		generation := users.loaded()
+		user := users.Lookup(db, scram.user)
+		if user == nil {
+			return p.authFailed(c, db, scram.user, errScramAuthFailed)
+		}
+		c.auth.user = user
+		c.auth.generation = generation
+		stats.BumpSum(p.stats, "auth.success", 1)
+		corelog.LogInfoMessage("client authenticated",
+			"client", c.conn.RemoteAddr(), "app", c.appName(), "user", scram.user, "db", db, "mechanism", scram.mechanism)
+		if c.auth.skipEmpty {
+			c.auth.scram = nil
+		}
+		return c.auth.saslReply(c.auth.skipEmpty, reply)
+	}
+	return p.authFailed(c, db, "", errUnsupportedAuth)
+}
+
+// checkUser looks the authenticated user of the client up again once the users
+// were reloaded. The client loses its authentication if the user was removed
+// or its credentials changed, and otherwise gets the user's new settings.
+func (p *Proxy) checkUser(c *proxyClient) {
+	users := p.ReplicaSet.UserStore
+	if c.auth.user == nil || c.auth.generation == users.loaded() {
+		return
+	}
+	// the generation is read before the lookup, so a load in between is
+	// caught by the next message
+	c.auth.generation = users.loaded()
+	user := users.Lookup(c.auth.user.DB, c.auth.user.User)
+	if user == nil || !reflect.DeepEqual(user.Credentials, c.auth.user.Credentials) {
+		stats.BumpSum(p.stats, "auth.revoked", 1)
+		corelog.LogInfoMessage("client authentication revoked",
+			"client", c.conn.RemoteAddr(), "app", c.appName(), "user", c.auth.user.User, "db", c.auth.user.DB)
+		c.auth.user = nil
+		return
+	}
+	c.auth.user = user
+}
+
+func sameConversation(v interface{}, id int32) bool {
+	switch v := v.(type) {
+	case int:
+		return v == int(id)
+	case int64:
+		return v == int64(id)
+	case float64:
+		return v == float64(id)
+	}
+	return false
+}
+
+// authFailed ends the ongoing authentication with the error and returns the
+// reply failing it.
+func (p *Proxy) authFailed(c *proxyClient, db, user string, err error) bson.D {
+	stats.BumpSum(p.stats, "auth.failure", 1)
+	corelog.LogErrorMessage("client authentication failed",
+		"client", c.conn.RemoteAddr(), "app", c.appName(), "user", user, "db", db, "error", err)
+	c.auth.scram = nil
+	if err != errScramAuthFailed {
+		return newProxyError(codeAuthenticationFailed, "dvara: %s", err).commandDoc()
+	}
+	return newProxyError(codeAuthenticationFailed, "%s", err).commandDoc()
+}
+
+func (a *clientAuth) saslReply(done bool, payload string) bson.D {
+	return bson.D{
+		{Name: "conversationId", Value: a.conversationID},
+		{Name: "done", Value: done},
+		{Name: "payload", Value: []byte(payload)},
+		{Name: "ok", Value: 1},
+	}
+}
+
+// saslPayload returns the payload of a sasl command.
+func saslPayload(cmd bson.D) string {
+	switch v := lookup(cmd, "payload").(type) {
+	case []byte:
+		return string(v)
+	case bson.Binary:
+		return string(v.Data)
+	case string:
+		return v
+	}
+	return ""
+}
+
+// commandDB returns the database of the command in the entire request.
+func commandDB(msg []byte, cmd bson.D) string {
+	if OpCode(getInt32(msg, 12)) == OpMsg {
+		db, _ := lookup(cmd, "$db").(string)
+		return db
+	}
+	ns := msg[headerLen+4:]
+	if i := bytes.IndexByte(ns, '.'); i >= 0 {
+		return string(ns[:i])
+	}
+	return ""
+}
+
+// commandReply returns the entire reply message to the entire command
+// request with the given document.
+func commandReply(request []byte, doc bson.D) []byte {
+	requestID := getInt32(request, 4)
+	if OpCode(getInt32(request, 12)) == OpMsg {
+		return opMsgReply(requestID, doc)
+	}
+	return opReply(requestID, 0, doc)
+}
+
+// withoutField returns the command document without the named field, looking
+// into the command wrapped with its read preference if it is, see
+// unwrapCommand.
+func withoutField(cmd bson.D, name string) bson.D {
+	for i, e := range cmd {
+		if e.Name == name {
+			return append(cmd[:i], cmd[i+1:]...)
+		}
+		if e.Name == "$query" || i == 0 && e.Name == "query" {
+			if q, ok := e.Value.(bson.D); ok {
+				cmd[i].Value = withoutField(q, name)
+			}
+		}
+	}
+	return cmd
+}
+
+// withoutCommandField returns the entire OpQuery or OpMsg command request
+// without the named field of its command document. The checksum of an OpMsg
+// is dropped, since it would no longer match.
+func withoutCommandField(msg []byte, name string) ([]byte, error) {
+	var start, end int
+	switch OpCode(getInt32(msg, 12)) {
+	case OpQuery:
+		ns := msg[headerLen+4:]
+		i := bytes.IndexByte(ns, x00)
+		start = headerLen + 4 + i + 1 + 8
+		if i < 0 || len(msg) < start+4 {
+			return msg, nil
+		}
+		end = start + int(getInt32(msg, start))
+	case OpMsg:
+		body := opMsgBody(msg)
+		if body == nil {
+			return msg, nil
+		}
+		// the body is a part of msg, which starts as far before it as its
+		// capacity is larger
+		start = cap(msg) - cap(body)
+		end = start + len(body)
+	default:
+		return msg, nil
+	}
+	if end > len(msg) {
+		return msg, nil
+	}
+	var q bson.D
+	if err := bson.Unmarshal(msg[start:end], &q); err != nil {
+		return nil, err
+	}
+	b := append([]byte(nil), msg[:start]...)
+	b, err := addBSON(b, withoutField(q, name))
+	if err != nil {
+		return nil, err
+	}
+	rest := msg[end:]
+	if OpCode(getInt32(msg, 12)) == OpMsg {
+		if flags := getInt32(msg, headerLen); flags&opMsgChecksumPresent != 0 && len(rest) >= 4 {
+			setInt32(b, headerLen, flags&^opMsgChecksumPresent)
+			rest = rest[:len(rest)-4]
+		}
+	}
+	b = append(b, rest...)
+	setInt32(b, 0, int32(len(b)))
+	return b, nil
+}
@@ -0,0 +1,253 @@
+package dvara
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// writeUsers writes a users file holding a single user.
+func writeUsers(t *testing.T, dir, user, db, password string) string {
+	u, err := NewUser(user, db, password)
+	ensure.Nil(t, err)
+	b, err := json.Marshal([]*User{u})
+	ensure.Nil(t, err)
+	path := filepath.Join(dir, "users.json")
+	ensure.Nil(t, ioutil.WriteFile(path, b, 0600))
+	return path
+}
+
+// authClient sends messages to the proxy's authorization.
+type authClient struct {
+	t      *testing.T
+	p      *Proxy
+	conn   *fakeConn
+	client *proxyClient
+}
+
+// send returns whether the message would be proxied, and the proxy's reply
+// otherwise.
+func (a *authClient) send(msg []byte) (bool, bson.M) {
+	a.conn.in = bytes.NewReader(msg)
+	a.conn.out.Reset()
+	h, err := a.p.clientReadHeader(a.client, time.Minute)
+	ensure.Nil(a.t, err)
+	var lastError LastError
+	ok, err := a.p.authorize(h, a.client, &lastError)
+	ensure.Nil(a.t, err)
+	if ok {
+		return true, nil
+	}
+	return false, replyDocument(a.t, a.conn.out.Bytes())
+}
+
+func TestAuthorize(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "dvara-auth")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+	users := &UserStore{Path: writeUsers(t, dir, "app", "admin", "secret")}
+	ensure.Nil(t, users.Start())
+	defer users.Stop()
+
+	hc := newCounterClient()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{MessageTimeout: time.Minute, UserStore: users},
+		stats:      hc,
+	}
+	conn := &fakeConn{}
+	a := &authClient{t: t, p: p, conn: conn, client: p.clients.add(conn)}
+
+	// unauthenticated clients can connect but not do anything else
+	ok, _ := a.send(fakeQuery(1, 0, "admin.$cmd", bson.D{{Name: "isMaster", Value: 1}}))
+	ensure.True(t, ok)
+	ok, reply := a.send(fakeQuery(2, 0, "db.$cmd", bson.D{{Name: "find", Value: "c"}}))
+	ensure.False(t, ok)
+	ensure.DeepEqual(t, reply["code"], codeUnauthorized)
+	ok, reply = a.send(fakeQuery(3, 0, "db.c", bson.M{}))
+	ensure.False(t, ok)
+	ensure.DeepEqual(t, reply["code"], codeUnauthorized)
+	ok, _ = a.send(fakeGetMore(1))
+	ensure.False(t, ok)
+	ensure.DeepEqual(t, hc.count("auth.rejected"), float64(3))
+
+	// a wrong password fails
+	ok, reply = a.send(fakeQuery(4, 0, "admin.$cmd", bson.D{
+		{Name: "saslStart", Value: 1},
+		{Name: "mechanism", Value: ScramSHA256},
+		{Name: "payload", Value: []byte("n,,n=app,r=nonce")},
+	}))
+	ensure.False(t, ok)
+	serverFirst := string(reply["payload"].([]byte))
+	ok, reply = a.send(fakeQuery(5, 0, "admin.$cmd", bson.D{
+		{Name: "saslContinue", Value: 1},
+		{Name: "conversationId", Value: reply["conversationId"]},
+		{Name: "payload", Value: []byte(scramClientFinal(ScramSHA256, "app", "guess", "n=app,r=nonce", serverFirst))},
+	}))
+	ensure.False(t, ok)
+	ensure.DeepEqual(t, reply["code"], codeAuthenticationFailed)
+	ensure.DeepEqual(t, hc.count("auth.failure"), float64(1))
+
+	// the right one authenticates the client, with the empty exchange
+	ok, reply = a.send(fakeQuery(6, 0, "admin.$cmd", bson.D{
+		{Name: "saslStart", Value: 1},
+		{Name: "mechanism", Value: ScramSHA1},
+		{Name: "payload", Value: []byte("n,,n=app,r=nonce")},
+	}))
+	ensure.False(t, ok)
+	serverFirst = string(reply["payload"].([]byte))
+	conversationID := reply["conversationId"]
+	ok, reply = a.send(fakeQuery(7, 0, "admin.$cmd", bson.D{
+		{Name: "saslContinue", Value: 1},
+		{Name: "conversationId", Value: conversationID},
+		{Name: "payload", Value: []byte(scramClientFinal(ScramSHA1, "app", "secret", "n=app,r=nonce", serverFirst))},
+	}))
+	ensure.False(t, ok)
+	ensure.DeepEqual(t, reply["ok"], 1)
+	ensure.DeepEqual(t, reply["done"], false)
+	ok, reply = a.send(fakeQuery(8, 0, "admin.$cmd", bson.D{
+		{Name: "saslContinue", Value: 1},
+		{Name: "conversationId", Value: conversationID},
+		{Name: "payload", Value: []byte{}},
+	}))
+	ensure.False(t, ok)
+	ensure.DeepEqual(t, reply["done"], true)
+	ensure.DeepEqual(t, hc.count("auth.success"), float64(1))
+
+	// then everything goes, but authentication which stays at the proxy
+	ok, _ = a.send(fakeQuery(9, 0, "db.$cmd", bson.D{{Name: "find", Value: "c"}}))
+	ensure.True(t, ok)
+	ok, _ = a.send(fakeGetMore(1))
+	ensure.True(t, ok)
+	ok, reply = a.send(fakeQuery(10, 0, "admin.$cmd", bson.D{{Name: "authenticate", Value: 1}}))
+	ensure.False(t, ok)
+	ensure.DeepEqual(t, reply["code"], codeAuthenticationFailed)
+
+	// until the client logs out
+	ok, _ = a.send(fakeQuery(11, 0, "admin.$cmd", bson.D{{Name: "logout", Value: 1}}))
+	ensure.False(t, ok)
+	ok, _ = a.send(fakeQuery(12, 0, "db.$cmd", bson.D{{Name: "find", Value: "c"}}))
+	ensure.False(t, ok)
+}
+
+// authenticate authenticates the client with SCRAM-SHA-256.
+func (a *authClient) authenticate(user, password string) {
+	clientFirst := "n=" + user + ",r=nonce"
+	ok, reply := a.send(fakeQuery(1, 0, "admin.$cmd", bson.D{
+		{Name: "saslStart", Value: 1},
+		{Name: "mechanism", Value: ScramSHA256},
+		{Name: "payload", Value: []byte("n,," + clientFirst)},
+	}))
+	ensure.False(a.t, ok)
+	serverFirst := string(reply["payload"].([]byte))
+	ok, reply = a.send(fakeQuery(2, 0, "admin.$cmd", bson.D{
+		{Name: "saslContinue", Value: 1},
+		{Name: "conversationId", Value: reply["conversationId"]},
+		{Name: "payload", Value: []byte(scramClientFinal(ScramSHA256, user, password, clientFirst, serverFirst))},
+	}))
+	ensure.False(a.t, ok)
+	ensure.DeepEqual(a.t, reply["ok"], 1)
+}
+
+func TestAuthorizeReloadedUsers(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "dvara-auth")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+	users := &UserStore{Path: writeUsers(t, dir, "app", "admin", "secret")}
+	ensure.Nil(t, users.Start())
+	defer users.Stop()
+
+	hc := newCounterClient()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{MessageTimeout: time.Minute, UserStore: users},
+		stats:      hc,
+	}
+	conn := &fakeConn{}
+	a := &authClient{t: t, p: p, conn: conn, client: p.clients.add(conn)}
+	a.authenticate("app", "secret")
+	find := fakeQuery(3, 0, "db.$cmd", bson.D{{Name: "find", Value: "c"}})
+	ok, _ := a.send(find)
+	ensure.True(t, ok)
+
+	// reloading the same user keeps the client authenticated
+	b, err := ioutil.ReadFile(users.Path)
+	ensure.Nil(t, err)
+	ensure.Nil(t, users.load())
+	ok, _ = a.send(find)
+	ensure.True(t, ok)
+
+	// removing it doesn't, from the next message on
+	ensure.Nil(t, ioutil.WriteFile(users.Path, []byte("[]"), 0600))
+	ensure.Nil(t, users.load())
+	ok, reply := a.send(find)
+	ensure.False(t, ok)
+	ensure.DeepEqual(t, reply["code"], codeUnauthorized)
+	ok, _ = a.send(fakeGetMore(1))
+	ensure.False(t, ok)
+	ensure.DeepEqual(t, hc.count("auth.revoked"), float64(1))
+
+	// neither does changing its password
+	ensure.Nil(t, ioutil.WriteFile(users.Path, b, 0600))
+	ensure.Nil(t, users.load())
+	a.authenticate("app", "secret")
+	ok, _ = a.send(find)
+	ensure.True(t, ok)
+	writeUsers(t, dir, "app", "admin", "changed")
+	ensure.Nil(t, users.load())
+	ok, _ = a.send(find)
+	ensure.False(t, ok)
+	ensure.DeepEqual(t, hc.count("auth.revoked"), float64(2))
+}
+
+func TestAuthorizeDisabled(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{ReplicaSet: &ReplicaSet{}}
+	ok, err := p.authorize(&messageHeader{OpCode: OpQuery}, nil, nil)
+	ensure.Nil(t, err)
+	ensure.True(t, ok)
+}
+
+func TestWithoutCommandField(t *testing.T) {
+	t.Parallel()
+	hello := bson.D{
+		{Name: "isMaster", Value: 1},
+		{Name: "speculativeAuthenticate", Value: bson.D{{Name: "saslStart", Value: 1}}},
+	}
+	check := func(msg []byte) []byte {
+		stripped, err := withoutCommandField(msg, "speculativeAuthenticate")
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, getInt32(stripped, 0), int32(len(stripped)))
+		name, cmd := requestCommand(stripped)
+		ensure.DeepEqual(t, name, "isMaster")
+		ensure.False(t, hasKey(cmd, "speculativeAuthenticate"))
+		return stripped
+	}
+	check(fakeQuery(1, 0, "admin.$cmd", hello))
+
+	// wrapped with the read preference
+	check(fakeQuery(1, 0, "admin.$cmd", bson.D{
+		{Name: "$query", Value: hello},
+		{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "primary"}}},
+	}))
+
+	// or in the body of an OpMsg, whose checksum is dropped
+	doc, err := bson.Marshal(append(hello, bson.DocElem{Name: "$db", Value: "admin"}))
+	ensure.Nil(t, err)
+	msg := addHeader(nil, int(OpMsg))
+	msg = addInt32(msg, opMsgChecksumPresent)
+	msg = append(msg, 0)
+	msg = append(msg, doc...)
+	msg = addInt32(msg, 0x12345678)
+	setInt32(msg, 0, int32(len(msg)))
+	stripped := check(msg)
+	ensure.DeepEqual(t, getInt32(stripped, headerLen), int32(0))
+	ensure.DeepEqual(t, len(stripped), headerLen+4+1+len(opMsgBody(stripped)))
+}
@@ -0,0 +1,152 @@
+package dvara
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SystemClass is the class of clients allowed to use the server connections
+// reserved for dvara's own health and admin traffic. dvara's own clients are
+// part of it, as are the clients of a ClientClass with its name.
+const SystemClass = "system"
+
+// systemDialTimeout is the time allowed for dvara's own clients to connect to
+// a proxy.
+const systemDialTimeout = 10 * time.Second
+
+// withSystemClient returns a context acquiring from a Pool as dvara itself,
+// which may use the connections reserved for the SystemClass.
+func withSystemClient(ctx context.Context) context.Context {
+	return WithPoolClient(ctx, "dvara", SystemClass)
+}
+
+// dialSystem connects to the proxy at addr as one of dvara's own clients,
+// until the returned connection is closed.
+func (r *ReplicaSet) dialSystem(addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, systemDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	local := tcpAddrPort(conn.LocalAddr().(*net.TCPAddr))
+	r.systemMutex.Lock()
+	if r.systemClients == nil {
+		r.systemClients = make(map[netip.AddrPort]struct{})
+	}
+	r.systemClients[local] = struct{}{}
+	atomic.StoreInt32(&r.systemCount, int32(len(r.systemClients)))
+	r.systemMutex.Unlock()
+	return &systemConn{Conn: conn, replicaSet: r, local: local}, nil
+}
+
+// isSystemClient returns true if the client at addr is one of dvara's own.
+func (r *ReplicaSet) isSystemClient(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok || atomic.LoadInt32(&r.systemCount) == 0 {
+		return false
+	}
+	r.systemMutex.Lock()
+	defer r.systemMutex.Unlock()
+	_, ok = r.systemClients[tcpAddrPort(tcp)]
+	return ok
+}
+
+// tcpAddrPort returns the address comparably whether IPv4 addresses are
+// mapped to IPv6 or not.
+func tcpAddrPort(addr *net.TCPAddr) netip.AddrPort {
+	ap := addr.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// systemConn is a connection of one of dvara's own clients.
+type systemConn struct {
+	net.Conn
+	replicaSet *ReplicaSet
+	local      netip.AddrPort
+}
+
+// Close closes the connection, which is no longer one of dvara's own.
+func (c *systemConn) Close() error {
+	r := c.replicaSet
+	r.systemMutex.Lock()
+	delete(r.systemClients, c.local)
+	atomic.StoreInt32(&r.systemCount, int32(len(r.systemClients)))
+	r.systemMutex.Unlock()
+	return c.Conn.Close()
+}
+
+// ClientClass groups clients by network for scheduling server connections.
+type ClientClass struct {
+	Name string
+	Nets []*net.IPNet
+}
+
+// Match returns true if the client IP is part of the class.
+func (c *ClientClass) Match(ip net.IP) bool {
+	for _, n := range c.Nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseClientClasses parses semicolon separated classes of comma separated
+// client networks, for example "batch=10.1.0.0/16,10.2.0.0/16;system=127.0.0.1".
+func ParseClientClasses(list string) ([]ClientClass, error) {
+	var classes []ClientClass
+	for _, s := range strings.Split(list, ";") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		i := strings.Index(s, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("dvara: invalid client class %q", s)
+		}
+		nets, err := ParseCIDRs(s[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		classes = append(classes, ClientClass{Name: strings.TrimSpace(s[:i]), Nets: nets})
+	}
+	return classes, nil
+}
+
+// ParseClassWeights parses comma separated class weights, for example
+// "batch=1,default=4".
+func ParseClassWeights(list string) (map[string]uint, error) {
+	weights := make(map[string]uint)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		i := strings.Index(s, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("dvara: invalid class weight %q", s)
+		}
+		w, err := strconv.ParseUint(strings.TrimSpace(s[i+1:]), 10, 32)
+		if err != nil || w == 0 {
+			return nil, fmt.Errorf("dvara: invalid class weight %q", s)
+		}
+		weights[strings.TrimSpace(s[:i])] = uint(w)
+	}
+	return weights, nil
+}
+
+// clientClass returns the name of the first class the client IP is part of,
+// DefaultClass if none.
+func (r *ReplicaSet) clientClass(ip net.IP) string {
+	for i := range r.ClientClasses {
+		if r.ClientClasses[i].Match(ip) {
+			return r.ClientClasses[i].Name
+		}
+	}
+	return DefaultClass
+}
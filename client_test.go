@@ -0,0 +1,120 @@
+package dvara
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestClientStopInterruptsIdleRead(t *testing.T) {
+	t.Parallel()
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+
+	var clients clientRegistry
+	c := clients.add(conn)
+	done := make(chan error)
+	go func() {
+		_, stopped, err := c.readHeader(time.Hour)
+		ensure.True(t, stopped)
+		done <- err
+	}()
+
+	// wait for the client to be idle
+	for {
+		c.mutex.Lock()
+		idle := c.idle
+		c.mutex.Unlock()
+		if idle {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	clients.stop()
+	err := <-done
+	ne, ok := err.(net.Error)
+	ensure.True(t, ok && ne.Timeout())
+
+	// clients don't wait for another message, nor do new ones
+	_, _, err = c.readHeader(time.Hour)
+	ensure.DeepEqual(t, err, errNormalClose)
+	_, _, err = clients.add(other).readHeader(time.Hour)
+	ensure.DeepEqual(t, err, errNormalClose)
+}
+
+func TestClientReadHeader(t *testing.T) {
+	t.Parallel()
+	msg := fakeQuery(7, 0, "db.c", map[string]int{"a": 1})
+	p := &Proxy{}
+	c := p.clients.add(&fakeConn{in: bytes.NewReader(msg)})
+	h, err := p.clientReadHeader(c, time.Minute)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, h.RequestID, int32(7))
+	ensure.DeepEqual(t, h.MessageLength, int32(len(msg)))
+}
+
+// cycleConn endlessly reads the same message and discards writes.
+type cycleConn struct {
+	fakeConn
+	msg []byte
+	pos int
+}
+
+func (c *cycleConn) Read(b []byte) (int, error) {
+	n := copy(b, c.msg[c.pos:])
+	c.pos = (c.pos + n) % len(c.msg)
+	return n, nil
+}
+
+func (c *cycleConn) Write(b []byte) (int, error) { return len(b), nil }
+
+func BenchmarkProxyMessage(b *testing.B) {
+	getMore := addHeader(nil, int(OpGetMore))
+	getMore = addInt32(getMore, 0)
+	getMore = addCString(getMore, "db.c")
+	getMore = addInt32(getMore, 0)
+	getMore = append(getMore, make([]byte, 8)...)
+	setInt32(getMore, 0, int32(len(getMore)))
+	reply := fakeReplyTo(1, map[string]string{"a": string(bytes.Repeat([]byte("x"), 16<<10))})
+
+	p := &Proxy{ReplicaSet: &ReplicaSet{MessageTimeout: time.Minute}}
+	client := p.clients.add(&cycleConn{msg: getMore})
+	server := &cycleConn{msg: reply}
+	var lastError LastError
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h, err := p.clientReadHeader(client, time.Minute)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := p.proxyMessage(h, client, server, &lastError); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProxyQuery(b *testing.B) {
+	query := fakeQuery(1, 0, "db.c", map[string]int{"a": 1})
+	reply := fakeReplyTo(1, map[string]string{"a": string(bytes.Repeat([]byte("x"), 16<<10))})
+
+	p := &Proxy{ReplicaSet: &ReplicaSet{MessageTimeout: time.Minute, ProxyQuery: &ProxyQuery{}}}
+	client := p.clients.add(&cycleConn{msg: query})
+	server := &cycleConn{msg: reply}
+	var lastError LastError
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h, err := p.clientReadHeader(client, time.Minute)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := p.proxyMessage(h, client, server, &lastError); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -15,7 +15,14 @@ import (
 )
 
 func main() {
-	if err := Main(); err != nil {
+	run := Main
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		run = func() error { return Replay(os.Args[2:]) }
+	}
+	if len(os.Args) > 1 && os.Args[1] == "user" {
+		run = func() error { return User(os.Args[2:]) }
+	}
+	if err := run(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
@@ -28,11 +35,34 @@ func Main() error {
 	listenAddr := flag.String("listen", "127.0.0.1", "address for listening, for example, 127.0.0.1 for reachable only from the same machine, or 0.0.0.0 for reachable from other machines")
 	maxConnections := flag.Uint("max_connections", 100, "maximum number of connections per mongo")
 	maxPerClientConnections := flag.Uint("max_per_client_connections", 100, "maximum number of connections from a single client")
+	clientRules := flag.String("client_rules", "", "semicolon separated rules allowing or denying client networks and limiting their connections, the first matching applies, for example, office=192.168.0.0/16 deny;batch=10.1.0.0/16 max_per_client=500 max=2000")
+	proxyProtocol := flag.String("proxy_protocol", "off", "off, optional or required, whether client connections start with a PROXY protocol v1 or v2 header conveying the client address from a load balancer")
+	proxyProtocolTrusted := flag.String("proxy_protocol_trusted", "", "comma separated networks of the load balancers allowed to send PROXY protocol headers, required with -proxy_protocol")
+	clientAcceptRate := flag.Float64("client_accept_rate", 0, "client connections per second accepted per mongo after client_accept_burst, the others wait in the listen backlog, no limit if 0")
+	clientAcceptBurst := flag.Uint("client_accept_burst", 100, "client connections accepted at once per mongo before client_accept_rate applies")
+	maxConcurrentDials := flag.Uint("max_concurrent_dials", 0, "maximum number of connections being opened to each mongo at the same time, no limit if 0")
+	maxClientStatNames := flag.Int("max_client_stat_names", 100, "maximum number of distinct applications, and of driver versions, named in stats and query shapes, clients beyond it are counted as other")
+	minDriverVersions := flag.String("min_driver_versions", "", "comma separated minimum versions by driver name, older drivers are rejected, for example, nodejs=4.0,mongo-java-driver=3.12")
 	messageTimeout := flag.Duration("message_timeout", 2*time.Minute, "timeout for one message to be proxied")
-	password := flag.String("password", "", "mongodb password")
+	awaitDataTimeout := flag.Duration("await_data_timeout", 10*time.Minute, "timeout for one message on a tailable awaitData cursor or change stream, which may wait for new data")
+	retryReads := flag.Bool("retry_reads", true, "if true, reads are retried once on a new server connection when theirs fails before replying, except with session pooling")
+	exhaustReplyTimeout := flag.Duration("exhaust_reply_timeout", 2*time.Minute, "timeout for each reply streamed to an exhaust query")
+	password := flag.String("password", "", "mongodb password, visible in the process list, prefer password_env or password_file")
+	usernameEnv := flag.String("username_env", "", "environment variable holding the mongo db username, username is used if empty")
+	passwordEnv := flag.String("password_env", "", "environment variable holding the mongodb password")
+	usernameFile := flag.String("username_file", "", "file holding the mongo db username, such as a mounted secret, username is used if empty")
+	passwordFile := flag.String("password_file", "", "file holding the mongodb password, such as a mounted secret")
+	credentialsReloadInterval := flag.Duration("credentials_reload_interval", 30*time.Second, "how often password_file and username_file are checked for rotated credentials, 0 disables checking")
 	portEnd := flag.Int("port_end", 6010, "end of port range")
 	portStart := flag.Int("port_start", 6000, "start of port range")
 	serverClosePoolSize := flag.Uint("server_close_pool_size", 1, "number of goroutines that will handle closing server connections.")
+	serverPoolMaxWait := flag.Duration("server_pool_max_wait", 0, "how long a message waits for a server connection when max_connections are in use, no limit if 0")
+	serverPoolMaxWaiting := flag.Uint("server_pool_max_waiting", 0, "how many messages may wait for a server connection before new ones are rejected, no limit if 0")
+	minIdleConnections := flag.Uint("min_idle_connections", 0, "number of idle connections per mongo kept around, and opened on start")
+	serverMaxLifetime := flag.Duration("server_max_lifetime", 0, "duration after which a server connection is closed rather than reused, no limit if 0")
+	serverLifetimeJitter := flag.Duration("server_lifetime_jitter", time.Minute, "maximum random duration added to server_max_lifetime for each connection")
+	serverValidateIdle := flag.Duration("server_validate_idle", 0, "idle duration after which a server connection is pinged before being used, disabled if 0")
+	serverValidateInterval := flag.Duration("server_validate_interval", 0, "how often idle server connections are pinged in the background, disabled if 0")
 	serverIdleTimeout := flag.Duration("server_idle_timeout", 60*time.Minute, "duration after which a server connection will be considered idle")
 	username := flag.String("username", "", "mongo db username")
 	metricsAddress := flag.String("metrics", "127.0.0.1:8125", "UDP address to send metrics to datadog, default is 127.0.0.1:8125")
@@ -40,10 +70,82 @@ func Main() error {
 	replicaSetName := flag.String("replica_set_name", "", "Replica set name, used to filter hosts runnning other replica sets")
 	healthCheckInterval := flag.Duration("healthcheckinterval", 5*time.Second, "How often to run the health check")
 	failedHealthCheckThreshold := flag.Uint("failedhealthcheckthreshold", 3, "How many failed checks before a restart")
+	adminAddr := flag.String("admin_addr", "", "address for the admin HTTP endpoint, for example, 127.0.0.1:6100, disabled if empty")
+	queryShapes := flag.Bool("query_shapes", false, "if true, aggregate statistics per query shape")
+	queryShapesMax := flag.Uint("query_shapes_max", 1000, "maximum number of distinct query shapes tracked")
+	queryShapesTop := flag.Uint("query_shapes_top", 20, "number of query shapes included in periodic log dumps")
+	queryShapesLogInterval := flag.Duration("query_shapes_log_interval", 0, "how often to log the top query shapes, disabled if 0")
+	captureFile := flag.String("capture_file", "", "file to capture client traffic to, for use with dvara replay, disabled if empty")
+	captureMaxSize := flag.Int64("capture_max_size", 100*1024*1024, "size in bytes after which the capture file is rotated, 0 disables rotation")
+	captureMaxFiles := flag.Uint("capture_max_files", 5, "number of rotated capture files to keep")
+	captureClients := flag.String("capture_clients", "", "comma separated list of client networks to capture, for example, 10.0.0.0/8, all if empty")
+	captureNamespaces := flag.String("capture_namespaces", "", "comma separated list of namespace patterns to capture, for example, prod.*, all if empty")
+	captureOpCodes := flag.String("capture_opcodes", "", "comma separated list of op codes to capture, for example, QUERY,INSERT, all if empty")
+	cancelAbandonedOps := flag.Bool("cancel_abandoned_ops", false, "if true, operations left running by abandoned server connections are killed, which needs the inprog and killop privileges")
+	connectionBudget := flag.Uint("connection_budget", 0, "maximum number of connections to all mongos combined, disabled if 0")
+	connectionBudgetMin := flag.Uint("connection_budget_min_per_member", 10, "number of connections of the budget guaranteed to each mongo")
+	connectionBudgetPrimaryWeight := flag.Float64("connection_budget_primary_weight", 1, "relative weight of the primary when splitting the connection budget")
+	connectionBudgetSecondaryWeight := flag.Float64("connection_budget_secondary_weight", 1, "relative weight of secondaries when splitting the connection budget")
+	adaptiveLatencyTarget := flag.Duration("adaptive_latency_target", 0, "message latency above which the connections per mongo are reduced, 0 disables adapting them")
+	adaptiveMinConnections := flag.Uint("adaptive_min_connections", 10, "minimum connections per mongo when adapting them to latency")
+	adaptiveBackoff := flag.Float64("adaptive_backoff", 0.9, "factor the connections per mongo are multiplied by when a message is slow")
+	poolingMode := flag.String("pooling_mode", "transaction", "transaction returns server connections to the pool after each message, session keeps them for the whole client connection")
+	listenerPoolingModes := flag.String("listener_pooling_modes", "", "comma separated pooling modes of the listeners on some ports or port ranges, overriding pooling_mode, for example, 6000=session,6001-6004=transaction")
+	fairQueuing := flag.Bool("fair_queuing", false, "if true, server connections are shared fairly between clients when all are in use")
+	clientClasses := flag.String("client_classes", "", "semicolon separated classes of client networks, for example, batch=10.1.0.0/16;system=127.0.0.1")
+	classWeights := flag.String("class_weights", "", "comma separated weights of client classes with fair_queuing, for example, batch=1,default=4")
+	reservedConnections := flag.Uint("reserved_connections", 0, "number of connections per mongo only available to the system client class, which includes dvara's own health check")
+	mirrorAddr := flag.String("mirror_addr", "", "address of a shadow mongo to mirror traffic to, disabled if empty")
+	mirrorSampleRate := flag.Float64("mirror_sample_rate", 1, "fraction of eligible messages to mirror, between 0 and 1")
+	mirrorWrites := flag.Bool("mirror_writes", false, "if true, writes are mirrored as well as reads")
+	mirrorCompare := flag.Bool("mirror_compare", false, "if true, shadow replies are compared to the real ones and mismatches counted")
+	mirrorQueueSize := flag.Uint("mirror_queue_size", 1000, "number of messages waiting to be mirrored after which new ones are dropped")
+	mirrorMaxConnections := flag.Uint("mirror_max_connections", 10, "maximum number of connections per proxy to the shadow mongo")
+	authUsers := flag.String("auth_users", "", "JSON array of the users clients authenticate as at the proxy with SCRAM, as printed by dvara user, clients aren't authenticated if empty")
+	userPoolMaxConnections := flag.Uint("user_pool_max_connections", 0, "maximum number of connections per mongo for the clients of each user with a backend user, max_connections if 0")
+	userPoolsMaxConnections := flag.Uint("user_pools_max_connections", 0, "maximum number of connections per mongo for the clients of all the users with a backend user together, max_connections if 0")
+	userPoolIdleTimeout := flag.Duration("user_pool_idle_timeout", 10*time.Minute, "how long the connections of a user with a backend user are kept once its clients stop using them, 0 keeps them forever")
+	authReloadInterval := flag.Duration("auth_reload_interval", 30*time.Second, "how often the users file is checked for changes, 0 disables reloading")
+	firewallPolicy := flag.String("firewall_policy", "", "JSON firewall policy allowing or denying requests by command, namespace, op code and client network, everything is allowed if empty")
+	firewallReloadInterval := flag.Duration("firewall_reload_interval", 30*time.Second, "how often the firewall policy file is checked for changes, 0 disables reloading")
+	rateLimitPolicy := flag.String("rate_limit_policy", "", "JSON policy of operations and bytes per second limits by client, user and namespace, delaying or rejecting requests exceeding them, nothing is limited if empty")
+	rateLimitReloadInterval := flag.Duration("rate_limit_reload_interval", 30*time.Second, "how often the rate limit policy file is checked for changes, 0 disables reloading")
+	readOnlyMode := flag.Bool("read_only", false, "if true, start in read only mode rejecting every write, SIGUSR1 and the admin endpoint switch it at runtime")
+	trackCursors := flag.Bool("track_cursors", false, "if true, cursors are tracked per client and the ones left open are killed when it disconnects")
+	maxCursorsPerClient := flag.Uint("max_cursors_per_client", 0, "number of open cursors after which a client can't open more, unlimited if 0")
 
 	flag.Parse()
 	statsClient := NewDataDogStatsDClient(*metricsAddress, "replica:"+*replicaName)
 
+	mode, err := dvara.ParsePoolingMode(*poolingMode)
+	if err != nil {
+		return err
+	}
+	listenerModes, err := dvara.ParseListenerPoolingModes(*listenerPoolingModes)
+	if err != nil {
+		return err
+	}
+	classes, err := dvara.ParseClientClasses(*clientClasses)
+	if err != nil {
+		return err
+	}
+	weights, err := dvara.ParseClassWeights(*classWeights)
+	if err != nil {
+		return err
+	}
+	rules, err := dvara.ParseClientRules(*clientRules)
+	if err != nil {
+		return err
+	}
+	proxyProtocolMode, err := dvara.ParseProxyProtocolMode(*proxyProtocol)
+	if err != nil {
+		return err
+	}
+	trusted, err := dvara.ParseCIDRs(*proxyProtocolTrusted)
+	if err != nil {
+		return err
+	}
+
 	replicaSet := dvara.ReplicaSet{
 		Addrs:                   *addrs,
 		ClientIdleTimeout:       *clientIdleTimeout,
@@ -51,17 +153,126 @@ func Main() error {
 		ListenAddr:              *listenAddr,
 		MaxConnections:          *maxConnections,
 		MaxPerClientConnections: *maxPerClientConnections,
+		ClientRules:             rules,
+		ProxyProtocol:           proxyProtocolMode,
+		ProxyProtocolTrusted:    trusted,
+		ClientAcceptRate:        *clientAcceptRate,
+		ClientAcceptBurst:       *clientAcceptBurst,
+		MaxConcurrentDials:      *maxConcurrentDials,
+		UserPoolMaxConnections:  *userPoolMaxConnections,
+		UserPoolsMaxConnections: *userPoolsMaxConnections,
+		UserPoolIdleTimeout:     *userPoolIdleTimeout,
 		MessageTimeout:          *messageTimeout,
+		AwaitDataTimeout:        *awaitDataTimeout,
+		ExhaustReplyTimeout:     *exhaustReplyTimeout,
+		RetryReads:              *retryReads,
 		Password:                *password,
 		PortEnd:                 *portEnd,
 		PortStart:               *portStart,
 		ServerClosePoolSize:     *serverClosePoolSize,
 		ServerIdleTimeout:       *serverIdleTimeout,
+		MinIdleConnections:      *minIdleConnections,
+		ServerMaxLifetime:       *serverMaxLifetime,
+		ServerLifetimeJitter:    *serverLifetimeJitter,
+		ServerValidateIdle:      *serverValidateIdle,
+		ServerValidateInterval:  *serverValidateInterval,
+		ServerPoolMaxWait:       *serverPoolMaxWait,
+		ServerPoolMaxWaiting:    *serverPoolMaxWaiting,
 		Username:                *username,
 		Name:                    *replicaSetName,
+		CancelAbandonedOps:      *cancelAbandonedOps,
+		AdaptiveLatencyTarget:   *adaptiveLatencyTarget,
+		AdaptiveMinConnections:  *adaptiveMinConnections,
+		AdaptiveBackoff:         *adaptiveBackoff,
+		PoolingMode:             mode,
+		ListenerPoolingModes:    listenerModes,
+		FairQueuing:             *fairQueuing,
+		ClientClasses:           classes,
+		ClassWeights:            weights,
+		ReservedConnections:     *reservedConnections,
+		MirrorAddr:              *mirrorAddr,
+		MirrorSampleRate:        *mirrorSampleRate,
+		MirrorWrites:            *mirrorWrites,
+		MirrorCompare:           *mirrorCompare,
+		MirrorQueueSize:         *mirrorQueueSize,
+		MirrorMaxConnections:    *mirrorMaxConnections,
 	}
 	stateManager := dvara.NewStateManager(&replicaSet)
 
+	queryShapeStats := dvara.QueryShapeStats{
+		Enabled:     *queryShapes,
+		MaxShapes:   *queryShapesMax,
+		TopShapes:   *queryShapesTop,
+		LogInterval: *queryShapesLogInterval,
+	}
+	adminServer := dvara.AdminServer{Addr: *adminAddr}
+
+	budget := dvara.ConnectionBudget{
+		Total:           *connectionBudget,
+		MinPerMember:    *connectionBudgetMin,
+		PrimaryWeight:   *connectionBudgetPrimaryWeight,
+		SecondaryWeight: *connectionBudgetSecondaryWeight,
+	}
+
+	credentialWatcher := dvara.CredentialWatcher{Interval: *credentialsReloadInterval}
+	if *passwordFile != "" {
+		credentialWatcher.Provider = dvara.FileCredentials{
+			Username:     *username,
+			UsernameFile: *usernameFile,
+			PasswordFile: *passwordFile,
+		}
+	} else if *passwordEnv != "" {
+		// the environment doesn't change, there is nothing to watch
+		credentialWatcher.Provider = dvara.EnvCredentials{
+			Username:    *username,
+			UsernameVar: *usernameEnv,
+			PasswordVar: *passwordEnv,
+		}
+		credentialWatcher.Interval = 0
+	}
+
+	userStore := dvara.UserStore{
+		Path:           *authUsers,
+		ReloadInterval: *authReloadInterval,
+	}
+
+	firewall := dvara.Firewall{
+		Path:           *firewallPolicy,
+		ReloadInterval: *firewallReloadInterval,
+	}
+
+	rateLimiter := dvara.RateLimiter{
+		Path:           *rateLimitPolicy,
+		ReloadInterval: *rateLimitReloadInterval,
+	}
+
+	minVersions, err := dvara.ParseMinDriverVersions(*minDriverVersions)
+	if err != nil {
+		return err
+	}
+	drivers := dvara.Drivers{MinVersions: minVersions, MaxStatNames: *maxClientStatNames}
+
+	var readOnly dvara.ReadOnly
+	if *readOnlyMode {
+		readOnly.Set(true)
+	}
+
+	cursorTracker := dvara.CursorTracker{
+		Enabled:      *trackCursors,
+		MaxPerClient: *maxCursorsPerClient,
+	}
+
+	captureFilter, err := dvara.NewCaptureFilter(*captureClients, *captureNamespaces, *captureOpCodes)
+	if err != nil {
+		return err
+	}
+	capture := dvara.Capture{
+		Path:        *captureFile,
+		MaxFileSize: *captureMaxSize,
+		MaxFiles:    *captureMaxFiles,
+		Filter:      captureFilter,
+	}
+
 	// Actual logger
 	corelog.SetupLogFmtLoggerTo(os.Stderr)
 	corelog.SetStandardFields("replicaset", *replicaName)
@@ -80,10 +291,21 @@ func Main() error {
 	log := Logger{}
 
 	var graph inject.Graph
-	err := graph.Provide(
+	err = graph.Provide(
 		&inject.Object{Value: &replicaSet},
 		&inject.Object{Value: &statsClient},
 		&inject.Object{Value: stateManager},
+		&inject.Object{Value: &queryShapeStats},
+		&inject.Object{Value: &adminServer},
+		&inject.Object{Value: &capture},
+		&inject.Object{Value: &budget},
+		&inject.Object{Value: &cursorTracker},
+		&inject.Object{Value: &userStore},
+		&inject.Object{Value: &credentialWatcher},
+		&inject.Object{Value: &firewall},
+		&inject.Object{Value: &rateLimiter},
+		&inject.Object{Value: &readOnly},
+		&inject.Object{Value: &drivers},
 	)
 	if err != nil {
 		return err
@@ -107,6 +329,16 @@ func Main() error {
 	go stateManager.KeepSynchronized(syncChan)
 	go hc.HealthCheck(&replicaSet, syncChan)
 
+	// SIGUSR1 switches read only mode on and off
+	readOnlySignals := make(chan os.Signal, 1)
+	signal.Notify(readOnlySignals, syscall.SIGUSR1)
+	defer signal.Stop(readOnlySignals)
+	go func() {
+		for range readOnlySignals {
+			readOnly.Toggle()
+		}
+	}()
+
 	ch := make(chan os.Signal, 2)
 	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
 	<-ch
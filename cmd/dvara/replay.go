@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/intercom/dvara"
+)
+
+// Replay implements the "replay" command, which replays capture files against
+// a target server and reports how it compares to the original traffic.
+func Replay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	target := flags.String("target", "localhost:27017", "address of the mongo server to replay against")
+	speed := flags.Float64("speed", 1, "replay speed relative to the original traffic, 0 replays as fast as possible")
+	timeout := flags.Duration("timeout", time.Minute, "timeout for each replayed message")
+	username := flags.String("username", "", "user replayed connections authenticate as, captured authentication commands are never replayed")
+	passwordEnv := flags.String("password_env", "", "environment variable holding the password of username")
+	passwordFile := flags.String("password_file", "", "file holding the password of username, such as a mounted secret")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dvara replay [flags] capture-file...")
+		fmt.Fprintln(os.Stderr, "capture files are replayed in the given order, oldest first")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no capture files given")
+	}
+
+	var captures []io.Reader
+	for _, name := range flags.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		captures = append(captures, f)
+	}
+
+	replayer := dvara.Replayer{
+		Target:  *target,
+		Speed:   *speed,
+		Timeout: *timeout,
+	}
+	if *username != "" && *passwordEnv == "" && *passwordFile == "" {
+		return errors.New("username needs password_env or password_file")
+	}
+	if *passwordFile != "" {
+		replayer.Credentials = dvara.FileCredentials{Username: *username, PasswordFile: *passwordFile}
+	} else if *username != "" {
+		replayer.Credentials = dvara.EnvCredentials{Username: *username, PasswordVar: *passwordEnv}
+	}
+	report, err := replayer.Replay(captures...)
+	if err != nil {
+		return err
+	}
+	fmt.Println(report)
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/intercom/dvara"
+)
+
+// User implements the "user" command, which prints the entry of a user for
+// the -auth_users file. The password is read from the standard input so it
+// doesn't show up in the process list. The password of the backend user, if
+// any, isn't part of the entry but read from an environment variable or a
+// file when connecting.
+func User(args []string) error {
+	flags := flag.NewFlagSet("user", flag.ContinueOnError)
+	db := flags.String("db", "admin", "database the user authenticates against")
+	backendUser := flags.String("backend_user", "", "mongo user the user's clients connect as, the proxy's if empty")
+	backendDB := flags.String("backend_db", "admin", "database the backend user authenticates against")
+	backendPasswordEnv := flags.String("backend_password_env", "", "environment variable holding the password of the backend user")
+	backendPasswordFile := flags.String("backend_password_file", "", "file holding the password of the backend user, such as a mounted secret")
+	maxConnections := flags.Uint("max_connections", 0, "maximum number of connections per mongo for the user's clients, user_pool_max_connections if 0")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dvara user [flags] name < password")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("no user name given")
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+	password, err := readPassword(stdin)
+	if err != nil {
+		return err
+	}
+	user, err := dvara.NewUser(flags.Arg(0), *db, password)
+	if err != nil {
+		return err
+	}
+	user.MaxConnections = *maxConnections
+	if *backendUser != "" {
+		if (*backendPasswordEnv == "") == (*backendPasswordFile == "") {
+			return errors.New("the backend user needs either -backend_password_env or -backend_password_file")
+		}
+		user.Backend = &dvara.BackendUser{
+			User:         *backendUser,
+			DB:           *backendDB,
+			PasswordEnv:  *backendPasswordEnv,
+			PasswordFile: *backendPasswordFile,
+		}
+	}
+	b, err := json.MarshalIndent(user, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+// readPassword reads a password on its own line.
+func readPassword(r *bufio.Reader) (string, error) {
+	password, err := r.ReadString('\n')
+	password = strings.TrimSuffix(password, "\n")
+	if password == "" {
+		if err != nil {
+			return "", err
+		}
+		return "", errors.New("empty password")
+	}
+	return password, nil
+}
@@ -0,0 +1,116 @@
+package dvara
+
+import (
+	"bytes"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// readCommands are the commands which only read data and can safely be
+// mirrored.
+var readCommands = map[string]bool{
+	"find":      true,
+	"count":     true,
+	"distinct":  true,
+	"aggregate": true,
+	"geoNear":   true,
+	"group":     true,
+}
+
+// writeCommands are the commands which modify data.
+var writeCommands = map[string]bool{
+	"insert":        true,
+	"update":        true,
+	"delete":        true,
+	"findAndModify": true,
+	"findandmodify": true,
+}
+
+// authCommands are the commands authenticating a connection.
+var authCommands = map[string]bool{
+	"saslStart":    true,
+	"saslContinue": true,
+	"authenticate": true,
+	"getnonce":     true,
+	"logout":       true,
+}
+
+// requestCommand returns the name and document of the command in the entire
+// request message, if it is one.
+func requestCommand(msg []byte) (string, bson.D) {
+	var doc []byte
+	switch OpCode(getInt32(msg, 12)) {
+	case OpQuery:
+		ns := msg[headerLen+4:]
+		i := bytes.IndexByte(ns, x00)
+		if i < 0 || len(ns) < i+1+8 {
+			return "", nil
+		}
+		doc = ns[i+1+8:]
+	case OpMsg:
+		doc = opMsgBody(msg)
+	}
+	var cmd bson.D
+	if doc == nil || bson.Unmarshal(doc, &cmd) != nil {
+		return "", nil
+	}
+	if cmd = unwrapCommand(cmd); len(cmd) == 0 {
+		return "", nil
+	}
+	return cmd[0].Name, cmd
+}
+
+// unwrapCommand returns the command of a legacy OpQuery command wrapped with
+// its read preference, like {$query: {count: "c"}, $readPreference: {...}},
+// which servers unwrap and run. Other commands are returned as is.
+func unwrapCommand(cmd bson.D) bson.D {
+	if q, ok := lookup(cmd, "$query").(bson.D); ok {
+		return q
+	}
+	if len(cmd) > 0 && cmd[0].Name == "query" {
+		if q, ok := cmd[0].Value.(bson.D); ok {
+			return q
+		}
+	}
+	return cmd
+}
+
+// requestNamespace returns the "db.collection" targeted by a request message,
+// resolving commands to the collection they operate on. It returns an empty
+// string if the namespace cannot be determined.
+func requestNamespace(msg []byte) string {
+	if len(msg) < headerLen+4 {
+		return ""
+	}
+	body := msg[headerLen:]
+	switch OpCode(getInt32(msg, 12)) {
+	case OpQuery, OpGetMore, OpUpdate, OpDelete, OpInsert:
+		// All start with an int32 (flags or ZERO) and the full collection name.
+		i := bytes.IndexByte(body[4:], x00)
+		if i < 0 {
+			return ""
+		}
+		ns := string(body[4 : 4+i])
+		if OpCode(getInt32(msg, 12)) != OpQuery || !strings.HasSuffix(ns, ".$cmd") {
+			return ns
+		}
+		rest := body[4+i+1:]
+		if len(rest) < 8 {
+			return ns
+		}
+		var q bson.D
+		if bson.Unmarshal(rest[8:], &q) != nil {
+			return ns
+		}
+		return shapeOfCommand(strings.TrimSuffix(ns, ".$cmd"), unwrapCommand(q)).Namespace
+	case OpMsg:
+		var q bson.D
+		if bson.Unmarshal(opMsgBody(msg), &q) != nil {
+			return ""
+		}
+		db, _ := lookup(q, "$db").(string)
+		return shapeOfCommand(db, q).Namespace
+	}
+	return ""
+}
@@ -0,0 +1,123 @@
+package dvara
+
+import (
+	"flag"
+	"io"
+	"net"
+	"sync"
+)
+
+var spliceThreshold = flag.Int64(
+	"dvara.splice-threshold",
+	0,
+	"message bodies of at least this many bytes are spliced between sockets by the kernel on linux, 0 disables it",
+)
+
+// copyBufferSize is the size of the buffers used to copy messages.
+const copyBufferSize = 32 << 10
+
+// copyBuffers holds the buffers used to copy messages, so proxying doesn't
+// allocate one per message.
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// copyN copies n bytes from r to w. When enabled, large copies between two
+// TCP connections are spliced instead of going through user space.
+func copyN(w io.Writer, r io.Reader, n int64) error {
+	if *spliceThreshold > 0 && n >= *spliceThreshold {
+		if dst, src := tcpConn(w), tcpConn(r); dst != nil && src != nil {
+			return splice(dst, src, n)
+		}
+	}
+	bp := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(bp)
+	return copyBuffer(w, r, n, *bp)
+}
+
+// splice copies n bytes between the TCP connections, which the runtime does
+// with the splice system call on linux.
+func splice(dst, src *net.TCPConn, n int64) error {
+	written, err := dst.ReadFrom(&io.LimitedReader{R: src, N: n})
+	if err == nil && written < n {
+		err = io.EOF
+	}
+	return err
+}
+
+// copyBuffer copies n bytes from r to w using the given buffer. Like
+// io.CopyN, it returns io.EOF if r has fewer bytes.
+func copyBuffer(w io.Writer, r io.Reader, n int64, buf []byte) error {
+	for n > 0 {
+		b := buf
+		if int64(len(b)) > n {
+			b = b[:n]
+		}
+		nr, err := r.Read(b)
+		if nr > 0 {
+			if err := writeAll(w, b[:nr]); err != nil {
+				return err
+			}
+			n -= int64(nr)
+		}
+		if err != nil {
+			if n == 0 && err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// writeAll writes b to w, returning errWrite if w doesn't take all of it.
+func writeAll(w io.Writer, b []byte) error {
+	n, err := w.Write(b)
+	if err != nil {
+		return err
+	}
+	if n != len(b) {
+		return errWrite
+	}
+	return nil
+}
+
+// tcpConn returns the TCP connection underlying v, nil if there is none or if
+// it is wrapped by something which needs to see the data.
+func tcpConn(v interface{}) *net.TCPConn {
+	switch c := v.(type) {
+	case *net.TCPConn:
+		return c
+	case *pooledConn:
+		return tcpConn(c.Conn)
+	case *proxiedConn:
+		if len(c.prefix) > 0 {
+			return nil
+		}
+		return tcpConn(c.Conn)
+	}
+	return nil
+}
+
+// copyRequest writes the header and copies the rest of the message from r to
+// w.
+func copyRequest(h *messageHeader, w io.Writer, r io.Reader) error {
+	n := int64(h.MessageLength - headerLen)
+	if *spliceThreshold > 0 && n >= *spliceThreshold {
+		if err := h.WriteTo(w); err != nil {
+			return err
+		}
+		return copyN(w, r, n)
+	}
+	bp := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(bp)
+	buf := *bp
+	h.encode(buf)
+	if err := writeAll(w, buf[:headerLen]); err != nil {
+		return err
+	}
+	return copyBuffer(w, r, n, buf)
+}
@@ -0,0 +1,89 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestCopyBuffer(t *testing.T) {
+	t.Parallel()
+	var w bytes.Buffer
+	r := bytes.NewReader([]byte("0123456789"))
+	ensure.Nil(t, copyBuffer(&w, r, 7, make([]byte, 3)))
+	ensure.DeepEqual(t, w.String(), "0123456")
+
+	// like io.CopyN, running out of bytes is io.EOF
+	ensure.DeepEqual(t, copyBuffer(&w, r, 7, make([]byte, 3)), io.EOF)
+	ensure.DeepEqual(t, w.String(), "0123456789")
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	ensure.Nil(t, err)
+	server, err := ln.Accept()
+	ensure.Nil(t, err)
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func TestSplice(t *testing.T) {
+	t.Parallel()
+	srcW, srcR := tcpPair(t)
+	defer srcW.Close()
+	defer srcR.Close()
+	dstW, dstR := tcpPair(t)
+	defer dstW.Close()
+	defer dstR.Close()
+
+	msg := bytes.Repeat([]byte("dvara"), 100000)
+	go func() {
+		srcW.Write(msg)
+		srcW.Write([]byte("next"))
+	}()
+
+	done := make(chan []byte)
+	go func() {
+		b := make([]byte, len(msg))
+		_, err := io.ReadFull(dstR, b)
+		ensure.Nil(t, err)
+		done <- b
+	}()
+
+	// the pooled connection wrapper doesn't get in the way
+	ensure.Nil(t, splice(tcpConn(&pooledConn{Conn: dstW}), srcR, int64(len(msg))))
+	ensure.DeepEqual(t, <-done, msg)
+
+	// only the requested bytes were consumed
+	next := make([]byte, 4)
+	_, err := io.ReadFull(srcR, next)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(next), "next")
+}
+
+func TestTCPConnWrapped(t *testing.T) {
+	t.Parallel()
+	ensure.True(t, tcpConn(&fakeConn{}) == nil)
+	ensure.True(t, tcpConn(&pooledConn{Conn: &fakeConn{}}) == nil)
+}
+
+func BenchmarkCopyMessage(b *testing.B) {
+	msg := fakeReplyTo(1, map[string]string{"a": string(bytes.Repeat([]byte("x"), 16<<10))})
+	r := bytes.NewReader(msg)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(msg)
+		if err := copyMessage(ioutil.Discard, r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
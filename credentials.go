@@ -0,0 +1,219 @@
+package dvara
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// Credentials are the user and password the proxy authenticates to the
+// servers as. An empty Username disables authentication.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// CredentialProvider provides the credentials the proxy authenticates to the
+// servers with, which may change over time.
+type CredentialProvider interface {
+	Credentials() (Credentials, error)
+}
+
+// Credentials returns the credentials themselves, so fixed ones can be used
+// as a CredentialProvider.
+func (c Credentials) Credentials() (Credentials, error) {
+	return c, nil
+}
+
+// EnvCredentials provides the credentials held by environment variables, so
+// they don't show up in the process list. Without a username the password
+// may be unset.
+type EnvCredentials struct {
+	// Username is used if UsernameVar is empty.
+	Username    string
+	UsernameVar string
+	PasswordVar string
+}
+
+// Credentials returns the credentials held by the variables.
+func (e EnvCredentials) Credentials() (Credentials, error) {
+	c := Credentials{Username: e.Username}
+	if e.UsernameVar != "" {
+		c.Username = os.Getenv(e.UsernameVar)
+	}
+	password, ok := os.LookupEnv(e.PasswordVar)
+	if !ok && c.Username != "" {
+		return Credentials{}, fmt.Errorf("dvara: environment variable %s is not set", e.PasswordVar)
+	}
+	c.Password = password
+	return c, nil
+}
+
+// FileCredentials provides the credentials held by files, such as mounted
+// secrets. The files are read every time, trailing new lines are ignored.
+type FileCredentials struct {
+	// Username is used if UsernameFile is empty.
+	Username     string
+	UsernameFile string
+	PasswordFile string
+}
+
+// Credentials returns the credentials held by the files.
+func (f FileCredentials) Credentials() (Credentials, error) {
+	c := Credentials{Username: f.Username}
+	if f.UsernameFile != "" {
+		username, err := readSecret(f.UsernameFile)
+		if err != nil {
+			return Credentials{}, err
+		}
+		c.Username = username
+	}
+	password, err := readSecret(f.PasswordFile)
+	if err != nil {
+		return Credentials{}, err
+	}
+	c.Password = password
+	return c, nil
+}
+
+func readSecret(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// CredentialWatcher caches the credentials of a Provider and checks them for
+// changes. When they're rotated, the server pools that joined the watcher
+// are recycled so their connections authenticate with the new ones.
+type CredentialWatcher struct {
+	// Provider provides the credentials. If nil the watcher is disabled and
+	// ReplicaSet.Username and Password are used.
+	Provider CredentialProvider
+
+	// Interval is how often the credentials are checked for changes. Zero
+	// disables checking.
+	Interval time.Duration
+
+	// Stats if provided will be used to record interesting stats.
+	Stats stats.Client `inject:""`
+
+	mutex   sync.RWMutex
+	current Credentials
+	pools   map[*Pool]struct{}
+	stop    chan struct{}
+}
+
+// Enabled returns true if the watcher has a provider.
+func (w *CredentialWatcher) Enabled() bool {
+	return w != nil && w.Provider != nil
+}
+
+// Start gets the credentials and starts checking them for changes.
+func (w *CredentialWatcher) Start() error {
+	if !w.Enabled() {
+		return nil
+	}
+	c, err := w.Provider.Credentials()
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	w.current = c
+	w.mutex.Unlock()
+	if w.Interval > 0 {
+		w.stop = make(chan struct{})
+		go w.reloadLoop()
+	}
+	return nil
+}
+
+// Stop stops checking the credentials.
+func (w *CredentialWatcher) Stop() error {
+	if w.stop != nil {
+		close(w.stop)
+	}
+	return nil
+}
+
+// Credentials returns the current credentials.
+func (w *CredentialWatcher) Credentials() (Credentials, error) {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	return w.current, nil
+}
+
+// Join adds the pool to those recycled when the credentials are rotated.
+func (w *CredentialWatcher) Join(pool *Pool) {
+	if !w.Enabled() {
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.pools == nil {
+		w.pools = make(map[*Pool]struct{})
+	}
+	w.pools[pool] = struct{}{}
+}
+
+// Leave removes the pool from those recycled when the credentials are
+// rotated.
+func (w *CredentialWatcher) Leave(pool *Pool) {
+	if !w.Enabled() {
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	delete(w.pools, pool)
+}
+
+func (w *CredentialWatcher) reloadLoop() {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.reload(); err != nil {
+				stats.BumpSum(w.Stats, "credentials.reload.error", 1)
+				corelog.LogError("error", err)
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// reload gets the credentials again and recycles the pools if they changed.
+// The current credentials are kept if they can't be had.
+func (w *CredentialWatcher) reload() error {
+	c, err := w.Provider.Credentials()
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	if c == w.current {
+		w.mutex.Unlock()
+		return nil
+	}
+	w.current = c
+	pools := make([]*Pool, 0, len(w.pools))
+	for pool := range w.pools {
+		pools = append(pools, pool)
+	}
+	w.mutex.Unlock()
+
+	stats.BumpSum(w.Stats, "credentials.rotated", 1)
+	corelog.LogInfoMessage("credentials rotated, recycling server connections",
+		"username", c.Username, "pools", len(pools))
+	for _, pool := range pools {
+		pool.Recycle()
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package dvara
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestEnvCredentials(t *testing.T) {
+	t.Parallel()
+	ensure.Nil(t, os.Setenv("DVARA_TEST_ENV_USER", "app"))
+	ensure.Nil(t, os.Setenv("DVARA_TEST_ENV_PASSWORD", "secret"))
+	c, err := EnvCredentials{
+		UsernameVar: "DVARA_TEST_ENV_USER",
+		PasswordVar: "DVARA_TEST_ENV_PASSWORD",
+	}.Credentials()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, c, Credentials{Username: "app", Password: "secret"})
+
+	// the password is required with a username only
+	_, err = EnvCredentials{Username: "app", PasswordVar: "DVARA_TEST_ENV_MISSING"}.Credentials()
+	ensure.NotNil(t, err)
+	c, err = EnvCredentials{PasswordVar: "DVARA_TEST_ENV_MISSING"}.Credentials()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, c, Credentials{})
+}
+
+func TestFileCredentials(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "dvara-credentials")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+	password := filepath.Join(dir, "password")
+	ensure.Nil(t, ioutil.WriteFile(password, []byte("secret\n"), 0600))
+
+	c, err := FileCredentials{Username: "app", PasswordFile: password}.Credentials()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, c, Credentials{Username: "app", Password: "secret"})
+
+	username := filepath.Join(dir, "username")
+	ensure.Nil(t, ioutil.WriteFile(username, []byte("batch"), 0600))
+	c, err = FileCredentials{Username: "app", UsernameFile: username, PasswordFile: password}.Credentials()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, c, Credentials{Username: "batch", Password: "secret"})
+
+	_, err = FileCredentials{PasswordFile: filepath.Join(dir, "missing")}.Credentials()
+	ensure.NotNil(t, err)
+}
+
+func TestCredentialWatcherRotation(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "dvara-credentials")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+	password := filepath.Join(dir, "password")
+	ensure.Nil(t, ioutil.WriteFile(password, []byte("old"), 0600))
+
+	hc := newCounterClient()
+	w := &CredentialWatcher{
+		Provider: FileCredentials{Username: "app", PasswordFile: password},
+		Stats:    hc,
+	}
+	ensure.Nil(t, w.Start())
+	defer w.Stop()
+	c, err := w.Credentials()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, c.Password, "old")
+
+	var cm resourceMaker
+	pool := &Pool{New: cm.New, Max: 1, IdleTimeout: time.Hour, ClosePoolSize: 1}
+	w.Join(pool)
+	r, err := pool.Acquire()
+	ensure.Nil(t, err)
+
+	// unchanged credentials leave the pools alone
+	ensure.Nil(t, w.reload())
+	pool.Release(r)
+	r, err = pool.Acquire()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(1))
+
+	// rotated ones recycle them
+	ensure.Nil(t, ioutil.WriteFile(password, []byte("new"), 0600))
+	ensure.Nil(t, w.reload())
+	c, err = w.Credentials()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, c.Password, "new")
+	ensure.DeepEqual(t, hc.count("credentials.rotated"), float64(1))
+	pool.Release(r)
+	r, err = pool.Acquire()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(2))
+	pool.Release(r)
+
+	// unless they left, and credentials that can't be had are kept
+	w.Leave(pool)
+	ensure.Nil(t, os.Remove(password))
+	ensure.NotNil(t, w.reload())
+	c, err = w.Credentials()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, c.Password, "new")
+	ensure.Nil(t, pool.Close())
+}
+
+func TestCredentialWatcherDisabled(t *testing.T) {
+	t.Parallel()
+	var w *CredentialWatcher
+	ensure.False(t, w.Enabled())
+	w.Join(&Pool{})
+	r := &ReplicaSet{Username: "app", Password: "secret"}
+	c, err := r.credentials().Credentials()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, c, Credentials{Username: "app", Password: "secret"})
+}
@@ -0,0 +1,370 @@
+package dvara
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// replyCursorNotFound is set in the ResponseFlags of an OpReply when the
+// cursor of a getMore no longer exists.
+const replyCursorNotFound = 1 << 0
+
+// cursorCommands are the commands which open a cursor.
+var cursorCommands = map[string]bool{
+	"find":                   true,
+	"aggregate":              true,
+	"listCollections":        true,
+	"listIndexes":            true,
+	"parallelCollectionScan": true,
+}
+
+// CursorTracker tracks the server cursors each client has open, so the ones
+// left behind when a client goes away can be killed instead of lingering
+// until the server times them out.
+type CursorTracker struct {
+	// Enabled turns on tracking.
+	Enabled bool
+
+	// MaxPerClient is the number of open cursors after which a client's
+	// queries opening new ones are rejected. Zero means no limit.
+	MaxPerClient uint
+
+	// Stats if provided will be used to record interesting stats.
+	Stats stats.Client `inject:""`
+
+	mutex   sync.Mutex
+	clients map[*Cursors]struct{}
+}
+
+// ClientCursors is the number of cursors a client has open on a member.
+type ClientCursors struct {
+	Member string `json:"member"`
+	Client string `json:"client"`
+	Open   int    `json:"open"`
+}
+
+// NewClient returns the cursors of a new client of the member, nil if
+// tracking is disabled.
+func (t *CursorTracker) NewClient(member, client string) *Cursors {
+	if t == nil || !t.Enabled {
+		return nil
+	}
+	c := &Cursors{
+		tracker: t,
+		member:  member,
+		client:  client,
+		open:    make(map[int64]string),
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.clients == nil {
+		t.clients = make(map[*Cursors]struct{})
+	}
+	t.clients[c] = struct{}{}
+	return c
+}
+
+// Open returns the number of cursors open by each client with any.
+func (t *CursorTracker) Open() []ClientCursors {
+	open := []ClientCursors{}
+	if t == nil {
+		return open
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for c := range t.clients {
+		if n := c.Len(); n > 0 {
+			open = append(open, ClientCursors{Member: c.member, Client: c.client, Open: n})
+		}
+	}
+	return open
+}
+
+// Cursors are the server cursors open by a client, by id with their
+// namespace. All methods are no-ops on a nil Cursors.
+type Cursors struct {
+	tracker *CursorTracker
+	member  string
+	client  string
+
+	mutex sync.Mutex
+	open  map[int64]string
+}
+
+// Len returns the number of open cursors.
+func (c *Cursors) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.open)
+}
+
+// Full returns true if the client can't open more cursors.
+func (c *Cursors) Full() bool {
+	if c == nil || c.tracker.MaxPerClient == 0 {
+		return false
+	}
+	return uint(c.Len()) >= c.tracker.MaxPerClient
+}
+
+func (c *Cursors) opened(id int64, ns string) {
+	if c == nil || id == 0 {
+		return
+	}
+	c.mutex.Lock()
+	c.open[id] = ns
+	c.mutex.Unlock()
+	stats.BumpSum(c.tracker.Stats, "cursor.opened", 1)
+}
+
+func (c *Cursors) closed(id int64, reason string) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	_, ok := c.open[id]
+	delete(c.open, id)
+	c.mutex.Unlock()
+	if ok {
+		stats.BumpSum(c.tracker.Stats, "cursor."+reason, 1)
+	}
+}
+
+// queryRequested handles a query before it is sent to the server.
+func (c *Cursors) queryRequested(q bson.D) {
+	if c == nil || len(q) == 0 || q[0].Name != "killCursors" {
+		return
+	}
+	ids, _ := lookup(q, "cursors").([]interface{})
+	for _, id := range ids {
+		if id, ok := id.(int64); ok {
+			c.closed(id, "killed")
+		}
+	}
+}
+
+// queryReplied handles the reply to a query on the namespace. The query
+// document is only needed for commands.
+func (c *Cursors) queryReplied(fullCollectionName []byte, q bson.D, reply *replyInfo) {
+	if c == nil {
+		return
+	}
+	ns := strings.TrimSuffix(string(fullCollectionName), "\x00")
+	if !strings.HasSuffix(ns, ".$cmd") {
+		c.opened(reply.CursorID, ns)
+		return
+	}
+	if len(q) == 0 || reply.Doc == nil {
+		return
+	}
+	if q[0].Name == "getMore" {
+		id, _ := q[0].Value.(int64)
+		if reply.Failed() || reply.Doc.Cursor == nil || reply.Doc.Cursor.ID == 0 {
+			c.closed(id, "exhausted")
+		}
+		return
+	}
+	if reply.Doc.Cursor != nil && !reply.Failed() {
+		c.opened(reply.Doc.Cursor.ID, reply.Doc.Cursor.NS)
+	}
+}
+
+// getMoreReplied handles the reply to a legacy OpGetMore for the cursor.
+func (c *Cursors) getMoreReplied(id int64, reply *replyInfo) {
+	if reply.CursorID == 0 || reply.ResponseFlags&replyCursorNotFound != 0 {
+		c.closed(id, "exhausted")
+	}
+}
+
+// killCursorsRequested handles an entire OpKillCursors message.
+func (c *Cursors) killCursorsRequested(msg []byte) {
+	for _, id := range killCursorsIDs(msg) {
+		c.closed(id, "killed")
+	}
+}
+
+// orphans returns the open cursors by namespace and forgets about them.
+func (c *Cursors) orphans() map[string][]int64 {
+	if c == nil {
+		return nil
+	}
+	c.tracker.mutex.Lock()
+	delete(c.tracker.clients, c)
+	c.tracker.mutex.Unlock()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.open) == 0 {
+		return nil
+	}
+	orphans := make(map[string][]int64)
+	for id, ns := range c.open {
+		orphans[ns] = append(orphans[ns], id)
+	}
+	c.open = make(map[int64]string)
+	return orphans
+}
+
+// killOrphans kills the cursors left open by a client which went away, using
+// the given server connection.
+func (c *Cursors) killOrphans(conn net.Conn, orphans map[string][]int64) error {
+	for ns, ids := range orphans {
+		db, coll := ns, ""
+		if i := strings.Index(ns, "."); i >= 0 {
+			db, coll = ns[:i], ns[i+1:]
+		}
+		cmd := bson.D{
+			{Name: "killCursors", Value: coll},
+			{Name: "cursors", Value: ids},
+		}
+		if err := runCommand(conn, db, cmd, nil); err != nil {
+			stats.BumpSum(c.tracker.Stats, "cursor.orphan.error", float64(len(ids)))
+			return err
+		}
+		stats.BumpSum(c.tracker.Stats, "cursor.orphan.killed", float64(len(ids)))
+		corelog.LogInfoMessage("killed orphan cursors",
+			"client", c.client, "member", c.member, "ns", ns, "count", len(ids))
+	}
+	return nil
+}
+
+// getMoreCursorID returns the cursor id of an entire OpGetMore message.
+func getMoreCursorID(msg []byte) int64 {
+	if len(msg) < headerLen+8 {
+		return 0
+	}
+	return getInt64(msg, len(msg)-8)
+}
+
+// killCursorsIDs returns the cursor ids of an entire OpKillCursors message.
+func killCursorsIDs(msg []byte) []int64 {
+	if len(msg) < headerLen+8 {
+		return nil
+	}
+	n := int(getInt32(msg, headerLen+4))
+	var ids []int64
+	for i := 0; i < n && headerLen+8+8*(i+1) <= len(msg); i++ {
+		ids = append(ids, getInt64(msg, headerLen+8+8*i))
+	}
+	return ids
+}
+
+// opensCursor returns true if the entire request message may open a cursor.
+func opensCursor(msg []byte) bool {
+	if OpCode(getInt32(msg, 12)) != OpQuery {
+		return false
+	}
+	if !isCommandRequest(msg) {
+		return true
+	}
+	name, _ := requestCommand(msg)
+	return cursorCommands[name]
+}
+
+// rejectCursor fails the query with the given header if it may open a
+// cursor, as the client has too many open. The query is buffered in the
+// client's request either way, to be proxied from there otherwise.
+func (p *Proxy) rejectCursor(h *messageHeader, c *proxyClient) (bool, error) {
+	msg, err := c.request.read(h, c.conn)
+	if err != nil {
+		return false, err
+	}
+	if !opensCursor(msg) {
+		return false, nil
+	}
+	stats.BumpSum(p.stats, "cursor.rejected", 1)
+	e := newProxyError(codeOperationFailed,
+		"dvara: too many open cursors for client %s on member %s", c.conn.RemoteAddr(), p.MongoAddr)
+	_, err = c.conn.Write(errorReply(msg, e))
+	return true, err
+}
+
+// proxyGetMore proxies an OpGetMore, forgetting about its cursor once
+// exhausted.
+func proxyGetMore(
+	h *messageHeader,
+	client io.ReadWriter,
+	server io.ReadWriter,
+	cursors *Cursors,
+	stream *cursorStream,
+) error {
+	msg, err := readMessageBody(h, client)
+	if err != nil {
+		return err
+	}
+	id := getMoreCursorID(msg)
+	stream.getMoreRequested(msg)
+	if err := writeAll(server, msg); err != nil {
+		return err
+	}
+	reply, err := copyReply(client, server, false)
+	if err != nil {
+		return err
+	}
+	cursors.getMoreReplied(id, reply)
+	stream.getMoreReplied(id, reply)
+	return nil
+}
+
+// proxyKillCursors proxies an OpKillCursors, forgetting about its cursors.
+func proxyKillCursors(
+	h *messageHeader,
+	client io.Reader,
+	server io.Writer,
+	cursors *Cursors,
+	stream *cursorStream,
+) error {
+	msg, err := readMessageBody(h, client)
+	if err != nil {
+		return err
+	}
+	if err := writeAll(server, msg); err != nil {
+		return err
+	}
+	cursors.killCursorsRequested(msg)
+	stream.killCursorsRequested(msg)
+	return nil
+}
+
+// killOrphanCursors kills the cursors a client left open when it went away.
+// The given server connection is used if any, otherwise one is taken from the
+// client's pool as dvara's own client.
+func (p *Proxy) killOrphanCursors(c *proxyClient, serverConn net.Conn) {
+	cursors := c.cursors
+	orphans := cursors.orphans()
+	if len(orphans) == 0 {
+		return
+	}
+	pooled := serverConn == nil
+	if pooled {
+		conn, err := p.getServerConn(withSystemClient(p.ctx), c)
+		if err != nil {
+			stats.BumpSum(p.stats, "cursor.orphan.error", 1)
+			corelog.LogError("error", err)
+			return
+		}
+		serverConn = conn
+	}
+	serverConn.SetDeadline(time.Now().Add(p.ReplicaSet.MessageTimeout))
+	err := cursors.killOrphans(serverConn, orphans)
+	if err != nil {
+		corelog.LogError("error", err)
+	}
+	if !pooled {
+		return
+	}
+	if err != nil {
+		p.discardServerConn(serverConn)
+		return
+	}
+	p.releaseServerConn(serverConn)
+}
@@ -0,0 +1,203 @@
+package dvara
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func fakeGetMore(id int64) []byte {
+	b := addHeader(nil, int(OpGetMore))
+	b = addInt32(b, 0)
+	b = addCString(b, "db.c")
+	b = addInt32(b, 0)
+	b = addInt64(b, id)
+	setInt32(b, 0, int32(len(b)))
+	return b
+}
+
+func fakeKillCursors(ids ...int64) []byte {
+	b := addHeader(nil, int(OpKillCursors))
+	b = addInt32(b, 0)
+	b = addInt32(b, int32(len(ids)))
+	for _, id := range ids {
+		b = addInt64(b, id)
+	}
+	setInt32(b, 0, int32(len(b)))
+	return b
+}
+
+func TestCursorMessageIDs(t *testing.T) {
+	t.Parallel()
+	ensure.DeepEqual(t, getMoreCursorID(fakeGetMore(42)), int64(42))
+	ensure.DeepEqual(t, killCursorsIDs(fakeKillCursors(1, 2, 3)), []int64{1, 2, 3})
+
+	// truncated messages don't read past their end
+	msg := fakeKillCursors(1, 2)
+	ensure.DeepEqual(t, killCursorsIDs(msg[:len(msg)-4]), []int64{1})
+}
+
+func TestOpensCursor(t *testing.T) {
+	t.Parallel()
+	ensure.True(t, opensCursor(fakeQuery(1, 0, "db.c", bson.M{"a": 1})))
+	ensure.True(t, opensCursor(fakeQuery(1, 0, "db.$cmd", bson.D{{Name: "find", Value: "c"}})))
+	ensure.False(t, opensCursor(fakeQuery(1, 0, "db.$cmd", bson.D{{Name: "count", Value: "c"}})))
+	ensure.False(t, opensCursor(fakeGetMore(1)))
+}
+
+func TestCursorsTracking(t *testing.T) {
+	t.Parallel()
+	hc := newCounterClient()
+	tracker := &CursorTracker{Enabled: true, MaxPerClient: 2, Stats: hc}
+	c := tracker.NewClient("mongo:27017", "10.1.2.3:4242")
+
+	// a legacy query and a find command open cursors
+	c.queryReplied([]byte("db.c\x00"), nil, &replyInfo{CursorID: 1})
+	find := bson.D{{Name: "find", Value: "c"}}
+	c.queryReplied([]byte("db.$cmd\x00"), find, &replyInfo{
+		Doc: &replyDoc{Ok: 1.0, Cursor: &replyCursor{ID: 2, NS: "db.c"}},
+	})
+	ensure.True(t, c.Full())
+	ensure.DeepEqual(t, tracker.Open(), []ClientCursors{
+		{Member: "mongo:27017", Client: "10.1.2.3:4242", Open: 2},
+	})
+
+	// one is exhausted by a getMore command, the other killed
+	getMore := bson.D{{Name: "getMore", Value: int64(2)}}
+	c.queryReplied([]byte("db.$cmd\x00"), getMore, &replyInfo{
+		Doc: &replyDoc{Ok: 1.0, Cursor: &replyCursor{NS: "db.c"}},
+	})
+	c.killCursorsRequested(fakeKillCursors(1))
+	ensure.DeepEqual(t, c.Len(), 0)
+	ensure.DeepEqual(t, hc.count("cursor.opened"), float64(2))
+	ensure.DeepEqual(t, hc.count("cursor.exhausted"), float64(1))
+	ensure.DeepEqual(t, hc.count("cursor.killed"), float64(1))
+
+	// legacy getMores exhaust cursors too
+	c.opened(3, "db.c")
+	c.getMoreReplied(3, &replyInfo{CursorID: 3})
+	ensure.DeepEqual(t, c.Len(), 1)
+	c.getMoreReplied(3, &replyInfo{ResponseFlags: replyCursorNotFound})
+	ensure.DeepEqual(t, c.Len(), 0)
+
+	// the killCursors command closes cursors as well
+	c.opened(4, "db.c")
+	c.queryRequested(bson.D{
+		{Name: "killCursors", Value: "c"},
+		{Name: "cursors", Value: []interface{}{int64(4)}},
+	})
+	ensure.DeepEqual(t, c.Len(), 0)
+}
+
+func TestCursorsDisabled(t *testing.T) {
+	t.Parallel()
+	var tracker *CursorTracker
+	c := tracker.NewClient("mongo:27017", "10.1.2.3:4242")
+	ensure.True(t, c == nil)
+	c.opened(1, "db.c")
+	ensure.False(t, c.Full())
+	ensure.DeepEqual(t, len(c.orphans()), 0)
+	ensure.DeepEqual(t, len(tracker.Open()), 0)
+	ensure.True(t, (&CursorTracker{}).NewClient("mongo:27017", "10.1.2.3:4242") == nil)
+}
+
+func TestKillOrphanCursors(t *testing.T) {
+	t.Parallel()
+	var mutex sync.Mutex
+	killed := map[string][]interface{}{}
+	l := fakeServer(t, func(request []byte) []byte {
+		requestID := getInt32(request, 4)
+		name, cmd := requestCommand(request)
+		if name != "killCursors" {
+			return fakeReplyTo(requestID, bson.M{"ok": 0, "errmsg": "no such command"})
+		}
+		mutex.Lock()
+		coll, _ := cmd[0].Value.(string)
+		killed[coll] = append(killed[coll], lookup(cmd, "cursors").([]interface{})...)
+		mutex.Unlock()
+		return fakeReplyTo(requestID, bson.M{"ok": 1})
+	})
+	defer l.Close()
+
+	hc := newCounterClient()
+	tracker := &CursorTracker{Enabled: true, Stats: hc}
+	c := tracker.NewClient("mongo:27017", "10.1.2.3:4242")
+	c.opened(1, "db.a")
+	c.opened(2, "db.a")
+	c.opened(3, "db.b")
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	ensure.Nil(t, err)
+	defer conn.Close()
+	orphans := c.orphans()
+	ensure.Nil(t, c.killOrphans(conn, orphans))
+
+	ensure.SameElements(t, killed["a"], []interface{}{int64(1), int64(2)})
+	ensure.SameElements(t, killed["b"], []interface{}{int64(3)})
+	ensure.DeepEqual(t, hc.count("cursor.orphan.killed"), float64(3))
+
+	// the client is forgotten with its cursors
+	ensure.DeepEqual(t, c.Len(), 0)
+	ensure.DeepEqual(t, len(tracker.Open()), 0)
+}
+
+func TestProxyRejectsCursors(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{ReplicaSet: &ReplicaSet{MessageTimeout: time.Minute}, MongoAddr: "mongo:27017"}
+	tracker := &CursorTracker{Enabled: true, MaxPerClient: 1}
+	cursors := tracker.NewClient(p.MongoAddr, fakeClientAddr.String())
+	cursors.opened(1, "db.c")
+
+	query := fakeQuery(7, 0, "db.c", bson.M{"a": 1})
+	conn := &fakeConn{in: bytes.NewReader(query), remote: fakeClientAddr}
+	client := p.clients.add(conn)
+	client.cursors = cursors
+	h, err := p.clientReadHeader(client, time.Minute)
+	ensure.Nil(t, err)
+	server := &fakeConn{}
+	var lastError LastError
+	ensure.Nil(t, p.proxyMessage(h, client, server, &lastError))
+
+	// the query never reaches the server
+	ensure.DeepEqual(t, server.out.Len(), 0)
+	reply := conn.out.Bytes()
+	ensure.DeepEqual(t, getInt32(reply, 8), int32(7))
+	ensure.DeepEqual(t, replyDocument(t, reply)["code"], codeOperationFailed)
+}
+
+func TestNoRetryAfterReplyAtCursorLimit(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MessageTimeout: time.Minute,
+			RetryReads:     true,
+			ProxyQuery:     &ProxyQuery{},
+		},
+		MongoAddr: "mongo:27017",
+	}
+	tracker := &CursorTracker{Enabled: true, MaxPerClient: 1}
+	cursors := tracker.NewClient(p.MongoAddr, fakeClientAddr.String())
+	cursors.opened(1, "db.c")
+
+	query := fakeQuery(7, 0, "db.$cmd", bson.D{{Name: "count", Value: "c"}})
+	conn := &fakeConn{in: bytes.NewReader(query), remote: fakeClientAddr}
+	client := p.clients.add(conn)
+	client.cursors = cursors
+	h, err := p.clientReadHeader(client, time.Minute)
+	ensure.Nil(t, err)
+
+	// the server dies half way through the reply
+	reply := fakeReplyTo(7, bson.M{"ok": 1, "n": 3})
+	server := &fakeConn{in: bytes.NewReader(reply[:len(reply)/2])}
+	var lastError LastError
+	err = p.proxyMessage(h, client, server, &lastError)
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, server.out.Bytes(), query)
+	ensure.True(t, conn.out.Len() > 0)
+	ensure.False(t, client.request.canRetry(err))
+}
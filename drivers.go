@@ -0,0 +1,340 @@
+package dvara
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var errDriverTooOld = errors.New("dvara: driver below the minimum version")
+
+const (
+	defaultMaxStatNames = 100
+
+	// otherStatName is what the names of clients are counted as once
+	// MaxStatNames were taken.
+	otherStatName = "other"
+)
+
+// ClientMetadata is what a driver tells about itself and its application in
+// the "client" document of its first isMaster.
+type ClientMetadata struct {
+	App           string `json:"app"`
+	Driver        string `json:"driver"`
+	DriverVersion string `json:"driverVersion"`
+	OS            string `json:"os"`
+}
+
+// parseClientMetadata returns the metadata of the isMaster command, nil if
+// there is none.
+func parseClientMetadata(cmd bson.D) *ClientMetadata {
+	client, ok := lookup(cmd, "client").(bson.D)
+	if !ok {
+		return nil
+	}
+	return &ClientMetadata{
+		App:           lookupString(client, "application", "name"),
+		Driver:        lookupString(client, "driver", "name"),
+		DriverVersion: lookupString(client, "driver", "version"),
+		OS:            lookupString(client, "os", "type"),
+	}
+}
+
+// lookupString returns the string at the path of nested documents, empty if
+// there is none.
+func lookupString(d bson.D, path ...string) string {
+	for _, k := range path[:len(path)-1] {
+		var ok bool
+		if d, ok = lookup(d, k).(bson.D); !ok {
+			return ""
+		}
+	}
+	s, _ := lookup(d, path[len(path)-1]).(string)
+	return s
+}
+
+// clientDriver is the metadata of a client, with the names its application
+// and driver are counted as in stats and query shapes.
+type clientDriver struct {
+	ClientMetadata
+	app          string
+	driver       string
+	messagesStat string
+	bytesStat    string
+}
+
+// statName makes s usable as a part of a stat name.
+func statName(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// baseDriver returns the name or version of the driver itself, without those
+// of the wrapping libraries, like the ODM in "nodejs|Mongoose".
+func baseDriver(s string) string {
+	if i := strings.Index(s, "|"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// ParseMinDriverVersions parses comma separated minimum versions by driver
+// name, for example "nodejs=4.0,mongo-java-driver=3.12".
+func ParseMinDriverVersions(list string) (map[string]string, error) {
+	versions := make(map[string]string)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		i := strings.Index(s, "=")
+		if i <= 0 || i == len(s)-1 {
+			return nil, fmt.Errorf("dvara: invalid minimum driver version %q", s)
+		}
+		versions[strings.ToLower(strings.TrimSpace(s[:i]))] = strings.TrimSpace(s[i+1:])
+	}
+	return versions, nil
+}
+
+// compareVersions compares dotted versions by their numeric parts, ignoring
+// suffixes like "-beta1". It returns -1, 0 or 1 if a is lower, equal or
+// higher than b.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = leadingNumber(as[i])
+		}
+		if i < len(bs) {
+			y = leadingNumber(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func leadingNumber(s string) int {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	n, _ := strconv.Atoi(s[:i])
+	return n
+}
+
+// DriverClients is the number of connected clients of an application with a
+// driver.
+type DriverClients struct {
+	ClientMetadata
+	Clients int `json:"clients"`
+}
+
+// Drivers keeps count of the connected clients by application and driver,
+// and rejects the drivers below their minimum versions.
+type Drivers struct {
+	// MinVersions are the minimum versions of drivers by lower case name.
+	// Other drivers and clients without metadata are allowed.
+	MinVersions map[string]string
+
+	// MaxStatNames bounds the number of distinct applications, and of driver
+	// versions, named in stats and query shapes. Clients send any name they
+	// like, those beyond it are counted as "other". Zero means
+	// defaultMaxStatNames.
+	MaxStatNames int
+
+	mutex   sync.Mutex
+	clients map[ClientMetadata]int
+	apps    map[string]bool
+	drivers map[string]bool
+}
+
+// MinVersion returns the minimum version the driver is below, empty if it is
+// allowed.
+func (d *Drivers) MinVersion(m *ClientMetadata) string {
+	if d == nil || len(d.MinVersions) == 0 {
+		return ""
+	}
+	min, ok := d.MinVersions[strings.ToLower(baseDriver(m.Driver))]
+	if !ok || compareVersions(baseDriver(m.DriverVersion), min) >= 0 {
+		return ""
+	}
+	return min
+}
+
+// newClientDriver returns the metadata of a client with the names it is
+// counted as.
+func (d *Drivers) newClientDriver(m *ClientMetadata) *clientDriver {
+	driver := statName(baseDriver(m.Driver)) + "." + statName(baseDriver(m.DriverVersion))
+	c := &clientDriver{ClientMetadata: *m, app: otherStatName, driver: otherStatName}
+	if d != nil {
+		d.mutex.Lock()
+		if d.apps == nil {
+			d.apps = make(map[string]bool)
+			d.drivers = make(map[string]bool)
+		}
+		c.app = d.boundedName(d.apps, statName(m.App))
+		c.driver = d.boundedName(d.drivers, driver)
+		d.mutex.Unlock()
+	}
+	c.messagesStat = "app." + c.app + ".messages"
+	c.bytesStat = "app." + c.app + ".bytes"
+	return c
+}
+
+// boundedName returns the name, unless MaxStatNames others were already taken
+// in names. It must be called with the mutex held.
+func (d *Drivers) boundedName(names map[string]bool, name string) string {
+	if names[name] {
+		return name
+	}
+	max := d.MaxStatNames
+	if max == 0 {
+		max = defaultMaxStatNames
+	}
+	if len(names) >= max {
+		return otherStatName
+	}
+	names[name] = true
+	return name
+}
+
+func (d *Drivers) connected(m *ClientMetadata) {
+	if d == nil {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.clients == nil {
+		d.clients = make(map[ClientMetadata]int)
+	}
+	d.clients[*m]++
+}
+
+func (d *Drivers) disconnected(m *ClientMetadata) {
+	if d == nil {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.clients[*m]--; d.clients[*m] <= 0 {
+		delete(d.clients, *m)
+	}
+}
+
+// Clients returns the number of connected clients by application and driver,
+// the most numerous first.
+func (d *Drivers) Clients() []DriverClients {
+	clients := []DriverClients{}
+	if d == nil {
+		return clients
+	}
+	d.mutex.Lock()
+	for m, n := range d.clients {
+		clients = append(clients, DriverClients{ClientMetadata: m, Clients: n})
+	}
+	d.mutex.Unlock()
+	sort.Sort(byClients(clients))
+	return clients
+}
+
+type byClients []DriverClients
+
+func (b byClients) Len() int      { return len(b) }
+func (b byClients) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byClients) Less(i, j int) bool {
+	if b[i].Clients != b[j].Clients {
+		return b[i].Clients > b[j].Clients
+	}
+	return b[i].App < b[j].App
+}
+
+// identifyClient captures the metadata of the client from its first message,
+// the isMaster drivers start with. Drivers below their minimum version get an
+// error reply and are disconnected. It returns true if the message should be
+// proxied.
+func (p *Proxy) identifyClient(h *messageHeader, c *proxyClient, lastError *LastError) (bool, error) {
+	if c.identified {
+		return true, nil
+	}
+	c.identified = true
+	if h.OpCode != OpQuery && h.OpCode != OpMsg {
+		return true, nil
+	}
+	msg, err := c.request.read(h, c.conn)
+	if err != nil {
+		return false, err
+	}
+	if !isCommandRequest(msg) {
+		return true, nil
+	}
+	name, cmd := requestCommand(msg)
+	if name = strings.ToLower(name); name != "ismaster" && name != "hello" {
+		return true, nil
+	}
+	m := parseClientMetadata(cmd)
+	if m == nil {
+		return true, nil
+	}
+
+	drivers := p.ReplicaSet.Drivers
+	if min := drivers.MinVersion(m); min != "" {
+		stats.BumpSum(p.stats, "client.driver.rejected", 1)
+		corelog.LogInfoMessage("rejecting client driver below the minimum version",
+			"client", c.conn.RemoteAddr(), "app", m.App, "driver", m.Driver, "version", m.DriverVersion, "min", min)
+		e := newProxyError(codeIllegalOperation, "dvara: driver %s %s is below the minimum version %s",
+			m.Driver, m.DriverVersion, min)
+		if err := p.rejectMessage(h, c, lastError, e); err != nil {
+			return false, err
+		}
+		return false, errDriverTooOld
+	}
+
+	c.driver = drivers.newClientDriver(m)
+	drivers.connected(m)
+	stats.BumpSum(p.stats, "client.app."+c.driver.app+".connected", 1)
+	stats.BumpSum(p.stats, "client.driver."+c.driver.driver+".connected", 1)
+	return true, nil
+}
+
+// clientLeft forgets the metadata of a disconnected client.
+func (p *Proxy) clientLeft(c *proxyClient) {
+	if c.driver != nil {
+		p.ReplicaSet.Drivers.disconnected(&c.driver.ClientMetadata)
+	}
+}
+
+// countAppMessage records a message of the client's application.
+func (p *Proxy) countAppMessage(h *messageHeader, c *proxyClient) {
+	if c.driver != nil {
+		stats.BumpSum(p.stats, c.driver.messagesStat, 1)
+		stats.BumpSum(p.stats, c.driver.bytesStat, float64(h.MessageLength))
+	}
+}
+
+// appName returns the name of the client's application, empty if unknown.
+func (c *proxyClient) appName() string {
+	if c.driver == nil {
+		return ""
+	}
+	return c.driver.App
+}
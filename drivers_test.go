@@ -0,0 +1,165 @@
+package dvara
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// fakeHello builds the isMaster a driver starts with.
+func fakeHello(app, driver, version string) []byte {
+	return fakeQuery(1, 0, "admin.$cmd", bson.D{
+		{Name: "isMaster", Value: 1},
+		{Name: "client", Value: bson.D{
+			{Name: "application", Value: bson.D{{Name: "name", Value: app}}},
+			{Name: "driver", Value: bson.D{{Name: "name", Value: driver}, {Name: "version", Value: version}}},
+			{Name: "os", Value: bson.D{{Name: "type", Value: "Linux"}, {Name: "name", Value: "linux"}}},
+			{Name: "platform", Value: "Node.js v18.1.0, LE"},
+		}},
+	})
+}
+
+func TestParseClientMetadata(t *testing.T) {
+	t.Parallel()
+	_, cmd := requestCommand(fakeHello("billing", "nodejs|Mongoose", "4.11.0|6.0.1"))
+	ensure.DeepEqual(t, *parseClientMetadata(cmd), ClientMetadata{
+		App:           "billing",
+		Driver:        "nodejs|Mongoose",
+		DriverVersion: "4.11.0|6.0.1",
+		OS:            "Linux",
+	})
+	_, cmd = requestCommand(fakeQuery(1, 0, "admin.$cmd", bson.D{{Name: "isMaster", Value: 1}}))
+	ensure.True(t, parseClientMetadata(cmd) == nil)
+	ensure.DeepEqual(t, lookupString(bson.D{{Name: "driver", Value: "flat"}}, "driver", "name"), "")
+	ensure.DeepEqual(t, statName("billing api.v2"), "billing_api_v2")
+	ensure.DeepEqual(t, statName(""), "unknown")
+}
+
+func TestMinDriverVersions(t *testing.T) {
+	t.Parallel()
+	ensure.DeepEqual(t, compareVersions("4.11.0", "4.2"), 1)
+	ensure.DeepEqual(t, compareVersions("4.2", "4.2.0"), 0)
+	ensure.DeepEqual(t, compareVersions("3.12.10-beta1", "4.0"), -1)
+	ensure.DeepEqual(t, compareVersions("r3.6.0", "3.0"), -1)
+
+	versions, err := ParseMinDriverVersions(" NodeJS=4.0, mongo-java-driver=3.12")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, versions, map[string]string{"nodejs": "4.0", "mongo-java-driver": "3.12"})
+	for _, list := range []string{"nodejs", "nodejs=", "=4.0"} {
+		_, err := ParseMinDriverVersions(list)
+		ensure.NotNil(t, err, list)
+	}
+
+	d := &Drivers{MinVersions: versions}
+	ensure.DeepEqual(t, d.MinVersion(&ClientMetadata{Driver: "nodejs|Mongoose", DriverVersion: "3.7.3|5.13.0"}), "4.0")
+	ensure.DeepEqual(t, d.MinVersion(&ClientMetadata{Driver: "nodejs", DriverVersion: "4.11.0"}), "")
+	ensure.DeepEqual(t, d.MinVersion(&ClientMetadata{Driver: "PyMongo", DriverVersion: "2.0"}), "")
+	var none *Drivers
+	ensure.DeepEqual(t, none.MinVersion(&ClientMetadata{Driver: "nodejs", DriverVersion: "1.0"}), "")
+}
+
+func TestIdentifyClient(t *testing.T) {
+	t.Parallel()
+	drivers := &Drivers{MinVersions: map[string]string{"nodejs": "4.0"}}
+	hc := newCounterClient()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{MessageTimeout: time.Minute, Drivers: drivers},
+		stats:      hc,
+	}
+	admit := func(c *proxyClient, msg []byte) (bool, error) {
+		conn := c.conn.(*fakeConn)
+		conn.in = bytes.NewReader(msg)
+		conn.out.Reset()
+		h, err := p.clientReadHeader(c, time.Minute)
+		ensure.Nil(t, err)
+		var lastError LastError
+		return p.admitMessage(h, c, &lastError)
+	}
+
+	// the first isMaster tells the driver and application
+	c := p.clients.add(&fakeConn{remote: fakeClientAddr})
+	ok, err := admit(c, fakeHello("billing", "nodejs", "4.11.0"))
+	ensure.True(t, ok)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, c.appName(), "billing")
+	ensure.DeepEqual(t, hc.count("client.app.billing.connected"), float64(1))
+	ensure.DeepEqual(t, hc.count("client.driver.nodejs.4_11_0.connected"), float64(1))
+
+	// later isMasters are just proxied, and the application's messages counted
+	hello := fakeHello("other", "nodejs", "4.11.0")
+	ok, _ = admit(c, hello)
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, c.appName(), "billing")
+	ensure.DeepEqual(t, hc.count("app.billing.messages"), float64(2))
+	ensure.DeepEqual(t, drivers.Clients(), []DriverClients{{
+		ClientMetadata: ClientMetadata{App: "billing", Driver: "nodejs", DriverVersion: "4.11.0", OS: "Linux"},
+		Clients:        1,
+	}})
+	p.clientLeft(c)
+	ensure.DeepEqual(t, drivers.Clients(), []DriverClients{})
+
+	// clients without metadata are anonymous
+	c = p.clients.add(&fakeConn{remote: fakeClientAddr})
+	ok, _ = admit(c, fakeQuery(1, 0, "admin.$cmd", bson.D{{Name: "isMaster", Value: 1}}))
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, c.appName(), "")
+
+	// and old drivers are turned away
+	c = p.clients.add(&fakeConn{remote: fakeClientAddr})
+	ok, err = admit(c, fakeHello("legacy", "nodejs", "3.7.3"))
+	ensure.False(t, ok)
+	ensure.DeepEqual(t, err, errDriverTooOld)
+	reply := replyDocument(t, c.conn.(*fakeConn).out.Bytes())
+	ensure.DeepEqual(t, reply["code"], codeIllegalOperation)
+	ensure.StringContains(t, reply["errmsg"].(string), "4.0")
+	ensure.DeepEqual(t, hc.count("client.driver.rejected"), float64(1))
+}
+
+func TestDriverStatNames(t *testing.T) {
+	t.Parallel()
+	d := &Drivers{MaxStatNames: 1}
+	billing := d.newClientDriver(&ClientMetadata{App: "billing", Driver: "nodejs|Mongoose", DriverVersion: "4.11.0|6.0.1"})
+	ensure.DeepEqual(t, billing.app, "billing")
+	ensure.DeepEqual(t, billing.driver, "nodejs.4_11_0")
+	ensure.DeepEqual(t, billing.messagesStat, "app.billing.messages")
+
+	// names beyond the maximum are counted as other
+	search := d.newClientDriver(&ClientMetadata{App: "search", Driver: "PyMongo", DriverVersion: "4.3"})
+	ensure.DeepEqual(t, search.app, "other")
+	ensure.DeepEqual(t, search.driver, "other")
+	ensure.DeepEqual(t, search.bytesStat, "app.other.bytes")
+	ensure.DeepEqual(t, d.newClientDriver(&billing.ClientMetadata).app, "billing")
+
+	var none *Drivers
+	ensure.DeepEqual(t, none.newClientDriver(&billing.ClientMetadata).app, "other")
+}
+
+func TestAdminDrivers(t *testing.T) {
+	t.Parallel()
+	drivers := &Drivers{}
+	m := &ClientMetadata{App: "billing", Driver: "nodejs", DriverVersion: "4.11.0"}
+	drivers.connected(m)
+	drivers.connected(m)
+	drivers.connected(&ClientMetadata{App: "search", Driver: "PyMongo", DriverVersion: "4.3"})
+
+	a := &AdminServer{Drivers: drivers}
+	ensure.Nil(t, a.Start())
+	defer a.Stop()
+	r, err := http.NewRequest("GET", "/drivers", nil)
+	ensure.Nil(t, err)
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	ensure.DeepEqual(t, w.Code, http.StatusOK)
+	var clients []DriverClients
+	ensure.Nil(t, json.Unmarshal(w.Body.Bytes(), &clients))
+	ensure.DeepEqual(t, len(clients), 2)
+	ensure.DeepEqual(t, clients[0].App, "billing")
+	ensure.DeepEqual(t, clients[0].Clients, 2)
+	ensure.DeepEqual(t, clients[1].Driver, "PyMongo")
+}
@@ -0,0 +1,136 @@
+package dvara
+
+import (
+	"fmt"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Error codes used in the errors we reply with. They are the server's codes so
+// drivers can handle them like errors coming from mongo.
+const (
+	codeHostUnreachable      = 6
+	codeUnauthorized         = 13
+	codeAuthenticationFailed = 18
+	codeIllegalOperation     = 20
+	codeExceededTimeLimit    = 50
+	codeOperationFailed      = 96
+	codeShutdownInProgress   = 91
+	codeRateLimitExceeded    = 462
+)
+
+var codeNames = map[int32]string{
+	codeHostUnreachable:      "HostUnreachable",
+	codeUnauthorized:         "Unauthorized",
+	codeAuthenticationFailed: "AuthenticationFailed",
+	codeIllegalOperation:     "IllegalOperation",
+	codeExceededTimeLimit:    "ExceededTimeLimit",
+	codeOperationFailed:      "OperationFailed",
+	codeShutdownInProgress:   "ShutdownInProgress",
+	codeRateLimitExceeded:    "IngressRequestRateLimitExceeded",
+}
+
+// ProxyError is an error returned to clients by the proxy itself rather than
+// by a mongo server.
+type ProxyError struct {
+	Code    int32
+	Message string
+}
+
+func (e *ProxyError) Error() string {
+	return e.Message
+}
+
+// CodeName returns the name of the error code.
+func (e *ProxyError) CodeName() string {
+	return codeNames[e.Code]
+}
+
+func newProxyError(code int32, format string, args ...interface{}) *ProxyError {
+	return &ProxyError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// commandDoc returns the error as a failed command reply.
+func (e *ProxyError) commandDoc() bson.D {
+	return bson.D{
+		{Name: "ok", Value: 0},
+		{Name: "errmsg", Value: e.Message},
+		{Name: "code", Value: e.Code},
+		{Name: "codeName", Value: e.CodeName()},
+	}
+}
+
+// queryDoc returns the error as a failed query reply.
+func (e *ProxyError) queryDoc() bson.D {
+	return append(bson.D{{Name: "$err", Value: e.Message}}, e.commandDoc()...)
+}
+
+// lastErrorDoc returns the error as a getLastError reply.
+func (e *ProxyError) lastErrorDoc() bson.D {
+	return bson.D{
+		{Name: "ok", Value: 1},
+		{Name: "err", Value: e.Message},
+		{Name: "code", Value: e.Code},
+		{Name: "codeName", Value: e.CodeName()},
+		{Name: "n", Value: 0},
+	}
+}
+
+// errorReply returns the entire reply message failing the entire request
+// message with the given error. It returns nil if the request doesn't expect a
+// reply.
+func errorReply(request []byte, e *ProxyError) []byte {
+	if len(request) < headerLen || !expectsReply(request) {
+		return nil
+	}
+	requestID := getInt32(request, 4)
+	if OpCode(getInt32(request, 12)) == OpMsg {
+		return opMsgReply(requestID, e.commandDoc())
+	}
+	if isCommandRequest(request) {
+		return opReply(requestID, 0, e.commandDoc())
+	}
+	return opReply(requestID, replyQueryFailure, e.queryDoc())
+}
+
+// opReply builds an entire OpReply message with a single document.
+func opReply(responseTo int32, flags int32, doc interface{}) []byte {
+	b := addHeader(nil, int(OpReply))
+	b = addInt32(b, flags)
+	b = addInt32(b, 0) // cursorID
+	b = addInt32(b, 0)
+	b = addInt32(b, 0) // startingFrom
+	b = addInt32(b, 1) // numberReturned
+	b, err := addBSON(b, doc)
+	if err != nil {
+		// our own documents always marshal
+		panic(err)
+	}
+	setInt32(b, 0, int32(len(b)))
+	setInt32(b, 8, responseTo)
+	return b
+}
+
+// opMsgReply builds an entire OpMsg message with a single body document.
+func opMsgReply(responseTo int32, doc interface{}) []byte {
+	b := addHeader(nil, int(OpMsg))
+	b = addInt32(b, 0) // flags
+	b = append(b, 0)   // body section
+	b, err := addBSON(b, doc)
+	if err != nil {
+		// our own documents always marshal
+		panic(err)
+	}
+	setInt32(b, 0, int32(len(b)))
+	setInt32(b, 8, responseTo)
+	return b
+}
+
+// Set caches the given error as the reply to the next getLastError call.
+func (l *LastError) Set(e *ProxyError) {
+	reply := opReply(0, 0, e.lastErrorDoc())
+	l.Reset()
+	l.header = new(messageHeader)
+	l.header.FromWire(reply)
+	l.rest.Write(reply[headerLen:])
+}
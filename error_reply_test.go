@@ -0,0 +1,88 @@
+package dvara
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func replyDocument(t *testing.T, reply []byte) bson.M {
+	docs, err := replyDocuments(reply)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(docs), 1)
+	return docs[0]
+}
+
+func TestErrorReplyQuery(t *testing.T) {
+	t.Parallel()
+	e := newProxyError(codeHostUnreachable, "dvara: no server")
+	reply := errorReply(fakeQuery(42, 0, "test.users", bson.M{}), e)
+	ensure.DeepEqual(t, getInt32(reply, 0), int32(len(reply)))
+	ensure.DeepEqual(t, getInt32(reply, 8), int32(42))
+	ensure.DeepEqual(t, OpCode(getInt32(reply, 12)), OpReply)
+	ensure.True(t, replyFailed(false, reply))
+	doc := replyDocument(t, reply)
+	ensure.DeepEqual(t, doc["$err"], "dvara: no server")
+	ensure.DeepEqual(t, doc["code"], codeHostUnreachable)
+	ensure.DeepEqual(t, doc["codeName"], "HostUnreachable")
+}
+
+func TestErrorReplyCommand(t *testing.T) {
+	t.Parallel()
+	e := newProxyError(codeShutdownInProgress, "dvara: bye")
+	reply := errorReply(fakeQuery(7, 0, "admin.$cmd", bson.M{"isMaster": 1}), e)
+	ensure.DeepEqual(t, getInt32(reply, 8), int32(7))
+	ensure.DeepEqual(t, getInt32(reply, headerLen)&replyQueryFailure, int32(0))
+	ensure.True(t, replyFailed(true, reply))
+	doc := replyDocument(t, reply)
+	ensure.DeepEqual(t, doc["ok"], 0)
+	ensure.DeepEqual(t, doc["errmsg"], "dvara: bye")
+	ensure.DeepEqual(t, doc["codeName"], "ShutdownInProgress")
+}
+
+func TestErrorReplyOpMsg(t *testing.T) {
+	t.Parallel()
+	body, err := bson.Marshal(bson.M{"find": "users", "$db": "test"})
+	ensure.Nil(t, err)
+	msg := addHeader(nil, int(OpMsg))
+	msg = addInt32(msg, 0)
+	msg = append(msg, 0)
+	msg = append(msg, body...)
+	setInt32(msg, 0, int32(len(msg)))
+	setInt32(msg, 4, 9)
+
+	reply := errorReply(msg, newProxyError(codeOperationFailed, "dvara: no"))
+	ensure.DeepEqual(t, OpCode(getInt32(reply, 12)), OpMsg)
+	ensure.DeepEqual(t, getInt32(reply, 8), int32(9))
+	ensure.True(t, replyFailed(true, reply))
+	ensure.DeepEqual(t, replyDocument(t, reply)["codeName"], "OperationFailed")
+
+	// no reply is expected with moreToCome
+	setInt32(msg, headerLen, opMsgMoreToCome)
+	ensure.True(t, errorReply(msg, newProxyError(codeOperationFailed, "dvara: no")) == nil)
+}
+
+func TestRejectMessageWithoutReply(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{ReplicaSet: &ReplicaSet{MessageTimeout: time.Second}}
+
+	insert := fakeQuery(3, 0, "test.users", bson.M{"name": "bob"})
+	setInt32(insert, 12, int32(OpInsert))
+	h, err := readHeader(bytes.NewReader(insert))
+	ensure.Nil(t, err)
+	client := &fakeConn{in: bytes.NewReader(insert[headerLen:])}
+	var lastError LastError
+	e := newProxyError(codeHostUnreachable, "dvara: no server")
+	ensure.Nil(t, p.rejectMessage(h, p.clients.add(client), &lastError, e))
+	ensure.DeepEqual(t, client.out.Len(), 0)
+
+	// the following getLastError is answered from the cache
+	ensure.True(t, lastError.Exists())
+	reply := append(lastError.header.ToWire(), lastError.rest.Bytes()...)
+	doc := replyDocument(t, reply)
+	ensure.DeepEqual(t, doc["err"], "dvara: no server")
+	ensure.DeepEqual(t, doc["code"], codeHostUnreachable)
+}
@@ -0,0 +1,342 @@
+package dvara
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// Firewall actions.
+const (
+	FirewallAllow = "allow"
+	FirewallDeny  = "deny"
+)
+
+// FirewallRule allows or denies the requests it matches. Empty fields match
+// everything.
+type FirewallRule struct {
+	// Name identifies the rule in errors, logs and stats.
+	Name string `json:"name"`
+
+	// Action is FirewallAllow or FirewallDeny.
+	Action string `json:"action"`
+
+	// Commands are command names, matched case insensitively. Rules with
+	// commands only match commands.
+	Commands []string `json:"commands"`
+
+	// Namespaces are glob patterns like "prod.*" matched against the
+	// "db.collection" a request targets. Database wide commands, like
+	// dropDatabase, target "db.".
+	Namespaces []string `json:"namespaces"`
+
+	// OpCodes are names of request op codes, like INSERT.
+	OpCodes []string `json:"opcodes"`
+
+	// Clients are client networks in CIDR notation, or bare IP addresses.
+	Clients []string `json:"clients"`
+
+	commands map[string]bool
+	opCodes  []OpCode
+	clients  []*net.IPNet
+}
+
+// FirewallPolicy is a list of rules, the first one matching a request decides
+// whether it is allowed.
+type FirewallPolicy struct {
+	// Default is the action for requests no rule matches, FirewallAllow if
+	// empty.
+	Default string          `json:"default"`
+	Rules   []*FirewallRule `json:"rules"`
+}
+
+// ParseFirewallPolicy parses a JSON FirewallPolicy.
+func ParseFirewallPolicy(b []byte) (*FirewallPolicy, error) {
+	var policy FirewallPolicy
+	if err := json.Unmarshal(b, &policy); err != nil {
+		return nil, err
+	}
+	if policy.Default == "" {
+		policy.Default = FirewallAllow
+	}
+	if !validFirewallAction(policy.Default) {
+		return nil, fmt.Errorf("dvara: invalid firewall default action %q", policy.Default)
+	}
+	for i, r := range policy.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		if err := r.parse(); err != nil {
+			return nil, err
+		}
+	}
+	return &policy, nil
+}
+
+func validFirewallAction(action string) bool {
+	return action == FirewallAllow || action == FirewallDeny
+}
+
+func (r *FirewallRule) parse() error {
+	if !validFirewallAction(r.Action) {
+		return fmt.Errorf("dvara: invalid action %q of firewall rule %s", r.Action, r.Name)
+	}
+	if len(r.Commands) > 0 {
+		r.commands = make(map[string]bool, len(r.Commands))
+		for _, c := range r.Commands {
+			r.commands[strings.ToLower(c)] = true
+		}
+	}
+	for _, ns := range r.Namespaces {
+		if _, err := path.Match(ns, ""); err != nil {
+			return fmt.Errorf("dvara: invalid namespace pattern %q of firewall rule %s", ns, r.Name)
+		}
+	}
+	for _, name := range r.OpCodes {
+		c, err := ParseOpCode(name)
+		if err != nil {
+			return err
+		}
+		r.opCodes = append(r.opCodes, c)
+	}
+	var err error
+	r.clients, err = ParseCIDRs(strings.Join(r.Clients, ","))
+	return err
+}
+
+// match returns true if the rule matches the request message of the client.
+// The command is its name, empty if the message isn't a command.
+func (r *FirewallRule) match(msg []byte, command string, ip net.IP) bool {
+	if r.commands != nil && !r.commands[strings.ToLower(command)] {
+		return false
+	}
+	if len(r.opCodes) > 0 {
+		op := OpCode(getInt32(msg, 12))
+		found := false
+		for _, o := range r.opCodes {
+			if o == op {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.clients) > 0 {
+		found := false
+		for _, n := range r.clients {
+			if ip != nil && n.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.Namespaces) > 0 {
+		ns := requestNamespace(msg)
+		if !strings.Contains(ns, ".") {
+			ns += "."
+		}
+		for _, pattern := range r.Namespaces {
+			if ok, _ := path.Match(pattern, ns); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Check returns the rule denying the request message of the client, nil if
+// it is allowed. A nil policy allows everything.
+func (p *FirewallPolicy) Check(msg []byte, ip net.IP) *FirewallRule {
+	if p == nil {
+		return nil
+	}
+	var command string
+	if isCommandRequest(msg) {
+		command, _ = requestCommand(msg)
+	}
+	for _, r := range p.Rules {
+		if r.match(msg, command, ip) {
+			if r.Action == FirewallDeny {
+				return r
+			}
+			return nil
+		}
+	}
+	if p.Default == FirewallDeny {
+		return defaultFirewallRule
+	}
+	return nil
+}
+
+var defaultFirewallRule = &FirewallRule{Name: "default", Action: FirewallDeny}
+
+// Firewall allows or denies client requests by command, namespace, op code
+// and client network, following a FirewallPolicy loaded from a JSON file. The
+// file is reloaded when it changes.
+type Firewall struct {
+	// Path is the file the policy is loaded from. If empty every request is
+	// allowed.
+	Path string
+
+	// ReloadInterval is how often the file is checked for changes. Zero
+	// disables reloading.
+	ReloadInterval time.Duration
+
+	// Stats if provided will be used to record interesting stats.
+	Stats stats.Client `inject:""`
+
+	mutex   sync.RWMutex
+	policy  *FirewallPolicy
+	modTime time.Time
+	stop    chan struct{}
+}
+
+// Enabled returns true if requests are checked.
+func (f *Firewall) Enabled() bool {
+	return f != nil && f.Path != ""
+}
+
+// Start loads the policy and starts watching the file for changes.
+func (f *Firewall) Start() error {
+	if !f.Enabled() {
+		return nil
+	}
+	if err := f.load(); err != nil {
+		return err
+	}
+	if f.ReloadInterval > 0 {
+		f.stop = make(chan struct{})
+		go f.reloadLoop()
+	}
+	return nil
+}
+
+// Stop stops watching the file.
+func (f *Firewall) Stop() error {
+	if f.stop != nil {
+		close(f.stop)
+	}
+	return nil
+}
+
+// Check returns the rule denying the request message of the client, nil if
+// it is allowed.
+func (f *Firewall) Check(msg []byte, ip net.IP) *FirewallRule {
+	f.mutex.RLock()
+	policy := f.policy
+	f.mutex.RUnlock()
+	return policy.Check(msg, ip)
+}
+
+func (f *Firewall) reloadLoop() {
+	ticker := time.NewTicker(f.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.reload(); err != nil {
+				stats.BumpSum(f.Stats, "firewall.reload.error", 1)
+				corelog.LogError("error", err)
+			}
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// reload loads the policy again if the file changed. The current policy is
+// kept if it can't be loaded.
+func (f *Firewall) reload() error {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return err
+	}
+	f.mutex.RLock()
+	changed := !info.ModTime().Equal(f.modTime)
+	f.mutex.RUnlock()
+	if !changed {
+		return nil
+	}
+	return f.load()
+}
+
+func (f *Firewall) load() error {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+	policy, err := ParseFirewallPolicy(b)
+	if err != nil {
+		return fmt.Errorf("dvara: invalid firewall policy %s: %s", f.Path, err)
+	}
+
+	f.mutex.Lock()
+	f.policy = policy
+	f.modTime = info.ModTime()
+	f.mutex.Unlock()
+	stats.BumpSum(f.Stats, "firewall.reload", 1)
+	corelog.LogInfoMessage("loaded firewall policy", "path", f.Path, "rules", len(policy.Rules))
+	return nil
+}
+
+// checkFirewall handles the message with the given header when the firewall
+// is enabled, denied messages are failed with an error reply. It returns true
+// if the message should be proxied.
+func (p *Proxy) checkFirewall(h *messageHeader, c *proxyClient, lastError *LastError) (bool, error) {
+	firewall := p.ReplicaSet.Firewall
+	if !firewall.Enabled() {
+		return true, nil
+	}
+	msg, err := c.request.read(h, c.conn)
+	if err != nil {
+		return false, err
+	}
+	rule := firewall.Check(msg, clientIP(c.conn))
+	if rule == nil {
+		return true, nil
+	}
+
+	stats.BumpSum(p.stats, "firewall.denied", 1)
+	stats.BumpSum(p.stats, "firewall.denied."+rule.Name, 1)
+	what := "operation " + h.OpCode.String()
+	if isCommandRequest(msg) {
+		name, _ := requestCommand(msg)
+		what = "command " + name
+	}
+	ns := requestNamespace(msg)
+	corelog.LogInfoMessage("firewall denied request",
+		"client", c.conn.RemoteAddr(), "app", c.appName(), "rule", rule.Name, "request", what, "ns", ns)
+	e := newProxyError(codeUnauthorized, "dvara: %s on %s denied by firewall rule %s", what, ns, rule.Name)
+	return false, p.rejectMessage(h, c, lastError, e)
+}
+
+// clientIP returns the IP address of the client connection, nil if it has
+// none.
+func clientIP(c net.Conn) net.IP {
+	switch addr := c.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.IPAddr:
+		return addr.IP
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package dvara
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const testFirewallPolicy = `{
+	"rules": [
+		{"name": "ops", "action": "allow", "clients": ["10.9.0.0/16"]},
+		{"name": "no-drops", "action": "deny", "commands": ["dropDatabase", "drop"], "namespaces": ["prod.*"]},
+		{"name": "no-shutdown", "action": "deny", "commands": ["shutdown", "replSetReconfig", "eval"]},
+		{"name": "office", "action": "deny", "opcodes": ["INSERT"], "clients": ["10.1.0.0/16"]}
+	]
+}`
+
+func fakeInsert(ns string, doc interface{}) []byte {
+	insert := fakeQuery(1, 0, ns, doc)
+	setInt32(insert, 12, int32(OpInsert))
+	return insert
+}
+
+func TestFirewallPolicyCheck(t *testing.T) {
+	t.Parallel()
+	policy, err := ParseFirewallPolicy([]byte(testFirewallPolicy))
+	ensure.Nil(t, err)
+	app := net.ParseIP("10.2.0.1")
+	office := net.ParseIP("10.1.0.1")
+	ops := net.ParseIP("10.9.0.1")
+
+	dropDatabase := fakeQuery(1, 0, "prod.$cmd", bson.D{{Name: "dropDatabase", Value: 1}})
+	ensure.DeepEqual(t, policy.Check(dropDatabase, app).Name, "no-drops")
+	ensure.True(t, policy.Check(dropDatabase, ops) == nil)
+	drop := fakeQuery(1, 0, "prod.$cmd", bson.D{{Name: "DROP", Value: "users"}})
+	ensure.DeepEqual(t, policy.Check(drop, app).Name, "no-drops")
+	drop = fakeQuery(1, 0, "test.$cmd", bson.D{{Name: "drop", Value: "users"}})
+	ensure.True(t, policy.Check(drop, app) == nil)
+	shutdown := fakeQuery(1, 0, "admin.$cmd", bson.D{{Name: "shutdown", Value: 1}})
+	ensure.DeepEqual(t, policy.Check(shutdown, app).Name, "no-shutdown")
+
+	// and wrapped with their read preference, as legacy drivers send them
+	wrapped := fakeQuery(1, 0, "prod.$cmd", bson.D{
+		{Name: "$query", Value: bson.D{{Name: "dropDatabase", Value: 1}}},
+		{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "primary"}}},
+	})
+	ensure.DeepEqual(t, policy.Check(wrapped, app).Name, "no-drops")
+	wrapped = fakeQuery(1, 0, "prod.$cmd", bson.D{{Name: "query", Value: bson.D{{Name: "drop", Value: "users"}}}})
+	ensure.DeepEqual(t, policy.Check(wrapped, app).Name, "no-drops")
+
+	// commands match OpMsg as well
+	doc, err := bson.Marshal(bson.D{{Name: "drop", Value: "users"}, {Name: "$db", Value: "prod"}})
+	ensure.Nil(t, err)
+	msg := addHeader(nil, int(OpMsg))
+	msg = addInt32(msg, 0)
+	msg = append(msg, 0)
+	msg = append(msg, doc...)
+	setInt32(msg, 0, int32(len(msg)))
+	ensure.DeepEqual(t, policy.Check(msg, app).Name, "no-drops")
+
+	// and rules without commands match anything
+	ensure.DeepEqual(t, policy.Check(fakeInsert("test.users", bson.M{}), office).Name, "office")
+	ensure.True(t, policy.Check(fakeInsert("test.users", bson.M{}), app) == nil)
+	ensure.True(t, policy.Check(fakeQuery(1, 0, "prod.users", bson.M{}), office) == nil)
+
+	// the default applies when nothing matches
+	policy, err = ParseFirewallPolicy([]byte(`{"default": "deny", "rules": [{"action": "allow", "namespaces": ["test.*"]}]}`))
+	ensure.Nil(t, err)
+	ensure.True(t, policy.Check(fakeQuery(1, 0, "test.users", bson.M{}), app) == nil)
+	ensure.DeepEqual(t, policy.Check(fakeQuery(1, 0, "prod.users", bson.M{}), app).Name, "default")
+	ensure.DeepEqual(t, policy.Rules[0].Name, "rule1")
+
+	var none *FirewallPolicy
+	ensure.True(t, none.Check(dropDatabase, app) == nil)
+}
+
+func TestParseFirewallPolicyErrors(t *testing.T) {
+	t.Parallel()
+	for _, policy := range []string{
+		`{`,
+		`{"default": "maybe"}`,
+		`{"rules": [{"action": "block"}]}`,
+		`{"rules": [{"action": "deny", "opcodes": ["BOGUS"]}]}`,
+		`{"rules": [{"action": "deny", "clients": ["10.0.0.300"]}]}`,
+		`{"rules": [{"action": "deny", "namespaces": ["prod.["]}]}`,
+	} {
+		_, err := ParseFirewallPolicy([]byte(policy))
+		ensure.NotNil(t, err, policy)
+	}
+}
+
+func TestCheckFirewall(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "dvara-firewall")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "firewall.json")
+	ensure.Nil(t, ioutil.WriteFile(path, []byte(testFirewallPolicy), 0600))
+	firewall := &Firewall{Path: path}
+	ensure.Nil(t, firewall.Start())
+	defer firewall.Stop()
+
+	hc := newCounterClient()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{MessageTimeout: time.Minute, Firewall: firewall},
+		stats:      hc,
+	}
+	conn := &fakeConn{remote: fakeClientAddr}
+	c := p.clients.add(conn)
+	check := func(msg []byte) (bool, *LastError) {
+		conn.in = bytes.NewReader(msg)
+		conn.out.Reset()
+		h, err := p.clientReadHeader(c, time.Minute)
+		ensure.Nil(t, err)
+		var lastError LastError
+		ok, err := p.checkFirewall(h, c, &lastError)
+		ensure.Nil(t, err)
+		return ok, &lastError
+	}
+
+	// denied commands get an error reply
+	ok, _ := check(fakeQuery(1, 0, "prod.$cmd", bson.D{{Name: "dropDatabase", Value: 1}}))
+	ensure.False(t, ok)
+	reply := replyDocument(t, conn.out.Bytes())
+	ensure.DeepEqual(t, reply["code"], codeUnauthorized)
+	ensure.StringContains(t, reply["errmsg"].(string), "no-drops")
+	ensure.DeepEqual(t, hc.count("firewall.denied.no-drops"), float64(1))
+
+	// denied writes fail the following getLastError
+	ok, lastError := check(fakeInsert("test.users", bson.M{"a": 1}))
+	ensure.False(t, ok)
+	ensure.True(t, lastError.Exists())
+	ensure.DeepEqual(t, hc.count("firewall.denied"), float64(2))
+
+	// allowed requests are proxied from the buffered message
+	query := fakeQuery(1, 0, "prod.users", bson.M{})
+	ok, _ = check(query)
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, c.request.msg, query)
+
+	// the policy is reloaded when it changes
+	ensure.Nil(t, ioutil.WriteFile(path, []byte(`{"default": "deny"}`), 0600))
+	future := time.Now().Add(time.Hour)
+	ensure.Nil(t, os.Chtimes(path, future, future))
+	ensure.Nil(t, firewall.reload())
+	ok, _ = check(query)
+	ensure.False(t, ok)
+}
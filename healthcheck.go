@@ -3,6 +3,7 @@ package dvara
 import (
 	"errors"
 	"fmt"
+	"net"
 	"strings"
 	"time"
 
@@ -91,7 +92,9 @@ func (r *ReplicaSet) HandleFailure() {
 func (r *ReplicaSet) runCheck(errChan chan<- error) {
 	// dvara opens a port per member of replica set, we don't expect to run more than 5 members in replica set
 	addrs := strings.Split(fmt.Sprintf("127.0.0.1:%d,127.0.0.1:%d,127.0.0.1:%d,127.0.0.1:%d,127.0.0.1:%d", r.PortStart, r.PortStart+1, r.PortStart+2, r.PortStart+3, r.PortStart+4), ",")
-	err := checkReplSetStatus(addrs, r.Name)
+	err := checkReplSetStatus(addrs, r.Name, func(addr *mgo.ServerAddr) (net.Conn, error) {
+		return r.dialSystem(addr.String())
+	})
 	select {
 	case errChan <- err:
 	default:
@@ -99,13 +102,15 @@ func (r *ReplicaSet) runCheck(errChan chan<- error) {
 	}
 }
 
-func checkReplSetStatus(addrs []string, replicaSetName string) error {
+// checkReplSetStatus connects with dial, the default dialer if nil.
+func checkReplSetStatus(addrs []string, replicaSetName string, dial func(*mgo.ServerAddr) (net.Conn, error)) error {
 	info := &mgo.DialInfo{
 		Addrs:    addrs,
 		FailFast: true,
 		// Without direct option, healthcheck fails in case there are only secondaries in the replica set
 		Direct:         true,
 		ReplicaSetName: replicaSetName,
+		DialServer:     dial,
 	}
 
 	session, err := mgo.DialWithInfo(info)
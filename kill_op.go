@@ -0,0 +1,204 @@
+package dvara
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var errCommandNoReply = errors.New("dvara: command returned no document")
+
+// pooledConn is a server connection along with the id the server knows it by,
+// which is needed to find the operations it is running.
+type pooledConn struct {
+	net.Conn
+	connectionID int32
+
+	// pool is the user pool the connection belongs to, nil for the proxy's
+	pool *userPool
+}
+
+// Close closes the connection, freeing its place in its user pool.
+func (c *pooledConn) Close() error {
+	if c.pool != nil {
+		c.pool.opened(-1)
+	}
+	return c.Conn.Close()
+}
+
+// runCommand runs the command against the database on the connection and
+// unmarshals the reply into result, which may be nil.
+func runCommand(conn net.Conn, db string, cmd interface{}, result interface{}) error {
+	b := addHeader(nil, int(OpQuery))
+	b = addInt32(b, 0)
+	b = addCString(b, db+".$cmd")
+	b = addInt32(b, 0)
+	b = addInt32(b, -1)
+	b, err := addBSON(b, cmd)
+	if err != nil {
+		return err
+	}
+	setInt32(b, 0, int32(len(b)))
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+
+	reply, err := readMessage(conn)
+	if err != nil {
+		return err
+	}
+	if replyFailed(true, reply) {
+		var e struct {
+			Err    string `bson:"$err"`
+			ErrMsg string `bson:"errmsg"`
+		}
+		if docs := reply[headerLen+len(replyPrefix{}):]; len(docs) > 0 {
+			bson.Unmarshal(docs, &e)
+		}
+		return fmt.Errorf("dvara: command failed: %s%s", e.Err, e.ErrMsg)
+	}
+	if getInt32(reply, headerLen+16) < 1 {
+		return errCommandNoReply
+	}
+	if result == nil {
+		return nil
+	}
+	return bson.Unmarshal(reply[headerLen+len(replyPrefix{}):], result)
+}
+
+// handshakeConnectionID returns the id the server assigned to the connection
+// as reported by isMaster.
+func handshakeConnectionID(conn net.Conn) (int32, error) {
+	var res struct {
+		ConnectionID int32 `bson:"connectionId"`
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if err := runCommand(conn, "admin", bson.D{{Name: "isMaster", Value: 1}}, &res); err != nil {
+		return 0, err
+	}
+	return res.ConnectionID, nil
+}
+
+// killOpQueueSize is the number of abandoned connections waiting for their
+// operations to be killed, after which more are dropped.
+const killOpQueueSize = 128
+
+// opKiller kills the operations left running by server connections we
+// abandoned. It uses its own control connection to the server, killing the
+// operations of one abandoned connection at a time.
+type opKiller struct {
+	dial  func() (net.Conn, error)
+	stats stats.Client
+
+	mutex  sync.RWMutex
+	queue  chan int32
+	closed bool
+	wg     sync.WaitGroup
+	conn   net.Conn
+}
+
+// start starts the goroutine killing the operations.
+func (k *opKiller) start() {
+	k.queue = make(chan int32, killOpQueueSize)
+	k.wg.Add(1)
+	go k.work()
+}
+
+// abandoned queues killing the operations still running for the given server
+// connection. It's dropped if too many are queued already.
+func (k *opKiller) abandoned(c net.Conn) {
+	pc, ok := c.(*pooledConn)
+	if !ok || pc.connectionID == 0 {
+		stats.BumpSum(k.stats, "server.killop.unknown", 1)
+		return
+	}
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	if k.closed {
+		return
+	}
+	select {
+	case k.queue <- pc.connectionID:
+	default:
+		stats.BumpSum(k.stats, "server.killop.dropped", 1)
+	}
+}
+
+func (k *opKiller) work() {
+	defer k.wg.Done()
+	for id := range k.queue {
+		n, err := k.kill(id)
+		if err != nil {
+			stats.BumpSum(k.stats, "server.killop.error", 1)
+			corelog.LogError("error", err)
+			continue
+		}
+		stats.BumpSum(k.stats, "server.killop.killed", float64(n))
+	}
+	k.closeConn()
+}
+
+// kill kills the operations running for the given server connection id and
+// returns how many there were.
+func (k *opKiller) kill(connectionID int32) (int, error) {
+	if k.conn == nil {
+		conn, err := k.dial()
+		if err != nil {
+			return 0, err
+		}
+		k.conn = conn
+	}
+	k.conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	var current struct {
+		InProg []struct {
+			OpID interface{} `bson:"opid"`
+		} `bson:"inprog"`
+	}
+	cmd := bson.D{
+		{Name: "currentOp", Value: 1},
+		{Name: "connectionId", Value: connectionID},
+	}
+	if err := runCommand(k.conn, "admin", cmd, &current); err != nil {
+		k.closeConn()
+		return 0, err
+	}
+
+	for _, op := range current.InProg {
+		cmd := bson.D{{Name: "killOp", Value: 1}, {Name: "op", Value: op.OpID}}
+		if err := runCommand(k.conn, "admin", cmd, nil); err != nil {
+			k.closeConn()
+			return 0, err
+		}
+		corelog.LogInfoMessage("killed abandoned operation",
+			"opid", op.OpID, "connectionId", connectionID)
+	}
+	return len(current.InProg), nil
+}
+
+func (k *opKiller) closeConn() {
+	if k.conn != nil {
+		k.conn.Close()
+		k.conn = nil
+	}
+}
+
+// Stop waits for the queued kills and closes the control connection.
+func (k *opKiller) Stop() {
+	k.mutex.Lock()
+	if k.closed {
+		k.mutex.Unlock()
+		return
+	}
+	k.closed = true
+	close(k.queue)
+	k.mutex.Unlock()
+	k.wg.Wait()
+}
@@ -0,0 +1,72 @@
+package dvara
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestOpKiller(t *testing.T) {
+	t.Parallel()
+	var mutex sync.Mutex
+	var killed []interface{}
+	l := fakeServer(t, func(request []byte) []byte {
+		requestID := getInt32(request, 4)
+		name, cmd := requestCommand(request)
+		switch name {
+		case "isMaster":
+			return fakeReplyTo(requestID, bson.M{"ok": 1, "ismaster": true, "connectionId": 42})
+		case "currentOp":
+			if lookup(cmd, "connectionId") != 42 {
+				return fakeReplyTo(requestID, bson.M{"ok": 1, "inprog": []bson.M{}})
+			}
+			return fakeReplyTo(requestID, bson.M{"ok": 1, "inprog": []bson.M{{"opid": 7}, {"opid": 8}}})
+		case "killOp":
+			mutex.Lock()
+			killed = append(killed, lookup(cmd, "op"))
+			mutex.Unlock()
+			return fakeReplyTo(requestID, bson.M{"ok": 1})
+		}
+		return fakeReplyTo(requestID, bson.M{"ok": 0, "errmsg": "no such command"})
+	})
+	defer l.Close()
+
+	dial := func() (net.Conn, error) { return net.Dial("tcp", l.Addr().String()) }
+	c, err := dial()
+	ensure.Nil(t, err)
+	defer c.Close()
+	id, err := handshakeConnectionID(c)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, id, int32(42))
+	ensure.NotNil(t, runCommand(c, "admin", bson.M{"bogus": 1}, nil))
+
+	hc := newCounterClient()
+	k := &opKiller{dial: dial, stats: hc}
+	k.start()
+	k.abandoned(&pooledConn{Conn: c, connectionID: id})
+	k.abandoned(&pooledConn{Conn: c, connectionID: 43})
+	k.abandoned(c)
+	k.Stop()
+
+	ensure.SameElements(t, killed, []interface{}{7, 8})
+	ensure.DeepEqual(t, hc.count("server.killop.killed"), float64(2))
+	ensure.DeepEqual(t, hc.count("server.killop.unknown"), float64(1))
+	ensure.DeepEqual(t, hc.count("server.killop.error"), float64(0))
+}
+
+func TestOpKillerQueueFull(t *testing.T) {
+	t.Parallel()
+	hc := newCounterClient()
+	k := &opKiller{stats: hc}
+	k.queue = make(chan int32, 1)
+	k.abandoned(&pooledConn{connectionID: 42})
+	k.abandoned(&pooledConn{connectionID: 43})
+	ensure.DeepEqual(t, hc.count("server.killop.dropped"), float64(1))
+	ensure.DeepEqual(t, <-k.queue, int32(42))
+	k.Stop()
+	k.abandoned(&pooledConn{connectionID: 44})
+	ensure.DeepEqual(t, hc.count("server.killop.dropped"), float64(1))
+}
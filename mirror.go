@@ -0,0 +1,314 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// volatileReplyFields are reply fields expected to differ between servers,
+// they're ignored when comparing replies.
+var volatileReplyFields = []string{
+	"$clusterTime",
+	"$gleStats",
+	"connectionId",
+	"electionId",
+	"lastOp",
+	"localTime",
+	"operationTime",
+}
+
+// Mirror asynchronously duplicates proxied messages to a shadow server. The
+// primary path is never slowed down by the mirror, messages are dropped if
+// the mirror can't keep up.
+type Mirror struct {
+	// Addr is the address of the shadow server.
+	Addr string
+
+	// SampleRate is the fraction of eligible messages that get mirrored,
+	// between 0 and 1.
+	SampleRate float64
+
+	// Writes enables mirroring of writes in addition to reads.
+	Writes bool
+
+	// Compare enables comparing the shadow replies with the primary ones.
+	Compare bool
+
+	// QueueSize is the number of messages waiting to be mirrored after which
+	// new messages are dropped.
+	QueueSize uint
+
+	// Pool is used for connections to the shadow server. Its Max also decides
+	// the number of concurrently mirrored messages.
+	Pool *Pool
+
+	// Stats is optional and records the mirror outcomes.
+	Stats stats.Client
+
+	mutex  sync.RWMutex
+	queue  chan *mirrorTap
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Start starts the goroutines sending messages to the shadow server.
+func (m *Mirror) Start() {
+	m.queue = make(chan *mirrorTap, m.QueueSize)
+	for i := uint(0); i < m.Pool.Max; i++ {
+		m.wg.Add(1)
+		go m.work()
+	}
+}
+
+// Stop waits for the queued messages to be mirrored and closes the
+// connections to the shadow server.
+func (m *Mirror) Stop() error {
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.queue)
+	m.mutex.Unlock()
+	m.wg.Wait()
+	return m.Pool.Close()
+}
+
+// tap returns a mirrorTap if the message with the given header was sampled to
+// be mirrored, nil otherwise.
+func (m *Mirror) tap(h *messageHeader) *mirrorTap {
+	switch {
+	case h.OpCode == OpQuery:
+	case h.OpCode.IsMutation() && m.Writes:
+	default:
+		return nil
+	}
+	if rand.Float64() >= m.SampleRate {
+		return nil
+	}
+	t := &mirrorTap{compare: m.Compare}
+	t.request.Write(h.ToWire())
+	return t
+}
+
+// send queues the tapped message if it is eligible for mirroring.
+func (m *Mirror) send(t *mirrorTap) {
+	if !m.eligible(t.request.Bytes()) {
+		return
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.closed {
+		return
+	}
+	select {
+	case m.queue <- t:
+	default:
+		stats.BumpSum(m.Stats, "dropped", 1)
+	}
+}
+
+// eligible returns true if the entire request is a read, or a write when
+// writes are being mirrored.
+func (m *Mirror) eligible(msg []byte) bool {
+	op := OpCode(getInt32(msg, 12))
+	if op.IsMutation() {
+		return m.Writes
+	}
+	// exhaust queries would stream replies the mirror doesn't wait for
+	if isExhaustQuery(msg) {
+		return false
+	}
+	if !isCommandRequest(msg) {
+		return true
+	}
+	name, cmd := requestCommand(msg)
+	if writeCommands[name] {
+		return m.Writes
+	}
+	if name == "aggregate" && hasOutputStage(cmd) {
+		return m.Writes
+	}
+	return readCommands[name]
+}
+
+func (m *Mirror) work() {
+	defer m.wg.Done()
+	for t := range m.queue {
+		if err := m.mirror(t); err != nil {
+			stats.BumpSum(m.Stats, "error", 1)
+			corelog.LogError("error", err)
+		}
+	}
+}
+
+func (m *Mirror) mirror(t *mirrorTap) error {
+	defer stats.BumpTime(m.Stats, "time").End()
+	r, err := m.Pool.Acquire()
+	if err != nil {
+		return err
+	}
+	conn := r.(net.Conn)
+	request := t.request.Bytes()
+
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	if _, err := conn.Write(request); err != nil {
+		m.Pool.Discard(conn)
+		return err
+	}
+	stats.BumpSum(m.Stats, "sent", 1)
+	if !expectsReply(request) {
+		m.Pool.Release(conn)
+		return nil
+	}
+	reply, err := readMessage(conn)
+	if err != nil {
+		m.Pool.Discard(conn)
+		return err
+	}
+	m.Pool.Release(conn)
+
+	if t.compare {
+		if sameReplies(t.reply.Bytes(), reply) {
+			stats.BumpSum(m.Stats, "match", 1)
+		} else {
+			stats.BumpSum(m.Stats, "mismatch", 1)
+		}
+	}
+	return nil
+}
+
+// mirrorTap records a message, and possibly its reply, as it is proxied.
+type mirrorTap struct {
+	compare bool
+	request bytes.Buffer
+	reply   bytes.Buffer
+}
+
+// wrap returns a client which records what is read from and written to it.
+func (t *mirrorTap) wrap(client io.ReadWriter) io.ReadWriter {
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{
+		Reader: io.TeeReader(client, &t.request),
+		Writer: client,
+	}
+	if t.compare {
+		rw.Writer = io.MultiWriter(client, &t.reply)
+	}
+	return rw
+}
+
+// hasOutputStage returns true if the aggregate command writes its results to
+// a collection.
+func hasOutputStage(cmd bson.D) bool {
+	stages, _ := lookup(cmd, "pipeline").([]interface{})
+	for _, s := range stages {
+		if d, ok := asDoc(s); ok && len(d) > 0 && (d[0].Name == "$out" || d[0].Name == "$merge") {
+			return true
+		}
+	}
+	return false
+}
+
+// sameReplies compares the documents in two entire reply messages, ignoring
+// the fields expected to differ between servers.
+func sameReplies(a, b []byte) bool {
+	da, erra := replyDocuments(a)
+	db, errb := replyDocuments(b)
+	if erra != nil || errb != nil {
+		return false
+	}
+	return reflect.DeepEqual(da, db)
+}
+
+// replyDocuments returns the normalized documents of an entire reply message.
+func replyDocuments(msg []byte) ([]bson.M, error) {
+	var raw []byte
+	switch OpCode(getInt32(msg, 12)) {
+	case OpReply:
+		if len(msg) < headerLen+len(replyPrefix{}) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		raw = msg[headerLen+len(replyPrefix{}):]
+	case OpMsg:
+		raw = opMsgBody(msg)
+	}
+
+	var docs []bson.M
+	r := bytes.NewReader(raw)
+	for r.Len() > 0 {
+		b, err := readDocument(r)
+		if err != nil {
+			return nil, err
+		}
+		var doc bson.M
+		if err := bson.Unmarshal(b, &doc); err != nil {
+			return nil, err
+		}
+		for _, f := range volatileReplyFields {
+			delete(doc, f)
+		}
+		if c, ok := doc["cursor"].(bson.M); ok {
+			delete(c, "id")
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// newMirror creates the Mirror for the proxy if one is configured.
+func (p *Proxy) newMirror() *Mirror {
+	r := p.ReplicaSet
+	if r.MirrorAddr == "" {
+		return nil
+	}
+	max := r.MirrorMaxConnections
+	if max == 0 {
+		max = 1
+	}
+	m := &Mirror{
+		Addr:       r.MirrorAddr,
+		SampleRate: r.MirrorSampleRate,
+		Writes:     r.MirrorWrites,
+		Compare:    r.MirrorCompare,
+		QueueSize:  r.MirrorQueueSize,
+		Pool: &Pool{
+			New:               p.newMirrorConn,
+			CloseErrorHandler: p.serverCloseErrorHandler,
+			Max:               max,
+			IdleTimeout:       r.ServerIdleTimeout,
+			ClosePoolSize:     1,
+		},
+	}
+	if r.Stats != nil {
+		m.Stats = stats.PrefixClient([]string{"mongoproxy.mirror."}, r.Stats)
+		m.Pool.Stats = stats.PrefixClient([]string{"mongoproxy.mirror.pool."}, r.Stats)
+	}
+	return m
+}
+
+// newMirrorConn opens a connection to the shadow server. Unlike server
+// connections we don't retry, the mirror is best effort.
+func (p *Proxy) newMirrorConn() (io.Closer, error) {
+	c, err := net.DialTimeout("tcp", p.ReplicaSet.MirrorAddr, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.AuthConn(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,138 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// counterClient counts the sums bumped per key.
+type counterClient struct {
+	stats.HookClient
+	mutex  sync.Mutex
+	counts map[string]float64
+}
+
+func newCounterClient() *counterClient {
+	c := &counterClient{counts: make(map[string]float64)}
+	c.BumpSumHook = func(key string, val float64) {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.counts[key] += val
+	}
+	return c
+}
+
+func (c *counterClient) count(key string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.counts[key]
+}
+
+func newTestMirror(addr string, stats stats.Client) *Mirror {
+	return &Mirror{
+		Addr:       addr,
+		SampleRate: 1,
+		Compare:    true,
+		QueueSize:  10,
+		Stats:      stats,
+		Pool: &Pool{
+			New: func() (io.Closer, error) {
+				return net.Dial("tcp", addr)
+			},
+			Max:           2,
+			IdleTimeout:   time.Minute,
+			ClosePoolSize: 1,
+		},
+	}
+}
+
+// tapMessage sends the request through the tap and answers it with reply.
+func tapMessage(t *testing.T, m *Mirror, request, reply []byte) *mirrorTap {
+	h, err := readHeader(bytes.NewReader(request))
+	ensure.Nil(t, err)
+	tap := m.tap(h)
+	if tap == nil {
+		return nil
+	}
+	client := &fakeConn{in: bytes.NewReader(request[headerLen:])}
+	rw := tap.wrap(client)
+	_, err = io.Copy(ioutil.Discard, rw)
+	ensure.Nil(t, err)
+	_, err = rw.Write(reply)
+	ensure.Nil(t, err)
+	return tap
+}
+
+func TestMirrorCompare(t *testing.T) {
+	t.Parallel()
+	var mutex sync.Mutex
+	var seen []string
+	l := fakeServer(t, func(request []byte) []byte {
+		name, _ := requestCommand(request)
+		mutex.Lock()
+		seen = append(seen, name)
+		mutex.Unlock()
+		if name == "distinct" {
+			return fakeReplyTo(getInt32(request, 4), bson.M{"ok": 1, "values": []int{2}})
+		}
+		return fakeReplyTo(getInt32(request, 4), bson.M{"ok": 1, "n": 3, "operationTime": 42})
+	})
+	defer l.Close()
+
+	hc := newCounterClient()
+	m := newTestMirror(l.Addr().String(), hc)
+	m.Start()
+
+	count := fakeQuery(1, 0, "test.$cmd", bson.D{{Name: "count", Value: "users"}})
+	m.send(tapMessage(t, m, count, fakeReplyTo(1, bson.M{"ok": 1, "n": 3})))
+	distinct := fakeQuery(2, 0, "test.$cmd", bson.D{{Name: "distinct", Value: "users"}})
+	m.send(tapMessage(t, m, distinct, fakeReplyTo(2, bson.M{"ok": 1, "values": []int{1}})))
+	insert := fakeQuery(3, 0, "test.$cmd", bson.D{{Name: "insert", Value: "users"}})
+	m.send(tapMessage(t, m, insert, fakeReplyTo(3, bson.M{"ok": 1})))
+	out := fakeQuery(4, 0, "test.$cmd", bson.D{
+		{Name: "aggregate", Value: "users"},
+		{Name: "pipeline", Value: []bson.M{{"$out": "copy"}}},
+	})
+	m.send(tapMessage(t, m, out, fakeReplyTo(4, bson.M{"ok": 1})))
+	ensure.Nil(t, m.Stop())
+
+	ensure.SameElements(t, seen, []string{"count", "distinct"})
+	ensure.DeepEqual(t, hc.count("sent"), float64(2))
+	ensure.DeepEqual(t, hc.count("match"), float64(1))
+	ensure.DeepEqual(t, hc.count("mismatch"), float64(1))
+	ensure.DeepEqual(t, hc.count("error"), float64(0))
+}
+
+func TestMirrorDropsOnOverflow(t *testing.T) {
+	t.Parallel()
+	hc := newCounterClient()
+	m := newTestMirror("127.0.0.1:0", hc)
+	m.QueueSize = 1
+	m.Pool.Max = 0 // no workers draining the queue
+	m.Start()
+
+	query := fakeQuery(1, 0, "test.users", bson.M{})
+	m.send(tapMessage(t, m, query, fakeReplyTo(1, bson.M{})))
+	m.send(tapMessage(t, m, query, fakeReplyTo(1, bson.M{})))
+	ensure.DeepEqual(t, hc.count("dropped"), float64(1))
+}
+
+func TestMirrorSampling(t *testing.T) {
+	t.Parallel()
+	m := newTestMirror("127.0.0.1:0", nil)
+	h := &messageHeader{OpCode: OpQuery}
+	ensure.True(t, m.tap(h) != nil)
+	ensure.True(t, m.tap(&messageHeader{OpCode: OpInsert}) == nil)
+	ensure.True(t, m.tap(&messageHeader{OpCode: OpGetMore}) == nil)
+	m.SampleRate = 0
+	ensure.True(t, m.tap(h) == nil)
+}
@@ -0,0 +1,86 @@
+package dvara
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PoolingMode defines for how long a client keeps a server connection.
+type PoolingMode string
+
+const (
+	// TransactionPooling returns the server connection to the pool after every
+	// message, or after the getLastError call following a mutation.
+	TransactionPooling PoolingMode = "transaction"
+
+	// SessionPooling keeps the server connection for the whole client session,
+	// for clients relying on connection scoped state such as legacy
+	// authentication, command cursors or setParameter.
+	SessionPooling PoolingMode = "session"
+)
+
+// ParsePoolingMode returns the PoolingMode with the given name.
+func ParsePoolingMode(name string) (PoolingMode, error) {
+	switch m := PoolingMode(name); m {
+	case TransactionPooling, SessionPooling:
+		return m, nil
+	}
+	return "", fmt.Errorf("dvara: unknown pooling mode %q", name)
+}
+
+// ListenerPoolingMode is the pooling mode of the proxies listening on a range
+// of ports.
+type ListenerPoolingMode struct {
+	PortStart int
+	PortEnd   int
+	Mode      PoolingMode
+}
+
+// ParseListenerPoolingModes parses comma separated pooling modes of ports or
+// port ranges, for example "6000=session,6001-6004=transaction".
+func ParseListenerPoolingModes(list string) ([]ListenerPoolingMode, error) {
+	var modes []ListenerPoolingMode
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		i := strings.Index(s, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("dvara: invalid listener pooling mode %q", s)
+		}
+		mode, err := ParsePoolingMode(strings.TrimSpace(s[i+1:]))
+		if err != nil {
+			return nil, err
+		}
+		ports := strings.TrimSpace(s[:i])
+		start, end := ports, ports
+		if j := strings.Index(ports, "-"); j >= 0 {
+			start, end = ports[:j], ports[j+1:]
+		}
+		m := ListenerPoolingMode{Mode: mode}
+		if m.PortStart, err = strconv.Atoi(strings.TrimSpace(start)); err != nil {
+			return nil, fmt.Errorf("dvara: invalid listener pooling mode %q", s)
+		}
+		if m.PortEnd, err = strconv.Atoi(strings.TrimSpace(end)); err != nil || m.PortEnd < m.PortStart {
+			return nil, fmt.Errorf("dvara: invalid listener pooling mode %q", s)
+		}
+		modes = append(modes, m)
+	}
+	return modes, nil
+}
+
+// poolingMode returns the pooling mode of the proxy with the given listener,
+// the first of the ListenerPoolingModes including its port or PoolingMode.
+func (r *ReplicaSet) poolingMode(l net.Listener) PoolingMode {
+	if addr, ok := l.Addr().(*net.TCPAddr); ok {
+		for _, m := range r.ListenerPoolingModes {
+			if addr.Port >= m.PortStart && addr.Port <= m.PortEnd {
+				return m.Mode
+			}
+		}
+	}
+	return r.PoolingMode
+}
@@ -0,0 +1,117 @@
+package dvara
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+type countingConn struct {
+	cycleConn
+	closed *int32
+}
+
+func (c *countingConn) Close() error {
+	atomic.AddInt32(c.closed, 1)
+	return nil
+}
+
+func TestParsePoolingMode(t *testing.T) {
+	t.Parallel()
+	mode, err := ParsePoolingMode("session")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, mode, SessionPooling)
+	_, err = ParsePoolingMode("statement")
+	ensure.NotNil(t, err)
+}
+
+func TestSessionPooling(t *testing.T) {
+	t.Parallel()
+	getMore := addHeader(nil, int(OpGetMore))
+	getMore = addInt32(getMore, 0)
+	getMore = addCString(getMore, "db.c")
+	getMore = addInt32(getMore, 0)
+	getMore = append(getMore, make([]byte, 8)...)
+	setInt32(getMore, 0, int32(len(getMore)))
+	reply := fakeReplyTo(1, map[string]int{"a": 1})
+
+	var created, closed int32
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MessageTimeout:    time.Minute,
+			ClientIdleTimeout: time.Minute,
+		},
+		PoolingMode: SessionPooling,
+		serverPool: Pool{
+			New: func() (io.Closer, error) {
+				atomic.AddInt32(&created, 1)
+				return &countingConn{cycleConn: cycleConn{msg: reply}, closed: &closed}, nil
+			},
+			Max:           1,
+			IdleTimeout:   time.Hour,
+			ClosePoolSize: 1,
+		},
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	// the client keeps the same server connection for all its messages
+	in := bytes.NewReader(bytes.Repeat(getMore, 3))
+	p.serveSession(p.ctx, p.clients.add(&fakeConn{in: in}))
+	ensure.DeepEqual(t, atomic.LoadInt32(&created), int32(1))
+
+	// which is closed rather than reused once it disconnects
+	ensure.Nil(t, p.serverPool.Close())
+	ensure.DeepEqual(t, atomic.LoadInt32(&closed), int32(1))
+}
+
+func TestParseListenerPoolingModes(t *testing.T) {
+	t.Parallel()
+	modes, err := ParseListenerPoolingModes("6000=session, 6001-6004=transaction")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, modes, []ListenerPoolingMode{
+		{PortStart: 6000, PortEnd: 6000, Mode: SessionPooling},
+		{PortStart: 6001, PortEnd: 6004, Mode: TransactionPooling},
+	})
+	for _, bad := range []string{"6000", "6000=statement", "x=session", "6004-6001=session"} {
+		_, err := ParseListenerPoolingModes(bad)
+		ensure.NotNil(t, err)
+	}
+}
+
+func TestListenerPoolingModes(t *testing.T) {
+	t.Parallel()
+	var ports []int
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		ensure.Nil(t, err)
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+		ensure.Nil(t, l.Close())
+	}
+	modes, err := ParseListenerPoolingModes(fmt.Sprintf("%d=session", ports[0]))
+	ensure.Nil(t, err)
+	r := &ReplicaSet{
+		ListenAddr:           "127.0.0.1",
+		PoolingMode:          TransactionPooling,
+		ListenerPoolingModes: modes,
+	}
+	manager := &StateManager{replicaSet: r}
+
+	// each listener gets the mode of its port
+	var proxies []*Proxy
+	for _, port := range ports {
+		r.PortStart, r.PortEnd = port, port
+		p, err := manager.generateProxies("127.0.0.1:27017")
+		ensure.Nil(t, err)
+		defer p[0].ClientListener.Close()
+		proxies = append(proxies, p...)
+	}
+	ensure.DeepEqual(t, proxies[0].PoolingMode, SessionPooling)
+	ensure.DeepEqual(t, proxies[1].PoolingMode, TransactionPooling)
+}
@@ -1,6 +1,7 @@
 package dvara
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -42,6 +43,8 @@ func (c OpCode) String() string {
 		return "DELETE"
 	case OpKillCursors:
 		return "KILL_CURSORS"
+	case OpMsg:
+		return "MSG"
 	}
 }
 
@@ -68,6 +71,7 @@ const (
 	OpGetMore     = OpCode(2005)
 	OpDelete      = OpCode(2006)
 	OpKillCursors = OpCode(2007)
+	OpMsg         = OpCode(2013)
 )
 
 // messageHeader is the mongo MessageHeader
@@ -86,11 +90,16 @@ type messageHeader struct {
 func (m messageHeader) ToWire() []byte {
 	var d [headerLen]byte
 	b := d[:]
+	m.encode(b)
+	return b
+}
+
+// encode writes the messageHeader in the wire protocol to the start of b.
+func (m *messageHeader) encode(b []byte) {
 	setInt32(b, 0, m.MessageLength)
 	setInt32(b, 4, m.RequestID)
 	setInt32(b, 8, m.ResponseTo)
 	setInt32(b, 12, int32(m.OpCode))
-	return b
 }
 
 // FromWire reads the wirebytes into this object
@@ -102,15 +111,7 @@ func (m *messageHeader) FromWire(b []byte) {
 }
 
 func (m *messageHeader) WriteTo(w io.Writer) error {
-	b := m.ToWire()
-	n, err := w.Write(b)
-	if err != nil {
-		return err
-	}
-	if n != len(b) {
-		return errWrite
-	}
-	return nil
+	return writeAll(w, m.ToWire())
 }
 
 // String returns a string representation of the message header. Useful for debugging.
@@ -138,15 +139,250 @@ func readHeader(r io.Reader) (*messageHeader, error) {
 
 // copyMessage copies reads & writes an entire message.
 func copyMessage(w io.Writer, r io.Reader) error {
-	h, err := readHeader(r)
-	if err != nil {
+	bp := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(bp)
+	buf := *bp
+	if _, err := io.ReadFull(r, buf[:headerLen]); err != nil {
 		return err
 	}
-	if err := h.WriteTo(w); err != nil {
+	if err := writeAll(w, buf[:headerLen]); err != nil {
 		return err
 	}
-	_, err = io.CopyN(w, r, int64(h.MessageLength-headerLen))
-	return err
+	return copyBuffer(w, r, int64(getInt32(buf, 0)-headerLen), buf)
+}
+
+// readMessage reads an entire message, including the header.
+func readMessage(r io.Reader) ([]byte, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return readMessageBody(h, r)
+}
+
+// readMessageBody reads the rest of the message with the given header, and
+// returns the entire message.
+func readMessageBody(h *messageHeader, r io.Reader) ([]byte, error) {
+	if h.MessageLength < headerLen {
+		return nil, fmt.Errorf("invalid message length %d", h.MessageLength)
+	}
+	msg := make([]byte, h.MessageLength)
+	copy(msg, h.ToWire())
+	if _, err := io.ReadFull(r, msg[headerLen:]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// replyInfo holds the interesting parts of a proxied reply.
+type replyInfo struct {
+	MessageLength  int32
+	ResponseFlags  int32
+	CursorID       int64
+	NumberReturned int32
+
+	// Doc is the single reply document, only available when it was inspected.
+	Doc *replyDoc
+}
+
+// replyDoc holds the interesting fields of a command reply document.
+type replyDoc struct {
+	Ok     interface{}  `bson:"ok"`
+	Code   int32        `bson:"code"`
+	ErrMsg string       `bson:"errmsg"`
+	Cursor *replyCursor `bson:"cursor"`
+}
+
+// replyCursor holds the cursor of a command reply document.
+type replyCursor struct {
+	ID int64  `bson:"id"`
+	NS string `bson:"ns"`
+}
+
+// replyQueryFailure is set in the ResponseFlags of an OpReply when the query
+// failed.
+const replyQueryFailure = 1 << 1
+
+// Failed returns true if the server flagged the reply as a query failure, or
+// the inspected command reply is not ok.
+func (r *replyInfo) Failed() bool {
+	if r.ResponseFlags&replyQueryFailure != 0 {
+		return true
+	}
+	return r.Doc != nil && r.Doc.Ok != nil && !isOk(r.Doc.Ok)
+}
+
+// isOk interprets the "ok" field of a command reply.
+func isOk(v interface{}) bool {
+	switch ok := v.(type) {
+	case bool:
+		return ok
+	case int:
+		return ok == 1
+	case int32:
+		return ok == 1
+	case int64:
+		return ok == 1
+	case float64:
+		return ok == 1
+	}
+	return false
+}
+
+// copyReply works like copyMessage, additionally returning the fixed fields of
+// an OpReply. For other op codes only the MessageLength is filled in. If
+// inspect is true and the reply consists of a single document, it is also
+// unmarshalled into the returned replyInfo.
+func copyReply(w io.Writer, r io.Reader, inspect bool) (*replyInfo, error) {
+	return new(replyBuffer).copy(w, r, inspect)
+}
+
+// replyBuffer holds the fixed fields of a reply being copied, so that replies
+// are copied without allocating.
+type replyBuffer struct {
+	header [headerLen]byte
+	prefix replyPrefix
+	info   replyInfo
+}
+
+// copy works like copyReply, the returned replyInfo being the buffer's.
+func (b *replyBuffer) copy(w io.Writer, r io.Reader, inspect bool) (*replyInfo, error) {
+	if _, err := io.ReadFull(r, b.header[:]); err != nil {
+		return nil, err
+	}
+	var h messageHeader
+	h.FromWire(b.header[:])
+	if err := writeAll(w, b.header[:]); err != nil {
+		return nil, err
+	}
+
+	b.info = replyInfo{MessageLength: h.MessageLength}
+	info := &b.info
+	rest := int64(h.MessageLength - headerLen)
+	if h.OpCode == OpReply && rest >= int64(len(replyPrefix{})) {
+		prefix := b.prefix[:]
+		if _, err := io.ReadFull(r, prefix); err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(prefix); err != nil {
+			return nil, err
+		}
+		info.ResponseFlags = getInt32(prefix, 0)
+		info.CursorID = getInt64(prefix, 4)
+		info.NumberReturned = getInt32(prefix, 16)
+		rest -= int64(len(prefix))
+
+		if inspect && info.NumberReturned == 1 {
+			doc, err := readDocument(r)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := w.Write(doc); err != nil {
+				return nil, err
+			}
+			rest -= int64(len(doc))
+
+			// The reply was proxied as is, failing to understand it is not an
+			// error.
+			var d replyDoc
+			if bson.Unmarshal(doc, &d) == nil {
+				info.Doc = &d
+			}
+		}
+	}
+
+	return info, copyN(w, r, rest)
+}
+
+// OpMsg flags telling the message ends with a checksum, and that no reply is
+// expected.
+const (
+	opMsgChecksumPresent = 1 << 0
+	opMsgMoreToCome      = 1 << 1
+)
+
+// opMsgBody returns the body document, the section of kind 0, of an entire
+// OpMsg message. It returns nil if there is none.
+func opMsgBody(msg []byte) []byte {
+	if len(msg) < headerLen+4 {
+		return nil
+	}
+	// Flags followed by sections, each starting with its kind and size.
+	for rest := msg[headerLen+4:]; len(rest) > 5; {
+		kind := rest[0]
+		size := int(getInt32(rest, 1))
+		if size < 5 || size+1 > len(rest) {
+			return nil
+		}
+		if kind == 0 {
+			return rest[1 : 1+size]
+		}
+		rest = rest[1+size:]
+	}
+	return nil
+}
+
+// expectsReply returns true if the server will reply to the entire request
+// message.
+func expectsReply(msg []byte) bool {
+	switch op := OpCode(getInt32(msg, 12)); op {
+	case OpMsg:
+		return len(msg) >= headerLen+4 && getInt32(msg, headerLen)&opMsgMoreToCome == 0
+	default:
+		return op.HasResponse()
+	}
+}
+
+// isCommandRequest returns true if the entire request message is a command.
+func isCommandRequest(msg []byte) bool {
+	switch OpCode(getInt32(msg, 12)) {
+	case OpMsg:
+		return true
+	case OpQuery:
+		if len(msg) < headerLen+4 {
+			return false
+		}
+		ns := msg[headerLen+4:]
+		if i := bytes.IndexByte(ns, x00); i >= 0 {
+			return bytes.HasSuffix(ns[:i+1], cmdCollectionSuffix)
+		}
+	}
+	return false
+}
+
+// replyFailed returns true if the entire reply message indicates the request
+// failed. Commands report failures in their "ok" field, so whether the reply
+// is for a command is needed to interpret them.
+func replyFailed(command bool, reply []byte) bool {
+	if len(reply) < headerLen {
+		return true
+	}
+	var doc []byte
+	switch OpCode(getInt32(reply, 12)) {
+	case OpReply:
+		if len(reply) < headerLen+len(replyPrefix{}) {
+			return true
+		}
+		if getInt32(reply, headerLen)&replyQueryFailure != 0 {
+			return true
+		}
+		if getInt32(reply, headerLen+16) > 0 {
+			doc = reply[headerLen+len(replyPrefix{}):]
+		}
+	case OpMsg:
+		doc = opMsgBody(reply)
+	}
+	if doc == nil || !command {
+		return false
+	}
+	if len(doc) < 5 || int(getInt32(doc, 0)) > len(doc) {
+		return true
+	}
+	var d replyDoc
+	if err := bson.Unmarshal(doc[:getInt32(doc, 0)], &d); err != nil {
+		return true
+	}
+	return d.Ok != nil && !isOk(d.Ok)
 }
 
 // readDocument read an entire BSON document. This document can be used with
@@ -170,14 +406,18 @@ const x00 = byte(0)
 // readCString reads a null turminated string as defined by BSON from the
 // reader. Note, the return value includes the trailing null byte.
 func readCString(r io.Reader) ([]byte, error) {
-	var b []byte
-	var n [1]byte
+	return appendCString(nil, r)
+}
+
+// appendCString reads a null terminated string like readCString, appending
+// it to b.
+func appendCString(b []byte, r io.Reader) ([]byte, error) {
 	for {
-		if _, err := io.ReadFull(r, n[:]); err != nil {
+		b = append(b, x00)
+		if _, err := io.ReadFull(r, b[len(b)-1:]); err != nil {
 			return nil, err
 		}
-		b = append(b, n[0])
-		if n[0] == x00 {
+		if b[len(b)-1] == x00 {
 			return b, nil
 		}
 	}
@@ -214,6 +454,10 @@ func addInt32(b []byte, i int32) []byte {
 	return append(b, byte(i), byte(i>>8), byte(i>>16), byte(i>>24))
 }
 
+func addInt64(b []byte, i int64) []byte {
+	return addInt32(addInt32(b, int32(i)), int32(i>>32))
+}
+
 func addCString(b []byte, s string) []byte {
 	b = append(b, []byte(s)...)
 	b = append(b, 0)
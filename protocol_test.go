@@ -5,6 +5,9 @@ import (
 	"errors"
 	"io"
 	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
 )
 
 type testReader struct {
@@ -35,6 +38,7 @@ func TestOpStrings(t *testing.T) {
 		{OpGetMore, "GET_MORE"},
 		{OpDelete, "DELETE"},
 		{OpKillCursors, "KILL_CURSORS"},
+		{OpMsg, "MSG"},
 	}
 	for _, c := range cases {
 		if c.OpCode.String() != c.String {
@@ -169,3 +173,33 @@ func TestReadCString(t *testing.T) {
 		}
 	}
 }
+
+func TestCopyReplyInspect(t *testing.T) {
+	t.Parallel()
+	var reply bytes.Buffer
+	_, err := reply.ReadFrom(fakeSingleDocReply(bson.M{"ok": 0, "errmsg": "boom", "code": 11000}))
+	ensure.Nil(t, err)
+	raw := append([]byte(nil), reply.Bytes()...)
+
+	var w bytes.Buffer
+	info, err := copyReply(&w, &reply, true)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, w.Bytes(), raw)
+	ensure.DeepEqual(t, info.MessageLength, int32(len(raw)))
+	ensure.DeepEqual(t, info.NumberReturned, int32(1))
+	ensure.DeepEqual(t, info.Doc.ErrMsg, "boom")
+	ensure.True(t, info.Failed())
+}
+
+func TestCopyReplyNotInspected(t *testing.T) {
+	t.Parallel()
+	var reply bytes.Buffer
+	_, err := reply.ReadFrom(fakeSingleDocReply(bson.M{"ok": 0}))
+	ensure.Nil(t, err)
+
+	var w bytes.Buffer
+	info, err := copyReply(&w, &reply, false)
+	ensure.Nil(t, err)
+	ensure.True(t, info.Doc == nil)
+	ensure.False(t, info.Failed())
+}
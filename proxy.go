@@ -1,6 +1,7 @@
 package dvara
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -8,10 +9,12 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/facebookgo/stats"
 	corelog "github.com/intercom/gocore/log"
+	"gopkg.in/mgo.v2/bson"
 )
 
 const headerLen = 16
@@ -25,20 +28,39 @@ var (
 	timeInPast = time.Now()
 )
 
+// serverPingTimeout is the time allowed for pinging an idle server connection.
+const serverPingTimeout = 5 * time.Second
+
+// Rejected clients have rejectTimeout to send the first message, which is
+// failed with the reason they're rejected. At most maxRejecting of them wait
+// at once, others are disconnected right away.
+const (
+	rejectTimeout = time.Second
+	maxRejecting  = 100
+)
+
 // Proxy sends stuff from clients to mongo servers.
 type Proxy struct {
 	ReplicaSet     *ReplicaSet
-	ClientListener net.Listener // Listener for incoming client connections
-	Username       string       // Mongo user, if mongo uses auth
-	Password       string       // Mongo password, if mongo uses auth
-	ProxyAddr      string       // Address for incoming client connections
-	MongoAddr      string       // Address for destination Mongo server
+	ClientListener net.Listener       // Listener for incoming client connections
+	Credentials    CredentialProvider // Mongo credentials, if mongo uses auth
+	ProxyAddr      string             // Address for incoming client connections
+	MongoAddr      string             // Address for destination Mongo server
+	PoolingMode    PoolingMode        // How long clients keep a server connection
 
 	wg                      sync.WaitGroup
-	closed                  chan struct{}
+	clients                 clientRegistry
+	ctx                     context.Context
+	cancel                  context.CancelFunc
 	serverPool              Pool
+	userPools               userPools
 	stats                   stats.Client
 	maxPerClientConnections *maxPerClientConnections
+	mirror                  *Mirror
+	limiter                 *AdaptiveLimiter
+	acceptLimiter           *acceptLimiter
+	dials                   chan struct{}
+	opKiller                *opKiller
 }
 
 // String representation for debugging.
@@ -54,15 +76,38 @@ func (p *Proxy) Start() error {
 	if p.ReplicaSet.MaxPerClientConnections == 0 {
 		return errZeroMaxPerClientConnections
 	}
+	if p.PoolingMode == "" {
+		p.PoolingMode = TransactionPooling
+	}
+	if _, err := ParsePoolingMode(string(p.PoolingMode)); err != nil {
+		return err
+	}
 
-	p.closed = make(chan struct{})
+	p.ctx, p.cancel = context.WithCancel(context.Background())
 	p.maxPerClientConnections = newMaxPerClientConnections(p.ReplicaSet.MaxPerClientConnections)
+	if p.ReplicaSet.ClientAcceptRate > 0 {
+		p.acceptLimiter = newAcceptLimiter(p.ReplicaSet.ClientAcceptRate, p.ReplicaSet.ClientAcceptBurst)
+	}
+	if p.ReplicaSet.MaxConcurrentDials > 0 {
+		p.dials = make(chan struct{}, p.ReplicaSet.MaxConcurrentDials)
+	}
 	p.serverPool = Pool{
 		New:               p.newServerConn,
 		CloseErrorHandler: p.serverCloseErrorHandler,
 		Max:               p.ReplicaSet.MaxConnections,
 		MinIdle:           p.ReplicaSet.MinIdleConnections,
 		IdleTimeout:       p.ReplicaSet.ServerIdleTimeout,
+		MaxWait:           p.ReplicaSet.ServerPoolMaxWait,
+		MaxWaiting:        p.ReplicaSet.ServerPoolMaxWaiting,
+		Fair:              p.ReplicaSet.FairQueuing,
+		ClassWeights:      p.ReplicaSet.ClassWeights,
+		Reserved:          p.ReplicaSet.ReservedConnections,
+		ReservedClass:     SystemClass,
+		MaxLifetime:       p.ReplicaSet.ServerMaxLifetime,
+		LifetimeJitter:    p.ReplicaSet.ServerLifetimeJitter,
+		Validate:          p.pingServerConn,
+		ValidateIdle:      p.ReplicaSet.ServerValidateIdle,
+		ValidateInterval:  p.ReplicaSet.ServerValidateInterval,
 		ClosePoolSize:     p.ReplicaSet.ServerClosePoolSize,
 	}
 
@@ -78,6 +123,41 @@ func (p *Proxy) Start() error {
 		)
 	}
 
+	if p.ReplicaSet.AdaptiveLatencyTarget > 0 {
+		p.limiter = &AdaptiveLimiter{
+			Min:     p.ReplicaSet.AdaptiveMinConnections,
+			Max:     p.ReplicaSet.MaxConnections,
+			Target:  p.ReplicaSet.AdaptiveLatencyTarget,
+			Backoff: p.ReplicaSet.AdaptiveBackoff,
+			Stats:   p.serverPool.Stats,
+			Changed: p.serverPool.LimitChanged,
+		}
+		p.serverPool.Limiter = p.limiter
+	}
+
+	// share the process wide budget with the other members
+	p.ReplicaSet.ConnectionBudget.Join(p.MongoAddr, &p.serverPool)
+
+	// and the limits of the pool with the user pools
+	p.userPools.share(&p.serverPool)
+	go p.manageUserPools()
+
+	// rotated credentials replace the server connections
+	p.ReplicaSet.CredentialWatcher.Join(&p.serverPool)
+
+	if p.ReplicaSet.CancelAbandonedOps {
+		p.opKiller = &opKiller{dial: p.newControlConn, stats: p.stats}
+		p.opKiller.start()
+	}
+
+	if p.serverPool.MinIdle > 0 {
+		p.serverPool.Prewarm()
+	}
+
+	if p.mirror = p.newMirror(); p.mirror != nil {
+		p.mirror.Start()
+	}
+
 	go p.clientAcceptLoop()
 
 	return nil
@@ -92,19 +172,39 @@ func (p *Proxy) stop(hard bool) error {
 	if err := p.ClientListener.Close(); err != nil {
 		return err
 	}
-	close(p.closed)
+	// clients waiting for their next message or a server connection give up
+	p.clients.stop()
+	p.cancel()
 	if !hard {
 		p.wg.Wait()
 	}
 	p.serverPool.Close()
+	p.userPools.close()
+	p.ReplicaSet.ConnectionBudget.Leave(p.MongoAddr, &p.serverPool)
+	p.ReplicaSet.CredentialWatcher.Leave(&p.serverPool)
+	if p.mirror != nil {
+		p.mirror.Stop()
+	}
+	if p.opKiller != nil {
+		p.opKiller.Stop()
+	}
 	return nil
 }
 
+// AuthConn authenticates the connection with the current credentials, if mongo
+// uses auth.
 func (p *Proxy) AuthConn(conn net.Conn) error {
+	if p.Credentials == nil {
+		return nil
+	}
+	creds, err := p.Credentials.Credentials()
+	if err != nil || creds.Username == "" {
+		return err
+	}
 	socket := &mongoSocket{
 		conn: conn,
 	}
-	err := socket.Login(Credential{Username: p.Username, Password: p.Password, Source: "admin"})
+	err = socket.Login(Credential{Username: creds.Username, Password: creds.Password, Source: "admin"})
 	if err != nil {
 		return err
 	}
@@ -115,17 +215,31 @@ func (p *Proxy) AuthConn(conn net.Conn) error {
 // each time. This means we'll a total of 12.75 seconds with the last wait
 // being 6.4 seconds.
 func (p *Proxy) newServerConn() (io.Closer, error) {
+	return p.dialServerConn(nil, p.newControlConn)
+}
+
+// dialServerConn opens a new connection of the given user pool, nil for the
+// proxy's own, with dial and the retries of newServerConn.
+func (p *Proxy) dialServerConn(pool *userPool, dial func() (net.Conn, error)) (io.Closer, error) {
 	retrySleep := 50 * time.Millisecond
 	for retryCount := 7; retryCount > 0; retryCount-- {
-		c, err := net.DialTimeout("tcp", p.MongoAddr, time.Second)
+		if err := p.acquireDial(); err != nil {
+			return nil, err
+		}
+		c, err := dial()
+		p.releaseDial()
 		if err == nil {
-			if len(p.Username) == 0 {
+			if p.opKiller == nil && pool == nil {
 				return c, nil
 			}
-			err = p.AuthConn(c)
-			if err == nil {
-				return c, nil
+			pc := &pooledConn{Conn: c, pool: pool}
+			if p.opKiller == nil {
+				return pc, nil
+			}
+			if pc.connectionID, err = handshakeConnectionID(c); err == nil {
+				return pc, nil
 			}
+			c.Close()
 		}
 		corelog.LogError("error", err)
 
@@ -135,35 +249,181 @@ func (p *Proxy) newServerConn() (io.Closer, error) {
 	return nil, fmt.Errorf("could not connect to %s", p.MongoAddr)
 }
 
-// getServerConn gets a server connection from the pool.
-func (p *Proxy) getServerConn() (net.Conn, error) {
-	c, err := p.serverPool.Acquire()
+// newControlConn opens a single, authenticated, connection to the server.
+func (p *Proxy) newControlConn() (net.Conn, error) {
+	c, err := net.DialTimeout("tcp", p.MongoAddr, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.AuthConn(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// pingServerConn checks an idle server connection is still usable.
+func (p *Proxy) pingServerConn(c io.Closer) error {
+	conn := c.(net.Conn)
+	conn.SetDeadline(time.Now().Add(serverPingTimeout))
+	return runCommand(conn, "admin", bson.D{{Name: "ping", Value: 1}}, nil)
+}
+
+// getServerConn gets a server connection from the client's pool, see
+// clientPool, scheduled as identified by the context.
+func (p *Proxy) getServerConn(ctx context.Context, client *proxyClient) (net.Conn, error) {
+	pool, err := p.clientPool(client)
+	if err != nil {
+		return nil, err
+	}
+	// dvara's own clients are only known once they connected, which they did
+	// by the time they sent a message
+	if p.ReplicaSet.isSystemClient(client.conn.RemoteAddr()) {
+		ctx = withSystemClient(ctx)
+	}
+	c, err := pool.AcquireContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 	return c.(net.Conn), nil
 }
 
+// observeLatency feeds the adaptive limiter with the outcome of a message.
+// Only timeouts count as failures, other errors are usually the client's.
+// Streamed messages are ignored as they may legitimately take long.
+func (p *Proxy) observeLatency(start time.Time, streamed bool, err error) {
+	if p.limiter == nil || streamed {
+		return
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		p.limiter.Observe(time.Since(start), false)
+		return
+	}
+	if err == nil {
+		p.limiter.Observe(time.Since(start), true)
+	}
+}
+
 func (p *Proxy) serverCloseErrorHandler(err error) {
 	corelog.LogError("error", err)
 }
 
+// serverConnError returns the error replied to clients when we fail to get a
+// server connection.
+func (p *Proxy) serverConnError(err error) *ProxyError {
+	switch err {
+	case errPoolClosed, context.Canceled:
+		return newProxyError(codeShutdownInProgress,
+			"dvara: proxy for member %s is shutting down", p.MongoAddr)
+	case errPoolTimeout, errPoolFull:
+		return newProxyError(codeExceededTimeLimit,
+			"dvara: server pool exhausted for member %s: %s", p.MongoAddr, err)
+	}
+	return newProxyError(codeHostUnreachable,
+		"dvara: could not connect to member %s: %s", p.MongoAddr, err)
+}
+
+// rejectMessage reads the rest of the message with the given header and fails
+// it with the given error. Messages without a reply will have the error
+// returned by the following getLastError call instead.
+func (p *Proxy) rejectMessage(
+	h *messageHeader,
+	c *proxyClient,
+	lastError *LastError,
+	e *ProxyError,
+) error {
+	stats.BumpSum(p.stats, "message.rejected", 1)
+	c.conn.SetDeadline(time.Now().Add(p.ReplicaSet.MessageTimeout))
+	msg, err := c.request.read(h, c.conn)
+	if err != nil {
+		return err
+	}
+	reply := errorReply(msg, e)
+	if reply == nil {
+		lastError.Set(e)
+		return nil
+	}
+	_, err = c.conn.Write(reply)
+	return err
+}
+
+// rejectClient fails the first message of a client we won't serve with the
+// given error and closes the connection. Drivers then surface the error
+// instead of a closed connection. Slow clients are not waited for, nor are
+// any past maxRejecting, so rejected clients don't pin connections.
+func (p *Proxy) rejectClient(c net.Conn, e *ProxyError) {
+	defer c.Close()
+	if atomic.AddInt32(&p.ReplicaSet.rejecting, 1) > maxRejecting {
+		atomic.AddInt32(&p.ReplicaSet.rejecting, -1)
+		stats.BumpSum(p.stats, "client.rejected.closed", 1)
+		return
+	}
+	defer atomic.AddInt32(&p.ReplicaSet.rejecting, -1)
+
+	pc := p.clients.add(c)
+	defer p.clients.remove(pc)
+	h, err := p.clientReadHeader(pc, rejectTimeout)
+	if err != nil {
+		return
+	}
+	stats.BumpSum(p.stats, "message.rejected", 1)
+	c.SetDeadline(time.Now().Add(rejectTimeout))
+	msg, err := pc.request.read(h, c)
+	if err != nil {
+		return
+	}
+	// Messages without a reply are rejected by closing the connection.
+	if reply := errorReply(msg, e); reply != nil {
+		if _, err := c.Write(reply); err != nil {
+			corelog.LogError("error", err)
+		}
+	}
+}
+
 // proxyMessage proxies a message, possibly it's response, and possibly a
 // follow up call.
 func (p *Proxy) proxyMessage(
 	h *messageHeader,
-	client net.Conn,
+	c *proxyClient,
 	server net.Conn,
 	lastError *LastError,
-) error {
+) (err error) {
+	client, cursors, stream := c.conn, c.cursors, &c.stream
 	deadline := time.Now().Add(p.ReplicaSet.MessageTimeout)
 	server.SetDeadline(deadline)
 	client.SetDeadline(deadline)
+	stream.begin(client, server, p.ReplicaSet.MessageTimeout)
+
+	// Clients with too many open cursors can't open more.
+	if cursors.Full() && h.OpCode == OpQuery {
+		if rejected, err := p.rejectCursor(h, c); rejected || err != nil {
+			return err
+		}
+	}
+
+	// Reads are buffered to be retried if the server connection fails, unless
+	// the client has a session the new connection wouldn't have.
+	rw, err := c.request.request(h, client, p.ReplicaSet.RetryReads && p.PoolingMode != SessionPooling)
+	if err != nil {
+		return err
+	}
+
+	// Sampled messages are recorded as they're proxied and then mirrored.
+	if p.mirror != nil {
+		if tap := p.mirror.tap(h); tap != nil {
+			rw = tap.wrap(rw)
+			defer func() {
+				if err == nil {
+					p.mirror.send(tap)
+				}
+			}()
+		}
+	}
 
 	// OpQuery may need to be transformed and need special handling in order to
 	// make the proxy transparent.
 	if h.OpCode == OpQuery {
-		return p.ReplicaSet.ProxyQuery.Proxy(h, client, server, lastError)
+		return p.ReplicaSet.ProxyQuery.Proxy(h, rw, server, lastError, cursors, stream, c.driver)
 	}
 
 	// Anything besides a getlasterror call (which requires an OpQuery) resets
@@ -173,20 +433,25 @@ func (p *Proxy) proxyMessage(
 		lastError.Reset()
 	}
 
-	// For other Ops we proxy the header & raw body over.
-	if err := h.WriteTo(server); err != nil {
-		corelog.LogError("error", err)
-		return err
+	// Tracked and awaitData cursors are iterated and killed with their own Ops.
+	if cursors != nil || len(stream.awaitData) > 0 {
+		switch h.OpCode {
+		case OpGetMore:
+			return proxyGetMore(h, rw, server, cursors, stream)
+		case OpKillCursors:
+			return proxyKillCursors(h, rw, server, cursors, stream)
+		}
 	}
 
-	if _, err := io.CopyN(server, client, int64(h.MessageLength-headerLen)); err != nil {
+	// For other Ops we proxy the header & raw body over.
+	if err := copyRequest(h, server, rw); err != nil {
 		corelog.LogError("error", err)
 		return err
 	}
 
 	// For Ops with responses we proxy the raw response message over.
 	if h.OpCode.HasResponse() {
-		if err := copyMessage(client, server); err != nil {
+		if err := copyMessage(rw, server); err != nil {
 			corelog.LogError("error", err)
 			return err
 		}
@@ -196,9 +461,12 @@ func (p *Proxy) proxyMessage(
 }
 
 // clientAcceptLoop accepts new clients and creates a clientServeLoop for each
-// new client that connects to the proxy.
+// new client that connects to the proxy, no faster than the accept rate.
 func (p *Proxy) clientAcceptLoop() {
 	for {
+		if p.acceptLimiter != nil && !p.throttleAccept() {
+			break
+		}
 		p.wg.Add(1)
 		c, err := p.ClientListener.Accept()
 		if err != nil {
@@ -216,36 +484,89 @@ func (p *Proxy) clientAcceptLoop() {
 // clientServeLoop loops on a single client connected to the proxy and
 // dispatches its requests.
 func (p *Proxy) clientServeLoop(c net.Conn) {
-	remoteIP := c.RemoteAddr().(*net.TCPAddr).IP.String()
+	// load balancers convey the client address with the PROXY protocol
+	conn, err := p.ReplicaSet.readProxyProtocol(c)
+	if err != nil {
+		defer p.wg.Done()
+		stats.BumpSum(p.stats, "client.rejected.proxy_protocol", 1)
+		corelog.LogErrorMessage(fmt.Sprintf("rejecting client connection from %s: %s", c.RemoteAddr(), err))
+		if err := c.Close(); err != nil {
+			corelog.LogError("error", err)
+		}
+		return
+	}
+	c = conn
+	ip := c.RemoteAddr().(*net.TCPAddr).IP
+	remoteIP := ip.String()
+
+	// enforce the client network rules
+	rule := p.ReplicaSet.clientRule(ip)
+	if rule != nil && rule.Deny {
+		defer p.wg.Done()
+		stats.BumpSum(p.stats, "client.rejected.rule."+rule.Name+".denied", 1)
+		corelog.LogErrorMessage(fmt.Sprintf("rejecting client connection denied by rule %s: %s", rule.Name, remoteIP))
+		p.rejectClient(c, newProxyError(codeUnauthorized,
+			"dvara: connections from %s are denied by rule %s", remoteIP, rule.Name))
+		return
+	}
 
 	// enforce per-client max connection limit
-	if p.maxPerClientConnections.inc(remoteIP) {
-		c.Close()
+	if full := p.maxPerClientConnections.inc(remoteIP, rule); full != connectionsAvailable {
+		defer p.wg.Done()
+		if full == ruleConnectionsFull {
+			stats.BumpSum(p.stats, "client.rejected.rule."+rule.Name+".max.connections", 1)
+			corelog.LogErrorMessage(fmt.Sprintf("rejecting client connection due to max connections limit of rule %s: %s", rule.Name, remoteIP))
+			p.rejectClient(c, newProxyError(codeOperationFailed,
+				"dvara: too many connections from the clients of rule %s to member %s", rule.Name, p.MongoAddr))
+			return
+		}
 		stats.BumpSum(p.stats, "client.rejected.max.connections", 1)
+		if rule != nil {
+			stats.BumpSum(p.stats, "client.rejected.rule."+rule.Name+".max.per.client", 1)
+		}
 		corelog.LogErrorMessage(fmt.Sprintf("rejecting client connection due to max connections limit: %s", remoteIP))
+		p.rejectClient(c, newProxyError(codeOperationFailed,
+			"dvara: too many connections from %s to member %s", remoteIP, p.MongoAddr))
 		return
 	}
 
 	// turn on TCP keep-alive and set it to the recommended period of 2 minutes
 	// http://docs.mongodb.org/manual/faq/diagnostics/#faq-keepalive
-	if conn, ok := c.(*net.TCPConn); ok {
+	if conn := tcpConn(c); conn != nil {
 		conn.SetKeepAlivePeriod(2 * time.Minute)
 		conn.SetKeepAlive(true)
 	}
 
 	c = teeIf(fmt.Sprintf("client %s <=> %s", c.RemoteAddr(), p), c)
+	c = p.ReplicaSet.Capture.Wrap(c)
 	stats.BumpSum(p.stats, "client.connected", 1)
+	pc := p.clients.add(c)
+	pc.cursors = p.ReplicaSet.CursorTracker.NewClient(p.MongoAddr, c.RemoteAddr().String())
+	pc.stream.AwaitDataTimeout = p.ReplicaSet.AwaitDataTimeout
+	pc.stream.ExhaustTimeout = p.ReplicaSet.ExhaustReplyTimeout
 	defer func() {
+		p.clients.remove(pc)
+		p.clientLeft(pc)
 		p.wg.Done()
 		if err := c.Close(); err != nil {
 			corelog.LogError("error", err)
 		}
-		p.maxPerClientConnections.dec(remoteIP)
+		p.maxPerClientConnections.dec(remoteIP, rule)
 	}()
 
+	// clients are scheduled by IP when waiting for a server connection
+	ctx := WithPoolClient(p.ctx, remoteIP, p.ReplicaSet.clientClass(ip))
+
+	if p.PoolingMode == SessionPooling {
+		p.serveSession(ctx, pc)
+		return
+	}
+
+	defer p.killOrphanCursors(pc, nil)
+
 	var lastError LastError
 	for {
-		h, err := p.idleClientReadHeader(c)
+		h, err := p.idleClientReadHeader(pc)
 		if err != nil {
 			if err != errNormalClose {
 				corelog.LogError("error", err)
@@ -253,25 +574,35 @@ func (p *Proxy) clientServeLoop(c net.Conn) {
 			return
 		}
 
+		// Messages answered by the proxy itself never reach the pool.
+		if ok, err := p.admitMessage(h, pc, &lastError); !ok {
+			if err != nil {
+				corelog.LogError("error", err)
+				return
+			}
+			continue
+		}
+
 		mpt := stats.BumpTime(p.stats, "message.proxy.time")
-		serverConn, err := p.getServerConn()
+		serverConn, err := p.getServerConn(ctx, pc)
 		if err != nil {
-			if err != errNormalClose {
-				corelog.LogError("error", err)
+			if p.serverConnFailed(h, pc, &lastError, err) {
+				continue
 			}
 			return
 		}
 
 		scht := stats.BumpTime(p.stats, "server.conn.held.time")
 		for {
-			err := p.proxyMessage(h, c, serverConn, &lastError)
-			if err != nil {
-				p.serverPool.Discard(serverConn)
-				corelog.LogErrorMessage(fmt.Sprintf("Proxy message failed %s ", err))
-				stats.BumpSum(p.stats, "message.proxy.error", 1)
-				if ne, ok := err.(net.Error); ok && ne.Timeout() {
-					stats.BumpSum(p.stats, "message.proxy.timeout", 1)
+			start := time.Now()
+			err := p.proxyMessage(h, pc, serverConn, &lastError)
+			p.observeLatency(start, pc.stream.Streamed(), err)
+			if err != nil && pc.request.canRetry(err) {
+				if serverConn = p.retryMessage(ctx, h, pc, serverConn, &lastError, err); serverConn == nil {
+					return
 				}
+			} else if err != nil {
+				p.proxyMessageFailed(serverConn, err)
 				return
 			}
 
@@ -287,7 +618,7 @@ func (p *Proxy) clientServeLoop(c net.Conn) {
 			// call which expects this behavior.
 
 			stats.BumpSum(p.stats, "message.with.mutation", 1)
-			h, err = p.gleClientReadHeader(c)
+			h, err = p.gleClientReadHeader(pc)
 			if err != nil {
 				// Client did not make _any_ query within the GetLastErrorTimeout.
 				// Return the server to the pool and wait go back to outer loop.
@@ -300,23 +631,151 @@ func (p *Proxy) clientServeLoop(c net.Conn) {
 				}
 				// We need to return our server to the pool (it's still good as far
 				// as we know).
-				p.serverPool.Release(serverConn)
+				p.releaseServerConn(serverConn)
 				return
 			}
+			if ok, err := p.admitMessage(h, pc, &lastError); !ok {
+				if err != nil {
+					corelog.LogError("error", err)
+					p.releaseServerConn(serverConn)
+					return
+				}
+				break
+			}
 
 			// Successfully read message when waiting for the getLastError call.
 			mpt = stats.BumpTime(p.stats, "message.proxy.time")
 		}
-		p.serverPool.Release(serverConn)
+		p.releaseServerConn(serverConn)
 		scht.End()
 		stats.BumpSum(p.stats, "message.proxy.success", 1)
 	}
 }
 
-// We wait for upto ClientIdleTimeout in MessageTimeout increments and keep
-// checking if we're waiting to be closed. This ensures that at worse we
-// wait for MessageTimeout when closing even when we're idling.
-func (p *Proxy) idleClientReadHeader(c net.Conn) (*messageHeader, error) {
+// serveSession loops on a single client in session pooling mode. The client
+// gets a server connection with its first message and keeps it until it
+// disconnects.
+func (p *Proxy) serveSession(ctx context.Context, c *proxyClient) {
+	var lastError LastError
+	var serverConn net.Conn
+	var sessionTime interface {
+		End()
+	}
+	defer func() {
+		if serverConn == nil {
+			p.killOrphanCursors(c, nil)
+			return
+		}
+		p.killOrphanCursors(c, serverConn)
+		// there is no way to reset the connection scoped state the client may
+		// have left behind, so the connection isn't reused
+		p.discardServerConn(serverConn)
+		sessionTime.End()
+		stats.BumpSum(p.stats, "session.end", 1)
+	}()
+
+	for {
+		h, err := p.idleClientReadHeader(c)
+		if err != nil {
+			if err != errNormalClose {
+				corelog.LogError("error", err)
+			}
+			return
+		}
+
+		if ok, err := p.admitMessage(h, c, &lastError); !ok {
+			if err != nil {
+				corelog.LogError("error", err)
+				return
+			}
+			continue
+		}
+
+		mpt := stats.BumpTime(p.stats, "message.proxy.time")
+		if serverConn == nil {
+			conn, err := p.getServerConn(ctx, c)
+			if err != nil {
+				if p.serverConnFailed(h, c, &lastError, err) {
+					continue
+				}
+				return
+			}
+			serverConn = conn
+			sessionTime = stats.BumpTime(p.stats, "server.conn.session.time")
+			stats.BumpSum(p.stats, "session.start", 1)
+		}
+
+		start := time.Now()
+		err = p.proxyMessage(h, c, serverConn, &lastError)
+		p.observeLatency(start, c.stream.Streamed(), err)
+		if err != nil {
+			// the session's state is lost with its connection, so the client
+			// is disconnected rather than retried on another one
+			p.proxyMessageFailed(serverConn, err)
+			serverConn = nil
+			return
+		}
+		mpt.End()
+		stats.BumpSum(p.stats, "message.proxy.success", 1)
+	}
+}
+
+// admitMessage returns true if the message with the given header should be
+// proxied, once the client's driver is allowed, the client is authorized, the
+// firewall allows it, it doesn't break read only mode and its rate limits
+// allow it. Other messages are answered by the proxy itself.
+func (p *Proxy) admitMessage(h *messageHeader, c *proxyClient, lastError *LastError) (bool, error) {
+	if ok, err := p.identifyClient(h, c, lastError); !ok {
+		return false, err
+	}
+	if ok, err := p.authorize(h, c, lastError); !ok {
+		return false, err
+	}
+	if ok, err := p.checkFirewall(h, c, lastError); !ok {
+		return false, err
+	}
+	if ok, err := p.checkReadOnly(h, c, lastError); !ok {
+		return false, err
+	}
+	if ok, err := p.checkRateLimit(h, c, lastError); !ok {
+		return false, err
+	}
+	p.countAppMessage(h, c)
+	return true, nil
+}
+
+// serverConnFailed fails the message with the given header after we failed to
+// get a server connection for it. It returns true if the client can go on.
+func (p *Proxy) serverConnFailed(
+	h *messageHeader,
+	c *proxyClient,
+	lastError *LastError,
+	err error,
+) bool {
+	corelog.LogError("error", err)
+	if err := p.rejectMessage(h, c, lastError, p.serverConnError(err)); err != nil {
+		corelog.LogError("error", err)
+		return false
+	}
+	return err != errPoolClosed && err != context.Canceled
+}
+
+// proxyMessageFailed throws away the server connection a message failed on.
+func (p *Proxy) proxyMessageFailed(serverConn net.Conn, err error) {
+	p.discardServerConn(serverConn)
+	if p.opKiller != nil {
+		p.opKiller.abandoned(serverConn)
+	}
+	corelog.LogErrorMessage(fmt.Sprintf("Proxy message failed %s ", err))
+	stats.BumpSum(p.stats, "message.proxy.error", 1)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		stats.BumpSum(p.stats, "message.proxy.timeout", 1)
+	}
+}
+
+// We wait for upto ClientIdleTimeout for the next message. Closing the proxy
+// interrupts the wait so we don't hold up closing even when we're idling.
+func (p *Proxy) idleClientReadHeader(c *proxyClient) (*messageHeader, error) {
 	h, err := p.clientReadHeader(c, p.ReplicaSet.ClientIdleTimeout)
 	if err == errClientReadTimeout {
 		stats.BumpSum(p.stats, "client.idle.timeout", 1)
@@ -324,7 +783,7 @@ func (p *Proxy) idleClientReadHeader(c net.Conn) (*messageHeader, error) {
 	return h, err
 }
 
-func (p *Proxy) gleClientReadHeader(c net.Conn) (*messageHeader, error) {
+func (p *Proxy) gleClientReadHeader(c *proxyClient) (*messageHeader, error) {
 	h, err := p.clientReadHeader(c, p.ReplicaSet.GetLastErrorTimeout)
 	if err == errClientReadTimeout {
 		stats.BumpSum(p.stats, "client.gle.timeout", 1)
@@ -332,43 +791,21 @@ func (p *Proxy) gleClientReadHeader(c net.Conn) (*messageHeader, error) {
 	return h, err
 }
 
-func (p *Proxy) clientReadHeader(c net.Conn, timeout time.Duration) (*messageHeader, error) {
-	type headerError struct {
-		header *messageHeader
-		error  error
-	}
-	resChan := make(chan headerError)
-
-	c.SetReadDeadline(time.Now().Add(timeout))
-	go func() {
-		h, err := readHeader(c)
-		resChan <- headerError{header: h, error: err}
-	}()
-
-	closed := false
-	var response headerError
-
-	select {
-	case response = <-resChan:
-		// all good
-	case <-p.closed:
-		closed = true
-		c.SetReadDeadline(timeInPast)
-		response = <-resChan
-	}
+func (p *Proxy) clientReadHeader(c *proxyClient, timeout time.Duration) (*messageHeader, error) {
+	h, closed, err := c.readHeader(timeout)
 
 	// Successfully read a header.
-	if response.error == nil {
-		return response.header, nil
+	if err == nil {
+		return h, nil
 	}
 
-	// Client side disconnected.
-	if response.error == io.EOF {
+	// Client side disconnected, or we're closing.
+	if err == io.EOF || err == errNormalClose {
 		return nil, errNormalClose
 	}
 
 	// We hit our ReadDeadline.
-	if ne, ok := response.error.(net.Error); ok && ne.Timeout() {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
 		if closed {
 			return nil, errNormalClose
 		}
@@ -377,8 +814,8 @@ func (p *Proxy) clientReadHeader(c net.Conn, timeout time.Duration) (*messageHea
 
 	// Some other unknown error.
 	stats.BumpSum(p.stats, "client.error.disconnect", 1)
-	corelog.LogError("error", response.error)
-	return nil, response.error
+	corelog.LogError("error", err)
+	return nil, err
 }
 
 var teeIfEnable = os.Getenv("MONGOPROXY_TEE") == "1"
@@ -414,31 +851,53 @@ func teeIf(context string, c net.Conn) net.Conn {
 	return c
 }
 
+// Outcomes of maxPerClientConnections.inc.
+const (
+	connectionsAvailable = iota
+	clientConnectionsFull
+	ruleConnectionsFull
+)
+
 type maxPerClientConnections struct {
-	max    uint
-	counts map[string]uint
-	mutex  sync.Mutex
+	max        uint
+	counts     map[string]uint
+	ruleCounts map[string]uint
+	mutex      sync.Mutex
 }
 
 func newMaxPerClientConnections(max uint) *maxPerClientConnections {
 	return &maxPerClientConnections{
-		max:    max,
-		counts: make(map[string]uint),
+		max:        max,
+		counts:     make(map[string]uint),
+		ruleCounts: make(map[string]uint),
 	}
 }
 
-func (m *maxPerClientConnections) inc(remoteIP string) bool {
+// inc counts a new connection of the client matching the rule, which may be
+// nil, unless it is over the limits. It returns which limit it is over if
+// any.
+func (m *maxPerClientConnections) inc(remoteIP string, rule *ClientRule) int {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
+	max := m.max
+	if rule != nil && rule.MaxPerClient > 0 {
+		max = rule.MaxPerClient
+	}
 	current := m.counts[remoteIP]
-	if current >= m.max {
-		return true
+	if current >= max {
+		return clientConnectionsFull
+	}
+	if rule != nil && rule.MaxConnections > 0 {
+		if m.ruleCounts[rule.Name] >= rule.MaxConnections {
+			return ruleConnectionsFull
+		}
+		m.ruleCounts[rule.Name]++
 	}
 	m.counts[remoteIP] = current + 1
-	return false
+	return connectionsAvailable
 }
 
-func (m *maxPerClientConnections) dec(remoteIP string) {
+func (m *maxPerClientConnections) dec(remoteIP string, rule *ClientRule) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	current := m.counts[remoteIP]
@@ -449,4 +908,11 @@ func (m *maxPerClientConnections) dec(remoteIP string) {
 	} else {
 		m.counts[remoteIP] = current - 1
 	}
+	if rule != nil && rule.MaxConnections > 0 {
+		if m.ruleCounts[rule.Name] == 1 {
+			delete(m.ruleCounts, rule.Name)
+		} else {
+			m.ruleCounts[rule.Name]--
+		}
+	}
 }
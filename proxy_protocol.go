@@ -0,0 +1,230 @@
+package dvara
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProxyProtocolMode defines whether client connections start with a PROXY
+// protocol header, sent by load balancers such as HAProxy or AWS NLB to convey
+// the address of the client they accepted the connection from.
+type ProxyProtocolMode string
+
+const (
+	// ProxyProtocolOff treats the peer as the client.
+	ProxyProtocolOff ProxyProtocolMode = "off"
+
+	// ProxyProtocolOptional uses the header when there is one, so clients can
+	// connect through the load balancer and directly.
+	ProxyProtocolOptional ProxyProtocolMode = "optional"
+
+	// ProxyProtocolRequired rejects connections without a header.
+	ProxyProtocolRequired ProxyProtocolMode = "required"
+)
+
+// ParseProxyProtocolMode returns the ProxyProtocolMode with the given name.
+func ParseProxyProtocolMode(name string) (ProxyProtocolMode, error) {
+	switch m := ProxyProtocolMode(name); m {
+	case ProxyProtocolOff, ProxyProtocolOptional, ProxyProtocolRequired:
+		return m, nil
+	}
+	return "", fmt.Errorf("dvara: unknown proxy protocol mode %q", name)
+}
+
+var (
+	errProxyProtocolMissing   = errors.New("dvara: missing PROXY protocol header")
+	errProxyProtocolUntrusted = errors.New("dvara: PROXY protocol header required from an untrusted peer")
+	errProxyProtocolInvalid   = errors.New("dvara: invalid PROXY protocol header")
+	errProxyProtocolNoTrusted = errors.New("dvara: PROXY protocol needs the networks of the trusted load balancers")
+)
+
+const (
+	// proxyV1MaxLen is the maximum length of a v1 header, CRLF included.
+	proxyV1MaxLen = 107
+
+	// proxyPeekLen is the number of bytes read to tell v1 and v2 headers from
+	// a mongo message, whose length could only start with them beyond the
+	// maximum message size.
+	proxyPeekLen = 5
+)
+
+var (
+	proxyV1Signature = []byte("PROXY")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxiedConn is a client connection with the address conveyed by its PROXY
+// protocol header, or the bytes read looking for one.
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+	prefix []byte
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// proxyProtocolTrusted returns true if the peer may send PROXY protocol
+// headers. No peer may unless its network is trusted, since headers conveying
+// any client address are easily forged.
+func (r *ReplicaSet) proxyProtocolTrusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range r.ProxyProtocolTrusted {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyProtocol reads the PROXY protocol header the client connection
+// starts with, according to the ReplicaSet's mode. It returns the connection
+// to serve, whose RemoteAddr is the client the header conveys.
+func (r *ReplicaSet) readProxyProtocol(c net.Conn) (net.Conn, error) {
+	if r.ProxyProtocol == "" || r.ProxyProtocol == ProxyProtocolOff {
+		return c, nil
+	}
+	if !r.proxyProtocolTrusted(c.RemoteAddr()) {
+		if r.ProxyProtocol == ProxyProtocolRequired {
+			return nil, errProxyProtocolUntrusted
+		}
+		return c, nil
+	}
+	if r.MessageTimeout > 0 {
+		if err := c.SetReadDeadline(time.Now().Add(r.MessageTimeout)); err != nil {
+			return nil, err
+		}
+		defer c.SetReadDeadline(time.Time{})
+	}
+
+	peek := make([]byte, proxyPeekLen)
+	if _, err := io.ReadFull(c, peek); err != nil {
+		return nil, err
+	}
+	var (
+		remote net.Addr
+		err    error
+	)
+	switch {
+	case bytes.Equal(peek, proxyV1Signature):
+		remote, err = readProxyV1(c)
+	case bytes.Equal(peek, proxyV2Signature[:proxyPeekLen]):
+		remote, err = readProxyV2(c)
+	default:
+		if r.ProxyProtocol == ProxyProtocolRequired {
+			return nil, errProxyProtocolMissing
+		}
+		return &proxiedConn{Conn: c, prefix: peek}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &proxiedConn{Conn: c, remote: remote}, nil
+}
+
+// readProxyV1 reads the rest of a text header, such as
+// "PROXY TCP4 10.1.2.3 10.0.0.1 51234 6000\r\n". It reads a byte at a time
+// so nothing past the header is consumed. The address is nil for UNKNOWN
+// connections, health checks of the load balancer itself for example.
+func readProxyV1(c net.Conn) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLen-proxyPeekLen)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == cap(line) {
+			return nil, errProxyProtocolInvalid
+		}
+		if _, err := io.ReadFull(c, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Fields(string(line))
+	if line[0] != ' ' || len(fields) == 0 {
+		return nil, errProxyProtocolInvalid
+	}
+	switch fields[0] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, errProxyProtocolInvalid
+	}
+	if len(fields) != 5 {
+		return nil, errProxyProtocolInvalid
+	}
+	ip := net.ParseIP(fields[1])
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[0] == "TCP4") {
+		return nil, errProxyProtocolInvalid
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the rest of a binary header. The address is nil for
+// LOCAL connections and for families other than TCP over IPv4 and IPv6.
+func readProxyV2(c net.Conn) (net.Addr, error) {
+	// the rest of the signature, the version and command, the family and the
+	// length of the addresses
+	h := make([]byte, len(proxyV2Signature)-proxyPeekLen+4)
+	if _, err := io.ReadFull(c, h); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(h[:len(h)-4], proxyV2Signature[proxyPeekLen:]) {
+		return nil, errProxyProtocolInvalid
+	}
+	versionCommand, family := h[len(h)-4], h[len(h)-3]
+	if versionCommand>>4 != 2 {
+		return nil, errProxyProtocolInvalid
+	}
+	addrs := make([]byte, binary.BigEndian.Uint16(h[len(h)-2:]))
+	if _, err := io.ReadFull(c, addrs); err != nil {
+		return nil, err
+	}
+	switch versionCommand & 0xf {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, errProxyProtocolInvalid
+	}
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		return nil, nil
+	}
+	// source and destination addresses, then source and destination ports
+	if len(addrs) < 2*ipLen+4 {
+		return nil, errProxyProtocolInvalid
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, addrs[:ipLen])
+	port := binary.BigEndian.Uint16(addrs[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,146 @@
+package dvara
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var fakeBalancerAddr = &net.TCPAddr{IP: net.ParseIP("10.9.0.1"), Port: 5000}
+
+// proxyV2Header builds a binary PROXY protocol header for the given client.
+func proxyV2Header(command byte, client *net.TCPAddr) []byte {
+	h := append([]byte{}, proxyV2Signature...)
+	ip, family := client.IP.To4(), byte(0x11)
+	if ip == nil {
+		ip, family = client.IP.To16(), 0x21
+	}
+	h = append(h, 0x20|command, family)
+	var addrs []byte
+	addrs = append(addrs, ip...)
+	addrs = append(addrs, make([]byte, len(ip))...)
+	addrs = append(addrs, byte(client.Port>>8), byte(client.Port), 0x17, 0x70)
+	// a TLV, which is skipped
+	addrs = append(addrs, 0x01, 0x00, 0x02, 'h', '2')
+	h = append(h, 0, 0)
+	binary.BigEndian.PutUint16(h[len(h)-2:], uint16(len(addrs)))
+	return append(h, addrs...)
+}
+
+func TestReadProxyProtocol(t *testing.T) {
+	t.Parallel()
+	client := &net.TCPAddr{IP: net.ParseIP("192.168.1.2").To4(), Port: 51234}
+	client6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 51234}
+	msg := []byte("\x10\x00\x00\x00rest of the message")
+	cases := []struct {
+		mode   ProxyProtocolMode
+		header string
+		remote net.Addr
+		err    error
+	}{
+		{ProxyProtocolOff, "", fakeBalancerAddr, nil},
+		{ProxyProtocolOptional, "", fakeBalancerAddr, nil},
+		{ProxyProtocolRequired, "", nil, errProxyProtocolMissing},
+		{ProxyProtocolRequired, "PROXY TCP4 192.168.1.2 10.0.0.1 51234 6000\r\n", client, nil},
+		{ProxyProtocolRequired, "PROXY TCP6 2001:db8::2 2001:db8::1 51234 6000\r\n", client6, nil},
+		{ProxyProtocolRequired, "PROXY UNKNOWN\r\n", fakeBalancerAddr, nil},
+		{ProxyProtocolOptional, string(proxyV2Header(1, client)), client, nil},
+		{ProxyProtocolOptional, string(proxyV2Header(1, client6)), client6, nil},
+		{ProxyProtocolOptional, string(proxyV2Header(0, client)), fakeBalancerAddr, nil},
+		{ProxyProtocolRequired, "PROXY TCP4 192.168.1.300 10.0.0.1 51234 6000\r\n", nil, errProxyProtocolInvalid},
+		{ProxyProtocolRequired, "PROXY TCP4 2001:db8::2 2001:db8::1 51234 6000\r\n", nil, errProxyProtocolInvalid},
+		{ProxyProtocolRequired, "PROXY TCP4 192.168.1.2 10.0.0.1 99999 6000\r\n", nil, errProxyProtocolInvalid},
+		{ProxyProtocolRequired, "PROXY UDP4 192.168.1.2 10.0.0.1 51234 6000\r\n", nil, errProxyProtocolInvalid},
+		{ProxyProtocolRequired, "PROXYTCP4 192.168.1.2 10.0.0.1 51234 6000\r\n", nil, errProxyProtocolInvalid},
+		{ProxyProtocolRequired, "PROXY TCP4" + string(bytes.Repeat([]byte(" "), 100)) + "\r\n", nil, errProxyProtocolInvalid},
+		{ProxyProtocolRequired, string(proxyV2Header(2, client)), nil, errProxyProtocolInvalid},
+	}
+	trusted, err := ParseCIDRs("10.9.0.0/16")
+	ensure.Nil(t, err)
+	for _, c := range cases {
+		r := &ReplicaSet{ProxyProtocol: c.mode, ProxyProtocolTrusted: trusted, MessageTimeout: time.Minute}
+		conn, err := r.readProxyProtocol(&fakeConn{
+			in:     bytes.NewReader(append([]byte(c.header), msg...)),
+			remote: fakeBalancerAddr,
+		})
+		ensure.DeepEqual(t, err, c.err, c.header)
+		if err != nil {
+			continue
+		}
+		ensure.DeepEqual(t, conn.RemoteAddr().String(), c.remote.String(), c.header)
+		// the message is read whole, peeked bytes included
+		rest, err := ioutil.ReadAll(conn)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, rest, msg, c.header)
+	}
+}
+
+func TestReadProxyProtocolTrusted(t *testing.T) {
+	t.Parallel()
+	trusted, err := ParseCIDRs("10.9.0.0/16")
+	ensure.Nil(t, err)
+	header := []byte("PROXY TCP4 192.168.1.2 10.0.0.1 51234 6000\r\n")
+	r := &ReplicaSet{ProxyProtocol: ProxyProtocolRequired, ProxyProtocolTrusted: trusted}
+
+	conn, err := r.readProxyProtocol(&fakeConn{in: bytes.NewReader(header), remote: fakeBalancerAddr})
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, conn.RemoteAddr().String(), "192.168.1.2:51234")
+
+	// headers from other peers are not read, nor accepted when required
+	_, err = r.readProxyProtocol(&fakeConn{in: bytes.NewReader(header), remote: fakeClientAddr})
+	ensure.DeepEqual(t, err, errProxyProtocolUntrusted)
+	r.ProxyProtocol = ProxyProtocolOptional
+	direct := &fakeConn{in: bytes.NewReader(header), remote: fakeClientAddr}
+	conn, err = r.readProxyProtocol(direct)
+	ensure.Nil(t, err)
+	ensure.True(t, conn == direct)
+
+	// as are headers from any peer without trusted networks
+	r.ProxyProtocol = ProxyProtocolRequired
+	r.ProxyProtocolTrusted = nil
+	_, err = r.readProxyProtocol(&fakeConn{in: bytes.NewReader(header), remote: fakeBalancerAddr})
+	ensure.DeepEqual(t, err, errProxyProtocolUntrusted)
+	ensure.DeepEqual(t, (&ReplicaSet{Addrs: "localhost:27017", ProxyProtocol: ProxyProtocolOptional}).Start(), errProxyProtocolNoTrusted)
+}
+
+func TestProxyProtocolClientAddr(t *testing.T) {
+	t.Parallel()
+	rules, err := ParseClientRules("office=192.168.0.0/16 deny")
+	ensure.Nil(t, err)
+	trusted, err := ParseCIDRs("10.9.0.0/16")
+	ensure.Nil(t, err)
+	hc := newCounterClient()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MessageTimeout:       time.Minute,
+			ProxyProtocol:        ProxyProtocolRequired,
+			ProxyProtocolTrusted: trusted,
+			ClientRules:          rules,
+		},
+		stats: hc,
+	}
+	p.maxPerClientConnections = newMaxPerClientConnections(10)
+
+	// client rules apply to the conveyed client rather than the balancer
+	header := []byte("PROXY TCP4 192.168.1.2 10.0.0.1 51234 6000\r\n")
+	query := fakeQuery(1, 0, "admin.$cmd", bson.D{{Name: "isMaster", Value: 1}})
+	conn := &fakeConn{in: bytes.NewReader(append(header, query...)), remote: fakeBalancerAddr}
+	p.wg.Add(1)
+	p.clientServeLoop(conn)
+	reply := replyDocument(t, conn.out.Bytes())
+	ensure.StringContains(t, reply["errmsg"].(string), "192.168.1.2")
+	ensure.DeepEqual(t, hc.count("client.rejected.rule.office.denied"), float64(1))
+
+	// and connections without a header are closed
+	conn = &fakeConn{in: bytes.NewReader(query), remote: fakeBalancerAddr}
+	p.wg.Add(1)
+	p.clientServeLoop(conn)
+	ensure.DeepEqual(t, conn.out.Len(), 0)
+	ensure.DeepEqual(t, hc.count("client.rejected.proxy_protocol"), float64(1))
+}
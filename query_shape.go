@@ -0,0 +1,455 @@
+package dvara
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corelog "github.com/intercom/gocore/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	defaultMaxQueryShapes = 1000
+	defaultTopQueryShapes = 20
+
+	// latencySamples is the number of most recent latencies kept per shape to
+	// compute percentiles from.
+	latencySamples = 256
+)
+
+// QueryShape is a normalized query or command. Literals are stripped so that
+// queries only differing in their values end up with the same shape.
+type QueryShape struct {
+	Namespace string `json:"ns"`
+	Operation string `json:"op"`
+	Pattern   string `json:"pattern"`
+
+	// App and Driver are the application and driver version of the clients,
+	// as named in stats, empty for clients without metadata.
+	App    string `json:"app,omitempty"`
+	Driver string `json:"driver,omitempty"`
+}
+
+// String returns a human readable representation of the shape.
+func (s QueryShape) String() string {
+	if s.App == "" && s.Driver == "" {
+		return fmt.Sprintf("%s %s %s", s.Namespace, s.Operation, s.Pattern)
+	}
+	return fmt.Sprintf("%s %s %s app=%s driver=%s", s.Namespace, s.Operation, s.Pattern, s.App, s.Driver)
+}
+
+// QueryShapeSummary is a snapshot of the aggregates for one QueryShape.
+type QueryShapeSummary struct {
+	QueryShape
+	Count        int64         `json:"count"`
+	Errors       int64         `json:"errors"`
+	TotalTime    time.Duration `json:"total_time"`
+	P50          time.Duration `json:"p50"`
+	P99          time.Duration `json:"p99"`
+	BytesIn      int64         `json:"bytes_in"`
+	BytesOut     int64         `json:"bytes_out"`
+	DocsReturned int64         `json:"docs_returned"`
+}
+
+// querySample is a single observation for a QueryShape.
+type querySample struct {
+	Duration     time.Duration
+	Error        bool
+	BytesIn      int64
+	BytesOut     int64
+	DocsReturned int64
+}
+
+type queryShapeAggregate struct {
+	summary   QueryShapeSummary
+	latencies [latencySamples]time.Duration
+	next      int
+}
+
+func (a *queryShapeAggregate) add(s querySample) {
+	a.summary.Count++
+	if s.Error {
+		a.summary.Errors++
+	}
+	a.summary.TotalTime += s.Duration
+	a.summary.BytesIn += s.BytesIn
+	a.summary.BytesOut += s.BytesOut
+	a.summary.DocsReturned += s.DocsReturned
+	a.latencies[a.next%latencySamples] = s.Duration
+	a.next++
+}
+
+func (a *queryShapeAggregate) snapshot() QueryShapeSummary {
+	n := a.next
+	if n > latencySamples {
+		n = latencySamples
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, a.latencies[:n])
+	sort.Sort(durations(sorted))
+
+	s := a.summary
+	s.P50 = percentile(sorted, 0.50)
+	s.P99 = percentile(sorted, 0.99)
+	return s
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// percentile returns the p-th percentile from the sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// QueryShapeStats aggregates statistics about the queries flowing through the
+// proxies grouped by their QueryShape. It is safe for concurrent use.
+type QueryShapeStats struct {
+	// Enabled turns on query shape collection. Collecting shapes requires
+	// parsing every query, so it is off by default.
+	Enabled bool
+
+	// MaxShapes bounds the number of distinct shapes tracked. When full, the
+	// shape with the least total time is evicted to make room.
+	MaxShapes uint
+
+	// TopShapes is the number of shapes included in periodic log dumps.
+	TopShapes uint
+
+	// LogInterval is how often the top shapes are logged. Zero disables
+	// logging.
+	LogInterval time.Duration
+
+	mutex  sync.Mutex
+	shapes map[QueryShape]*queryShapeAggregate
+	stop   chan struct{}
+}
+
+// Start starts the periodic log dumps if configured.
+func (s *QueryShapeStats) Start() error {
+	if !s.Enabled || s.LogInterval == 0 {
+		return nil
+	}
+	s.stop = make(chan struct{})
+	go s.logLoop()
+	return nil
+}
+
+// Stop stops the periodic log dumps.
+func (s *QueryShapeStats) Stop() error {
+	if s.stop != nil {
+		close(s.stop)
+	}
+	return nil
+}
+
+func (s *QueryShapeStats) logLoop() {
+	ticker := time.NewTicker(s.LogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.logTop()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *QueryShapeStats) logTop() {
+	n := s.TopShapes
+	if n == 0 {
+		n = defaultTopQueryShapes
+	}
+	for i, q := range s.Top(int(n)) {
+		corelog.LogInfoMessage(
+			"query shape",
+			"rank", i+1,
+			"ns", q.Namespace,
+			"op", q.Operation,
+			"pattern", q.Pattern,
+			"app", q.App,
+			"driver", q.Driver,
+			"count", q.Count,
+			"errors", q.Errors,
+			"total_ms", q.TotalTime.Seconds()*1000,
+			"p50_ms", q.P50.Seconds()*1000,
+			"p99_ms", q.P99.Seconds()*1000,
+			"bytes_in", q.BytesIn,
+			"bytes_out", q.BytesOut,
+			"docs_returned", q.DocsReturned,
+		)
+	}
+}
+
+// Record adds a sample for the given shape.
+func (s *QueryShapeStats) Record(shape QueryShape, sample querySample) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.shapes == nil {
+		s.shapes = make(map[QueryShape]*queryShapeAggregate)
+	}
+
+	a, ok := s.shapes[shape]
+	if !ok {
+		max := s.MaxShapes
+		if max == 0 {
+			max = defaultMaxQueryShapes
+		}
+		if uint(len(s.shapes)) >= max {
+			s.evictLocked()
+		}
+		a = &queryShapeAggregate{summary: QueryShapeSummary{QueryShape: shape}}
+		s.shapes[shape] = a
+	}
+	a.add(sample)
+}
+
+// evictLocked drops the shape with the least total time.
+func (s *QueryShapeStats) evictLocked() {
+	var victim *queryShapeAggregate
+	for _, a := range s.shapes {
+		if victim == nil || a.summary.TotalTime < victim.summary.TotalTime {
+			victim = a
+		}
+	}
+	if victim != nil {
+		delete(s.shapes, victim.summary.QueryShape)
+	}
+}
+
+// Top returns up to n shapes ordered by their total time, the most expensive
+// first.
+func (s *QueryShapeStats) Top(n int) []QueryShapeSummary {
+	s.mutex.Lock()
+	all := make([]QueryShapeSummary, 0, len(s.shapes))
+	for _, a := range s.shapes {
+		all = append(all, a.snapshot())
+	}
+	s.mutex.Unlock()
+
+	sort.Sort(byTotalTime(all))
+	if n >= 0 && len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+// Reset drops all the collected aggregates.
+func (s *QueryShapeStats) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.shapes = nil
+}
+
+type byTotalTime []QueryShapeSummary
+
+func (b byTotalTime) Len() int           { return len(b) }
+func (b byTotalTime) Less(i, j int) bool { return b[i].TotalTime > b[j].TotalTime }
+func (b byTotalTime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// commandFilterFields are the top level fields of commands which carry the
+// query filter.
+var commandFilterFields = []string{"filter", "query", "q"}
+
+// shapeOfQuery builds the QueryShape for an OpQuery given its full collection
+// name (including the trailing null byte) and query document.
+func shapeOfQuery(fullCollectionName []byte, q bson.D) QueryShape {
+	ns := string(bytes.TrimSuffix(fullCollectionName, []byte{x00}))
+
+	if strings.HasSuffix(ns, ".$cmd") {
+		return shapeOfCommand(strings.TrimSuffix(ns, ".$cmd"), q)
+	}
+
+	// Legacy drivers wrap the filter when they send modifiers like a sort.
+	filter, orderBy := q, bson.D(nil)
+	for _, e := range q {
+		switch e.Name {
+		case "$query":
+			if d, ok := asDoc(e.Value); ok {
+				filter = d
+			}
+		case "$orderby":
+			orderBy, _ = asDoc(e.Value)
+		}
+	}
+
+	pattern := shapeOfDoc(filter)
+	if len(orderBy) > 0 {
+		pattern += " sort=" + shapeOfKeys(orderBy)
+	}
+	return QueryShape{Namespace: ns, Operation: "query", Pattern: pattern}
+}
+
+// shapeOfCommand builds the QueryShape for a command run against db.
+func shapeOfCommand(db string, q bson.D) QueryShape {
+	if len(q) == 0 {
+		return QueryShape{Namespace: db, Operation: "command"}
+	}
+
+	shape := QueryShape{Namespace: db, Operation: q[0].Name}
+	if c, ok := q[0].Value.(string); ok && c != "" {
+		shape.Namespace = db + "." + c
+	}
+
+	var parts []string
+	for _, e := range q[1:] {
+		switch {
+		case containsString(commandFilterFields, e.Name):
+			if d, ok := asDoc(e.Value); ok {
+				parts = append(parts, e.Name+"="+shapeOfDoc(d))
+			}
+		case e.Name == "sort":
+			if d, ok := asDoc(e.Value); ok {
+				parts = append(parts, "sort="+shapeOfKeys(d))
+			}
+		case e.Name == "pipeline":
+			parts = append(parts, "pipeline="+shapeOfPipeline(e.Value))
+		case e.Name == "updates" || e.Name == "deletes":
+			// Batched writes, the first statement is representative.
+			if stmts, ok := e.Value.([]interface{}); ok && len(stmts) > 0 {
+				if d, ok := asDoc(stmts[0]); ok {
+					if f, ok := asDoc(lookup(d, "q")); ok {
+						parts = append(parts, "q="+shapeOfDoc(f))
+					}
+				}
+			}
+		}
+	}
+	shape.Pattern = strings.Join(parts, " ")
+	return shape
+}
+
+// shapeOfPipeline lists the stages of an aggregation pipeline, including the
+// shape of any $match stage.
+func shapeOfPipeline(v interface{}) string {
+	stages, ok := v.([]interface{})
+	if !ok {
+		return "?"
+	}
+	parts := make([]string, 0, len(stages))
+	for _, s := range stages {
+		d, ok := asDoc(s)
+		if !ok || len(d) == 0 {
+			parts = append(parts, "?")
+			continue
+		}
+		name := d[0].Name
+		if name == "$match" {
+			if m, ok := asDoc(d[0].Value); ok {
+				name += shapeOfDoc(m)
+			}
+		}
+		parts = append(parts, name)
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+// shapeOfDoc renders a filter document with all literals replaced by "?".
+// Keys are sorted so that field order does not produce different shapes.
+func shapeOfDoc(d bson.D) string {
+	parts := make([]string, 0, len(d))
+	for _, e := range d {
+		parts = append(parts, e.Name+": "+shapeOfValue(e.Name, e.Value))
+	}
+	sort.Strings(parts)
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// shapeOfKeys renders only the keys of a document, like a sort or projection.
+func shapeOfKeys(d bson.D) string {
+	parts := make([]string, 0, len(d))
+	for _, e := range d {
+		parts = append(parts, e.Name)
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+func shapeOfValue(key string, v interface{}) string {
+	switch key {
+	case "$and", "$or", "$nor":
+		clauses, ok := v.([]interface{})
+		if !ok {
+			return "?"
+		}
+		var parts []string
+		seen := make(map[string]struct{}, len(clauses))
+		for _, c := range clauses {
+			d, ok := asDoc(c)
+			if !ok {
+				continue
+			}
+			s := shapeOfDoc(d)
+			if _, dup := seen[s]; dup {
+				continue
+			}
+			seen[s] = struct{}{}
+			parts = append(parts, s)
+		}
+		sort.Strings(parts)
+		return "[" + strings.Join(parts, ", ") + "]"
+	case "$elemMatch", "$not":
+		if d, ok := asDoc(v); ok {
+			return shapeOfDoc(d)
+		}
+		return "?"
+	}
+
+	// Embedded documents made of operators are shaped, anything else is a
+	// literal.
+	if d, ok := asDoc(v); ok && len(d) > 0 && strings.HasPrefix(d[0].Name, "$") {
+		return shapeOfDoc(d)
+	}
+	return "?"
+}
+
+// asDoc returns the value as a bson.D if it is a document.
+func asDoc(v interface{}) (bson.D, bool) {
+	switch d := v.(type) {
+	case bson.D:
+		return d, true
+	case bson.M:
+		r := make(bson.D, 0, len(d))
+		for k, v := range d {
+			r = append(r, bson.DocElem{Name: k, Value: v})
+		}
+		return r, true
+	}
+	return nil, false
+}
+
+// lookup returns the value of the top level key k in d, if any.
+func lookup(d bson.D, k string) interface{} {
+	for _, e := range d {
+		if e.Name == k {
+			return e.Value
+		}
+	}
+	return nil
+}
+
+func containsString(set []string, s string) bool {
+	for _, v := range set {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+package dvara
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestShapeOfQuery(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name       string
+		Collection string
+		Query      bson.D
+		Shape      QueryShape
+	}{
+		{
+			Name:       "plain query",
+			Collection: "test.users\000",
+			Query: bson.D{
+				{Name: "name", Value: "bob"},
+				{Name: "age", Value: bson.D{{Name: "$gt", Value: 42}}},
+			},
+			Shape: QueryShape{
+				Namespace: "test.users",
+				Operation: "query",
+				Pattern:   "{age: {$gt: ?}, name: ?}",
+			},
+		},
+		{
+			Name:       "wrapped query with sort",
+			Collection: "test.users\000",
+			Query: bson.D{
+				{Name: "$query", Value: bson.D{{Name: "name", Value: "bob"}}},
+				{Name: "$orderby", Value: bson.D{{Name: "age", Value: -1}}},
+			},
+			Shape: QueryShape{
+				Namespace: "test.users",
+				Operation: "query",
+				Pattern:   "{name: ?} sort={age}",
+			},
+		},
+		{
+			Name:       "or clauses are deduplicated",
+			Collection: "test.users\000",
+			Query: bson.D{
+				{Name: "$or", Value: []interface{}{
+					bson.D{{Name: "a", Value: 1}},
+					bson.D{{Name: "a", Value: 2}},
+					bson.D{{Name: "b", Value: bson.D{{Name: "$in", Value: []interface{}{1, 2}}}}},
+				}},
+			},
+			Shape: QueryShape{
+				Namespace: "test.users",
+				Operation: "query",
+				Pattern:   "{$or: [{a: ?}, {b: {$in: ?}}]}",
+			},
+		},
+		{
+			Name:       "embedded document literal",
+			Collection: "test.users\000",
+			Query: bson.D{
+				{Name: "address", Value: bson.D{{Name: "city", Value: "Dublin"}}},
+			},
+			Shape: QueryShape{
+				Namespace: "test.users",
+				Operation: "query",
+				Pattern:   "{address: ?}",
+			},
+		},
+		{
+			Name:       "find command",
+			Collection: "test.$cmd\000",
+			Query: bson.D{
+				{Name: "find", Value: "users"},
+				{Name: "filter", Value: bson.D{{Name: "email", Value: "a@b.c"}}},
+				{Name: "sort", Value: bson.D{{Name: "created", Value: 1}}},
+				{Name: "limit", Value: 10},
+			},
+			Shape: QueryShape{
+				Namespace: "test.users",
+				Operation: "find",
+				Pattern:   "filter={email: ?} sort={created}",
+			},
+		},
+		{
+			Name:       "aggregate command",
+			Collection: "test.$cmd\000",
+			Query: bson.D{
+				{Name: "aggregate", Value: "events"},
+				{Name: "pipeline", Value: []interface{}{
+					bson.D{{Name: "$match", Value: bson.D{{Name: "app", Value: 7}}}},
+					bson.D{{Name: "$group", Value: bson.D{{Name: "_id", Value: "$type"}}}},
+				}},
+			},
+			Shape: QueryShape{
+				Namespace: "test.events",
+				Operation: "aggregate",
+				Pattern:   "pipeline=[$match{app: ?}, $group]",
+			},
+		},
+		{
+			Name:       "delete command",
+			Collection: "test.$cmd\000",
+			Query: bson.D{
+				{Name: "delete", Value: "users"},
+				{Name: "deletes", Value: []interface{}{
+					bson.D{{Name: "q", Value: bson.D{{Name: "_id", Value: 1}}}, {Name: "limit", Value: 1}},
+				}},
+			},
+			Shape: QueryShape{
+				Namespace: "test.users",
+				Operation: "delete",
+				Pattern:   "q={_id: ?}",
+			},
+		},
+		{
+			Name:       "admin command",
+			Collection: "admin.$cmd\000",
+			Query:      bson.D{{Name: "isMaster", Value: 1}},
+			Shape: QueryShape{
+				Namespace: "admin",
+				Operation: "isMaster",
+			},
+		},
+	}
+	for _, c := range cases {
+		ensure.DeepEqual(t, shapeOfQuery([]byte(c.Collection), c.Query), c.Shape, c.Name)
+	}
+}
+
+func TestQueryShapeOfClientDriver(t *testing.T) {
+	t.Parallel()
+	s := &QueryShapeStats{Enabled: true}
+	p := &ProxyQuery{QueryShapeStats: s}
+	query := fakeQuery(7, 0, "test.users", bson.M{"name": "bob"})
+	var h messageHeader
+	h.FromWire(query)
+	client := &fakeConn{in: bytes.NewReader(query[headerLen:])}
+	server := &fakeConn{in: bytes.NewReader(fakeReplyTo(7, bson.M{"name": "bob"}))}
+	driver := (&Drivers{}).newClientDriver(&ClientMetadata{App: "billing", Driver: "nodejs", DriverVersion: "4.11.0"})
+	ensure.Nil(t, p.Proxy(&h, client, server, &LastError{}, nil, nil, driver))
+
+	// shapes are told apart by the application and driver of their clients
+	ensure.DeepEqual(t, s.Top(1)[0].QueryShape, QueryShape{
+		Namespace: "test.users",
+		Operation: "query",
+		Pattern:   "{name: ?}",
+		App:       "billing",
+		Driver:    "nodejs.4_11_0",
+	})
+}
+
+func TestQueryShapeStatsTop(t *testing.T) {
+	t.Parallel()
+	var s QueryShapeStats
+	slow := QueryShape{Namespace: "test.a", Operation: "query", Pattern: "{a: ?}"}
+	fast := QueryShape{Namespace: "test.b", Operation: "query", Pattern: "{b: ?}"}
+	for i := 1; i <= 100; i++ {
+		s.Record(slow, querySample{Duration: time.Duration(i) * time.Millisecond, DocsReturned: 2})
+		s.Record(fast, querySample{Duration: time.Millisecond, Error: i%10 == 0})
+	}
+
+	top := s.Top(10)
+	ensure.DeepEqual(t, len(top), 2)
+	ensure.DeepEqual(t, top[0].QueryShape, slow)
+	ensure.DeepEqual(t, top[0].Count, int64(100))
+	ensure.DeepEqual(t, top[0].DocsReturned, int64(200))
+	ensure.DeepEqual(t, top[0].P50, 50*time.Millisecond)
+	ensure.DeepEqual(t, top[0].P99, 99*time.Millisecond)
+	ensure.DeepEqual(t, top[1].QueryShape, fast)
+	ensure.DeepEqual(t, top[1].Errors, int64(10))
+	ensure.DeepEqual(t, len(s.Top(1)), 1)
+}
+
+func TestQueryShapeStatsEvictsCheapest(t *testing.T) {
+	t.Parallel()
+	s := QueryShapeStats{MaxShapes: 2}
+	a := QueryShape{Pattern: "a"}
+	b := QueryShape{Pattern: "b"}
+	c := QueryShape{Pattern: "c"}
+	s.Record(a, querySample{Duration: time.Second})
+	s.Record(b, querySample{Duration: time.Millisecond})
+	s.Record(c, querySample{Duration: time.Minute})
+
+	top := s.Top(-1)
+	ensure.DeepEqual(t, len(top), 2)
+	ensure.DeepEqual(t, top[0].QueryShape, c)
+	ensure.DeepEqual(t, top[1].QueryShape, a)
+}
+
+func TestAdminQueryShapes(t *testing.T) {
+	t.Parallel()
+	a := AdminServer{QueryShapeStats: &QueryShapeStats{}}
+	ensure.Nil(t, a.Start())
+	defer a.Stop()
+	a.QueryShapeStats.Record(QueryShape{Pattern: "a"}, querySample{})
+
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest("GET", "/query_shapes?top=5", nil))
+	ensure.DeepEqual(t, w.Code, http.StatusOK)
+	ensure.StringContains(t, w.Body.String(), `"pattern":"a"`)
+
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest("DELETE", "/query_shapes", nil))
+	ensure.DeepEqual(t, w.Code, http.StatusNoContent)
+	ensure.DeepEqual(t, len(a.QueryShapeStats.Top(-1)), 0)
+}
@@ -0,0 +1,566 @@
+package dvara
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// Rate limit keys, what each client of a limit gets its own buckets by.
+const (
+	RateLimitByClient    = "client"
+	RateLimitByUser      = "user"
+	RateLimitByNamespace = "namespace"
+	RateLimitByApp       = "app"
+)
+
+// Rate limit actions, for requests exceeding a limit.
+const (
+	RateLimitDelay  = "delay"
+	RateLimitReject = "reject"
+)
+
+const (
+	// defaultRateLimitMaxDelay is how long requests are delayed at most by
+	// default, before being rejected.
+	defaultRateLimitMaxDelay = time.Second
+
+	// rateLimitSweepInterval is how often full buckets, which allow as much
+	// as new ones, are forgotten.
+	rateLimitSweepInterval = time.Minute
+
+	// defaultRateLimitMaxKeys is how many keys get buckets of their own at
+	// most by default.
+	defaultRateLimitMaxKeys = 10000
+
+	// rateLimitOtherKey is the key of the buckets shared by the keys beyond
+	// the maximum, which no client can choose.
+	rateLimitOtherKey = "\x00other"
+)
+
+// RateLimit limits the operations and bytes per second of the requests it
+// matches, with token buckets. Empty filters match everything.
+type RateLimit struct {
+	// Name identifies the limit in errors, logs and stats.
+	Name string `json:"name"`
+
+	// Key is RateLimitByClient, RateLimitByUser, RateLimitByNamespace or
+	// RateLimitByApp to give each client IP, authenticated user,
+	// "db.collection" or application name its own buckets. If empty the
+	// matching requests share them. Clients not authenticated at the proxy
+	// share the same user, and those without driver metadata the same
+	// application.
+	Key string `json:"key"`
+
+	// Ops and Bytes are the allowed operations and bytes per second, zero
+	// means no limit.
+	Ops   float64 `json:"ops"`
+	Bytes float64 `json:"bytes"`
+
+	// OpsBurst and BytesBurst are the sizes of the buckets, one second worth
+	// of requests if zero. Requests larger than BytesBurst take it whole.
+	OpsBurst   float64 `json:"opsBurst"`
+	BytesBurst float64 `json:"bytesBurst"`
+
+	// Action is RateLimitDelay to delay requests until the limit allows them,
+	// or RateLimitReject, the default, to fail them.
+	Action string `json:"action"`
+
+	// MaxDelay is the longest requests are delayed, like "500ms", beyond
+	// which they're rejected. One second if empty.
+	MaxDelay string `json:"maxDelay"`
+
+	// MaxKeys is how many keys get buckets of their own at most, as clients
+	// choose their namespaces and application names. The requests of the
+	// keys beyond share the same buckets until some are forgotten. 10000 if
+	// zero.
+	MaxKeys int `json:"maxKeys"`
+
+	// Clients are client networks in CIDR notation, or bare IP addresses.
+	Clients []string `json:"clients"`
+
+	// Users are authenticated users, as "db.user".
+	Users []string `json:"users"`
+
+	// Apps are application names, as the drivers tell them.
+	Apps []string `json:"apps"`
+
+	// Namespaces are glob patterns like "prod.*" matched against the
+	// "db.collection" a request targets. Database wide commands target "db.".
+	Namespaces []string `json:"namespaces"`
+
+	maxDelay time.Duration
+	clients  []*net.IPNet
+	users    map[string]bool
+	apps     map[string]bool
+	buckets  *rateBuckets
+}
+
+// rateBuckets are the token buckets of a limit, by key.
+type rateBuckets struct {
+	mutex sync.Mutex
+	m     map[string]*rateBucket
+}
+
+type rateBucket struct {
+	ops   float64
+	bytes float64
+	last  time.Time
+}
+
+// rateLimitRequest is what limits match requests by.
+type rateLimitRequest struct {
+	ip    net.IP
+	user  string
+	app   string
+	ns    string
+	bytes float64
+}
+
+// RateLimitPolicy is a list of limits, every limit matching a request
+// applies to it.
+type RateLimitPolicy struct {
+	Limits []*RateLimit `json:"limits"`
+}
+
+// ParseRateLimitPolicy parses a JSON RateLimitPolicy.
+func ParseRateLimitPolicy(b []byte) (*RateLimitPolicy, error) {
+	var policy RateLimitPolicy
+	if err := json.Unmarshal(b, &policy); err != nil {
+		return nil, err
+	}
+	for i, l := range policy.Limits {
+		if l.Name == "" {
+			l.Name = fmt.Sprintf("limit%d", i+1)
+		}
+		if err := l.parse(); err != nil {
+			return nil, err
+		}
+	}
+	return &policy, nil
+}
+
+func (l *RateLimit) parse() error {
+	switch l.Key {
+	case "", RateLimitByClient, RateLimitByUser, RateLimitByNamespace, RateLimitByApp:
+	default:
+		return fmt.Errorf("dvara: invalid key %q of rate limit %s", l.Key, l.Name)
+	}
+	switch l.Action {
+	case "":
+		l.Action = RateLimitReject
+	case RateLimitDelay, RateLimitReject:
+	default:
+		return fmt.Errorf("dvara: invalid action %q of rate limit %s", l.Action, l.Name)
+	}
+	if l.Ops < 0 || l.Bytes < 0 || l.OpsBurst < 0 || l.BytesBurst < 0 || l.Ops+l.Bytes == 0 {
+		return fmt.Errorf("dvara: rate limit %s needs positive ops or bytes", l.Name)
+	}
+	if l.OpsBurst == 0 {
+		l.OpsBurst = math.Max(l.Ops, 1)
+	}
+	if l.BytesBurst == 0 {
+		l.BytesBurst = l.Bytes
+	}
+	if l.MaxKeys < 0 {
+		return fmt.Errorf("dvara: invalid max keys %d of rate limit %s", l.MaxKeys, l.Name)
+	}
+	if l.MaxKeys == 0 {
+		l.MaxKeys = defaultRateLimitMaxKeys
+	}
+	l.maxDelay = defaultRateLimitMaxDelay
+	if l.MaxDelay != "" {
+		d, err := time.ParseDuration(l.MaxDelay)
+		if err != nil || d < 0 {
+			return fmt.Errorf("dvara: invalid max delay %q of rate limit %s", l.MaxDelay, l.Name)
+		}
+		l.maxDelay = d
+	}
+	for _, ns := range l.Namespaces {
+		if _, err := path.Match(ns, ""); err != nil {
+			return fmt.Errorf("dvara: invalid namespace pattern %q of rate limit %s", ns, l.Name)
+		}
+	}
+	if len(l.Users) > 0 {
+		l.users = make(map[string]bool, len(l.Users))
+		for _, u := range l.Users {
+			l.users[u] = true
+		}
+	}
+	if len(l.Apps) > 0 {
+		l.apps = make(map[string]bool, len(l.Apps))
+		for _, a := range l.Apps {
+			l.apps[a] = true
+		}
+	}
+	l.buckets = &rateBuckets{m: make(map[string]*rateBucket)}
+	var err error
+	l.clients, err = ParseCIDRs(strings.Join(l.Clients, ","))
+	return err
+}
+
+// match returns true if the limit applies to the request.
+func (l *RateLimit) match(r *rateLimitRequest) bool {
+	if l.users != nil && !l.users[r.user] {
+		return false
+	}
+	if l.apps != nil && !l.apps[r.app] {
+		return false
+	}
+	if len(l.clients) > 0 {
+		found := false
+		for _, n := range l.clients {
+			if r.ip != nil && n.Contains(r.ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(l.Namespaces) > 0 {
+		ns := r.ns
+		if !strings.Contains(ns, ".") {
+			ns += "."
+		}
+		for _, pattern := range l.Namespaces {
+			if ok, _ := path.Match(pattern, ns); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// key returns the key of the request's buckets.
+func (l *RateLimit) key(r *rateLimitRequest) string {
+	switch l.Key {
+	case RateLimitByClient:
+		return r.ip.String()
+	case RateLimitByUser:
+		return r.user
+	case RateLimitByNamespace:
+		return r.ns
+	case RateLimitByApp:
+		return r.app
+	}
+	return ""
+}
+
+// refill adds the tokens earned since the bucket was last used.
+func (l *RateLimit) refill(b *rateBucket, now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.ops = math.Min(l.OpsBurst, b.ops+elapsed*l.Ops)
+		b.bytes = math.Min(l.BytesBurst, b.bytes+elapsed*l.Bytes)
+		b.last = now
+	}
+}
+
+// reserve takes the tokens of a request from the key's buckets. It returns
+// how long the request has to wait for the buckets to have them.
+func (l *RateLimit) reserve(key string, bytes float64, now time.Time) time.Duration {
+	l.buckets.mutex.Lock()
+	defer l.buckets.mutex.Unlock()
+	b := l.buckets.m[key]
+	if b == nil {
+		if len(l.buckets.m) >= l.MaxKeys {
+			key = rateLimitOtherKey
+			b = l.buckets.m[key]
+		}
+		if b == nil {
+			b = &rateBucket{ops: l.OpsBurst, bytes: l.BytesBurst, last: now}
+			l.buckets.m[key] = b
+		}
+	}
+	l.refill(b, now)
+	var wait float64
+	if l.Ops > 0 {
+		b.ops--
+		wait = math.Max(wait, -b.ops/l.Ops)
+	}
+	if l.Bytes > 0 {
+		b.bytes -= math.Min(bytes, l.BytesBurst)
+		wait = math.Max(wait, -b.bytes/l.Bytes)
+	}
+	return time.Duration(wait * float64(time.Second))
+}
+
+// cancel gives back the tokens a rejected request reserved.
+func (l *RateLimit) cancel(key string, bytes float64) {
+	l.buckets.mutex.Lock()
+	defer l.buckets.mutex.Unlock()
+	b := l.buckets.m[key]
+	if b == nil {
+		// the request's key didn't get its own buckets
+		b = l.buckets.m[rateLimitOtherKey]
+	}
+	if b == nil {
+		return
+	}
+	if l.Ops > 0 {
+		b.ops++
+	}
+	if l.Bytes > 0 {
+		b.bytes += math.Min(bytes, l.BytesBurst)
+	}
+}
+
+// sweep forgets the buckets which are full again.
+func (l *RateLimit) sweep(now time.Time) {
+	l.buckets.mutex.Lock()
+	defer l.buckets.mutex.Unlock()
+	for key, b := range l.buckets.m {
+		l.refill(b, now)
+		if b.ops >= l.OpsBurst && b.bytes >= l.BytesBurst {
+			delete(l.buckets.m, key)
+		}
+	}
+}
+
+// Reserve takes the tokens of the request from the buckets of every limit
+// it matches. It returns how long the request must be delayed, or the limit
+// rejecting it, in which case nothing is taken. A nil policy allows
+// everything.
+func (p *RateLimitPolicy) Reserve(r *rateLimitRequest, now time.Time) (time.Duration, *RateLimit) {
+	if p == nil {
+		return 0, nil
+	}
+	var wait time.Duration
+	for i, l := range p.Limits {
+		if !l.match(r) {
+			continue
+		}
+		w := l.reserve(l.key(r), r.bytes, now)
+		if w == 0 {
+			continue
+		}
+		if l.Action == RateLimitReject || w > l.maxDelay {
+			p.cancel(r, i+1)
+			return w, l
+		}
+		if w > wait {
+			wait = w
+		}
+	}
+	return wait, nil
+}
+
+// cancel gives back the tokens the request reserved from the first n limits.
+func (p *RateLimitPolicy) cancel(r *rateLimitRequest, n int) {
+	for _, l := range p.Limits[:n] {
+		if l.match(r) {
+			l.cancel(l.key(r), r.bytes)
+		}
+	}
+}
+
+// keep carries the buckets of the old policy's limits over to the limits of
+// the same name, so reloading doesn't reset them.
+func (p *RateLimitPolicy) keep(old *RateLimitPolicy) {
+	if old == nil {
+		return
+	}
+	buckets := make(map[string]*rateBuckets, len(old.Limits))
+	for _, l := range old.Limits {
+		buckets[l.Name] = l.buckets
+	}
+	for _, l := range p.Limits {
+		if b := buckets[l.Name]; b != nil {
+			l.buckets = b
+		}
+	}
+}
+
+func (p *RateLimitPolicy) sweep(now time.Time) {
+	if p == nil {
+		return
+	}
+	for _, l := range p.Limits {
+		l.sweep(now)
+	}
+}
+
+// RateLimiter delays or rejects client requests exceeding the limits of a
+// RateLimitPolicy loaded from a JSON file. The file is reloaded when it
+// changes.
+type RateLimiter struct {
+	// Path is the file the policy is loaded from. If empty nothing is
+	// limited.
+	Path string
+
+	// ReloadInterval is how often the file is checked for changes. Zero
+	// disables reloading.
+	ReloadInterval time.Duration
+
+	// Stats if provided will be used to record interesting stats.
+	Stats stats.Client `inject:""`
+
+	mutex   sync.RWMutex
+	policy  *RateLimitPolicy
+	modTime time.Time
+	stop    chan struct{}
+}
+
+// Enabled returns true if requests are limited.
+func (r *RateLimiter) Enabled() bool {
+	return r != nil && r.Path != ""
+}
+
+// Start loads the policy and starts watching the file for changes.
+func (r *RateLimiter) Start() error {
+	if !r.Enabled() {
+		return nil
+	}
+	if err := r.load(); err != nil {
+		return err
+	}
+	r.stop = make(chan struct{})
+	go r.loop()
+	return nil
+}
+
+// Stop stops watching the file.
+func (r *RateLimiter) Stop() error {
+	if r.stop != nil {
+		close(r.stop)
+	}
+	return nil
+}
+
+// Reserve takes the tokens of the request from the limits it matches. It
+// returns how long the request must be delayed, or the limit rejecting it.
+func (r *RateLimiter) Reserve(req *rateLimitRequest, now time.Time) (time.Duration, *RateLimit) {
+	r.mutex.RLock()
+	policy := r.policy
+	r.mutex.RUnlock()
+	return policy.Reserve(req, now)
+}
+
+func (r *RateLimiter) loop() {
+	var reload <-chan time.Time
+	if r.ReloadInterval > 0 {
+		ticker := time.NewTicker(r.ReloadInterval)
+		defer ticker.Stop()
+		reload = ticker.C
+	}
+	sweep := time.NewTicker(rateLimitSweepInterval)
+	defer sweep.Stop()
+	for {
+		select {
+		case <-reload:
+			if err := r.reload(); err != nil {
+				stats.BumpSum(r.Stats, "rate_limit.reload.error", 1)
+				corelog.LogError("error", err)
+			}
+		case now := <-sweep.C:
+			r.mutex.RLock()
+			policy := r.policy
+			r.mutex.RUnlock()
+			policy.sweep(now)
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// reload loads the policy again if the file changed. The current policy is
+// kept if it can't be loaded.
+func (r *RateLimiter) reload() error {
+	info, err := os.Stat(r.Path)
+	if err != nil {
+		return err
+	}
+	r.mutex.RLock()
+	changed := !info.ModTime().Equal(r.modTime)
+	r.mutex.RUnlock()
+	if !changed {
+		return nil
+	}
+	return r.load()
+}
+
+func (r *RateLimiter) load() error {
+	info, err := os.Stat(r.Path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(r.Path)
+	if err != nil {
+		return err
+	}
+	policy, err := ParseRateLimitPolicy(b)
+	if err != nil {
+		return fmt.Errorf("dvara: invalid rate limit policy %s: %s", r.Path, err)
+	}
+
+	r.mutex.Lock()
+	policy.keep(r.policy)
+	r.policy = policy
+	r.modTime = info.ModTime()
+	r.mutex.Unlock()
+	stats.BumpSum(r.Stats, "rate_limit.reload", 1)
+	corelog.LogInfoMessage("loaded rate limit policy", "path", r.Path, "limits", len(policy.Limits))
+	return nil
+}
+
+// checkRateLimit handles the message with the given header when rate limits
+// are enabled. Messages exceeding a limit are delayed until it allows them,
+// or failed with an error reply. It returns true if the message should be
+// proxied.
+func (p *Proxy) checkRateLimit(h *messageHeader, c *proxyClient, lastError *LastError) (bool, error) {
+	limiter := p.ReplicaSet.RateLimiter
+	if !limiter.Enabled() {
+		return true, nil
+	}
+	msg, err := c.request.read(h, c.conn)
+	if err != nil {
+		return false, err
+	}
+	req := rateLimitRequest{
+		ip:    clientIP(c.conn),
+		app:   c.appName(),
+		ns:    requestNamespace(msg),
+		bytes: float64(h.MessageLength),
+	}
+	if u := c.auth.user; u != nil {
+		req.user = u.DB + "." + u.User
+	}
+	wait, limit := limiter.Reserve(&req, time.Now())
+	if limit == nil {
+		if wait > 0 {
+			stats.BumpSum(p.stats, "rate_limit.delayed", 1)
+			stats.BumpAvg(p.stats, "rate_limit.delay", float64(wait)/float64(time.Millisecond))
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-p.ctx.Done():
+				return false, p.ctx.Err()
+			}
+		}
+		return true, nil
+	}
+
+	stats.BumpSum(p.stats, "rate_limit.rejected", 1)
+	stats.BumpSum(p.stats, "rate_limit.rejected."+limit.Name, 1)
+	what := "operation " + h.OpCode.String()
+	if isCommandRequest(msg) {
+		name, _ := requestCommand(msg)
+		what = "command " + name
+	}
+	e := newProxyError(codeRateLimitExceeded, "dvara: %s on %s exceeds rate limit %s", what, req.ns, limit.Name)
+	return false, p.rejectMessage(h, c, lastError, e)
+}
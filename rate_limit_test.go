@@ -0,0 +1,231 @@
+package dvara
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const testRateLimitPolicy = `{
+	"limits": [
+		{"name": "clients", "key": "client", "ops": 2},
+		{"name": "events", "namespaces": ["prod.events"], "bytes": 1000, "action": "delay", "maxDelay": "2s"},
+		{"name": "batch", "key": "user", "users": ["admin.batch"], "ops": 1, "opsBurst": 3}
+	]
+}`
+
+func TestRateLimitPolicyReserve(t *testing.T) {
+	t.Parallel()
+	policy, err := ParseRateLimitPolicy([]byte(testRateLimitPolicy))
+	ensure.Nil(t, err)
+	now := time.Now()
+	app := &rateLimitRequest{ip: net.ParseIP("10.2.0.1"), ns: "prod.users", bytes: 100}
+	other := &rateLimitRequest{ip: net.ParseIP("10.2.0.2"), ns: "prod.users", bytes: 100}
+
+	// each client gets its own bucket
+	for i := 0; i < 2; i++ {
+		wait, limit := policy.Reserve(app, now)
+		ensure.DeepEqual(t, wait, time.Duration(0))
+		ensure.True(t, limit == nil)
+	}
+	wait, limit := policy.Reserve(app, now)
+	ensure.DeepEqual(t, limit.Name, "clients")
+	ensure.DeepEqual(t, wait, 500*time.Millisecond)
+	_, limit = policy.Reserve(other, now)
+	ensure.True(t, limit == nil)
+
+	// rejected requests take nothing, and the buckets refill over time
+	_, limit = policy.Reserve(app, now.Add(250*time.Millisecond))
+	ensure.DeepEqual(t, limit.Name, "clients")
+	_, limit = policy.Reserve(app, now.Add(500*time.Millisecond))
+	ensure.True(t, limit == nil)
+
+	// delayed requests wait for the bytes they need
+	events := &rateLimitRequest{ip: net.ParseIP("10.2.0.3"), ns: "prod.events", bytes: 800}
+	wait, limit = policy.Reserve(events, now)
+	ensure.DeepEqual(t, wait, time.Duration(0))
+	events.ip = net.ParseIP("10.2.0.4")
+	wait, limit = policy.Reserve(events, now)
+	ensure.True(t, limit == nil)
+	ensure.DeepEqual(t, wait, 600*time.Millisecond)
+
+	// requests larger than the burst take it whole
+	events.ip = net.ParseIP("10.2.0.5")
+	events.bytes = 5000
+	wait, limit = policy.Reserve(events, now)
+	ensure.True(t, limit == nil)
+	ensure.DeepEqual(t, wait, 1600*time.Millisecond)
+
+	// until they'd wait longer than the maximum delay
+	events.ip = net.ParseIP("10.2.0.6")
+	events.bytes = 800
+	wait, limit = policy.Reserve(events, now)
+	ensure.DeepEqual(t, limit.Name, "events")
+	ensure.DeepEqual(t, wait, 2400*time.Millisecond)
+
+	// users have their own bursts
+	batch := &rateLimitRequest{ip: net.ParseIP("10.3.0.1"), user: "admin.batch", ns: "prod.users"}
+	for i := 0; i < 3; i++ {
+		batch.ip[15]++
+		_, limit = policy.Reserve(batch, now)
+		ensure.True(t, limit == nil)
+	}
+	batch.ip[15]++
+	_, limit = policy.Reserve(batch, now)
+	ensure.DeepEqual(t, limit.Name, "batch")
+
+	// full buckets are forgotten
+	policy.sweep(now.Add(time.Hour))
+	for _, l := range policy.Limits {
+		ensure.DeepEqual(t, len(l.buckets.m), 0)
+	}
+
+	var none *RateLimitPolicy
+	_, limit = none.Reserve(app, now)
+	ensure.True(t, limit == nil)
+}
+
+func TestRateLimitByApp(t *testing.T) {
+	t.Parallel()
+	policy, err := ParseRateLimitPolicy([]byte(`{"limits": [{"key": "app", "apps": ["billing", "search"], "ops": 1}]}`))
+	ensure.Nil(t, err)
+	now := time.Now()
+	billing := &rateLimitRequest{ip: net.ParseIP("10.2.0.1"), app: "billing"}
+	_, limit := policy.Reserve(billing, now)
+	ensure.True(t, limit == nil)
+	_, limit = policy.Reserve(billing, now)
+	ensure.DeepEqual(t, limit.Name, "limit1")
+
+	// other applications have their own buckets, or no limit
+	_, limit = policy.Reserve(&rateLimitRequest{app: "search"}, now)
+	ensure.True(t, limit == nil)
+	for i := 0; i < 2; i++ {
+		_, limit = policy.Reserve(&rateLimitRequest{}, now)
+		ensure.True(t, limit == nil)
+	}
+}
+
+func TestRateLimitMaxKeys(t *testing.T) {
+	t.Parallel()
+	policy, err := ParseRateLimitPolicy([]byte(`{"limits": [{"key": "namespace", "ops": 1, "maxKeys": 2}]}`))
+	ensure.Nil(t, err)
+	now := time.Now()
+	reserve := func(ns string) *RateLimit {
+		_, limit := policy.Reserve(&rateLimitRequest{ns: ns}, now)
+		return limit
+	}
+
+	// the first keys get their own buckets
+	ensure.True(t, reserve("prod.a") == nil)
+	ensure.True(t, reserve("prod.b") == nil)
+
+	// the others share one, whatever namespaces clients make up
+	ensure.True(t, reserve("prod.c") == nil)
+	ensure.DeepEqual(t, reserve("prod.d").Name, "limit1")
+	ensure.DeepEqual(t, reserve("prod.e").Name, "limit1")
+	ensure.DeepEqual(t, len(policy.Limits[0].buckets.m), 3)
+
+	// rejected requests give back what they took from it
+	l := policy.Limits[0]
+	ensure.DeepEqual(t, l.buckets.m[rateLimitOtherKey].ops, float64(0))
+
+	// until the buckets are forgotten
+	policy.sweep(now.Add(time.Hour))
+	ensure.DeepEqual(t, len(l.buckets.m), 0)
+	now = now.Add(time.Hour)
+	ensure.True(t, reserve("prod.d") == nil)
+}
+
+func TestParseRateLimitPolicyErrors(t *testing.T) {
+	t.Parallel()
+	for _, policy := range []string{
+		`{`,
+		`{"limits": [{"key": "driver", "ops": 1}]}`,
+		`{"limits": [{"action": "block", "ops": 1}]}`,
+		`{"limits": [{"name": "none"}]}`,
+		`{"limits": [{"ops": -1}]}`,
+		`{"limits": [{"ops": 1, "maxDelay": "soon"}]}`,
+		`{"limits": [{"ops": 1, "maxKeys": -1}]}`,
+		`{"limits": [{"ops": 1, "clients": ["10.0.0.300"]}]}`,
+		`{"limits": [{"ops": 1, "namespaces": ["prod.["]}]}`,
+	} {
+		_, err := ParseRateLimitPolicy([]byte(policy))
+		ensure.NotNil(t, err, policy)
+	}
+}
+
+func TestCheckRateLimit(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "dvara-rate-limit")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rate_limit.json")
+	ensure.Nil(t, ioutil.WriteFile(path, []byte(`{"limits": [
+		{"name": "users", "namespaces": ["prod.users"], "ops": 1},
+		{"name": "events", "namespaces": ["prod.events"], "ops": 20, "opsBurst": 1, "action": "delay"}
+	]}`), 0600))
+	limiter := &RateLimiter{Path: path}
+	ensure.Nil(t, limiter.Start())
+	defer limiter.Stop()
+
+	hc := newCounterClient()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{MessageTimeout: time.Minute, RateLimiter: limiter},
+		stats:      hc,
+		ctx:        context.Background(),
+	}
+	conn := &fakeConn{remote: fakeClientAddr}
+	c := p.clients.add(conn)
+	check := func(msg []byte) (bool, *LastError) {
+		conn.in = bytes.NewReader(msg)
+		conn.out.Reset()
+		h, err := p.clientReadHeader(c, time.Minute)
+		ensure.Nil(t, err)
+		var lastError LastError
+		ok, err := p.checkRateLimit(h, c, &lastError)
+		ensure.Nil(t, err)
+		return ok, &lastError
+	}
+
+	// requests over the limit get an error reply
+	find := fakeQuery(1, 0, "prod.$cmd", bson.D{{Name: "find", Value: "users"}})
+	ok, _ := check(find)
+	ensure.True(t, ok)
+	ok, _ = check(find)
+	ensure.False(t, ok)
+	reply := replyDocument(t, conn.out.Bytes())
+	ensure.DeepEqual(t, reply["code"], codeRateLimitExceeded)
+	ensure.StringContains(t, reply["errmsg"].(string), "users")
+	ensure.DeepEqual(t, hc.count("rate_limit.rejected.users"), float64(1))
+
+	// and writes fail the following getLastError
+	ok, lastError := check(fakeInsert("prod.users", bson.M{"a": 1}))
+	ensure.False(t, ok)
+	ensure.True(t, lastError.Exists())
+
+	// or they're delayed
+	insert := fakeInsert("prod.events", bson.M{"a": 1})
+	ok, _ = check(insert)
+	ensure.True(t, ok)
+	start := time.Now()
+	ok, _ = check(insert)
+	ensure.True(t, ok)
+	ensure.True(t, time.Since(start) >= 40*time.Millisecond)
+	ensure.DeepEqual(t, hc.count("rate_limit.delayed"), float64(1))
+
+	// the buckets are kept when the policy is reloaded
+	ensure.Nil(t, ioutil.WriteFile(path, []byte(`{"limits": [{"name": "users", "namespaces": ["prod.*"], "ops": 1}]}`), 0600))
+	future := time.Now().Add(time.Hour)
+	ensure.Nil(t, os.Chtimes(path, future, future))
+	ensure.Nil(t, limiter.reload())
+	ok, _ = check(find)
+	ensure.False(t, ok)
+}
@@ -0,0 +1,175 @@
+package dvara
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// mutationCommands are the commands rejected in read only mode, by lower case
+// name. Aggregations are rejected only with an output stage.
+var mutationCommands = map[string]bool{
+	"insert":                   true,
+	"update":                   true,
+	"delete":                   true,
+	"findandmodify":            true,
+	"create":                   true,
+	"createindexes":            true,
+	"dropindexes":              true,
+	"deleteindexes":            true,
+	"reindex":                  true,
+	"drop":                     true,
+	"dropdatabase":             true,
+	"renamecollection":         true,
+	"collmod":                  true,
+	"converttocapped":          true,
+	"clonecollectionascapped":  true,
+	"emptycapped":              true,
+	"mapreduce":                true,
+	"applyops":                 true,
+	"createuser":               true,
+	"updateuser":               true,
+	"dropuser":                 true,
+	"dropallusersfromdatabase": true,
+	"createrole":               true,
+	"updaterole":               true,
+	"droprole":                 true,
+	"dropallrolesfromdatabase": true,
+	"grantrolestouser":         true,
+	"revokerolesfromuser":      true,
+	"grantprivilegestorole":    true,
+	"revokeprivilegesfromrole": true,
+	"grantrolestorole":         true,
+	"revokerolesfromrole":      true,
+	"eval":                     true,
+	"$eval":                    true,
+	"copydb":                   true,
+	"clonecollection":          true,
+	"compact":                  true,
+}
+
+// ReadOnly rejects every mutation while reads go on, process wide or for
+// some listeners only. It is switched at runtime, to freeze writes during
+// data migrations for example.
+type ReadOnly struct {
+	enabled int32
+
+	// listeners is the set of proxy addresses in read only mode, replaced
+	// rather than modified so it can be read without locking
+	mutex     sync.Mutex
+	listeners atomic.Value
+}
+
+// Enabled returns true if the listener with the given proxy address is in
+// read only mode.
+func (r *ReadOnly) Enabled(proxyAddr string) bool {
+	if r == nil {
+		return false
+	}
+	if atomic.LoadInt32(&r.enabled) == 1 {
+		return true
+	}
+	listeners, _ := r.listeners.Load().(map[string]bool)
+	return listeners[proxyAddr]
+}
+
+// Set switches read only mode process wide.
+func (r *ReadOnly) Set(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&r.enabled, v)
+	corelog.LogInfoMessage("read only mode switched", "enabled", enabled)
+}
+
+// Toggle switches read only mode process wide on if it was off and off
+// otherwise. It returns the new mode.
+func (r *ReadOnly) Toggle() bool {
+	enabled := atomic.LoadInt32(&r.enabled) == 0
+	r.Set(enabled)
+	return enabled
+}
+
+// SetListener switches read only mode for the listener with the given proxy
+// address.
+func (r *ReadOnly) SetListener(proxyAddr string, enabled bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	old, _ := r.listeners.Load().(map[string]bool)
+	listeners := make(map[string]bool, len(old)+1)
+	for addr := range old {
+		listeners[addr] = true
+	}
+	if enabled {
+		listeners[proxyAddr] = true
+	} else {
+		delete(listeners, proxyAddr)
+	}
+	r.listeners.Store(listeners)
+	corelog.LogInfoMessage("read only mode switched", "listener", proxyAddr, "enabled", enabled)
+}
+
+// ReadOnlyStatus is the current read only mode.
+type ReadOnlyStatus struct {
+	Enabled   bool     `json:"enabled"`
+	Listeners []string `json:"listeners"`
+}
+
+// Status returns the current read only mode.
+func (r *ReadOnly) Status() ReadOnlyStatus {
+	s := ReadOnlyStatus{Enabled: atomic.LoadInt32(&r.enabled) == 1, Listeners: []string{}}
+	listeners, _ := r.listeners.Load().(map[string]bool)
+	for addr := range listeners {
+		s.Listeners = append(s.Listeners, addr)
+	}
+	sort.Strings(s.Listeners)
+	return s
+}
+
+// isMutation returns true if the entire request message modifies data.
+func isMutation(msg []byte) bool {
+	op := OpCode(getInt32(msg, 12))
+	if op.IsMutation() {
+		return true
+	}
+	if (op != OpQuery && op != OpMsg) || !isCommandRequest(msg) {
+		return false
+	}
+	name, cmd := requestCommand(msg)
+	if strings.ToLower(name) == "aggregate" {
+		return hasOutputStage(cmd)
+	}
+	return mutationCommands[strings.ToLower(name)]
+}
+
+// checkReadOnly rejects the message with the given header if it is a
+// mutation and the listener is in read only mode. It returns true if the
+// message should be proxied.
+func (p *Proxy) checkReadOnly(h *messageHeader, c *proxyClient, lastError *LastError) (bool, error) {
+	if !p.ReplicaSet.ReadOnly.Enabled(p.ProxyAddr) {
+		return true, nil
+	}
+	if !h.OpCode.IsMutation() && h.OpCode != OpQuery && h.OpCode != OpMsg {
+		return true, nil
+	}
+	msg, err := c.request.read(h, c.conn)
+	if err != nil {
+		return false, err
+	}
+	if !isMutation(msg) {
+		return true, nil
+	}
+	stats.BumpSum(p.stats, "read_only.rejected", 1)
+	what := "operation " + h.OpCode.String()
+	if isCommandRequest(msg) {
+		name, _ := requestCommand(msg)
+		what = "command " + name
+	}
+	e := newProxyError(codeIllegalOperation, "dvara: %s rejected, the proxy is in read only mode", what)
+	return false, p.rejectMessage(h, c, lastError, e)
+}
@@ -0,0 +1,171 @@
+package dvara
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestIsMutation(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		msg      []byte
+		mutation bool
+	}{
+		{fakeInsert("db.c", bson.M{}), true},
+		{fakeQuery(1, 0, "db.c", bson.M{}), false},
+		{fakeQuery(1, 0, "db.$cmd", bson.D{{Name: "find", Value: "c"}}), false},
+		{fakeQuery(1, 0, "db.$cmd", bson.D{{Name: "insert", Value: "c"}}), true},
+		{fakeQuery(1, 0, "db.$cmd", bson.D{{Name: "findandmodify", Value: "c"}}), true},
+		{fakeQuery(1, 0, "db.$cmd", bson.D{{Name: "createIndexes", Value: "c"}}), true},
+		{fakeQuery(1, 0, "db.$cmd", bson.D{{Name: "create", Value: "c"}}), true},
+		{fakeQuery(1, 0, "db.$cmd", bson.D{
+			{Name: "aggregate", Value: "c"},
+			{Name: "pipeline", Value: []interface{}{bson.D{{Name: "$match", Value: bson.M{}}}}},
+		}), false},
+		{fakeQuery(1, 0, "db.$cmd", bson.D{
+			{Name: "aggregate", Value: "c"},
+			{Name: "pipeline", Value: []interface{}{bson.D{{Name: "$merge", Value: "d"}}}},
+		}), true},
+		{fakeQuery(1, 0, "db.$cmd", bson.D{{Name: "$eval", Value: "db.c.drop()"}}), true},
+		{fakeQuery(1, 0, "db.$cmd", bson.D{{Name: "compact", Value: "c"}}), true},
+		{fakeQuery(1, 0, "admin.$cmd", bson.D{{Name: "copydb", Value: 1}}), true},
+		{fakeQuery(1, 0, "admin.$cmd", bson.D{{Name: "grantRolesToUser", Value: "u"}}), true},
+		{fakeQuery(1, 0, "db.$cmd", bson.D{
+			{Name: "$query", Value: bson.D{{Name: "insert", Value: "c"}}},
+			{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "primary"}}},
+		}), true},
+		{fakeQuery(1, 0, "db.$cmd", bson.D{
+			{Name: "$query", Value: bson.D{{Name: "count", Value: "c"}}},
+			{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "secondary"}}},
+		}), false},
+		{fakeGetMore(1), false},
+	}
+	for _, c := range cases {
+		ensure.DeepEqual(t, isMutation(c.msg), c.mutation, c.msg)
+	}
+}
+
+func TestReadOnlyModes(t *testing.T) {
+	t.Parallel()
+	var none *ReadOnly
+	ensure.False(t, none.Enabled("127.0.0.1:6000"))
+
+	var r ReadOnly
+	ensure.False(t, r.Enabled("127.0.0.1:6000"))
+	r.SetListener("127.0.0.1:6000", true)
+	ensure.True(t, r.Enabled("127.0.0.1:6000"))
+	ensure.False(t, r.Enabled("127.0.0.1:6001"))
+	ensure.True(t, r.Toggle())
+	ensure.True(t, r.Enabled("127.0.0.1:6001"))
+	ensure.DeepEqual(t, r.Status(), ReadOnlyStatus{Enabled: true, Listeners: []string{"127.0.0.1:6000"}})
+	ensure.False(t, r.Toggle())
+	r.SetListener("127.0.0.1:6000", false)
+	ensure.False(t, r.Enabled("127.0.0.1:6000"))
+}
+
+func TestCheckReadOnly(t *testing.T) {
+	t.Parallel()
+	readOnly := &ReadOnly{}
+	hc := newCounterClient()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{MessageTimeout: time.Minute, ReadOnly: readOnly},
+		ProxyAddr:  "127.0.0.1:6000",
+		stats:      hc,
+	}
+	conn := &fakeConn{}
+	c := p.clients.add(conn)
+	check := func(msg []byte) (bool, *LastError) {
+		conn.in = bytes.NewReader(msg)
+		conn.out.Reset()
+		h, err := p.clientReadHeader(c, time.Minute)
+		ensure.Nil(t, err)
+		var lastError LastError
+		ok, err := p.checkReadOnly(h, c, &lastError)
+		ensure.Nil(t, err)
+		return ok, &lastError
+	}
+	insert := fakeQuery(1, 0, "db.$cmd", bson.D{{Name: "insert", Value: "c"}})
+
+	// everything goes until read only mode is on
+	ok, _ := check(insert)
+	ensure.True(t, ok)
+	readOnly.SetListener(p.ProxyAddr, true)
+
+	// then write commands fail
+	ok, _ = check(insert)
+	ensure.False(t, ok)
+	reply := replyDocument(t, conn.out.Bytes())
+	ensure.DeepEqual(t, reply["code"], codeIllegalOperation)
+	ensure.DeepEqual(t, reply["codeName"], "IllegalOperation")
+
+	// and so do legacy writes, on the following getLastError
+	ok, lastError := check(fakeInsert("db.c", bson.M{"a": 1}))
+	ensure.False(t, ok)
+	ensure.True(t, lastError.Exists())
+	ensure.DeepEqual(t, hc.count("read_only.rejected"), float64(2))
+
+	// while reads go on
+	ok, _ = check(fakeQuery(1, 0, "db.$cmd", bson.D{{Name: "find", Value: "c"}}))
+	ensure.True(t, ok)
+	ok, _ = check(fakeGetMore(1))
+	ensure.True(t, ok)
+}
+
+func TestAdminReadOnly(t *testing.T) {
+	t.Parallel()
+	manager := NewStateManager(&ReplicaSet{})
+	manager.proxyToReal["127.0.0.1:6000"] = "127.0.0.1:27017"
+	a := &AdminServer{ReadOnly: &ReadOnly{}, StateManager: manager}
+	ensure.Nil(t, a.Start())
+	defer a.Stop()
+	send := func(method string, form url.Values) (int, ReadOnlyStatus) {
+		r, err := http.NewRequest(method, "/read_only?"+form.Encode(), nil)
+		ensure.Nil(t, err)
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		var status ReadOnlyStatus
+		if w.Code == http.StatusOK {
+			ensure.Nil(t, json.Unmarshal(w.Body.Bytes(), &status))
+		}
+		return w.Code, status
+	}
+
+	code, status := send("POST", url.Values{"enabled": {"true"}, "listener": {"127.0.0.1:6000"}})
+	ensure.DeepEqual(t, code, http.StatusOK)
+	ensure.DeepEqual(t, status, ReadOnlyStatus{Listeners: []string{"127.0.0.1:6000"}})
+	code, status = send("POST", url.Values{"enabled": {"1"}})
+	ensure.DeepEqual(t, code, http.StatusOK)
+	ensure.True(t, status.Enabled)
+	code, status = send("GET", nil)
+	ensure.DeepEqual(t, code, http.StatusOK)
+	ensure.True(t, status.Enabled)
+
+	// only listeners of running proxies are switched on
+	code, _ = send("POST", url.Values{"enabled": {"true"}, "listener": {"127.0.0.1:6001"}})
+	ensure.DeepEqual(t, code, http.StatusBadRequest)
+	code, _ = send("POST", url.Values{"enabled": {"true"}, "listener": {"bogus"}})
+	ensure.DeepEqual(t, code, http.StatusBadRequest)
+
+	// but they're switched off after their proxy is gone
+	manager.Lock()
+	delete(manager.proxyToReal, "127.0.0.1:6000")
+	manager.Unlock()
+	code, status = send("POST", url.Values{"enabled": {"false"}, "listener": {"127.0.0.1:6000"}})
+	ensure.DeepEqual(t, code, http.StatusOK)
+	ensure.DeepEqual(t, status.Listeners, []string{})
+	code, _ = send("POST", url.Values{"enabled": {"false"}, "listener": {"127.0.0.1:6000"}})
+	ensure.DeepEqual(t, code, http.StatusBadRequest)
+
+	code, _ = send("POST", url.Values{"enabled": {"maybe"}})
+	ensure.DeepEqual(t, code, http.StatusBadRequest)
+	code, _ = send("DELETE", nil)
+	ensure.DeepEqual(t, code, http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,459 @@
+package dvara
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// replayQueueSize is the number of pending requests buffered per replayed
+// connection.
+const replayQueueSize = 1024
+
+// Replayer replays captured client traffic against a mongo server.
+type Replayer struct {
+	// Target is the address of the server the traffic is replayed against.
+	Target string
+
+	// Speed scales the original timing, 2 replays twice as fast as the
+	// original traffic. Zero replays as fast as possible.
+	Speed float64
+
+	// Timeout is the time allowed for each replayed message.
+	Timeout time.Duration
+
+	// Credentials replayed connections authenticate with, if the target uses
+	// auth. The captured authentication conversations are not replayed, as
+	// they can't succeed against another server.
+	Credentials CredentialProvider
+
+	mutex   sync.Mutex
+	results map[replayKey]*replayResult
+	cursors map[uint32]map[int64]*replayResult
+	report  ReplayReport
+}
+
+// ReplayReport summarizes the outcome of a replay compared to the original
+// traffic.
+type ReplayReport struct {
+	Connections int
+	Requests    int
+
+	// AuthSkipped counts the captured authentication commands which were not
+	// replayed.
+	AuthSkipped int
+
+	// Replies is the number of replies received during the replay.
+	Replies int
+
+	// NetworkErrors counts requests which could not be replayed.
+	NetworkErrors int
+
+	OriginalErrors int
+	ReplayErrors   int
+
+	// NewErrors counts requests that succeeded originally but failed in the
+	// replay, FixedErrors the reverse.
+	NewErrors   int
+	FixedErrors int
+
+	OriginalP50 time.Duration
+	OriginalP99 time.Duration
+	ReplayP50   time.Duration
+	ReplayP99   time.Duration
+}
+
+// String returns a human readable summary of the report.
+func (r *ReplayReport) String() string {
+	return fmt.Sprintf(
+		"connections:%d requests:%d auth_skipped:%d replies:%d network_errors:%d "+
+			"errors:%d (original %d, new %d, fixed %d) "+
+			"p50:%s (original %s) p99:%s (original %s)",
+		r.Connections, r.Requests, r.AuthSkipped, r.Replies, r.NetworkErrors,
+		r.ReplayErrors, r.OriginalErrors, r.NewErrors, r.FixedErrors,
+		r.ReplayP50, r.OriginalP50, r.ReplayP99, r.OriginalP99,
+	)
+}
+
+type replayKey struct {
+	conn      uint32
+	requestID int32
+}
+
+type replayResult struct {
+	command bool
+
+	originalStart   time.Time
+	originalLatency time.Duration
+	originalFailed  bool
+	originalReplied bool
+
+	replayLatency time.Duration
+	replayFailed  bool
+	replayReplied bool
+	replayCursor  int64
+}
+
+// Replay replays the given captures, in order, and reports how the replay
+// compares to the original traffic.
+func (r *Replayer) Replay(captures ...io.Reader) (*ReplayReport, error) {
+	r.results = make(map[replayKey]*replayResult)
+	r.cursors = make(map[uint32]map[int64]*replayResult)
+	r.report = ReplayReport{}
+
+	conns := make(map[uint32]chan []byte)
+	var wg sync.WaitGroup
+	var first time.Time
+	start := time.Now()
+
+	for _, capture := range captures {
+		cr, err := NewCaptureReader(capture)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			rec, err := cr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			if first.IsZero() {
+				first = rec.Time
+			}
+			if r.Speed > 0 {
+				due := start.Add(time.Duration(float64(rec.Time.Sub(first)) / r.Speed))
+				if wait := due.Sub(time.Now()); wait > 0 {
+					time.Sleep(wait)
+				}
+			}
+
+			switch rec.Kind {
+			case CaptureClose:
+				if q, ok := conns[rec.Conn]; ok {
+					close(q)
+					delete(conns, rec.Conn)
+				}
+			case CaptureRequest:
+				if name, _ := requestCommand(rec.Payload); authCommands[name] {
+					r.mutex.Lock()
+					r.report.AuthSkipped++
+					r.mutex.Unlock()
+					continue
+				}
+				q, ok := conns[rec.Conn]
+				if !ok {
+					// Captures may start or rotate while a connection is open.
+					q = make(chan []byte, replayQueueSize)
+					conns[rec.Conn] = q
+					r.mutex.Lock()
+					r.cursors[rec.Conn] = make(map[int64]*replayResult)
+					r.mutex.Unlock()
+					wg.Add(1)
+					go r.replayConn(rec.Conn, q, &wg)
+				}
+				r.mutex.Lock()
+				r.report.Requests++
+				if expectsReply(rec.Payload) {
+					r.results[replayKey{rec.Conn, getInt32(rec.Payload, 4)}] = &replayResult{
+						command:       isCommandRequest(rec.Payload),
+						originalStart: rec.Time,
+					}
+				}
+				r.mutex.Unlock()
+				q <- rec.Payload
+			case CaptureReply:
+				key := replayKey{rec.Conn, getInt32(rec.Payload, 8)}
+				r.mutex.Lock()
+				if res, ok := r.results[key]; ok && !res.originalReplied {
+					res.originalReplied = true
+					res.originalLatency = rec.Time.Sub(res.originalStart)
+					res.originalFailed = replyFailed(res.command, rec.Payload)
+					// Later requests of the connection refer to the cursor by
+					// the original id, which is mapped to the one the request
+					// opening it got in the replay. Replies to getMores carry
+					// the id again.
+					if id := replyCursorID(res.command, rec.Payload); id != 0 && r.cursors[rec.Conn] != nil {
+						if _, ok := r.cursors[rec.Conn][id]; !ok {
+							r.cursors[rec.Conn][id] = res
+						}
+					}
+				}
+				r.mutex.Unlock()
+			}
+		}
+	}
+
+	for _, q := range conns {
+		close(q)
+	}
+	wg.Wait()
+	return r.summarize(), nil
+}
+
+// replayConn sends the requests of one captured connection over its own
+// connection to the target.
+func (r *Replayer) replayConn(id uint32, requests chan []byte, wg *sync.WaitGroup) {
+	defer wg.Done()
+	r.mutex.Lock()
+	r.report.Connections++
+	r.mutex.Unlock()
+
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+		r.mutex.Lock()
+		delete(r.cursors, id)
+		r.mutex.Unlock()
+	}()
+
+	for msg := range requests {
+		if conn == nil {
+			var err error
+			if conn, err = r.dial(); err != nil {
+				r.networkError()
+				continue
+			}
+		}
+
+		msg = remapCursors(msg, func(cursor int64) int64 {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			if res, ok := r.cursors[id][cursor]; ok && res.replayCursor != 0 {
+				return res.replayCursor
+			}
+			return cursor
+		})
+
+		// Exhaust queries would stream replies we don't wait for.
+		if isExhaustQuery(msg) {
+			msg = append([]byte(nil), msg...)
+			setInt32(msg, headerLen, getInt32(msg, headerLen)&^queryExhaust)
+		}
+
+		start := time.Now()
+		conn.SetDeadline(start.Add(r.timeout()))
+		if _, err := conn.Write(msg); err != nil {
+			r.networkError()
+			conn.Close()
+			conn = nil
+			continue
+		}
+		if !expectsReply(msg) {
+			continue
+		}
+		reply, err := readMessage(conn)
+		if err != nil {
+			r.networkError()
+			conn.Close()
+			conn = nil
+			continue
+		}
+
+		r.mutex.Lock()
+		r.report.Replies++
+		if res, ok := r.results[replayKey{id, getInt32(msg, 4)}]; ok {
+			res.replayReplied = true
+			res.replayLatency = time.Since(start)
+			res.replayFailed = replyFailed(res.command, reply)
+			res.replayCursor = replyCursorID(res.command, reply)
+		}
+		r.mutex.Unlock()
+	}
+}
+
+// dial opens a connection to the target, authenticated with the credentials
+// if there are any.
+func (r *Replayer) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", r.Target, r.timeout())
+	if err != nil || r.Credentials == nil {
+		return conn, err
+	}
+	creds, err := r.Credentials.Credentials()
+	if err == nil && creds.Username != "" {
+		conn.SetDeadline(time.Now().Add(r.timeout()))
+		socket := &mongoSocket{conn: conn}
+		err = socket.Login(Credential{Username: creds.Username, Password: creds.Password, Source: "admin"})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (r *Replayer) timeout() time.Duration {
+	if r.Timeout == 0 {
+		return time.Minute
+	}
+	return r.Timeout
+}
+
+func (r *Replayer) networkError() {
+	r.mutex.Lock()
+	r.report.NetworkErrors++
+	r.mutex.Unlock()
+}
+
+func (r *Replayer) summarize() *ReplayReport {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	report := r.report
+	var original, replay []time.Duration
+	for _, res := range r.results {
+		if res.originalReplied {
+			original = append(original, res.originalLatency)
+			if res.originalFailed {
+				report.OriginalErrors++
+			}
+		}
+		if res.replayReplied {
+			replay = append(replay, res.replayLatency)
+			if res.replayFailed {
+				report.ReplayErrors++
+			}
+		}
+		if res.originalReplied && res.replayReplied {
+			if !res.originalFailed && res.replayFailed {
+				report.NewErrors++
+			}
+			if res.originalFailed && !res.replayFailed {
+				report.FixedErrors++
+			}
+		}
+	}
+
+	sort.Sort(durations(original))
+	sort.Sort(durations(replay))
+	report.OriginalP50 = percentile(original, 0.50)
+	report.OriginalP99 = percentile(original, 0.99)
+	report.ReplayP50 = percentile(replay, 0.50)
+	report.ReplayP99 = percentile(replay, 0.99)
+	return &report
+}
+
+// replyCursorID returns the id of the cursor opened by the entire reply
+// message, zero if there is none. Commands reply with their cursor in the
+// reply document.
+func replyCursorID(command bool, reply []byte) int64 {
+	var doc []byte
+	switch OpCode(getInt32(reply, 12)) {
+	case OpReply:
+		if len(reply) < headerLen+len(replyPrefix{}) {
+			return 0
+		}
+		if id := getInt64(reply, headerLen+4); id != 0 || !command {
+			return id
+		}
+		if getInt32(reply, headerLen+16) > 0 {
+			doc = reply[headerLen+len(replyPrefix{}):]
+		}
+	case OpMsg:
+		doc = opMsgBody(reply)
+	}
+	if len(doc) < 5 || int(getInt32(doc, 0)) > len(doc) {
+		return 0
+	}
+	var d replyDoc
+	if bson.Unmarshal(doc[:getInt32(doc, 0)], &d) != nil || d.Cursor == nil {
+		return 0
+	}
+	return d.Cursor.ID
+}
+
+// remapCursors returns the entire request message with the ids of the
+// cursors it continues or kills replaced by remap. The ids have a fixed size,
+// so they are replaced in a copy of the message, which is returned as is if
+// it refers to no cursor.
+func remapCursors(msg []byte, remap func(int64) int64) []byte {
+	var ids [][]byte
+	b := append([]byte(nil), msg...)
+	switch OpCode(getInt32(b, 12)) {
+	case OpGetMore:
+		if len(b) >= headerLen+8 {
+			ids = append(ids, b[len(b)-8:])
+		}
+	case OpKillCursors:
+		if len(b) >= headerLen+8 {
+			n := int(getInt32(b, headerLen+4))
+			for i := 0; i < n && headerLen+8+8*(i+1) <= len(b); i++ {
+				ids = append(ids, b[headerLen+8+8*i:headerLen+8+8*(i+1)])
+			}
+		}
+	case OpQuery, OpMsg:
+		ids = commandCursorIDs(b)
+	}
+	if len(ids) == 0 {
+		return msg
+	}
+	for _, id := range ids {
+		binary.LittleEndian.PutUint64(id, uint64(remap(int64(binary.LittleEndian.Uint64(id)))))
+	}
+	// A checksum would no longer match the message.
+	if OpCode(getInt32(b, 12)) == OpMsg {
+		if flags := getInt32(b, headerLen); flags&opMsgChecksumPresent != 0 && len(b) >= headerLen+8 {
+			setInt32(b, headerLen, flags&^opMsgChecksumPresent)
+			b = b[:len(b)-4]
+			setInt32(b, 0, int32(len(b)))
+		}
+	}
+	return b
+}
+
+// commandCursorIDs returns the cursor ids of the getMore or killCursors
+// command in the entire request message, as the parts of the message holding
+// them.
+func commandCursorIDs(msg []byte) [][]byte {
+	var doc []byte
+	switch OpCode(getInt32(msg, 12)) {
+	case OpQuery:
+		if len(msg) < headerLen+4 {
+			return nil
+		}
+		ns := msg[headerLen+4:]
+		i := bytes.IndexByte(ns, x00)
+		if i < 0 || len(ns) < i+1+8 {
+			return nil
+		}
+		doc = ns[i+1+8:]
+	case OpMsg:
+		doc = opMsgBody(msg)
+	}
+	// Raw values refer to the message rather than copies of it.
+	var cmd bson.RawD
+	if doc == nil || bson.Unmarshal(doc, &cmd) != nil || len(cmd) == 0 {
+		return nil
+	}
+	var ids [][]byte
+	switch cmd[0].Name {
+	case "getMore":
+		if cmd[0].Value.Kind == 0x12 {
+			ids = append(ids, cmd[0].Value.Data)
+		}
+	case "killCursors":
+		for _, e := range cmd {
+			var cursors bson.RawD
+			if e.Name != "cursors" || e.Value.Kind != 0x04 || bson.Unmarshal(e.Value.Data, &cursors) != nil {
+				continue
+			}
+			for _, c := range cursors {
+				if c.Value.Kind == 0x12 {
+					ids = append(ids, c.Value.Data)
+				}
+			}
+		}
+	}
+	return ids
+}
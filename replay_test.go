@@ -0,0 +1,182 @@
+package dvara
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// fakeServer replies to every message it receives with the reply returned by
+// the given function.
+func fakeServer(t *testing.T, reply func(request []byte) []byte) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				for {
+					msg, err := readMessage(c)
+					if err != nil {
+						return
+					}
+					if _, err := c.Write(reply(msg)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestReplay(t *testing.T) {
+	t.Parallel()
+
+	// the replay target fails every count command
+	l := fakeServer(t, func(request []byte) []byte {
+		if bytes.Contains(request, []byte("count")) {
+			return fakeReplyTo(getInt32(request, 4), bson.M{"ok": 0, "errmsg": "nope"})
+		}
+		return fakeReplyTo(getInt32(request, 4), bson.M{"ok": 1})
+	})
+	defer l.Close()
+
+	var capture bytes.Buffer
+	capture.WriteString(captureMagic)
+	start := time.Now()
+	records := []*CaptureRecord{
+		{Conn: 1, Kind: CaptureOpen, Payload: []byte("10.0.0.1:1234")},
+		{Conn: 1, Kind: CaptureRequest, Payload: fakeQuery(1, 0, "test.$cmd", bson.M{"count": "users"})},
+		{Conn: 1, Kind: CaptureReply, Payload: fakeReplyTo(1, bson.M{"ok": 1, "n": 3})},
+		{Conn: 1, Kind: CaptureRequest, Payload: fakeQuery(2, 0, "test.$cmd", bson.M{"ping": 1})},
+		{Conn: 1, Kind: CaptureReply, Payload: fakeReplyTo(2, bson.M{"ok": 0})},
+		{Conn: 2, Kind: CaptureRequest, Payload: fakeQuery(1, queryExhaust, "test.users", bson.M{})},
+		{Conn: 2, Kind: CaptureReply, Payload: fakeReplyTo(1, bson.M{"name": "bob"})},
+		{Conn: 1, Kind: CaptureClose},
+	}
+	for i, r := range records {
+		r.Time = start.Add(time.Duration(i) * time.Millisecond)
+		_, err := r.writeTo(&capture)
+		ensure.Nil(t, err)
+	}
+
+	replayer := Replayer{Target: l.Addr().String(), Speed: 10}
+	report, err := replayer.Replay(&capture)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, report.Connections, 2)
+	ensure.DeepEqual(t, report.Requests, 3)
+	ensure.DeepEqual(t, report.Replies, 3)
+	ensure.DeepEqual(t, report.NetworkErrors, 0)
+	ensure.DeepEqual(t, report.OriginalErrors, 1)
+	ensure.DeepEqual(t, report.ReplayErrors, 1)
+	ensure.DeepEqual(t, report.NewErrors, 1)
+	ensure.DeepEqual(t, report.FixedErrors, 1)
+}
+
+func TestReplayNetworkErrors(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	target := l.Addr().String()
+	l.Close()
+
+	var capture bytes.Buffer
+	capture.WriteString(captureMagic)
+	r := CaptureRecord{Conn: 1, Kind: CaptureRequest, Payload: fakeQuery(1, 0, "test.users", bson.M{})}
+	_, err = r.writeTo(&capture)
+	ensure.Nil(t, err)
+
+	replayer := Replayer{Target: target, Timeout: time.Second}
+	report, err := replayer.Replay(&capture)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, report.NetworkErrors, 1)
+	ensure.DeepEqual(t, report.Replies, 0)
+}
+
+func TestReplayCursors(t *testing.T) {
+	t.Parallel()
+
+	// the replay target opens cursor 42 where the original server opened 7
+	l := fakeServer(t, func(request []byte) []byte {
+		id := getInt32(request, 4)
+		name, cmd := requestCommand(request)
+		switch name {
+		case "find":
+			return fakeReplyTo(id, bson.M{"ok": 1, "cursor": bson.M{"id": int64(42), "ns": "test.users"}})
+		case "getMore":
+			if cmd[0].Value == int64(42) {
+				return fakeReplyTo(id, bson.M{"ok": 1, "cursor": bson.M{"id": int64(42), "ns": "test.users"}})
+			}
+		case "killCursors":
+			if cursors, _ := lookup(cmd, "cursors").([]interface{}); len(cursors) == 1 && cursors[0] == int64(42) {
+				return fakeReplyTo(id, bson.M{"ok": 1})
+			}
+		}
+		return fakeReplyTo(id, bson.M{"ok": 0, "errmsg": "nope"})
+	})
+	defer l.Close()
+
+	var capture bytes.Buffer
+	capture.WriteString(captureMagic)
+	start := time.Now()
+	cursor := bson.M{"id": int64(7), "ns": "test.users"}
+	records := []*CaptureRecord{
+		{Conn: 1, Kind: CaptureRequest, Payload: fakeQuery(1, 0, "admin.$cmd", bson.M{"saslStart": 1})},
+		{Conn: 1, Kind: CaptureReply, Payload: fakeReplyTo(1, bson.M{"ok": 1})},
+		{Conn: 1, Kind: CaptureRequest, Payload: fakeQuery(2, 0, "test.$cmd", bson.D{{Name: "find", Value: "users"}})},
+		{Conn: 1, Kind: CaptureReply, Payload: fakeReplyTo(2, bson.M{"ok": 1, "cursor": cursor})},
+		{Conn: 1, Kind: CaptureRequest, Payload: fakeQuery(3, 0, "test.$cmd", bson.D{{Name: "getMore", Value: int64(7)}, {Name: "collection", Value: "users"}})},
+		{Conn: 1, Kind: CaptureReply, Payload: fakeReplyTo(3, bson.M{"ok": 1, "cursor": cursor})},
+		{Conn: 1, Kind: CaptureRequest, Payload: fakeQuery(4, 0, "test.$cmd", bson.D{{Name: "killCursors", Value: "users"}, {Name: "cursors", Value: []int64{7}}})},
+		{Conn: 1, Kind: CaptureReply, Payload: fakeReplyTo(4, bson.M{"ok": 1})},
+	}
+	for i, r := range records {
+		r.Time = start.Add(time.Duration(i) * time.Millisecond)
+		_, err := r.writeTo(&capture)
+		ensure.Nil(t, err)
+	}
+
+	replayer := Replayer{Target: l.Addr().String()}
+	report, err := replayer.Replay(&capture)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, report.AuthSkipped, 1)
+	ensure.DeepEqual(t, report.Requests, 3)
+	ensure.DeepEqual(t, report.Replies, 3)
+	ensure.DeepEqual(t, report.ReplayErrors, 0)
+	ensure.DeepEqual(t, report.NewErrors, 0)
+}
+
+func TestRemapCursors(t *testing.T) {
+	t.Parallel()
+	remap := func(id int64) int64 { return id * 10 }
+
+	getMore := addHeader(nil, int(OpGetMore))
+	getMore = addInt32(getMore, 0)
+	getMore = addCString(getMore, "test.users")
+	getMore = addInt32(getMore, 0)
+	getMore = addInt64(getMore, 7)
+	setInt32(getMore, 0, int32(len(getMore)))
+	remapped := remapCursors(getMore, remap)
+	ensure.DeepEqual(t, getMoreCursorID(remapped), int64(70))
+	ensure.DeepEqual(t, getMoreCursorID(getMore), int64(7))
+
+	kill := addHeader(nil, int(OpKillCursors))
+	kill = addInt32(kill, 0)
+	kill = addInt32(kill, 2)
+	kill = addInt64(kill, 7)
+	kill = addInt64(kill, 8)
+	setInt32(kill, 0, int32(len(kill)))
+	ensure.DeepEqual(t, killCursorsIDs(remapCursors(kill, remap)), []int64{70, 80})
+
+	find := fakeQuery(1, 0, "test.$cmd", bson.M{"find": "users"})
+	ensure.DeepEqual(t, remapCursors(find, remap), find)
+}
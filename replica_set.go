@@ -6,6 +6,7 @@ import (
 	"flag"
 	"fmt"
 	"net"
+	"net/netip"
 	"sync"
 	"time"
 
@@ -28,6 +29,15 @@ var errNoAddrsGiven = errors.New("dvara: no seed addresses given for ReplicaSet"
 type ReplicaSet struct {
 	ReplicaSetStateCreator *ReplicaSetStateCreator `inject:""`
 	ProxyQuery             *ProxyQuery             `inject:""`
+	Capture                *Capture                `inject:""`
+	ConnectionBudget       *ConnectionBudget       `inject:""`
+	CursorTracker          *CursorTracker          `inject:""`
+	UserStore              *UserStore              `inject:""`
+	CredentialWatcher      *CredentialWatcher      `inject:""`
+	Firewall               *Firewall               `inject:""`
+	RateLimiter            *RateLimiter            `inject:""`
+	ReadOnly               *ReadOnly               `inject:""`
+	Drivers                *Drivers                `inject:""`
 
 	// Stats if provided will be used to record interesting stats.
 	Stats stats.Client `inject:""`
@@ -50,6 +60,22 @@ type ReplicaSet struct {
 	// Maximum number of connections that will be established to each mongo node.
 	MaxConnections uint
 
+	// UserPoolMaxConnections is the maximum number of connections to each
+	// mongo node for the clients of each user mapped to a backend user, unless
+	// the user has its own limit. Zero means MaxConnections.
+	UserPoolMaxConnections uint
+
+	// UserPoolsMaxConnections is the maximum number of connections to each
+	// mongo node of all the user pools together, which also share the limits
+	// of the ConnectionBudget and adaptive concurrency with the proxy's pool.
+	// Zero means MaxConnections.
+	UserPoolsMaxConnections uint
+
+	// UserPoolIdleTimeout is how long a user pool may go unused before it is
+	// closed along with its connections. Zero keeps them until the proxy
+	// stops.
+	UserPoolIdleTimeout time.Duration
+
 	// MinIdleConnections is the number of idle server connections we'll keep
 	// around.
 	MinIdleConnections uint
@@ -58,6 +84,61 @@ type ReplicaSet struct {
 	// considered idle.
 	ServerIdleTimeout time.Duration
 
+	// ServerPoolMaxWait is how long a client message will wait for a server
+	// connection when MaxConnections are in use. Zero means no limit.
+	ServerPoolMaxWait time.Duration
+
+	// ServerPoolMaxWaiting is how many client messages may wait for a server
+	// connection before new ones are rejected. Zero means no limit.
+	ServerPoolMaxWaiting uint
+
+	// AdaptiveLatencyTarget enables adapting the number of concurrent server
+	// connections per member to their latency. Messages slower than the target
+	// reduce it, down to AdaptiveMinConnections.
+	AdaptiveLatencyTarget  time.Duration
+	AdaptiveMinConnections uint
+	AdaptiveBackoff        float64
+
+	// PoolingMode is the pooling mode of the proxies, TransactionPooling by
+	// default.
+	PoolingMode PoolingMode
+
+	// ListenerPoolingModes overrides the PoolingMode of the proxies listening
+	// on some ports, so clients choose the mode by the port they connect to.
+	ListenerPoolingModes []ListenerPoolingMode
+
+	// FairQueuing enables fair scheduling of server connections between
+	// clients, when all are in use, instead of first come first served.
+	FairQueuing bool
+
+	// ClientClasses groups clients for scheduling, by default all clients are
+	// part of DefaultClass.
+	ClientClasses []ClientClass
+
+	// ClassWeights is the relative weight of each class when FairQueuing.
+	ClassWeights map[string]uint
+
+	// ReservedConnections is the number of server connections per member only
+	// available to SystemClass clients, which include dvara's own health check
+	// and the cursors it kills for clients which went away.
+	ReservedConnections uint
+
+	// ServerMaxLifetime is the duration after which a server connection is
+	// closed rather than reused. Zero means no limit.
+	ServerMaxLifetime time.Duration
+
+	// ServerLifetimeJitter is the maximum random duration added to
+	// ServerMaxLifetime for each connection.
+	ServerLifetimeJitter time.Duration
+
+	// ServerValidateIdle is the idle duration after which a server connection
+	// is pinged before being used. Zero disables it.
+	ServerValidateIdle time.Duration
+
+	// ServerValidateInterval is how often idle server connections are pinged in
+	// the background. Zero disables it.
+	ServerValidateInterval time.Duration
+
 	// ServerClosePoolSize is the number of goroutines that will handle closing
 	// server connections.
 	ServerClosePoolSize uint
@@ -70,6 +151,28 @@ type ReplicaSet struct {
 	// single client.
 	MaxPerClientConnections uint
 
+	// ProxyProtocol is whether client connections start with a PROXY protocol
+	// header conveying the client address, ProxyProtocolOff by default.
+	ProxyProtocol ProxyProtocolMode
+
+	// ProxyProtocolTrusted are the networks of the load balancers allowed to
+	// send PROXY protocol headers. It is required with the PROXY protocol.
+	ProxyProtocolTrusted []*net.IPNet
+
+	// ClientAcceptRate is how many client connections per second each proxy
+	// accepts, after a burst of ClientAcceptBurst. Clients beyond it wait in
+	// the listen backlog. Zero means no limit.
+	ClientAcceptRate  float64
+	ClientAcceptBurst uint
+
+	// MaxConcurrentDials is how many server connections to each member may be
+	// opened at the same time. Zero means no limit.
+	MaxConcurrentDials uint
+
+	// ClientRules allow or deny clients by network and override their
+	// connection limits, the first rule a client matches applies.
+	ClientRules []ClientRule
+
 	// GetLastErrorTimeout is how long we'll hold on to an acquired server
 	// connection expecting a possibly getLastError call.
 	GetLastErrorTimeout time.Duration
@@ -78,29 +181,95 @@ type ReplicaSet struct {
 	// proxied.
 	MessageTimeout time.Duration
 
+	// AwaitDataTimeout is the timeout for messages on tailable awaitData
+	// cursors, which may wait on the server for new data. Zero means
+	// MessageTimeout.
+	AwaitDataTimeout time.Duration
+
+	// ExhaustReplyTimeout is the timeout for each reply streamed to an exhaust
+	// query. Zero means MessageTimeout.
+	ExhaustReplyTimeout time.Duration
+
+	// RetryReads if true retries reads once on a new server connection when
+	// theirs fails before any of the reply reached the client. Reads aren't
+	// retried in session pooling mode, the session being lost with the
+	// connection.
+	RetryReads bool
+
 	// Name is the name of the replica set to connect to. Nodes that are not part
 	// of this replica set will be ignored. If this is empty, the first replica set
 	// will be used
 	Name string
 
-	// Username is the username used to connect to the server for retrieving replica state.
+	// Username is the username used to connect to the server, unless the
+	// CredentialWatcher provides the credentials.
 	Username string
 
-	// Password is the password used to connect to the server for retrieving replica state.
+	// Password is the password used to connect to the server, unless the
+	// CredentialWatcher provides the credentials.
 	Password string
 
+	// CancelAbandonedOps enables killing the operations still running on a
+	// server connection we abandon, because the client went away or the
+	// message timed out. The proxy user needs the inprog and killop
+	// privileges.
+	CancelAbandonedOps bool
+
+	// MirrorAddr is the address of a shadow server which reads, and optionally
+	// writes, are duplicated to. Mirroring is disabled if empty.
+	MirrorAddr string
+
+	// MirrorSampleRate is the fraction of eligible messages that are mirrored.
+	MirrorSampleRate float64
+
+	// MirrorWrites enables mirroring writes as well as reads.
+	MirrorWrites bool
+
+	// MirrorCompare enables comparing shadow replies with the real ones.
+	MirrorCompare bool
+
+	// MirrorQueueSize is the number of messages waiting to be mirrored, per
+	// proxy, after which new messages are dropped.
+	MirrorQueueSize uint
+
+	// MirrorMaxConnections is the maximum number of connections each proxy
+	// will establish to the shadow server.
+	MirrorMaxConnections uint
+
 	restarter *sync.Once
+
+	// rejecting is the number of rejected clients, across proxies, being
+	// answered with the reason they're rejected.
+	rejecting int32
+
+	// systemClients are the local addresses of dvara's own clients of the
+	// proxies, such as the health check, systemCount how many there are.
+	systemMutex   sync.Mutex
+	systemClients map[netip.AddrPort]struct{}
+	systemCount   int32
 }
 
 func (r *ReplicaSet) Start() error {
 	if r.Addrs == "" {
 		return errNoAddrsGiven
 	}
+	if r.ProxyProtocol != "" && r.ProxyProtocol != ProxyProtocolOff && len(r.ProxyProtocolTrusted) == 0 {
+		return errProxyProtocolNoTrusted
+	}
 
 	r.restarter = new(sync.Once)
 	return nil
 }
 
+// credentials returns the provider of the credentials used to connect to the
+// servers.
+func (r *ReplicaSet) credentials() CredentialProvider {
+	if r.CredentialWatcher.Enabled() {
+		return r.CredentialWatcher
+	}
+	return Credentials{Username: r.Username, Password: r.Password}
+}
+
 func (r *ReplicaSet) proxyAddr(l net.Listener) string {
 	return l.Addr().String()
 }
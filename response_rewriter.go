@@ -8,6 +8,8 @@ import (
 	"io"
 	"io/ioutil"
 	"strings"
+	"sync"
+	"time"
 
 	corelog "github.com/intercom/gocore/log"
 	"gopkg.in/mgo.v2/bson"
@@ -32,14 +34,38 @@ type ProxyQuery struct {
 	GetLastErrorRewriter             *GetLastErrorRewriter             `inject:""`
 	IsMasterResponseRewriter         *IsMasterResponseRewriter         `inject:""`
 	ReplSetGetStatusResponseRewriter *ReplSetGetStatusResponseRewriter `inject:""`
+	QueryShapeStats                  *QueryShapeStats                  `inject:""`
 }
 
-// Proxy proxies an OpQuery and a corresponding response.
+// queryBuffer holds what is read of a query before it is proxied, and of its
+// reply, so that queries are proxied without allocating.
+type queryBuffer struct {
+	header   [headerLen]byte
+	flags    [4]byte
+	twoInt32 [8]byte
+	name     []byte
+	parts    [][]byte
+	reply    replyBuffer
+}
+
+// queryBuffers holds the buffers of the queries being proxied.
+var queryBuffers = sync.Pool{
+	New: func() interface{} {
+		return &queryBuffer{parts: make([][]byte, 0, 5)}
+	},
+}
+
+// Proxy proxies an OpQuery and a corresponding response. The client's
+// cursors, if tracked, are updated from the response. Query shapes are
+// recorded for the client's driver, nil if unknown.
 func (p *ProxyQuery) Proxy(
 	h *messageHeader,
 	client io.ReadWriter,
 	server io.ReadWriter,
 	lastError *LastError,
+	cursors *Cursors,
+	stream *cursorStream,
+	driver *clientDriver,
 ) error {
 
 	// https://github.com/mongodb/mongo/search?q=lastError.disableForCommand
@@ -48,30 +74,47 @@ func (p *ProxyQuery) Proxy(
 	// layer.
 	resetLastError := true
 
-	parts := [][]byte{h.ToWire()}
+	// When collecting query shapes, every query is parsed and its outcome is
+	// recorded once we're done with it.
+	collectShape := p.QueryShapeStats != nil && p.QueryShapeStats.Enabled
+	var shape *QueryShape
+	sample := querySample{BytesIn: int64(h.MessageLength)}
+	start := time.Now()
+	defer func() {
+		if shape != nil {
+			sample.Duration = time.Since(start)
+			p.QueryShapeStats.Record(*shape, sample)
+		}
+	}()
 
-	var flags [4]byte
-	if _, err := io.ReadFull(client, flags[:]); err != nil {
+	qb := queryBuffers.Get().(*queryBuffer)
+	defer queryBuffers.Put(qb)
+	h.encode(qb.header[:])
+	parts := append(qb.parts[:0], qb.header[:])
+
+	if _, err := io.ReadFull(client, qb.flags[:]); err != nil {
 		corelog.LogError("error", err)
 		return err
 	}
-	parts = append(parts, flags[:])
+	parts = append(parts, qb.flags[:])
+	queryFlags := getInt32(qb.flags[:], 0)
 
-	fullCollectionName, err := readCString(client)
+	fullCollectionName, err := appendCString(qb.name[:0], client)
 	if err != nil {
 		corelog.LogError("error", err)
 		return err
 	}
+	qb.name = fullCollectionName
 	parts = append(parts, fullCollectionName)
 
 	var rewriter responseRewriter
-	if *proxyAllQueries || bytes.HasSuffix(fullCollectionName, cmdCollectionSuffix) {
-		var twoInt32 [8]byte
-		if _, err := io.ReadFull(client, twoInt32[:]); err != nil {
+	var q bson.D
+	if *proxyAllQueries || collectShape || bytes.HasSuffix(fullCollectionName, cmdCollectionSuffix) {
+		if _, err := io.ReadFull(client, qb.twoInt32[:]); err != nil {
 			corelog.LogError("error", err)
 			return err
 		}
-		parts = append(parts, twoInt32[:])
+		parts = append(parts, qb.twoInt32[:])
 
 		queryDoc, err := readDocument(client)
 		if err != nil {
@@ -80,20 +123,34 @@ func (p *ProxyQuery) Proxy(
 		}
 		parts = append(parts, queryDoc)
 
-		var q bson.D
-		if err := bson.Unmarshal(queryDoc, &q); err != nil {
+		// unmarshalled apart so that only parsed queries allocate it
+		var doc bson.D
+		if err := bson.Unmarshal(queryDoc, &doc); err != nil {
 			corelog.LogError("error", err)
 			return err
 		}
+		q = doc
+		cursors.queryRequested(q)
+
+		if collectShape {
+			s := shapeOfQuery(fullCollectionName, q)
+			if driver != nil {
+				s.App, s.Driver = driver.app, driver.driver
+			}
+			shape = &s
+			sample.Error = true // until proven otherwise
+		}
 
 		if hasKey(q, "getLastError") {
-			return p.GetLastErrorRewriter.Rewrite(
+			err := p.GetLastErrorRewriter.Rewrite(
 				h,
 				parts,
 				client,
 				server,
 				lastError,
 			)
+			sample.Error = err != nil
+			return err
 		}
 
 		if hasKey(q, "isMaster") {
@@ -115,6 +172,9 @@ func (p *ProxyQuery) Proxy(
 		lastError.Reset()
 	}
 
+	// Tailable and exhaust queries may take longer than other messages.
+	stream.queryRequested(queryFlags, q)
+
 	var written int
 	for _, b := range parts {
 		n, err := server.Write(b)
@@ -126,7 +186,7 @@ func (p *ProxyQuery) Proxy(
 	}
 
 	pending := int64(h.MessageLength) - int64(written)
-	if _, err := io.CopyN(server, client, pending); err != nil {
+	if err := copyN(server, client, pending); err != nil {
 		corelog.LogError("error", err)
 		return err
 	}
@@ -135,14 +195,30 @@ func (p *ProxyQuery) Proxy(
 		if err := rewriter.Rewrite(client, server); err != nil {
 			return err
 		}
+		sample.Error = false
 		return nil
 	}
 
-	if err := copyMessage(client, server); err != nil {
+	// Only command replies carry "ok" and "cursor" fields worth inspecting.
+	inspect := (shape != nil || cursors != nil) && bytes.HasSuffix(fullCollectionName, cmdCollectionSuffix)
+	reply, err := qb.reply.copy(client, server, inspect)
+	if err != nil {
 		corelog.LogError("error", err)
 		return err
 	}
-
+	cursors.queryReplied(fullCollectionName, q, reply)
+	stream.queryReplied(queryFlags, q, reply)
+	sample.Error = reply.Failed()
+	sample.BytesOut = int64(reply.MessageLength)
+	sample.DocsReturned = int64(reply.NumberReturned)
+
+	// Exhaust queries get replies until their cursor is exhausted.
+	if queryFlags&queryExhaust != 0 {
+		if err := copyExhaust(client, server, reply, cursors, stream); err != nil {
+			corelog.LogError("error", err)
+			return err
+		}
+	}
 	return nil
 }
 
@@ -191,7 +267,7 @@ func (r *GetLastErrorRewriter) Rewrite(
 		}
 
 		pending := int64(h.MessageLength) - int64(written)
-		if _, err := io.CopyN(server, client, pending); err != nil {
+		if err := copyN(server, client, pending); err != nil {
 			corelog.LogError("error", err)
 			return err
 		}
@@ -202,7 +278,7 @@ func (r *GetLastErrorRewriter) Rewrite(
 			return err
 		}
 		pending = int64(lastError.header.MessageLength - headerLen)
-		if _, err = io.CopyN(&lastError.rest, server, pending); err != nil {
+		if err = copyN(&lastError.rest, server, pending); err != nil {
 			corelog.LogError("error", err)
 			return err
 		}
@@ -215,7 +291,7 @@ func (r *GetLastErrorRewriter) Rewrite(
 			written += len(b)
 		}
 		pending := int64(h.MessageLength) - int64(written)
-		if _, err := io.CopyN(ioutil.Discard, client, pending); err != nil {
+		if err := copyN(ioutil.Discard, client, pending); err != nil {
 			corelog.LogError("error", err)
 			return err
 		}
@@ -444,7 +444,7 @@ func TestProxyQuery(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		err := p.Proxy(c.Header, c.Client, nil, nil)
+		err := p.Proxy(c.Header, c.Client, nil, nil, nil, nil, nil)
 		if err == nil || !strings.Contains(err.Error(), c.Error) {
 			t.Fatalf("did not find expected error for %s, instead found %s", c.Name, err)
 		}
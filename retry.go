@@ -0,0 +1,150 @@
+package dvara
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// retryMaxMessageLength is the size above which queries are not buffered to be
+// retried. Reads are small, large queries are usually writes anyway.
+const retryMaxMessageLength = 1 << 20
+
+// requestBuffer holds the current request of a client when it had to be read
+// before being proxied, to be inspected or retried on another server
+// connection if it fails before any of the reply reached the client.
+type requestBuffer struct {
+	client net.Conn
+
+	// msg is the entire current request once buffered
+	msg []byte
+
+	// retryable is true if the request is a read which can be retried, and
+	// retried once it was
+	retryable bool
+	retried   bool
+
+	// written is true once any of the reply was written to the client
+	written bool
+
+	body bytes.Reader
+}
+
+// reset forgets about the previous request.
+func (b *requestBuffer) reset() {
+	b.msg = nil
+	b.retryable = false
+	b.retried = false
+}
+
+// read returns the entire request with the given header, reading the rest of
+// it from the client unless it was already.
+func (b *requestBuffer) read(h *messageHeader, client net.Conn) ([]byte, error) {
+	if b.msg != nil {
+		return b.msg, nil
+	}
+	msg, err := readMessageBody(h, client)
+	if err != nil {
+		return nil, err
+	}
+	b.msg = msg
+	return msg, nil
+}
+
+// request returns the client to proxy the request with the given header from
+// and to. Queries are buffered if retry is true.
+func (b *requestBuffer) request(h *messageHeader, client net.Conn, retry bool) (io.ReadWriter, error) {
+	b.client = client
+	b.written = false
+	if b.msg == nil {
+		if !retry || h.OpCode != OpQuery || h.MessageLength > retryMaxMessageLength {
+			return client, nil
+		}
+		if _, err := b.read(h, client); err != nil {
+			return nil, err
+		}
+	}
+	b.retryable = retry && isRetryableRead(b.msg)
+	b.body.Reset(b.msg[headerLen:])
+	return b, nil
+}
+
+func (b *requestBuffer) Read(p []byte) (int, error) {
+	return b.body.Read(p)
+}
+
+func (b *requestBuffer) Write(p []byte) (int, error) {
+	b.written = true
+	return b.client.Write(p)
+}
+
+// canRetry returns true if the request can be retried after failing with err.
+// Timeouts are not retried as the server is likely alive but slow.
+func (b *requestBuffer) canRetry(err error) bool {
+	if !b.retryable || b.retried || b.written {
+		return false
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return true
+}
+
+// isRetryableRead returns true if the entire request is an idempotent read.
+func isRetryableRead(msg []byte) bool {
+	if OpCode(getInt32(msg, 12)) != OpQuery {
+		return false
+	}
+	if !isCommandRequest(msg) {
+		return true
+	}
+	name, cmd := requestCommand(msg)
+	if name == "aggregate" && hasOutputStage(cmd) {
+		return false
+	}
+	return readCommands[name]
+}
+
+// retryMessage retries the message with the given header on a fresh server
+// connection after it failed on serverConn, which is thrown away. It returns
+// the new server connection, or nil if the retry failed too.
+func (p *Proxy) retryMessage(
+	ctx context.Context,
+	h *messageHeader,
+	c *proxyClient,
+	serverConn net.Conn,
+	lastError *LastError,
+	err error,
+) net.Conn {
+	p.proxyMessageFailed(serverConn, err)
+	stats.BumpSum(p.stats, "message.retry", 1)
+	corelog.LogInfoMessage("retrying message on a new server connection",
+		"client", c.conn.RemoteAddr(), "app", c.appName(), "error", err)
+
+	serverConn, err = p.getServerConn(ctx, c)
+	if err != nil {
+		stats.BumpSum(p.stats, "message.retry.error", 1)
+		corelog.LogError("error", err)
+		if reply := errorReply(c.request.msg, p.serverConnError(err)); reply != nil {
+			c.conn.SetDeadline(time.Now().Add(p.ReplicaSet.MessageTimeout))
+			if _, err := c.conn.Write(reply); err != nil {
+				corelog.LogError("error", err)
+			}
+		}
+		return nil
+	}
+
+	c.request.retried = true
+	if err := p.proxyMessage(h, c, serverConn, lastError); err != nil {
+		stats.BumpSum(p.stats, "message.retry.error", 1)
+		p.proxyMessageFailed(serverConn, err)
+		return nil
+	}
+	stats.BumpSum(p.stats, "message.retry.success", 1)
+	return serverConn
+}
@@ -0,0 +1,118 @@
+package dvara
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestIsRetryableRead(t *testing.T) {
+	t.Parallel()
+	ensure.True(t, isRetryableRead(fakeQuery(1, 0, "db.c", bson.M{"a": 1})))
+	ensure.True(t, isRetryableRead(fakeQuery(1, 0, "db.$cmd", bson.D{{Name: "count", Value: "c"}})))
+	ensure.False(t, isRetryableRead(fakeQuery(1, 0, "db.$cmd", bson.D{{Name: "insert", Value: "c"}})))
+	ensure.False(t, isRetryableRead(fakeQuery(1, 0, "db.$cmd", bson.D{{Name: "getMore", Value: int64(1)}})))
+	ensure.False(t, isRetryableRead(fakeQuery(1, 0, "db.$cmd", bson.D{
+		{Name: "aggregate", Value: "c"},
+		{Name: "pipeline", Value: []interface{}{bson.M{"$out": "d"}}},
+	})))
+	ensure.False(t, isRetryableRead(fakeGetMore(1)))
+}
+
+func TestRetryDeadServerConn(t *testing.T) {
+	t.Parallel()
+	reply := fakeReplyTo(7, bson.M{"a": 1})
+	servers := []net.Conn{
+		// the first connection died while idle in the pool
+		&fakeConn{in: bytes.NewReader(nil)},
+		&fakeConn{in: bytes.NewReader(reply)},
+	}
+	hc := newCounterClient()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MessageTimeout: time.Minute,
+			RetryReads:     true,
+			ProxyQuery:     &ProxyQuery{},
+		},
+		stats: hc,
+		serverPool: Pool{
+			New: func() (io.Closer, error) {
+				c := servers[0]
+				servers = servers[1:]
+				return c, nil
+			},
+			Max:           2,
+			IdleTimeout:   time.Hour,
+			ClosePoolSize: 1,
+		},
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	defer p.serverPool.Close()
+
+	query := fakeQuery(7, 0, "db.c", bson.M{"a": 1})
+	conn := &fakeConn{in: bytes.NewReader(query)}
+	client := p.clients.add(conn)
+	h, err := p.clientReadHeader(client, time.Minute)
+	ensure.Nil(t, err)
+	serverConn, err := p.getServerConn(p.ctx, client)
+	ensure.Nil(t, err)
+
+	var lastError LastError
+	err = p.proxyMessage(h, client, serverConn, &lastError)
+	ensure.DeepEqual(t, err, io.EOF)
+	ensure.True(t, client.request.canRetry(err))
+
+	// the query is sent again on a new connection and the client never knows
+	serverConn = p.retryMessage(p.ctx, h, client, serverConn, &lastError, err)
+	ensure.NotNil(t, serverConn)
+	ensure.DeepEqual(t, serverConn.(*fakeConn).out.Bytes(), query)
+	ensure.DeepEqual(t, conn.out.Bytes(), reply)
+	ensure.DeepEqual(t, hc.count("message.retry.success"), float64(1))
+	p.serverPool.Release(serverConn)
+
+	// retries happen only once
+	ensure.False(t, client.request.canRetry(io.EOF))
+}
+
+func TestNoRetryInSession(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MessageTimeout: time.Minute,
+			RetryReads:     true,
+			ProxyQuery:     &ProxyQuery{},
+		},
+		PoolingMode: SessionPooling,
+	}
+	query := fakeQuery(7, 0, "db.c", bson.M{"a": 1})
+	client := p.clients.add(&fakeConn{in: bytes.NewReader(query)})
+	h, err := p.clientReadHeader(client, time.Minute)
+	ensure.Nil(t, err)
+
+	// the session's connection dying fails the client
+	var lastError LastError
+	err = p.proxyMessage(h, client, &fakeConn{in: bytes.NewReader(nil)}, &lastError)
+	ensure.DeepEqual(t, err, io.EOF)
+	ensure.False(t, client.request.canRetry(err))
+}
+
+func TestRetryAfterReply(t *testing.T) {
+	t.Parallel()
+	var b requestBuffer
+	query := fakeQuery(7, 0, "db.c", bson.M{"a": 1})
+	h := &messageHeader{}
+	h.FromWire(query)
+	_, err := b.request(h, &fakeConn{in: bytes.NewReader(query[headerLen:])}, true)
+	ensure.Nil(t, err)
+	ensure.True(t, b.canRetry(io.EOF))
+
+	// once the client got some of the reply it's too late
+	b.Write([]byte{0})
+	ensure.False(t, b.canRetry(io.EOF))
+}
@@ -2,9 +2,10 @@
 package dvara
 
 import (
-	"container/list"
+	"context"
 	"errors"
 	"io"
+	"math/rand"
 	"sync"
 	"time"
 
@@ -16,11 +17,14 @@ var (
 	errPoolClosed  = errors.New("rpool: pool has been closed")
 	errCloseAgain  = errors.New("rpool: Pool.Close called more than once")
 	errWrongPool   = errors.New("rpool: provided resource was not acquired from this pool")
-	closedSentinel = sentinelCloser(1)
-	newSentinel    = sentinelCloser(2)
+	errPoolTimeout = errors.New("rpool: timed out waiting for a resource")
+	errPoolFull    = errors.New("rpool: too many waiting for a resource")
+	newSentinel    = sentinelCloser(1)
 )
 
-// Pool manages the life cycle of resources.
+// Pool manages the life cycle of resources. Its state is protected by a mutex
+// so acquiring an idle resource, or releasing one, doesn't involve any other
+// goroutine. A background goroutine only handles the periodic work.
 type Pool struct {
 	// New is used to create a new resource when necessary.
 	New func() (io.Closer, error)
@@ -43,6 +47,52 @@ type Pool struct {
 	// be closed.
 	IdleTimeout time.Duration
 
+	// Limiter is optional and further limits the number of allocated
+	// resources, it can change over time unlike Max.
+	Limiter PoolLimiter
+
+	// Fair enables fair queuing of waiting Acquire calls. Instead of being
+	// served in order, waiters are served round robin between clients,
+	// weighted by their class. See WithPoolClient.
+	Fair bool
+
+	// ClassWeights defines the weight of each class when Fair. Classes default
+	// to a weight of 1.
+	ClassWeights map[string]uint
+
+	// Reserved defines a number of resources only available to Acquire calls
+	// of the ReservedClass, whose waiters are also always served first.
+	Reserved      uint
+	ReservedClass string
+
+	// MaxWait defines the maximum duration Acquire will wait for a resource when
+	// Max resources are already in use. Zero means no limit.
+	MaxWait time.Duration
+
+	// MaxWaiting defines the maximum number of Acquire calls waiting for a
+	// resource, after which they are immediately rejected. Zero means no limit.
+	MaxWaiting uint
+
+	// MaxLifetime defines the duration after which a resource is closed rather
+	// than reused. Zero means no limit.
+	MaxLifetime time.Duration
+
+	// LifetimeJitter defines the maximum random duration added to MaxLifetime,
+	// so resources created together aren't all closed together.
+	LifetimeJitter time.Duration
+
+	// Validate is optional and checks a resource is still usable. Resources
+	// failing validation are discarded.
+	Validate func(io.Closer) error
+
+	// ValidateIdle defines the idle duration after which a resource is
+	// validated before being handed out. Zero disables it.
+	ValidateIdle time.Duration
+
+	// ValidateInterval defines how often idle resources are validated in the
+	// background. Zero disables it.
+	ValidateInterval time.Duration
+
 	// ClosePoolSize defines the number of concurrent goroutines that will close
 	// resources.
 	ClosePoolSize uint
@@ -51,69 +101,241 @@ type Pool struct {
 	// in production code.
 	Clock clock.Clock
 
-	manageOnce sync.Once
-	acquire    chan chan io.Closer
-	new        chan io.Closer
-	release    chan returnResource
-	discard    chan returnResource
-	close      chan chan error
+	initOnce       sync.Once
+	mutex          sync.Mutex
+	klock          clock.Clock
+	idle           []entry
+	outResources   map[io.Closer]struct{}
+	out            uint
+	waiting        *waitQueue
+	expires        map[io.Closer]time.Time
+	closed         bool
+	drained        chan struct{}
+	stop           chan struct{}
+	closeSem       chan struct{}
+	closeWG        sync.WaitGroup
+	idleTicker     *clock.Ticker
+	validateTicker *clock.Ticker
+	statsTicker    *clock.Ticker
 }
 
 // Acquire will pull a resource from the pool or create a new one if necessary.
 func (p *Pool) Acquire() (io.Closer, error) {
-	p.manageOnce.Do(p.goManage)
-	r := make(chan io.Closer)
-	p.acquire <- r
-	c := <-r
+	return p.AcquireContext(context.Background())
+}
+
+// AcquireContext is like Acquire but gives up waiting for a resource once the
+// context is done.
+func (p *Pool) AcquireContext(ctx context.Context) (io.Closer, error) {
+	p.initOnce.Do(p.init)
+	if p.MaxWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.MaxWait)
+		defer cancel()
+	}
+	for {
+		c, err := p.tryAcquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// resources idle for a while are validated before being handed out
+		s, ok := c.(staleResource)
+		if !ok {
+			return c, nil
+		}
+		if err := p.Validate(s.Closer); err != nil {
+			stats.BumpSum(p.Stats, "validate.failed", 1)
+			p.Discard(s.Closer)
+			continue
+		}
+		return s.Closer, nil
+	}
+}
+
+// LimitChanged tells the pool the limit of its Limiter changed.
+func (p *Pool) LimitChanged() {
+	p.initOnce.Do(p.init)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// the limit shrunk, close the oldest idle resources over it
+	for len(p.idle) > 0 && uint(len(p.idle))+p.out > p.maxOut() {
+		stats.BumpSum(p.Stats, "limit.close", 1)
+		p.closeResource(p.idle[0].resource)
+		p.idle = p.idle[1:]
+	}
+
+	// the limit grew, make new resources for those waiting
+	p.dispatch()
+}
+
+// Counts returns the number of idle and acquired resources.
+func (p *Pool) Counts() (idle, acquired uint) {
+	p.initOnce.Do(p.init)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return uint(len(p.idle)), p.out
+}
+
+// Prewarm creates resources, in the background, until MinIdle are available.
+func (p *Pool) Prewarm() {
+	p.initOnce.Do(p.init)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return
+	}
+	alive := uint(len(p.idle)) + p.out
+	for ; alive < p.MinIdle && p.out < p.maxOut(); alive++ {
+		// assumed checked out until it is created
+		p.out++
+		go p.warm()
+	}
+}
+
+// Recycle replaces all the current resources with new ones without
+// disrupting their users: idle resources are closed right away and acquired
+// ones once they're released.
+func (p *Pool) Recycle() {
+	p.initOnce.Do(p.init)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := p.klock.Now()
+	for c := range p.outResources {
+		p.expires[c] = now
+	}
+	for _, e := range p.idle {
+		stats.BumpSum(p.Stats, "recycle.forced", 1)
+		p.closeResource(e.resource)
+	}
+	p.idle = p.idle[:0]
+}
+
+func (p *Pool) tryAcquire(ctx context.Context) (io.Closer, error) {
+	start := time.Now()
+	class := poolClientClass(ctx)
 
-	// sentinel value indicates the pool is closed
-	if c == closedSentinel {
+	p.mutex.Lock()
+	// if closed, new acquire calls are rejected
+	if p.closed {
+		p.mutex.Unlock()
+		stats.BumpSum(p.Stats, "acquire.error.closed", 1)
 		return nil, errPoolClosed
 	}
 
-	// need to allocate a new resource
-	if c == newSentinel {
-		c, err := p.New()
-		if err != nil {
-			stats.BumpSum(p.Stats, "acquire.error.new", 1)
-			// discard our assumed checked out resource since we failed to New
-			p.discard <- returnResource{resource: newSentinel}
-		} else {
-			p.new <- c
+	// acquire from pool, or make a new resource
+	if p.out < p.classMaxOut(class) {
+		c := p.take()
+		p.mutex.Unlock()
+		p.waited(class, start)
+		return p.acquired(c)
+	}
+
+	// max resources already in use, need to block & wait
+	if p.MaxWaiting > 0 && uint(p.waiting.Len()) >= p.MaxWaiting {
+		p.mutex.Unlock()
+		stats.BumpSum(p.Stats, "acquire.error.full", 1)
+		return nil, errPoolFull
+	}
+	w := newWaiter(ctx)
+	p.waiting.Push(w)
+	p.mutex.Unlock()
+	stats.BumpSum(p.Stats, "acquire.waiting", 1)
+
+	var c io.Closer
+	select {
+	case c = <-w.acquire:
+	case <-ctx.Done():
+		p.mutex.Lock()
+		removed := p.waiting.Remove(w)
+		if removed {
+			p.drain()
+		}
+		p.mutex.Unlock()
+		if removed {
+			p.waited(w.class, start)
+			if ctx.Err() == context.DeadlineExceeded {
+				stats.BumpSum(p.Stats, "acquire.error.timeout", 1)
+				return nil, errPoolTimeout
+			}
+			stats.BumpSum(p.Stats, "acquire.error.cancelled", 1)
+			return nil, ctx.Err()
 		}
-		return c, err
+		// we were given a resource while giving up
+		c = <-w.acquire
 	}
+	p.waited(w.class, start)
+	return p.acquired(c)
+}
 
-	// successfully acquired from pool
+// acquired makes a new resource if the one handed out is the sentinel for it.
+func (p *Pool) acquired(c io.Closer) (io.Closer, error) {
+	if c != newSentinel {
+		return c, nil
+	}
+	c, err := p.New()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err != nil {
+		stats.BumpSum(p.Stats, "acquire.error.new", 1)
+		// give up our assumed checked out resource since we failed to New
+		p.out--
+		p.dispatch()
+		p.drain()
+		return nil, err
+	}
+	p.outResources[c] = struct{}{}
+	p.track(c)
 	return c, nil
 }
 
 // Release puts the resource back into the pool. It will panic if you try to
 // release a resource that wasn't acquired from this pool.
 func (p *Pool) Release(c io.Closer) {
-	p.manageOnce.Do(p.goManage)
+	p.initOnce.Do(p.init)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// ensure we're dealing with a resource acquired thru us
+	if _, found := p.outResources[c]; !found {
+		panic(errWrongPool)
+	}
 
-	// we get an error back and panic here instead of the manage function so the
-	// caller gets the panic and we end up with a useful stack.
-	res := make(chan error)
-	p.release <- returnResource{resource: c, response: res}
-	if err := <-res; err != nil {
-		panic(err)
+	// no longer out
+	p.out--
+	delete(p.outResources, c)
+
+	// past its lifetime, replace it with a new one if someone is waiting
+	if p.expired(c, p.klock.Now()) {
+		stats.BumpSum(p.Stats, "recycle.lifetime", 1)
+		p.closeResource(c)
+		p.dispatch()
+	} else {
+		// put it back in our pool, or pass it to someone who's waiting
+		p.put(c)
 	}
+	p.drain()
 }
 
 // Discard closes the resource and indicates we're throwing it away. It will
 // panic if you try to discard a resource that wasn't acquired from this pool.
 func (p *Pool) Discard(c io.Closer) {
-	p.manageOnce.Do(p.goManage)
+	p.initOnce.Do(p.init)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 
-	// we get an error back and panic here instead of the manage function so the
-	// caller gets the panic and we end up with a useful stack.
-	res := make(chan error)
-	p.discard <- returnResource{resource: c, response: res}
-	if err := <-res; err != nil {
-		panic(err)
+	// ensure we're dealing with a resource acquired thru us
+	if _, found := p.outResources[c]; !found {
+		panic(errWrongPool)
 	}
+	delete(p.outResources, c)
+	p.closeResource(c)
+
+	// we lost a resource, we can make a new one if someone is waiting
+	p.out--
+	p.dispatch()
+	p.drain()
 }
 
 // Close closes the pool and its resources. It waits until all acquired
@@ -122,13 +344,36 @@ func (p *Pool) Discard(c io.Closer) {
 func (p *Pool) Close() error {
 	elapsedTime := stats.BumpTime(p.Stats, "shutdown.time")
 	defer elapsedTime.End()
-	p.manageOnce.Do(p.goManage)
-	r := make(chan error)
-	p.close <- r
-	return <-r
+	p.initOnce.Do(p.init)
+
+	p.mutex.Lock()
+	// cant call close if already closing
+	if p.closed {
+		p.mutex.Unlock()
+		return errCloseAgain
+	}
+	p.closed = true
+	p.idleTicker.Stop() // stop idle processing
+	p.validateTicker.Stop()
+
+	// close idle unless someone is waiting for them
+	if p.waiting.Len() == 0 {
+		for _, e := range p.idle {
+			p.closeResource(e.resource)
+		}
+		p.idle = nil
+	}
+	p.drain()
+	p.mutex.Unlock()
+
+	// all waiting acquires are done, all resources have been released. now
+	// just wait for all resources to close.
+	<-p.drained
+	p.closeWG.Wait()
+	return nil
 }
 
-func (p *Pool) goManage() {
+func (p *Pool) init() {
 	if p.Max == 0 {
 		panic("no max configured")
 	}
@@ -139,11 +384,36 @@ func (p *Pool) goManage() {
 		panic("no close pool size configured")
 	}
 
-	p.acquire = make(chan chan io.Closer)
-	p.new = make(chan io.Closer)
-	p.release = make(chan returnResource)
-	p.discard = make(chan returnResource)
-	p.close = make(chan chan error)
+	p.klock = p.Clock
+	if p.klock == nil {
+		p.klock = clock.New()
+	}
+	p.outResources = map[io.Closer]struct{}{}
+	p.expires = map[io.Closer]time.Time{}
+	p.waiting = newWaitQueue(p.Fair, p.ClassWeights, p.ReservedClass)
+	p.drained = make(chan struct{})
+	p.stop = make(chan struct{})
+	p.closeSem = make(chan struct{}, p.ClosePoolSize)
+
+	p.idleTicker = p.klock.Ticker(p.IdleTimeout)
+
+	// setup a ticker for background validation, we Stop it if it isn't enabled.
+	validateInterval := p.ValidateInterval
+	if validateInterval == 0 {
+		validateInterval = time.Hour
+	}
+	p.validateTicker = p.klock.Ticker(validateInterval)
+	if p.Validate == nil || p.ValidateInterval == 0 {
+		p.validateTicker.Stop()
+	}
+
+	// setup a ticker to report various averages every minute. if we don't have a
+	// Stats implementation provided, we Stop it so it never ticks.
+	p.statsTicker = p.klock.Ticker(time.Minute)
+	if p.Stats == nil {
+		p.statsTicker.Stop()
+	}
+
 	go p.manage()
 }
 
@@ -152,205 +422,272 @@ type entry struct {
 	use      time.Time
 }
 
+// manage does the periodic work until the pool is drained.
 func (p *Pool) manage() {
-	klock := p.Clock
-	if klock == nil {
-		klock = clock.New()
-	}
-
-	// setup goroutines to close resources
-	closers := make(chan io.Closer)
-	var closeWG sync.WaitGroup
-	closeWG.Add(int(p.ClosePoolSize))
-	for i := uint(0); i < p.ClosePoolSize; i++ {
-		go func() {
-			defer closeWG.Done()
-			for c := range closers {
-				t := stats.BumpTime(p.Stats, "close.time")
-				stats.BumpSum(p.Stats, "close", 1)
-				if err := c.Close(); err != nil {
-					stats.BumpSum(p.Stats, "close.error", 1)
-					p.CloseErrorHandler(err)
-				}
-				t.End()
-			}
-		}()
-	}
-
-	// setup a ticker to report various averages every minute. if we don't have a
-	// Stats implementation provided, we Stop it so it never ticks.
-	statsTicker := klock.Ticker(time.Minute)
-	if p.Stats == nil {
-		statsTicker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-p.idleTicker.C:
+			p.closeIdle(now)
+		case now := <-p.validateTicker.C:
+			p.validateIdle(now)
+		case <-p.statsTicker.C:
+			// We can assume if we hit this then p.Stats is not nil
+			p.mutex.Lock()
+			p.Stats.BumpAvg("waiting", float64(p.waiting.Len()))
+			p.Stats.BumpAvg("idle", float64(len(p.idle)))
+			p.Stats.BumpAvg("out", float64(p.out))
+			p.Stats.BumpAvg("alive", float64(uint(len(p.idle))+p.out))
+			p.Stats.BumpAvg("limit", float64(p.maxOut()))
+			p.mutex.Unlock()
+		}
 	}
+}
 
-	resources := []entry{}
-	outResources := map[io.Closer]struct{}{}
-	out := uint(0)
-	waiting := list.New()
-	idleTicker := klock.Ticker(p.IdleTimeout)
-	closed := false
-	var closeResponse chan error
-	for {
-		if closed && out == 0 && waiting.Len() == 0 {
-			if p.Stats != nil {
-				statsTicker.Stop()
-			}
+// closeIdle closes the resources idle for longer than IdleTimeout, beyond
+// MinIdle, and those past their lifetime.
+func (p *Pool) closeIdle(now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 
-			// all waiting acquires are done, all resources have been released.
-			// now just wait for all resources to close.
-			close(closers)
-			closeWG.Wait()
+	eligibleOffset := len(p.idle) - int(p.MinIdle)
 
-			// close internal channels.
-			close(p.acquire)
-			close(p.new)
-			close(p.release)
-			close(p.discard)
-			close(p.close)
+	// less than min idle, nothing to do
+	if eligibleOffset <= 0 {
+		return
+	}
 
-			// return a response to the original close.
-			closeResponse <- nil
+	t := stats.BumpTime(p.Stats, "idle.cleanup.time")
+	defer t.End()
 
-			return
+	// cleanup idle resources
+	idleLen := 0
+	for _, e := range p.idle[:eligibleOffset] {
+		if now.Sub(e.use) < p.IdleTimeout {
+			break
 		}
+		p.closeResource(e.resource)
+		idleLen++
+	}
 
-		select {
-		case r := <-p.acquire:
-			// if closed, new acquire calls are rejected
-			if closed {
-				r <- closedSentinel
-				stats.BumpSum(p.Stats, "acquire.error.closed", 1)
-				continue
-			}
-
-			// acquire from pool
-			if cl := len(resources); cl > 0 {
-				c := resources[cl-1]
-				outResources[c.resource] = struct{}{}
-				r <- c.resource
-				resources = resources[:cl-1]
-				out++
-				continue
-			}
+	// move the remaining resources to the beginning
+	p.idle = p.idle[:copy(p.idle, p.idle[idleLen:])]
 
-			// max resources already in use, need to block & wait
-			if out == p.Max {
-				waiting.PushBack(r)
-				stats.BumpSum(p.Stats, "acquire.waiting", 1)
-				continue
-			}
+	// close the resources past their lifetime
+	alive := p.idle[:0]
+	for _, e := range p.idle {
+		if p.expired(e.resource, now) {
+			stats.BumpSum(p.Stats, "recycle.lifetime", 1)
+			p.closeResource(e.resource)
+			continue
+		}
+		alive = append(alive, e)
+	}
+	p.idle = alive
+}
 
-			// Make a new resource in the calling goroutine by sending it a
-			// newSentinel. We assume it's checked out. Acquire will discard if
-			// creating a new resource fails.
-			out++
-			r <- newSentinel
-		case c := <-p.new:
-			outResources[c] = struct{}{}
-		case rr := <-p.release:
-			// ensure we're dealing with a resource acquired thru us
-			if _, found := outResources[rr.resource]; !found {
-				rr.response <- errWrongPool
-				return
-			}
-			close(rr.response)
+// validateIdle validates idle resources in the background, they're checked
+// out while being validated.
+func (p *Pool) validateIdle(now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	idle := p.idle[:0]
+	for _, e := range p.idle {
+		if now.Sub(e.use) < p.ValidateInterval {
+			idle = append(idle, e)
+			continue
+		}
+		p.outResources[e.resource] = struct{}{}
+		p.out++
+		go p.validate(e.resource)
+	}
+	p.idle = idle
+}
 
-			// pass it to someone who's waiting
-			if e := waiting.Front(); e != nil {
-				r := waiting.Remove(e).(chan io.Closer)
-				r <- rr.resource
-				continue
-			}
+// maxOut returns the maximum number of allocated resources right now.
+func (p *Pool) maxOut() uint {
+	if p.Limiter != nil {
+		if l := p.Limiter.Limit(); l < p.Max {
+			return l
+		}
+	}
+	return p.Max
+}
 
-			// no longer out
-			out--
-			delete(outResources, rr.resource)
+// unreservedMaxOut returns the maximum number of allocated resources outside
+// of the reserved class.
+func (p *Pool) unreservedMaxOut() uint {
+	max := p.maxOut()
+	if max <= p.Reserved {
+		return 0
+	}
+	return max - p.Reserved
+}
 
-			// no one is waiting, and we're closed, schedule it to be closed
-			if closed {
-				closers <- rr.resource
-				continue
-			}
+func (p *Pool) classMaxOut(class string) uint {
+	if p.ReservedClass != "" && class == p.ReservedClass {
+		return p.maxOut()
+	}
+	return p.unreservedMaxOut()
+}
 
-			// put it back in our pool
-			resources = append(resources, entry{resource: rr.resource, use: klock.Now()})
-		case rr := <-p.discard:
-			// ensure we're dealing with a resource acquired thru us
-			if rr.resource != newSentinel { // this happens when new fails
-				if _, found := outResources[rr.resource]; !found {
-					rr.response <- errWrongPool
-					return
-				}
-				close(rr.response)
-				delete(outResources, rr.resource)
-				closers <- rr.resource
-			}
+// take checks out the last idle resource if there is one, or the sentinel
+// telling the caller to make a new one. We assume it's checked out, Acquire
+// will give it up if creating a new resource fails. It must be called with the
+// mutex held.
+func (p *Pool) take() io.Closer {
+	p.out++
+	l := len(p.idle)
+	if l == 0 {
+		return newSentinel
+	}
+	e := p.idle[l-1]
+	p.idle = p.idle[:l-1]
+	p.outResources[e.resource] = struct{}{}
+	stats.BumpSum(p.Stats, "acquire.pool", 1)
+	if p.Validate != nil && p.ValidateIdle > 0 && p.klock.Now().Sub(e.use) >= p.ValidateIdle {
+		return staleResource{e.resource}
+	}
+	return e.resource
+}
 
-			// we can make a new one if someone is waiting. no need to decrement out
-			// in this case since we assume this new one is checked out. Acquire will
-			// discard if creating a new resource fails.
-			if e := waiting.Front(); e != nil {
-				r := waiting.Remove(e).(chan io.Closer)
-				r <- newSentinel
-				continue
-			}
+// dispatch serves waiters for as long as the limits allow it. It must be
+// called with the mutex held.
+func (p *Pool) dispatch() {
+	for {
+		w := p.waiting.Pop(p.out < p.maxOut(), p.out < p.unreservedMaxOut())
+		if w == nil {
+			return
+		}
+		// buffered so this never blocks on a waiter which gave up
+		w.acquire <- p.take()
+	}
+}
 
-			// otherwise we lost a resource and dont need a new one right away
-			out--
-		case now := <-idleTicker.C:
-			eligibleOffset := len(resources) - int(p.MinIdle)
+// put returns a resource which is no longer checked out to the idle ones,
+// possibly to be handed out right away. It must be called with the mutex
+// held.
+func (p *Pool) put(c io.Closer) {
+	switch {
+	// no one is waiting, and we're closed, schedule it to be closed
+	case p.closed && p.waiting.Len() == 0:
+		p.closeResource(c)
+	// over the limit since it was lowered
+	case uint(len(p.idle))+p.out >= p.maxOut():
+		stats.BumpSum(p.Stats, "limit.close", 1)
+		p.closeResource(c)
+	default:
+		p.idle = append(p.idle, entry{resource: c, use: p.klock.Now()})
+	}
+	p.dispatch()
+}
 
-			// less than min idle, nothing to do
-			if eligibleOffset <= 0 {
-				continue
-			}
+// drain finishes closing the pool once all waiting acquires are done and all
+// resources have been released. It must be called with the mutex held.
+func (p *Pool) drain() {
+	if !p.closed || p.out != 0 || p.waiting.Len() != 0 {
+		return
+	}
+	select {
+	case <-p.drained:
+		return
+	default:
+	}
+	for _, e := range p.idle {
+		p.closeResource(e.resource)
+	}
+	p.idle = nil
+	p.statsTicker.Stop()
+	close(p.stop)
+	close(p.drained)
+}
 
-			t := stats.BumpTime(p.Stats, "idle.cleanup.time")
+// track records the expiry time of a new resource. It must be called with the
+// mutex held.
+func (p *Pool) track(c io.Closer) {
+	if p.MaxLifetime > 0 {
+		lifetime := p.MaxLifetime
+		if p.LifetimeJitter > 0 {
+			lifetime += time.Duration(rand.Int63n(int64(p.LifetimeJitter)))
+		}
+		p.expires[c] = p.klock.Now().Add(lifetime)
+	}
+}
 
-			// cleanup idle resources
-			idleLen := 0
-			for _, e := range resources[:eligibleOffset] {
-				if now.Sub(e.use) < p.IdleTimeout {
-					break
-				}
-				closers <- e.resource
-				idleLen++
-			}
+// expired returns true if the resource is past its lifetime. It must be
+// called with the mutex held.
+func (p *Pool) expired(c io.Closer, now time.Time) bool {
+	e, ok := p.expires[c]
+	return ok && !now.Before(e)
+}
 
-			// move the remaining resources to the beginning
-			resources = resources[:copy(resources, resources[idleLen:])]
+// closeResource closes the resource in the background, at most ClosePoolSize
+// at a time. It must be called with the mutex held.
+func (p *Pool) closeResource(c io.Closer) {
+	delete(p.expires, c)
+	p.closeWG.Add(1)
+	go func() {
+		defer p.closeWG.Done()
+		p.closeSem <- struct{}{}
+		defer func() { <-p.closeSem }()
+		t := stats.BumpTime(p.Stats, "close.time")
+		stats.BumpSum(p.Stats, "close", 1)
+		if err := c.Close(); err != nil {
+			stats.BumpSum(p.Stats, "close.error", 1)
+			p.CloseErrorHandler(err)
+		}
+		t.End()
+	}()
+}
 
-			t.End()
-		case <-statsTicker.C:
-			// We can assume if we hit this then p.Stats is not nil
-			p.Stats.BumpAvg("waiting", float64(waiting.Len()))
-			p.Stats.BumpAvg("idle", float64(len(resources)))
-			p.Stats.BumpAvg("out", float64(out))
-			p.Stats.BumpAvg("alive", float64(uint(len(resources))+out))
-		case r := <-p.close:
-			// cant call close if already closing
-			if closed {
-				r <- errCloseAgain
-				continue
-			}
+// warm makes a new resource for Prewarm.
+func (p *Pool) warm() {
+	c, err := p.New()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.out--
+	if err != nil {
+		stats.BumpSum(p.Stats, "prewarm.error", 1)
+		p.dispatch()
+	} else {
+		stats.BumpSum(p.Stats, "prewarm", 1)
+		p.track(c)
+		p.put(c)
+	}
+	p.drain()
+}
 
-			closed = true
-			idleTicker.Stop() // stop idle processing
+// validate checks the checked out resource and returns it to the pool if it
+// is still usable.
+func (p *Pool) validate(c io.Closer) {
+	if err := p.Validate(c); err != nil {
+		stats.BumpSum(p.Stats, "validate.failed", 1)
+		p.Discard(c)
+		return
+	}
+	p.Release(c)
+}
 
-			// close idle since if we have idle, implicitly no one is waiting
-			for _, e := range resources {
-				closers <- e.resource
-			}
+// staleResource wraps an idle resource which needs to be validated before
+// being handed out.
+type staleResource struct {
+	io.Closer
+}
 
-			closeResponse = r
-		}
+// waited records how long an Acquire call of the class waited.
+func (p *Pool) waited(class string, start time.Time) {
+	if p.Stats == nil {
+		return
 	}
+	ms := msSince(start)
+	p.Stats.BumpHistogram("acquire.wait.time", ms)
+	p.Stats.BumpHistogram("acquire.wait.time."+class, ms)
 }
 
-type returnResource struct {
-	resource io.Closer
-	response chan error
+// msSince returns the milliseconds elapsed since start.
+func msSince(start time.Time) float64 {
+	return float64(time.Since(start)) / float64(time.Millisecond)
 }
 
 type sentinelCloser int
@@ -1,6 +1,7 @@
 package dvara
 
 import (
+	"context"
 	"errors"
 	"io"
 	"regexp"
@@ -532,3 +533,312 @@ func contains(set []string, key string) bool {
 	}
 	return false
 }
+
+func TestAcquireMaxWait(t *testing.T) {
+	t.Parallel()
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Max:           1,
+		MaxWait:       10 * time.Millisecond,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+	r, err := p.Acquire()
+	ensure.Nil(t, err)
+
+	// times out waiting for the held resource
+	_, err = p.Acquire()
+	ensure.DeepEqual(t, err, errPoolTimeout)
+
+	// the timed out waiter is not given the released resource
+	p.Release(r)
+	r, err = p.Acquire()
+	ensure.Nil(t, err)
+	p.Release(r)
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(1))
+}
+
+func TestAcquireMaxWaiting(t *testing.T) {
+	t.Parallel()
+	statsDone := make(chan struct{})
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			if key == "acquire.waiting" {
+				close(statsDone)
+			}
+		},
+	}
+
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Stats:         hc,
+		Max:           1,
+		MaxWaiting:    1,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+	r, err := p.Acquire()
+	ensure.Nil(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r, err := p.Acquire()
+		ensure.Nil(t, err)
+		p.Release(r)
+	}()
+	<-statsDone
+
+	// the waiting queue is full
+	_, err = p.Acquire()
+	ensure.DeepEqual(t, err, errPoolFull)
+
+	p.Release(r)
+	<-done
+	ensure.Nil(t, p.Close())
+}
+
+func TestAcquireContextCancel(t *testing.T) {
+	t.Parallel()
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Max:           1,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+	r, err := p.Acquire()
+	ensure.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := p.AcquireContext(ctx)
+		ensure.DeepEqual(t, err, context.Canceled)
+	}()
+	cancel()
+	<-done
+
+	// closing doesn't wait on the cancelled waiter
+	p.Release(r)
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(1))
+}
+
+func TestPrewarm(t *testing.T) {
+	t.Parallel()
+	statsDone := make(chan struct{}, 2)
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			if key == "prewarm" {
+				statsDone <- struct{}{}
+			}
+		},
+	}
+
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Stats:         hc,
+		Max:           4,
+		MinIdle:       2,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+	p.Prewarm()
+	<-statsDone
+	<-statsDone
+
+	// the prewarmed resources are handed out
+	r1, err := p.Acquire()
+	ensure.Nil(t, err)
+	r2, err := p.Acquire()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(2))
+	p.Release(r1)
+	p.Release(r2)
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(2))
+}
+
+func TestMaxLifetime(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Max:           1,
+		MaxLifetime:   time.Minute,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+		Clock:         klock,
+	}
+
+	// released before its lifetime, it is reused
+	r, err := p.Acquire()
+	ensure.Nil(t, err)
+	p.Release(r)
+	r, err = p.Acquire()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(1))
+
+	// released after its lifetime, it is replaced
+	klock.Add(time.Minute)
+	p.Release(r)
+	r, err = p.Acquire()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(2))
+	p.Release(r)
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(2))
+}
+
+func TestRecycle(t *testing.T) {
+	t.Parallel()
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Max:           2,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+	r1, err := p.Acquire()
+	ensure.Nil(t, err)
+	r2, err := p.Acquire()
+	ensure.Nil(t, err)
+	p.Release(r2)
+
+	// the idle resource is replaced right away, the acquired one when released
+	p.Recycle()
+	r2, err = p.Acquire()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(3))
+	p.Release(r1)
+	r1, err = p.Acquire()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(4))
+
+	// new resources aren't recycled again
+	p.Release(r1)
+	p.Release(r2)
+	r1, err = p.Acquire()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(4))
+	p.Release(r1)
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(4))
+}
+
+func TestValidateIdle(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	var cm resourceMaker
+	var validated int32
+	p := Pool{
+		New: cm.New,
+		Validate: func(io.Closer) error {
+			atomic.AddInt32(&validated, 1)
+			return errors.New("gone")
+		},
+		Max:           1,
+		ValidateIdle:  time.Minute,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+		Clock:         klock,
+	}
+
+	// recently used resources aren't validated
+	r, err := p.Acquire()
+	ensure.Nil(t, err)
+	p.Release(r)
+	r, err = p.Acquire()
+	ensure.Nil(t, err)
+	p.Release(r)
+	ensure.DeepEqual(t, atomic.LoadInt32(&validated), int32(0))
+
+	// idle ones are, and replaced when they fail
+	klock.Add(time.Minute)
+	r, err = p.Acquire()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&validated), int32(1))
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(2))
+	p.Release(r)
+	ensure.Nil(t, p.Close())
+}
+
+func TestValidateInterval(t *testing.T) {
+	t.Parallel()
+	statsDone := make(chan struct{})
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			if key == "validate.failed" {
+				close(statsDone)
+			}
+		},
+	}
+
+	klock := clock.NewMock()
+	var cm resourceMaker
+	p := Pool{
+		New:              cm.New,
+		Stats:            hc,
+		Validate:         func(io.Closer) error { return errors.New("gone") },
+		Max:              1,
+		ValidateInterval: time.Minute,
+		IdleTimeout:      time.Hour,
+		ClosePoolSize:    1,
+		Clock:            klock,
+	}
+	r, err := p.Acquire()
+	ensure.Nil(t, err)
+	p.Release(r)
+
+	klock.Add(time.Minute)
+	<-statsDone
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(1))
+}
+
+func BenchmarkPoolAcquireRelease(b *testing.B) {
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Max:           100,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, err := p.Acquire()
+		if err != nil {
+			b.Fatal(err)
+		}
+		p.Release(r)
+	}
+}
+
+func BenchmarkPoolAcquireReleaseParallel(b *testing.B) {
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Max:           1000,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			r, err := p.Acquire()
+			if err != nil {
+				b.Fatal(err)
+			}
+			p.Release(r)
+		}
+	})
+}
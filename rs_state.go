@@ -116,6 +116,15 @@ func (r *ReplicaSetState) Addrs() []string {
 	return members
 }
 
+// States returns the state of each member.
+func (r *ReplicaSetState) States() map[string]ReplicaState {
+	states := make(map[string]ReplicaState)
+	for _, m := range r.lastRS.Members {
+		states[m.Name] = m.State
+	}
+	return states
+}
+
 // ReplicaSetStateCreator allows for creating a ReplicaSetState from a given
 // set of seed addresses.
 type ReplicaSetStateCreator struct {
@@ -123,10 +132,14 @@ type ReplicaSetStateCreator struct {
 
 // FromAddrs creates a ReplicaSetState from the given set of see addresses. It
 // requires the addresses to be part of the same Replica Set.
-func (c *ReplicaSetStateCreator) FromAddrs(username, password string, addrs []string, replicaSetName string) (*ReplicaSetState, error) {
+func (c *ReplicaSetStateCreator) FromAddrs(credentials CredentialProvider, addrs []string, replicaSetName string) (*ReplicaSetState, error) {
+	creds, err := credentials.Credentials()
+	if err != nil {
+		return nil, err
+	}
 	var r *ReplicaSetState
 	for _, addr := range addrs {
-		ar, err := NewReplicaSetState(username, password, addr)
+		ar, err := NewReplicaSetState(creds.Username, creds.Password, addr)
 		if err != nil {
 			if err != errNoReachableServers {
 				corelog.LogErrorMessage(fmt.Sprintf("ignoring failure against address %s: %s", addr, err))
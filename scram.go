@@ -0,0 +1,209 @@
+package dvara
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// The SCRAM mechanisms clients can authenticate with.
+const (
+	ScramSHA1   = "SCRAM-SHA-1"
+	ScramSHA256 = "SCRAM-SHA-256"
+)
+
+// defaultScramIterations is the iteration count of new credentials, the same
+// as mongo's default for SCRAM-SHA-256.
+const defaultScramIterations = 15000
+
+var scramHashes = map[string]func() hash.Hash{
+	ScramSHA1:   sha1.New,
+	ScramSHA256: sha256.New,
+}
+
+var errScramAuthFailed = errors.New("Authentication failed.")
+
+// ScramCredentials are the hashed credentials of a user for one SCRAM
+// mechanism, as mongo stores them. The password can't be recovered from them.
+type ScramCredentials struct {
+	IterationCount int    `json:"iterationCount"`
+	Salt           []byte `json:"salt"`
+	StoredKey      []byte `json:"storedKey"`
+	ServerKey      []byte `json:"serverKey"`
+}
+
+// NewScramCredentials hashes the password of the user for the mechanism with
+// a random salt. Zero iterations means the default.
+func NewScramCredentials(mechanism, user, password string, iterations int) (*ScramCredentials, error) {
+	h, ok := scramHashes[mechanism]
+	if !ok {
+		return nil, fmt.Errorf("dvara: unsupported mechanism %q", mechanism)
+	}
+	if iterations == 0 {
+		iterations = defaultScramIterations
+	}
+	salt := make([]byte, h().Size()-4)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	salted := pbkdf2(h, []byte(scramPassword(mechanism, user, password)), salt, iterations)
+	clientKey := hmacSum(h, salted, "Client Key")
+	storedKey := h()
+	storedKey.Write(clientKey)
+	return &ScramCredentials{
+		IterationCount: iterations,
+		Salt:           salt,
+		StoredKey:      storedKey.Sum(nil),
+		ServerKey:      hmacSum(h, salted, "Server Key"),
+	}, nil
+}
+
+// scramPassword returns the password the way mongo feeds it to the mechanism:
+// SCRAM-SHA-1 uses the digest of the legacy MONGODB-CR scheme. Passwords are
+// not SASLprep'd, so only ASCII ones interoperate with SCRAM-SHA-256 clients
+// in every case.
+func scramPassword(mechanism, user, password string) string {
+	if mechanism != ScramSHA1 {
+		return password
+	}
+	sum := md5.Sum([]byte(user + ":mongo:" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSum(h func() hash.Hash, key []byte, s string) []byte {
+	m := hmac.New(h, key)
+	m.Write([]byte(s))
+	return m.Sum(nil)
+}
+
+// pbkdf2 derives a key as long as the hash from the password, RFC 2898.
+func pbkdf2(h func() hash.Hash, password, salt []byte, iterations int) []byte {
+	m := hmac.New(h, password)
+	m.Write(salt)
+	var block [4]byte
+	binary.BigEndian.PutUint32(block[:], 1)
+	m.Write(block[:])
+	u := m.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		m.Reset()
+		m.Write(u)
+		u = m.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// scramServer is the server side of a SCRAM conversation, RFC 5802.
+type scramServer struct {
+	mechanism string
+	hash      func() hash.Hash
+	lookup    func(user string) *ScramCredentials
+
+	user        string
+	credentials *ScramCredentials
+	gs2Header   string
+	nonce       string
+
+	clientFirstBare string
+	serverFirst     string
+}
+
+// newScramServer starts a conversation for the mechanism, looking up the
+// credentials of users with the given function.
+func newScramServer(mechanism string, lookup func(user string) *ScramCredentials) (*scramServer, error) {
+	h, ok := scramHashes[mechanism]
+	if !ok {
+		return nil, fmt.Errorf("dvara: unsupported mechanism %q", mechanism)
+	}
+	return &scramServer{mechanism: mechanism, hash: h, lookup: lookup}, nil
+}
+
+// first handles the client-first message and returns the server-first one.
+func (s *scramServer) first(payload string) (string, error) {
+	// gs2-header: channel binding isn't supported, nor authorization identities
+	parts := strings.SplitN(payload, ",", 3)
+	if len(parts) != 3 || (parts[0] != "n" && parts[0] != "y") || parts[1] != "" {
+		return "", errors.New("dvara: invalid SCRAM client-first message")
+	}
+	s.gs2Header = parts[0] + ",,"
+	s.clientFirstBare = parts[2]
+
+	attrs := scramAttributes(s.clientFirstBare)
+	user, clientNonce := attrs["n"], attrs["r"]
+	if user == "" || clientNonce == "" {
+		return "", errors.New("dvara: invalid SCRAM client-first message")
+	}
+	s.user = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(user)
+	if s.credentials = s.lookup(s.user); s.credentials == nil {
+		return "", errScramAuthFailed
+	}
+
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+	s.nonce = clientNonce + base64.StdEncoding.EncodeToString(nonce[:])
+	s.serverFirst = "r=" + s.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(s.credentials.Salt) +
+		",i=" + strconv.Itoa(s.credentials.IterationCount)
+	return s.serverFirst, nil
+}
+
+// final handles the client-final message, verifying the client's proof, and
+// returns the server-final one.
+func (s *scramServer) final(payload string) (string, error) {
+	if s.credentials == nil {
+		return "", errors.New("dvara: SCRAM conversation not started")
+	}
+	i := strings.LastIndex(payload, ",p=")
+	if i < 0 {
+		return "", errors.New("dvara: invalid SCRAM client-final message")
+	}
+	withoutProof := payload[:i]
+	attrs := scramAttributes(withoutProof)
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(s.gs2Header)) || attrs["r"] != s.nonce {
+		return "", errScramAuthFailed
+	}
+	proof, err := base64.StdEncoding.DecodeString(payload[i+len(",p="):])
+	if err != nil || len(proof) != s.hash().Size() {
+		return "", errScramAuthFailed
+	}
+
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + withoutProof
+	clientSignature := hmacSum(s.hash, s.credentials.StoredKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for j := range proof {
+		clientKey[j] = proof[j] ^ clientSignature[j]
+	}
+	storedKey := s.hash()
+	storedKey.Write(clientKey)
+	if !hmac.Equal(storedKey.Sum(nil), s.credentials.StoredKey) {
+		return "", errScramAuthFailed
+	}
+	serverSignature := hmacSum(s.hash, s.credentials.ServerKey, authMessage)
+	return "v=" + base64.StdEncoding.EncodeToString(serverSignature), nil
+}
+
+// scramAttributes parses the comma separated attributes of a SCRAM message.
+func scramAttributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, a := range strings.Split(msg, ",") {
+		if len(a) >= 2 && a[1] == '=' {
+			attrs[a[:1]] = a[2:]
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,101 @@
+package dvara
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+// scramClientFinal returns the client-final message answering the
+// server-first one of a conversation started with the client-first-bare one.
+func scramClientFinal(mechanism, user, password, clientFirstBare, serverFirst string) string {
+	attrs := scramAttributes(serverFirst)
+	salt, _ := base64.StdEncoding.DecodeString(attrs["s"])
+	iterations, _ := strconv.Atoi(attrs["i"])
+	h := scramHashes[mechanism]
+	salted := pbkdf2(h, []byte(scramPassword(mechanism, user, password)), salt, iterations)
+	clientKey := hmacSum(h, salted, "Client Key")
+	storedKey := h()
+	storedKey.Write(clientKey)
+	withoutProof := "c=biws,r=" + attrs["r"]
+	authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+	signature := hmacSum(h, storedKey.Sum(nil), authMessage)
+	for i := range clientKey {
+		clientKey[i] ^= signature[i]
+	}
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(clientKey)
+}
+
+func TestScramRFC7677(t *testing.T) {
+	t.Parallel()
+	salt, err := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	ensure.Nil(t, err)
+	salted := pbkdf2(sha256.New, []byte("pencil"), salt, 4096)
+	storedKey := sha256.Sum256(hmacSum(sha256.New, salted, "Client Key"))
+	s, err := newScramServer(ScramSHA256, nil)
+	ensure.Nil(t, err)
+	s.credentials = &ScramCredentials{
+		IterationCount: 4096,
+		Salt:           salt,
+		StoredKey:      storedKey[:],
+		ServerKey:      hmacSum(sha256.New, salted, "Server Key"),
+	}
+	s.gs2Header = "n,,"
+	s.clientFirstBare = "n=user,r=rOprNGfwEbeRWgbNEkqO"
+	s.nonce = "rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	s.serverFirst = "r=" + s.nonce + ",s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+
+	serverFinal, err := s.final("c=biws,r=" + s.nonce + ",p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, serverFinal, "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")
+}
+
+func TestScramConversation(t *testing.T) {
+	t.Parallel()
+	for mechanism := range scramHashes {
+		creds, err := NewScramCredentials(mechanism, "app", "secret", 1000)
+		ensure.Nil(t, err)
+		lookup := func(user string) *ScramCredentials {
+			if user == "app" {
+				return creds
+			}
+			return nil
+		}
+
+		// the right password authenticates
+		s, err := newScramServer(mechanism, lookup)
+		ensure.Nil(t, err)
+		serverFirst, err := s.first("n,,n=app,r=nonce")
+		ensure.Nil(t, err)
+		serverFinal, err := s.final(scramClientFinal(mechanism, "app", "secret", "n=app,r=nonce", serverFirst))
+		ensure.Nil(t, err)
+		ensure.StringContains(t, serverFinal, "v=")
+
+		// the wrong one doesn't
+		s, err = newScramServer(mechanism, lookup)
+		ensure.Nil(t, err)
+		serverFirst, err = s.first("n,,n=app,r=nonce")
+		ensure.Nil(t, err)
+		_, err = s.final(scramClientFinal(mechanism, "app", "guess", "n=app,r=nonce", serverFirst))
+		ensure.DeepEqual(t, err, errScramAuthFailed)
+
+		// nor unknown users
+		s, err = newScramServer(mechanism, lookup)
+		ensure.Nil(t, err)
+		_, err = s.first("n,,n=bob,r=nonce")
+		ensure.DeepEqual(t, err, errScramAuthFailed)
+	}
+}
+
+func TestScramUnsupported(t *testing.T) {
+	t.Parallel()
+	_, err := newScramServer("PLAIN", nil)
+	ensure.NotNil(t, err)
+	s, err := newScramServer(ScramSHA1, nil)
+	ensure.Nil(t, err)
+	_, err = s.first("p=tls-unique,,n=app,r=nonce")
+	ensure.NotNil(t, err)
+}
@@ -54,6 +54,7 @@ func (manager *StateManager) Start() error {
 	}
 
 	manager.addProxies(healthyAddrs...)
+	manager.replicaSet.ConnectionBudget.SetStates(manager.currentReplicaSetState.States())
 
 	for _, proxy := range manager.proxies {
 		go manager.startProxy(proxy)
@@ -107,6 +108,7 @@ func (manager *StateManager) Synchronize() {
 
 	manager.stopStartProxies(comparison)
 	manager.currentReplicaSetState = newState
+	manager.replicaSet.ConnectionBudget.SetStates(newState.States())
 
 	// Add discovered nodes to seed address list. Over time if the original seed
 	// nodes have gone away and new nodes have joined this ensures that we'll
@@ -170,9 +172,9 @@ func (manager *StateManager) generateProxies(addresses ...string) ([]*Proxy, err
 			ReplicaSet:     manager.replicaSet,
 			ClientListener: listener,
 			ProxyAddr:      manager.replicaSet.proxyAddr(listener),
-			Username:       manager.replicaSet.Username,
-			Password:       manager.replicaSet.Password,
+			Credentials:    manager.replicaSet.credentials(),
 			MongoAddr:      address,
+			PoolingMode:    manager.replicaSet.poolingMode(listener),
 		}
 
 		proxies = append(proxies, p)
@@ -183,7 +185,7 @@ func (manager *StateManager) generateProxies(addresses ...string) ([]*Proxy, err
 func (manager *StateManager) generateReplicaSetState() (*ReplicaSetState, error) {
 	replicaSet := manager.replicaSet
 	addrs := strings.Split(manager.baseAddrs, ",")
-	return replicaSet.ReplicaSetStateCreator.FromAddrs(replicaSet.Username, replicaSet.Password, addrs, replicaSet.Name)
+	return replicaSet.ReplicaSetStateCreator.FromAddrs(replicaSet.credentials(), addrs, replicaSet.Name)
 }
 
 func (manager *StateManager) getComparison(oldResp, newResp *replSetGetStatusResponse) (*ReplicaSetComparison, error) {
@@ -0,0 +1,106 @@
+package dvara
+
+import (
+	"math"
+	"time"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// acceptLimiter limits the rate clients are accepted at with a token bucket,
+// so a storm of reconnecting clients, after a deploy for example, waits in
+// the listen backlog rather than flooding the servers with new connections.
+// It is only used by the accept loop.
+type acceptLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	// the ongoing storm, zero if there is none
+	stormStart time.Time
+	throttled  uint64
+}
+
+func newAcceptLimiter(rate float64, burst uint) *acceptLimiter {
+	b := math.Max(float64(burst), 1)
+	return &acceptLimiter{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// reserve takes the token of the next client. It returns how long to wait
+// before accepting it.
+func (a *acceptLimiter) reserve(now time.Time) time.Duration {
+	if elapsed := now.Sub(a.last).Seconds(); elapsed > 0 {
+		a.tokens = math.Min(a.burst, a.tokens+elapsed*a.rate)
+		a.last = now
+	}
+	a.tokens--
+	if a.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-a.tokens / a.rate * float64(time.Second))
+}
+
+// throttleAccept waits until the next client may be accepted. A storm starts
+// when clients have to wait, and is over once the bucket is full again. It
+// returns false if the proxy was stopped in the meantime.
+func (p *Proxy) throttleAccept() bool {
+	a := p.acceptLimiter
+	now := time.Now()
+	wait := a.reserve(now)
+	if wait == 0 {
+		if !a.stormStart.IsZero() && a.tokens+1 >= a.burst {
+			corelog.LogInfoMessage("connection storm over", "proxy", p.ProxyAddr,
+				"throttled", a.throttled, "duration", now.Sub(a.stormStart))
+			a.stormStart = time.Time{}
+			a.throttled = 0
+		}
+		return true
+	}
+
+	if a.stormStart.IsZero() {
+		a.stormStart = now
+		stats.BumpSum(p.stats, "client.accept.storm", 1)
+		corelog.LogInfoMessage("connection storm, throttling accepted clients", "proxy", p.ProxyAddr,
+			"rate", a.rate, "burst", a.burst)
+	}
+	a.throttled++
+	stats.BumpSum(p.stats, "client.accept.throttled", 1)
+	stats.BumpAvg(p.stats, "client.accept.wait", float64(wait)/float64(time.Millisecond))
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-p.ctx.Done():
+		return false
+	}
+}
+
+// acquireDial waits for one of the concurrent dials to the member, when they
+// are limited, so a storm of clients doesn't open every server connection at
+// once. It fails if the proxy was stopped in the meantime.
+func (p *Proxy) acquireDial() error {
+	if p.dials == nil {
+		return nil
+	}
+	select {
+	case p.dials <- struct{}{}:
+		return nil
+	default:
+	}
+	stats.BumpSum(p.stats, "server.dial.throttled", 1)
+	select {
+	case p.dials <- struct{}{}:
+		return nil
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+}
+
+func (p *Proxy) releaseDial() {
+	if p.dials != nil {
+		<-p.dials
+	}
+}
@@ -0,0 +1,105 @@
+package dvara
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestAcceptLimiterReserve(t *testing.T) {
+	t.Parallel()
+	a := newAcceptLimiter(10, 3)
+	now := a.last
+	for i := 0; i < 3; i++ {
+		ensure.DeepEqual(t, a.reserve(now), time.Duration(0))
+	}
+	ensure.DeepEqual(t, a.reserve(now), 100*time.Millisecond)
+	ensure.DeepEqual(t, a.reserve(now), 200*time.Millisecond)
+
+	// the bucket refills at the rate, up to the burst
+	ensure.DeepEqual(t, a.reserve(now.Add(300*time.Millisecond)), time.Duration(0))
+	a.reserve(now.Add(time.Hour))
+	ensure.DeepEqual(t, a.tokens, float64(2))
+
+	// there is always a burst of one
+	ensure.DeepEqual(t, newAcceptLimiter(10, 0).burst, float64(1))
+}
+
+func TestThrottleAccept(t *testing.T) {
+	t.Parallel()
+	hc := newCounterClient()
+	p := &Proxy{stats: hc, acceptLimiter: newAcceptLimiter(100, 2)}
+	var cancel context.CancelFunc
+	p.ctx, cancel = context.WithCancel(context.Background())
+
+	// clients beyond the burst wait, which starts a storm
+	for i := 0; i < 4; i++ {
+		ensure.True(t, p.throttleAccept())
+	}
+	ensure.DeepEqual(t, hc.count("client.accept.storm"), float64(1))
+	ensure.DeepEqual(t, hc.count("client.accept.throttled"), float64(2))
+	ensure.False(t, p.acceptLimiter.stormStart.IsZero())
+
+	// which is over once the bucket is full again
+	p.acceptLimiter.last = p.acceptLimiter.last.Add(-time.Second)
+	ensure.True(t, p.throttleAccept())
+	ensure.True(t, p.acceptLimiter.stormStart.IsZero())
+	ensure.DeepEqual(t, p.acceptLimiter.throttled, uint64(0))
+
+	// stopping the proxy stops waiting
+	p.acceptLimiter = newAcceptLimiter(0.001, 1)
+	ensure.True(t, p.throttleAccept())
+	cancel()
+	ensure.False(t, p.throttleAccept())
+	ensure.DeepEqual(t, hc.count("client.accept.storm"), float64(2))
+}
+
+func TestMaxConcurrentDials(t *testing.T) {
+	t.Parallel()
+	hc := newCounterClient()
+	p := &Proxy{stats: hc, dials: make(chan struct{}, 2)}
+	var cancel context.CancelFunc
+	p.ctx, cancel = context.WithCancel(context.Background())
+
+	var dialing, maxDialing int32
+	dial := func() (net.Conn, error) {
+		n := atomic.AddInt32(&dialing, 1)
+		defer atomic.AddInt32(&dialing, -1)
+		for {
+			max := atomic.LoadInt32(&maxDialing)
+			if n <= max || atomic.CompareAndSwapInt32(&maxDialing, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return &fakeConn{}, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := p.dialServerConn(nil, dial)
+			ensure.Nil(t, err)
+			ensure.NotNil(t, c)
+		}()
+	}
+	wg.Wait()
+	ensure.DeepEqual(t, atomic.LoadInt32(&maxDialing), int32(2))
+	ensure.True(t, hc.count("server.dial.throttled") > 0)
+
+	// dials waiting for the others give up when the proxy stops
+	p.dials <- struct{}{}
+	p.dials <- struct{}{}
+	cancel()
+	_, err := p.dialServerConn(nil, func() (net.Conn, error) {
+		return nil, errors.New("dialed")
+	})
+	ensure.DeepEqual(t, err, context.Canceled)
+}
@@ -0,0 +1,228 @@
+package dvara
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// OpQuery flags of tailable cursors. Along with queryExhaust they make for
+// cursors which don't follow the usual one reply per request within
+// MessageTimeout.
+const (
+	queryTailable  = 1 << 1
+	queryAwaitData = 1 << 5
+)
+
+// cursorStream handles the messages of a client's awaitData and exhaust
+// cursors. A getMore on an awaitData cursor may block on the server until new
+// data comes in, and an exhaust query gets a stream of replies, so both are
+// given their own timeouts. All methods are no-ops on a nil cursorStream.
+type cursorStream struct {
+	// AwaitDataTimeout is the timeout for messages which may wait for new
+	// data, zero meaning MessageTimeout.
+	AwaitDataTimeout time.Duration
+
+	// ExhaustTimeout is the timeout for each reply streamed to an exhaust
+	// query, zero meaning MessageTimeout.
+	ExhaustTimeout time.Duration
+
+	// the connections the current message is proxied between, and its timeout
+	client         net.Conn
+	server         net.Conn
+	messageTimeout time.Duration
+
+	// streamed is true if the current message waited on an awaitData cursor
+	// or got many replies
+	streamed bool
+
+	// the open awaitData cursors by id
+	awaitData map[int64]struct{}
+}
+
+// begin starts proxying a message between the connections with the given
+// timeout.
+func (s *cursorStream) begin(client, server net.Conn, timeout time.Duration) {
+	if s == nil {
+		return
+	}
+	s.client = client
+	s.server = server
+	s.messageTimeout = timeout
+	s.streamed = false
+}
+
+// Streamed returns true if the current message waited on an awaitData cursor
+// or got many replies, so its latency says nothing of the server's load.
+func (s *cursorStream) Streamed() bool {
+	return s != nil && s.streamed
+}
+
+// extend pushes back the deadline of the current message.
+func (s *cursorStream) extend(timeout time.Duration) {
+	if s == nil {
+		return
+	}
+	s.streamed = true
+	if timeout <= 0 {
+		timeout = s.messageTimeout
+	}
+	if timeout <= 0 || s.client == nil || s.server == nil {
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	s.client.SetDeadline(deadline)
+	s.server.SetDeadline(deadline)
+}
+
+// awaiting returns true if the cursor is an awaitData one.
+func (s *cursorStream) awaiting(id int64) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := s.awaitData[id]
+	return ok
+}
+
+func (s *cursorStream) opened(id int64) {
+	if s == nil || id == 0 {
+		return
+	}
+	if s.awaitData == nil {
+		s.awaitData = make(map[int64]struct{})
+	}
+	s.awaitData[id] = struct{}{}
+}
+
+func (s *cursorStream) closed(id int64) {
+	if s == nil {
+		return
+	}
+	delete(s.awaitData, id)
+}
+
+// queryRequested handles a query with the given flags, and command document
+// if it is one, before it is sent to the server.
+func (s *cursorStream) queryRequested(flags int32, q bson.D) {
+	if s == nil {
+		return
+	}
+	if flags&queryTailable != 0 && flags&queryAwaitData != 0 {
+		s.extend(s.AwaitDataTimeout)
+		return
+	}
+	if len(q) == 0 {
+		return
+	}
+	switch q[0].Name {
+	case "getMore":
+		if id, _ := q[0].Value.(int64); s.awaiting(id) {
+			s.extend(s.AwaitDataTimeout)
+		}
+	case "killCursors":
+		ids, _ := lookup(q, "cursors").([]interface{})
+		for _, id := range ids {
+			if id, ok := id.(int64); ok {
+				s.closed(id)
+			}
+		}
+	}
+}
+
+// queryReplied handles the reply to a query with the given flags and command
+// document.
+func (s *cursorStream) queryReplied(flags int32, q bson.D, reply *replyInfo) {
+	if s == nil {
+		return
+	}
+	if flags&queryTailable != 0 && flags&queryAwaitData != 0 {
+		s.opened(reply.CursorID)
+		return
+	}
+	if len(q) == 0 || reply.Doc == nil {
+		return
+	}
+	if q[0].Name == "getMore" {
+		if reply.Failed() || reply.Doc.Cursor == nil || reply.Doc.Cursor.ID == 0 {
+			id, _ := q[0].Value.(int64)
+			s.closed(id)
+		}
+		return
+	}
+	if opensAwaitDataCursor(q) && reply.Doc.Cursor != nil && !reply.Failed() {
+		s.opened(reply.Doc.Cursor.ID)
+	}
+}
+
+// getMoreRequested handles an entire OpGetMore message before it is sent to
+// the server.
+func (s *cursorStream) getMoreRequested(msg []byte) {
+	if s.awaiting(getMoreCursorID(msg)) {
+		s.extend(s.AwaitDataTimeout)
+	}
+}
+
+// getMoreReplied handles the reply to an OpGetMore for the cursor.
+func (s *cursorStream) getMoreReplied(id int64, reply *replyInfo) {
+	if reply.CursorID == 0 || reply.ResponseFlags&replyCursorNotFound != 0 {
+		s.closed(id)
+	}
+}
+
+// killCursorsRequested handles an entire OpKillCursors message.
+func (s *cursorStream) killCursorsRequested(msg []byte) {
+	for _, id := range killCursorsIDs(msg) {
+		s.closed(id)
+	}
+}
+
+// copyExhaust copies the replies streamed to an exhaust query after the first
+// one, until its cursor is exhausted.
+func copyExhaust(
+	client io.Writer,
+	server io.Reader,
+	reply *replyInfo,
+	cursors *Cursors,
+	stream *cursorStream,
+) error {
+	for id := reply.CursorID; id != 0 && !reply.Failed(); id = reply.CursorID {
+		stream.extend(stream.exhaustTimeout())
+		var err error
+		if reply, err = copyReply(client, server, false); err != nil {
+			return err
+		}
+		cursors.getMoreReplied(id, reply)
+	}
+	return nil
+}
+
+func (s *cursorStream) exhaustTimeout() time.Duration {
+	if s == nil {
+		return 0
+	}
+	return s.ExhaustTimeout
+}
+
+// opensAwaitDataCursor returns true if the command opens a cursor whose
+// getMores wait for new data: a tailable awaitData find, or a change stream.
+func opensAwaitDataCursor(q bson.D) bool {
+	switch q[0].Name {
+	case "find":
+		return lookup(q, "tailable") == true && lookup(q, "awaitData") == true
+	case "aggregate":
+		pipeline, _ := lookup(q, "pipeline").([]interface{})
+		if len(pipeline) == 0 {
+			return false
+		}
+		switch stage := pipeline[0].(type) {
+		case bson.D:
+			return len(stage) > 0 && stage[0].Name == "$changeStream"
+		case bson.M:
+			_, ok := stage["$changeStream"]
+			return ok
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package dvara
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// deadlineConn records the last deadline set on it.
+type deadlineConn struct {
+	fakeConn
+	deadline time.Time
+}
+
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+// fakeCursorReply builds an entire OpReply message for the cursor.
+func fakeCursorReply(cursorID int64, doc interface{}) []byte {
+	b := fakeReplyTo(1, doc)
+	binary.LittleEndian.PutUint64(b[headerLen+4:], uint64(cursorID))
+	return b
+}
+
+func TestOpensAwaitDataCursor(t *testing.T) {
+	t.Parallel()
+	ensure.True(t, opensAwaitDataCursor(bson.D{
+		{Name: "find", Value: "oplog.rs"},
+		{Name: "tailable", Value: true},
+		{Name: "awaitData", Value: true},
+	}))
+	ensure.False(t, opensAwaitDataCursor(bson.D{
+		{Name: "find", Value: "oplog.rs"},
+		{Name: "tailable", Value: true},
+	}))
+	ensure.True(t, opensAwaitDataCursor(bson.D{
+		{Name: "aggregate", Value: "c"},
+		{Name: "pipeline", Value: []interface{}{bson.D{{Name: "$changeStream", Value: bson.D{}}}}},
+	}))
+	ensure.True(t, opensAwaitDataCursor(bson.D{
+		{Name: "aggregate", Value: "c"},
+		{Name: "pipeline", Value: []interface{}{bson.M{"$changeStream": bson.M{}}}},
+	}))
+	ensure.False(t, opensAwaitDataCursor(bson.D{
+		{Name: "aggregate", Value: "c"},
+		{Name: "pipeline", Value: []interface{}{bson.M{"$match": bson.M{}}}},
+	}))
+}
+
+func TestCursorStreamAwaitData(t *testing.T) {
+	t.Parallel()
+	var s cursorStream
+
+	// a change stream opens an awaitData cursor
+	aggregate := bson.D{
+		{Name: "aggregate", Value: "c"},
+		{Name: "pipeline", Value: []interface{}{bson.D{{Name: "$changeStream", Value: bson.D{}}}}},
+	}
+	s.queryRequested(0, aggregate)
+	ensure.False(t, s.Streamed())
+	s.queryReplied(0, aggregate, &replyInfo{
+		Doc: &replyDoc{Ok: 1.0, Cursor: &replyCursor{ID: 5, NS: "db.c"}},
+	})
+	ensure.True(t, s.awaiting(5))
+
+	// whose getMores wait for new data until it is exhausted
+	getMore := bson.D{{Name: "getMore", Value: int64(5)}}
+	s.queryRequested(0, getMore)
+	ensure.True(t, s.Streamed())
+	s.queryReplied(0, getMore, &replyInfo{Doc: &replyDoc{Ok: 1.0, Cursor: &replyCursor{}}})
+	ensure.False(t, s.awaiting(5))
+
+	// legacy tailable queries too, until killed
+	s.queryReplied(queryTailable|queryAwaitData, nil, &replyInfo{CursorID: 6})
+	ensure.True(t, s.awaiting(6))
+	s.killCursorsRequested(fakeKillCursors(6))
+	ensure.False(t, s.awaiting(6))
+}
+
+func TestProxyAwaitDataGetMore(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{ReplicaSet: &ReplicaSet{MessageTimeout: time.Minute}}
+	conn := &deadlineConn{fakeConn: fakeConn{in: bytes.NewReader(fakeGetMore(5))}}
+	client := p.clients.add(conn)
+	client.stream.AwaitDataTimeout = time.Hour
+	client.stream.opened(5)
+	server := &deadlineConn{fakeConn: fakeConn{in: bytes.NewReader(fakeCursorReply(0, bson.M{}))}}
+
+	h, err := p.clientReadHeader(client, time.Minute)
+	ensure.Nil(t, err)
+	var lastError LastError
+	ensure.Nil(t, p.proxyMessage(h, client, server, &lastError))
+
+	// the getMore was given the awaitData timeout, and exhausted the cursor
+	ensure.True(t, client.stream.Streamed())
+	ensure.True(t, time.Until(conn.deadline) > 30*time.Minute)
+	ensure.True(t, time.Until(server.deadline) > 30*time.Minute)
+	ensure.False(t, client.stream.awaiting(5))
+}
+
+func TestProxyExhaustQuery(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{ReplicaSet: &ReplicaSet{
+		MessageTimeout: time.Minute,
+		ProxyQuery:     &ProxyQuery{},
+	}}
+	query := fakeQuery(7, queryExhaust, "db.c", bson.M{})
+	conn := &fakeConn{in: bytes.NewReader(query)}
+	client := p.clients.add(conn)
+
+	// the server streams replies until the cursor is exhausted
+	var replies []byte
+	replies = append(replies, fakeCursorReply(5, bson.M{"a": 1})...)
+	replies = append(replies, fakeCursorReply(5, bson.M{"a": 2})...)
+	replies = append(replies, fakeCursorReply(0, bson.M{"a": 3})...)
+	next := fakeCursorReply(0, bson.M{"b": 1})
+	server := &fakeConn{in: bytes.NewReader(append(append([]byte{}, replies...), next...))}
+
+	h, err := p.clientReadHeader(client, time.Minute)
+	ensure.Nil(t, err)
+	var lastError LastError
+	ensure.Nil(t, p.proxyMessage(h, client, server, &lastError))
+	ensure.DeepEqual(t, conn.out.Bytes(), replies)
+	ensure.True(t, client.stream.Streamed())
+
+	// and nothing after them is consumed
+	ensure.DeepEqual(t, server.in.(*bytes.Reader).Len(), len(next))
+}
+
+func TestMirrorSkipsExhaust(t *testing.T) {
+	t.Parallel()
+	m := &Mirror{}
+	ensure.True(t, m.eligible(fakeQuery(1, 0, "db.c", bson.M{})))
+	ensure.False(t, m.eligible(fakeQuery(1, queryExhaust, "db.c", bson.M{})))
+}
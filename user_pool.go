@@ -0,0 +1,352 @@
+package dvara
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// userPoolsInterval is how often unused user pools are closed, and the pools
+// pick up the changes of the limits they share.
+const userPoolsInterval = time.Second
+
+// userPools are the server pools of the users mapped to a backend user, by
+// db.user. They're created when the first client of the user needs a server
+// connection, and closed once unused or with the proxy.
+type userPools struct {
+	mutex  sync.Mutex
+	pools  map[string]*userPool
+	closed bool
+
+	// max is the limit on the connections of all the pools, which also share
+	// the limit of the proxy's pool, if any
+	max    uint
+	server *Pool
+	limit  PoolLimiter
+	open   int64
+}
+
+// share makes the user pools share the limit of the proxy's pool, set by the
+// ConnectionBudget and AdaptiveLimiter, the connections of the user pools
+// counting against it. It must be called before the pools are used.
+func (u *userPools) share(server *Pool) {
+	if server.Limiter == nil {
+		return
+	}
+	u.server = server
+	u.limit = server.Limiter
+	server.Limiter = serverShareLimiter{u}
+}
+
+// free returns how many more connections the user pools may open.
+func (u *userPools) free() int64 {
+	open := atomic.LoadInt64(&u.open)
+	free := int64(u.max) - open
+	if u.limit != nil {
+		idle, acquired := u.server.Counts()
+		if f := int64(u.limit.Limit()) - int64(idle+acquired) - open; f < free {
+			free = f
+		}
+	}
+	if free < 0 {
+		return 0
+	}
+	return free
+}
+
+// serverShareLimiter leaves the proxy's pool the part of its limit the user
+// pools don't use.
+type serverShareLimiter struct {
+	pools *userPools
+}
+
+func (s serverShareLimiter) Limit() uint {
+	limit := int64(s.pools.limit.Limit()) - atomic.LoadInt64(&s.pools.open)
+	if limit < 1 {
+		return 1
+	}
+	return uint(limit)
+}
+
+// closeIdle closes the pools unused for the timeout, and returns how many
+// were.
+func (u *userPools) closeIdle(now time.Time, timeout time.Duration) int {
+	var idle []*userPool
+	u.mutex.Lock()
+	for key, pool := range u.pools {
+		if now.Sub(pool.used) < timeout {
+			continue
+		}
+		if _, acquired := pool.Counts(); acquired == 0 {
+			delete(u.pools, key)
+			idle = append(idle, pool)
+		}
+	}
+	u.mutex.Unlock()
+	for _, pool := range idle {
+		pool.Close()
+	}
+	return len(idle)
+}
+
+// checkCredentials recycles the pools whose backend user or its credentials
+// changed, so their connections authenticate as the new one.
+func (u *userPools) checkCredentials(users *UserStore) {
+	u.mutex.Lock()
+	pools := make([]*userPool, 0, len(u.pools))
+	for _, pool := range u.pools {
+		pools = append(pools, pool)
+	}
+	u.mutex.Unlock()
+	for _, pool := range pools {
+		// users which lost their backend have no clients left in the pool,
+		// which is closed once idle
+		backend, err := userBackend(users, pool.db, pool.user)
+		if err != nil || backend == pool.backend {
+			continue
+		}
+		pool.backend = backend
+		stats.BumpSum(pool.Stats, "credentials.rotated", 1)
+		corelog.LogInfoMessage("backend user changed, recycling user server connections",
+			"user", pool.user, "db", pool.db, "backend", backend.Username)
+		pool.Recycle()
+	}
+}
+
+// limitChanged tells the pools the limits they share may have changed.
+func (u *userPools) limitChanged() {
+	u.mutex.Lock()
+	pools := make([]*userPool, 0, len(u.pools))
+	for _, pool := range u.pools {
+		pools = append(pools, pool)
+	}
+	u.mutex.Unlock()
+	for _, pool := range pools {
+		pool.LimitChanged()
+	}
+	if u.server != nil {
+		u.server.LimitChanged()
+	}
+}
+
+// close closes all the pools, no more are created afterwards.
+func (u *userPools) close() {
+	u.mutex.Lock()
+	pools := u.pools
+	u.pools = nil
+	u.closed = true
+	u.mutex.Unlock()
+	for _, pool := range pools {
+		pool.Close()
+	}
+}
+
+// userPool is the server pool of a user, limited by the connections the
+// other pools leave.
+type userPool struct {
+	Pool
+	pools *userPools
+	open  int64
+	used  time.Time
+
+	// the user and the backend user its connections authenticate as, only
+	// used by manageUserPools once the pool is created
+	db, user string
+	backend  backendCredentials
+}
+
+// backendCredentials are the credentials of a backend user.
+type backendCredentials struct {
+	Credentials
+	DB string
+}
+
+// Limit lets the pool open as many connections as the user pools may still
+// open, in addition to its own.
+func (u *userPool) Limit() uint {
+	return uint(atomic.LoadInt64(&u.open) + u.pools.free())
+}
+
+// opened counts the connections the pool opens, or closes if n is negative.
+func (u *userPool) opened(n int64) {
+	atomic.AddInt64(&u.open, n)
+	atomic.AddInt64(&u.pools.open, n)
+}
+
+// clientPool returns the pool the client gets its server connections from,
+// the one of the user it authenticated as if that user maps to a backend
+// user, the proxy's otherwise.
+func (p *Proxy) clientPool(c *proxyClient) (*Pool, error) {
+	if c == nil || c.auth.user == nil || c.auth.user.Backend == nil {
+		return &p.serverPool, nil
+	}
+	u := c.auth.user
+	key := u.DB + "." + u.User
+
+	p.userPools.mutex.Lock()
+	defer p.userPools.mutex.Unlock()
+	if p.userPools.closed {
+		return nil, errPoolClosed
+	}
+	if pool := p.userPools.pools[key]; pool != nil {
+		pool.used = time.Now()
+		return &pool.Pool, nil
+	}
+	if p.userPools.pools == nil {
+		p.userPools.pools = make(map[string]*userPool)
+		p.userPools.max = p.ReplicaSet.UserPoolsMaxConnections
+		if p.userPools.max == 0 {
+			p.userPools.max = p.ReplicaSet.MaxConnections
+		}
+	}
+	pool := p.newUserPool(u)
+	pool.used = time.Now()
+	p.userPools.pools[key] = pool
+	stats.BumpSum(p.stats, "user.pool.created", 1)
+	corelog.LogInfoMessage("created user server pool",
+		"user", u.User, "db", u.DB, "backend", u.Backend.User, "max", pool.Max)
+	return &pool.Pool, nil
+}
+
+// manageUserPools closes the user pools unused for the UserPoolIdleTimeout,
+// recycles those whose backend credentials changed, and lets the pools pick
+// up the changes of the limits they share, until the proxy stops.
+func (p *Proxy) manageUserPools() {
+	ticker := time.NewTicker(userPoolsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case now := <-ticker.C:
+			if timeout := p.ReplicaSet.UserPoolIdleTimeout; timeout > 0 {
+				if n := p.userPools.closeIdle(now, timeout); n > 0 {
+					stats.BumpSum(p.stats, "user.pool.closed", float64(n))
+					corelog.LogInfoMessage("closed idle user server pools", "count", n)
+				}
+			}
+			p.userPools.checkCredentials(p.ReplicaSet.UserStore)
+			p.userPools.limitChanged()
+		}
+	}
+}
+
+// newUserPool returns the server pool of the user. It is limited to the
+// user's MaxConnections and to what the other user pools leave, and otherwise
+// configured like the proxy's.
+func (p *Proxy) newUserPool(u *User) *userPool {
+	max := u.MaxConnections
+	if max == 0 {
+		max = p.ReplicaSet.UserPoolMaxConnections
+	}
+	if max == 0 {
+		max = p.ReplicaSet.MaxConnections
+	}
+	// ordinary clients keep at least one connection
+	reserved := p.ReplicaSet.ReservedConnections
+	if reserved > 0 && reserved >= max {
+		reserved = max - 1
+	}
+	pool := &userPool{pools: &p.userPools, db: u.DB, user: u.User}
+	// without credentials yet, the pool can't connect until there are some
+	pool.backend, _ = userBackend(p.ReplicaSet.UserStore, u.DB, u.User)
+	pool.Pool = Pool{
+		CloseErrorHandler: p.serverCloseErrorHandler,
+		Max:               max,
+		Limiter:           pool,
+		IdleTimeout:       p.ReplicaSet.ServerIdleTimeout,
+		MaxWait:           p.ReplicaSet.ServerPoolMaxWait,
+		MaxWaiting:        p.ReplicaSet.ServerPoolMaxWaiting,
+		Fair:              p.ReplicaSet.FairQueuing,
+		ClassWeights:      p.ReplicaSet.ClassWeights,
+		Reserved:          reserved,
+		ReservedClass:     SystemClass,
+		MaxLifetime:       p.ReplicaSet.ServerMaxLifetime,
+		LifetimeJitter:    p.ReplicaSet.ServerLifetimeJitter,
+		Validate:          p.pingServerConn,
+		ValidateIdle:      p.ReplicaSet.ServerValidateIdle,
+		ValidateInterval:  p.ReplicaSet.ServerValidateInterval,
+		ClosePoolSize:     p.ReplicaSet.ServerClosePoolSize,
+	}
+	db, name := u.DB, u.User
+	pool.New = func() (io.Closer, error) {
+		pool.opened(1)
+		c, err := p.dialServerConn(pool, func() (net.Conn, error) {
+			return p.newUserConn(db, name)
+		})
+		if err != nil {
+			pool.opened(-1)
+		}
+		return c, err
+	}
+	if p.ReplicaSet.Stats != nil {
+		pool.Stats = stats.PrefixClient(
+			[]string{fmt.Sprintf("mongoproxy.server.pool.user.%s.%s.", db, name)},
+			p.ReplicaSet.Stats,
+		)
+	}
+	return pool
+}
+
+// newUserConn opens a single connection to the server authenticated as the
+// backend user the user currently maps to, so new connections pick up
+// changes to the users file and to the backend user's password.
+func (p *Proxy) newUserConn(db, name string) (net.Conn, error) {
+	backend, err := userBackend(p.ReplicaSet.UserStore, db, name)
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.DialTimeout("tcp", p.MongoAddr, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	socket := &mongoSocket{conn: c}
+	err = socket.Login(Credential{
+		Username: backend.Username,
+		Password: backend.Password,
+		Source:   backend.DB,
+	})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// userBackend returns the current credentials of the backend user the user
+// maps to.
+func userBackend(users *UserStore, db, name string) (backendCredentials, error) {
+	u := users.Lookup(db, name)
+	if u == nil || u.Backend == nil {
+		return backendCredentials{}, fmt.Errorf("dvara: user %s.%s no longer has a backend user", db, name)
+	}
+	c, err := u.Backend.credentials().Credentials()
+	if err != nil {
+		return backendCredentials{}, err
+	}
+	return backendCredentials{Credentials: c, DB: u.Backend.DB}, nil
+}
+
+// serverConnPool returns the pool the server connection was acquired from.
+func (p *Proxy) serverConnPool(c net.Conn) *Pool {
+	if pc, ok := c.(*pooledConn); ok && pc.pool != nil {
+		return &pc.pool.Pool
+	}
+	return &p.serverPool
+}
+
+// releaseServerConn returns the server connection to its pool.
+func (p *Proxy) releaseServerConn(c net.Conn) {
+	p.serverConnPool(c).Release(c)
+}
+
+// discardServerConn throws away the server connection.
+func (p *Proxy) discardServerConn(c net.Conn) {
+	p.serverConnPool(c).Discard(c)
+}
@@ -0,0 +1,224 @@
+package dvara
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// writeBackendUsers writes a users file holding the users.
+func writeBackendUsers(t *testing.T, dir string, users ...*User) string {
+	b, err := json.Marshal(users)
+	ensure.Nil(t, err)
+	path := filepath.Join(dir, "users.json")
+	ensure.Nil(t, ioutil.WriteFile(path, b, 0600))
+	return path
+}
+
+func TestClientPool(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "dvara-user-pool")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+	users := &UserStore{Path: writeBackendUsers(t, dir,
+		&User{User: "shared", DB: "admin"},
+		&User{User: "app", DB: "admin", Backend: &BackendUser{User: "app", DB: "admin", PasswordEnv: "APP_PASSWORD"}},
+		&User{User: "batch", DB: "admin", Backend: &BackendUser{User: "batch", DB: "admin", PasswordEnv: "BATCH_PASSWORD"}, MaxConnections: 5},
+	)}
+	ensure.Nil(t, users.Start())
+
+	hc := newCounterClient()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:         10,
+			UserPoolMaxConnections: 3,
+			ServerIdleTimeout:      time.Hour,
+			ServerClosePoolSize:    1,
+			UserStore:              users,
+		},
+		stats: hc,
+	}
+	client := func(user string) *proxyClient {
+		c := p.clients.add(&fakeConn{})
+		c.auth.user = users.Lookup("admin", user)
+		return c
+	}
+
+	// unauthenticated clients and users without a backend share the proxy's
+	pool, err := p.clientPool(nil)
+	ensure.Nil(t, err)
+	ensure.True(t, pool == &p.serverPool)
+	pool, err = p.clientPool(client("shared"))
+	ensure.Nil(t, err)
+	ensure.True(t, pool == &p.serverPool)
+
+	// the others get their own, with their limit
+	app, err := p.clientPool(client("app"))
+	ensure.Nil(t, err)
+	ensure.True(t, app != &p.serverPool)
+	ensure.DeepEqual(t, app.Max, uint(3))
+	pool, err = p.clientPool(client("app"))
+	ensure.Nil(t, err)
+	ensure.True(t, pool == app)
+	batch, err := p.clientPool(client("batch"))
+	ensure.Nil(t, err)
+	ensure.True(t, batch != app)
+	ensure.DeepEqual(t, batch.Max, uint(5))
+	ensure.DeepEqual(t, hc.count("user.pool.created"), float64(2))
+
+	// which are closed with the proxy
+	p.userPools.close()
+	_, err = p.clientPool(client("app"))
+	ensure.DeepEqual(t, err, errPoolClosed)
+}
+
+func TestUserPoolLimits(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "dvara-user-pool")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+	users := &UserStore{Path: writeBackendUsers(t, dir,
+		&User{User: "app", DB: "admin", Backend: &BackendUser{User: "app", DB: "admin", PasswordEnv: "APP_PASSWORD"}},
+		&User{User: "batch", DB: "admin", Backend: &BackendUser{User: "batch", DB: "admin", PasswordEnv: "BATCH_PASSWORD"}},
+	)}
+	ensure.Nil(t, users.Start())
+
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:          10,
+			UserPoolMaxConnections:  3,
+			UserPoolsMaxConnections: 4,
+			ReservedConnections:     5,
+			ServerIdleTimeout:       time.Hour,
+			ServerClosePoolSize:     1,
+			UserStore:               users,
+		},
+	}
+	pool := func(user string) *userPool {
+		c := p.clients.add(&fakeConn{})
+		c.auth.user = users.Lookup("admin", user)
+		_, err := p.clientPool(c)
+		ensure.Nil(t, err)
+		return p.userPools.pools["admin."+user]
+	}
+	app, batch := pool("app"), pool("batch")
+	ensure.DeepEqual(t, app.Reserved, uint(2))
+
+	// the pools share their combined limit
+	ensure.DeepEqual(t, app.Limit(), uint(4))
+	app.opened(3)
+	ensure.DeepEqual(t, app.Limit(), uint(4))
+	ensure.DeepEqual(t, batch.Limit(), uint(1))
+
+	// and the limit of the proxy's pool, set by the budget
+	server := &Pool{Max: 10, IdleTimeout: time.Hour, ClosePoolSize: 1, Limiter: &budgetShare{limit: 5}}
+	defer server.Close()
+	p.userPools.share(server)
+	ensure.DeepEqual(t, server.Limiter.Limit(), uint(2))
+	ensure.DeepEqual(t, batch.Limit(), uint(1))
+	batch.opened(1)
+	ensure.DeepEqual(t, batch.Limit(), uint(1))
+	ensure.DeepEqual(t, server.Limiter.Limit(), uint(1))
+	app.opened(-3)
+	ensure.DeepEqual(t, server.Limiter.Limit(), uint(4))
+	ensure.DeepEqual(t, app.Limit(), uint(3))
+
+	// unused pools are closed
+	batch.used = time.Now().Add(-time.Hour)
+	ensure.DeepEqual(t, p.userPools.closeIdle(time.Now(), time.Minute), 1)
+	ensure.DeepEqual(t, len(p.userPools.pools), 1)
+	ensure.True(t, p.userPools.pools["admin.app"] == app)
+	p.userPools.close()
+}
+
+func TestUserPoolServerConns(t *testing.T) {
+	t.Parallel()
+	var mutex sync.Mutex
+	var authenticated []string
+	l := fakeServer(t, func(request []byte) []byte {
+		name, cmd := requestCommand(request)
+		if name == "getnonce" {
+			return fakeReplyTo(getInt32(request, 4), bson.M{"nonce": "abc", "ok": 1})
+		}
+		if name == "authenticate" {
+			mutex.Lock()
+			authenticated = append(authenticated, lookup(cmd, "user").(string))
+			mutex.Unlock()
+		}
+		return fakeReplyTo(getInt32(request, 4), bson.M{"ok": 1})
+	})
+	defer l.Close()
+
+	dir, err := ioutil.TempDir("", "dvara-user-pool")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+	password := filepath.Join(dir, "password")
+	ensure.Nil(t, ioutil.WriteFile(password, []byte("pw\n"), 0600))
+	users := &UserStore{Path: writeBackendUsers(t, dir,
+		&User{User: "app", DB: "admin", Backend: &BackendUser{User: "app-rw", DB: "prod", PasswordFile: password}},
+	)}
+	ensure.Nil(t, users.Start())
+
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:      10,
+			ServerIdleTimeout:   time.Hour,
+			ServerClosePoolSize: 1,
+			UserStore:           users,
+		},
+		MongoAddr: l.Addr().String(),
+		ctx:       context.Background(),
+	}
+	defer p.userPools.close()
+	c := p.clients.add(&fakeConn{})
+	c.auth.user = users.Lookup("admin", "app")
+
+	// connections are authenticated as the backend user
+	serverConn, err := p.getServerConn(p.ctx, c)
+	ensure.Nil(t, err)
+	mutex.Lock()
+	ensure.DeepEqual(t, authenticated, []string{"app-rw"})
+	mutex.Unlock()
+
+	// and go back to the user's pool
+	pool, err := p.clientPool(c)
+	ensure.Nil(t, err)
+	ensure.True(t, p.serverConnPool(serverConn) == pool)
+	p.releaseServerConn(serverConn)
+	again, err := p.getServerConn(p.ctx, c)
+	ensure.Nil(t, err)
+	ensure.True(t, again == serverConn)
+	p.releaseServerConn(again)
+
+	// the connections are kept while the backend credentials stay the same
+	p.userPools.checkCredentials(users)
+	again, err = p.getServerConn(p.ctx, c)
+	ensure.Nil(t, err)
+	ensure.True(t, again == serverConn)
+	p.releaseServerConn(again)
+
+	// and replaced once the password is rotated
+	ensure.Nil(t, ioutil.WriteFile(password, []byte("rotated\n"), 0600))
+	p.userPools.checkCredentials(users)
+	again, err = p.getServerConn(p.ctx, c)
+	ensure.Nil(t, err)
+	ensure.False(t, again == serverConn)
+	mutex.Lock()
+	ensure.DeepEqual(t, authenticated, []string{"app-rw", "app-rw"})
+	mutex.Unlock()
+	p.discardServerConn(again)
+
+	// users losing their backend can't connect anymore
+	writeBackendUsers(t, dir, &User{User: "app", DB: "admin"})
+	ensure.Nil(t, users.load())
+	_, err = p.newUserConn("admin", "app")
+	ensure.NotNil(t, err)
+}
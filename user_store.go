@@ -0,0 +1,199 @@
+package dvara
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// User is a user clients can authenticate as at the proxy, with its hashed
+// credentials by SCRAM mechanism.
+type User struct {
+	User        string                       `json:"user"`
+	DB          string                       `json:"db"`
+	Credentials map[string]*ScramCredentials `json:"credentials"`
+
+	// Backend is the user the servers know this one as. Its clients get
+	// server connections of their own, authenticated as the backend user, so
+	// the servers' access control and auditing apply to them. Clients of
+	// users without one share the proxy's server connections.
+	Backend *BackendUser `json:"backend,omitempty"`
+
+	// MaxConnections is the maximum number of server connections per member
+	// for the user's clients, ReplicaSet.UserPoolMaxConnections if zero.
+	MaxConnections uint `json:"maxConnections,omitempty"`
+}
+
+// BackendUser is a user of the servers. Its password isn't kept in the users
+// file but in an environment variable or a file, such as a mounted secret,
+// which is read every time a connection is opened.
+type BackendUser struct {
+	User         string `json:"user"`
+	DB           string `json:"db"`
+	PasswordEnv  string `json:"passwordEnv,omitempty"`
+	PasswordFile string `json:"passwordFile,omitempty"`
+}
+
+// credentials returns the provider of the backend user's credentials.
+func (b *BackendUser) credentials() CredentialProvider {
+	if b.PasswordFile != "" {
+		return FileCredentials{Username: b.User, PasswordFile: b.PasswordFile}
+	}
+	return EnvCredentials{Username: b.User, PasswordVar: b.PasswordEnv}
+}
+
+// NewUser returns the user of the database with the password hashed for
+// every supported mechanism.
+func NewUser(user, db, password string) (*User, error) {
+	u := &User{User: user, DB: db, Credentials: make(map[string]*ScramCredentials)}
+	for mechanism := range scramHashes {
+		c, err := NewScramCredentials(mechanism, user, password, 0)
+		if err != nil {
+			return nil, err
+		}
+		u.Credentials[mechanism] = c
+	}
+	return u, nil
+}
+
+// UserStore holds the users clients authenticate as, loaded from a file
+// holding a JSON array of Users. The file is reloaded when it changes.
+type UserStore struct {
+	// Path is the file the users are loaded from. If empty clients aren't
+	// authenticated at the proxy.
+	Path string
+
+	// ReloadInterval is how often the file is checked for changes. Zero
+	// disables reloading.
+	ReloadInterval time.Duration
+
+	// Stats if provided will be used to record interesting stats.
+	Stats stats.Client `inject:""`
+
+	mutex   sync.RWMutex
+	users   map[string]*User
+	modTime time.Time
+	stop    chan struct{}
+
+	// generation is incremented every time the users are loaded
+	generation uint32
+}
+
+// Enabled returns true if clients must authenticate.
+func (s *UserStore) Enabled() bool {
+	return s != nil && s.Path != ""
+}
+
+// Start loads the users and starts watching the file for changes.
+func (s *UserStore) Start() error {
+	if !s.Enabled() {
+		return nil
+	}
+	if err := s.load(); err != nil {
+		return err
+	}
+	if s.ReloadInterval > 0 {
+		s.stop = make(chan struct{})
+		go s.reloadLoop()
+	}
+	return nil
+}
+
+// Stop stops watching the file.
+func (s *UserStore) Stop() error {
+	if s.stop != nil {
+		close(s.stop)
+	}
+	return nil
+}
+
+// Lookup returns the user of the database, nil if there is none.
+func (s *UserStore) Lookup(db, user string) *User {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.users[db+"."+user]
+}
+
+// loaded returns the generation of the users, which changes every time they
+// are loaded.
+func (s *UserStore) loaded() uint32 {
+	return atomic.LoadUint32(&s.generation)
+}
+
+func (s *UserStore) reloadLoop() {
+	ticker := time.NewTicker(s.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.reload(); err != nil {
+				stats.BumpSum(s.Stats, "users.reload.error", 1)
+				corelog.LogError("error", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// reload loads the users again if the file changed. The current users are
+// kept if it can't be loaded.
+func (s *UserStore) reload() error {
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return err
+	}
+	s.mutex.RLock()
+	changed := !info.ModTime().Equal(s.modTime)
+	s.mutex.RUnlock()
+	if !changed {
+		return nil
+	}
+	return s.load()
+}
+
+func (s *UserStore) load() error {
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return err
+	}
+	var list []*User
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("dvara: invalid users file %s: %s", s.Path, err)
+	}
+	users := make(map[string]*User, len(list))
+	for _, u := range list {
+		if u.User == "" || u.DB == "" {
+			return fmt.Errorf("dvara: invalid users file %s: user without name or db", s.Path)
+		}
+		if u.Backend != nil && (u.Backend.User == "" || u.Backend.DB == "") {
+			return fmt.Errorf("dvara: invalid users file %s: backend of %s.%s without name or db",
+				s.Path, u.DB, u.User)
+		}
+		if u.Backend != nil && (u.Backend.PasswordEnv == "") == (u.Backend.PasswordFile == "") {
+			return fmt.Errorf("dvara: invalid users file %s: backend of %s.%s needs either passwordEnv or passwordFile",
+				s.Path, u.DB, u.User)
+		}
+		users[u.DB+"."+u.User] = u
+	}
+
+	s.mutex.Lock()
+	s.users = users
+	s.modTime = info.ModTime()
+	atomic.AddUint32(&s.generation, 1)
+	s.mutex.Unlock()
+	stats.BumpSum(s.Stats, "users.reload", 1)
+	corelog.LogInfoMessage("loaded users", "path", s.Path, "count", len(users))
+	return nil
+}
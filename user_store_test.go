@@ -0,0 +1,57 @@
+package dvara
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestUserStoreReload(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "dvara-users")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s := &UserStore{Path: writeUsers(t, dir, "app", "admin", "secret")}
+	ensure.Nil(t, s.Start())
+	defer s.Stop()
+	ensure.NotNil(t, s.Lookup("admin", "app"))
+	ensure.True(t, s.Lookup("db", "app") == nil)
+	u := s.Lookup("admin", "app")
+	ensure.DeepEqual(t, len(u.Credentials), 2)
+
+	// unchanged files aren't loaded again
+	ensure.Nil(t, s.reload())
+	ensure.True(t, s.Lookup("admin", "app") == u)
+
+	// changed ones are
+	writeUsers(t, dir, "batch", "admin", "secret")
+	future := time.Now().Add(time.Hour)
+	ensure.Nil(t, os.Chtimes(s.Path, future, future))
+	ensure.Nil(t, s.reload())
+	ensure.True(t, s.Lookup("admin", "app") == nil)
+	ensure.NotNil(t, s.Lookup("admin", "batch"))
+
+	// and broken ones are ignored
+	ensure.Nil(t, ioutil.WriteFile(s.Path, []byte("{"), 0600))
+	ensure.Nil(t, os.Chtimes(s.Path, future.Add(time.Hour), future.Add(time.Hour)))
+	ensure.NotNil(t, s.reload())
+	ensure.NotNil(t, s.Lookup("admin", "batch"))
+
+	// as are backend users without a password source
+	writeBackendUsers(t, dir, &User{User: "app", DB: "admin", Backend: &BackendUser{User: "app", DB: "admin"}})
+	ensure.NotNil(t, s.load())
+	ensure.NotNil(t, s.Lookup("admin", "batch"))
+}
+
+func TestUserStoreDisabled(t *testing.T) {
+	t.Parallel()
+	var s *UserStore
+	ensure.False(t, s.Enabled())
+	ensure.Nil(t, (&UserStore{}).Start())
+	ensure.NotNil(t, (&UserStore{Path: filepath.Join(os.TempDir(), "dvara-missing.json")}).Start())
+}
@@ -0,0 +1,190 @@
+package dvara
+
+import (
+	"container/list"
+	"context"
+	"io"
+)
+
+// DefaultClass is the class of Acquire calls which don't specify one.
+const DefaultClass = "default"
+
+type poolClientKey struct{}
+
+type poolClient struct {
+	key   string
+	class string
+}
+
+// WithPoolClient returns a context identifying who is acquiring from a Pool.
+// Fair pools queue waiters per key and weight keys by their class.
+func WithPoolClient(ctx context.Context, key, class string) context.Context {
+	return context.WithValue(ctx, poolClientKey{}, poolClient{key: key, class: class})
+}
+
+// waiter is an Acquire call waiting for a resource.
+type waiter struct {
+	acquire chan io.Closer
+	key     string
+	class   string
+
+	// where the waiter is queued, so it is removed without searching, elem
+	// being nil once it was
+	elem    *list.Element
+	list    *list.List
+	waitKey *waitKey
+}
+
+func newWaiter(ctx context.Context) *waiter {
+	w := &waiter{acquire: make(chan io.Closer, 1), class: DefaultClass}
+	if c, ok := ctx.Value(poolClientKey{}).(poolClient); ok {
+		w.key = c.key
+		if c.class != "" {
+			w.class = c.class
+		}
+	}
+	return w
+}
+
+// poolClientClass returns the class of the client acquiring from a Pool.
+func poolClientClass(ctx context.Context) string {
+	if c, ok := ctx.Value(poolClientKey{}).(poolClient); ok && c.class != "" {
+		return c.class
+	}
+	return DefaultClass
+}
+
+// waitQueue holds the waiters of a Pool. Waiters of the reserved class are
+// always served first. The others are served in order, or when fair, round
+// robin between keys with each key served as many times in a row as the weight
+// of its class.
+type waitQueue struct {
+	fair          bool
+	weights       map[string]uint
+	reservedClass string
+
+	n        int
+	reserved list.List
+	fifo     list.List
+	keys     map[string]*waitKey
+	order    list.List
+	next     *list.Element
+	served   uint
+}
+
+// waitKey holds the waiters of a key of a fair waitQueue.
+type waitKey struct {
+	key     string
+	waiters list.List
+	elem    *list.Element
+}
+
+func newWaitQueue(fair bool, weights map[string]uint, reservedClass string) *waitQueue {
+	return &waitQueue{
+		fair:          fair,
+		weights:       weights,
+		reservedClass: reservedClass,
+		keys:          make(map[string]*waitKey),
+	}
+}
+
+// Len returns the number of waiters.
+func (q *waitQueue) Len() int {
+	return q.n
+}
+
+// Push adds a waiter to the queue.
+func (q *waitQueue) Push(w *waiter) {
+	q.n++
+	switch {
+	case q.reservedClass != "" && w.class == q.reservedClass:
+		w.list = &q.reserved
+	case !q.fair:
+		w.list = &q.fifo
+	default:
+		k, ok := q.keys[w.key]
+		if !ok {
+			k = &waitKey{key: w.key}
+			k.elem = q.order.PushBack(k)
+			q.keys[w.key] = k
+		}
+		w.list = &k.waiters
+		w.waitKey = k
+	}
+	w.elem = w.list.PushBack(w)
+}
+
+// Pop removes and returns the next waiter, nil if there is none. Waiters of
+// the reserved class are considered if reserved is true, others if unreserved
+// is true.
+func (q *waitQueue) Pop(reserved, unreserved bool) *waiter {
+	if reserved && q.reserved.Len() > 0 {
+		return q.pop(&q.reserved)
+	}
+	if !unreserved {
+		return nil
+	}
+	if !q.fair {
+		if q.fifo.Len() == 0 {
+			return nil
+		}
+		return q.pop(&q.fifo)
+	}
+	if q.order.Len() == 0 {
+		return nil
+	}
+
+	if q.next == nil {
+		q.next = q.order.Front()
+	}
+	k := q.next.Value.(*waitKey)
+	w := q.pop(&k.waiters)
+	q.served++
+	if k.waiters.Len() == 0 {
+		q.removeKey(k)
+	} else if q.served >= q.weight(w.class) {
+		q.next = q.next.Next()
+		q.served = 0
+	}
+	return w
+}
+
+// pop removes and returns the first waiter of the list.
+func (q *waitQueue) pop(l *list.List) *waiter {
+	w := l.Remove(l.Front()).(*waiter)
+	w.elem = nil
+	q.n--
+	return w
+}
+
+// Remove removes the waiter and returns true if it was still queued.
+func (q *waitQueue) Remove(w *waiter) bool {
+	if w.elem == nil {
+		return false
+	}
+	w.list.Remove(w.elem)
+	w.elem = nil
+	q.n--
+	if k := w.waitKey; k != nil && k.waiters.Len() == 0 {
+		q.removeKey(k)
+	}
+	return true
+}
+
+// removeKey removes the key from the round robin order, the next key being
+// served if it was.
+func (q *waitQueue) removeKey(k *waitKey) {
+	if q.next == k.elem {
+		q.next = k.elem.Next()
+		q.served = 0
+	}
+	q.order.Remove(k.elem)
+	delete(q.keys, k.key)
+}
+
+func (q *waitQueue) weight(class string) uint {
+	if w := q.weights[class]; w > 0 {
+		return w
+	}
+	return 1
+}
@@ -0,0 +1,189 @@
+package dvara
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/stats"
+)
+
+func testWaiter(key, class string) *waiter {
+	return newWaiter(WithPoolClient(context.Background(), key, class))
+}
+
+func popKeys(q *waitQueue, n int) []string {
+	var keys []string
+	for i := 0; i < n; i++ {
+		keys = append(keys, q.Pop(true, true).key)
+	}
+	return keys
+}
+
+func TestWaitQueueFIFO(t *testing.T) {
+	t.Parallel()
+	q := newWaitQueue(false, nil, SystemClass)
+	q.Push(testWaiter("a", DefaultClass))
+	q.Push(testWaiter("a", DefaultClass))
+	q.Push(testWaiter("b", DefaultClass))
+	q.Push(testWaiter("c", SystemClass))
+	ensure.DeepEqual(t, q.Len(), 4)
+
+	// reserved class first, then in order
+	ensure.DeepEqual(t, popKeys(q, 4), []string{"c", "a", "a", "b"})
+	ensure.True(t, q.Pop(true, true) == nil)
+	ensure.DeepEqual(t, q.Len(), 0)
+}
+
+func TestWaitQueueWeightedRoundRobin(t *testing.T) {
+	t.Parallel()
+	q := newWaitQueue(true, map[string]uint{"batch": 1, DefaultClass: 2}, "")
+	for i := 0; i < 4; i++ {
+		q.Push(testWaiter("batch1", "batch"))
+	}
+	for i := 0; i < 3; i++ {
+		q.Push(testWaiter("web1", DefaultClass))
+	}
+	q.Push(testWaiter("web2", DefaultClass))
+
+	ensure.DeepEqual(t, popKeys(q, 8), []string{
+		"batch1", "web1", "web1", "web2",
+		"batch1", "web1",
+		"batch1", "batch1",
+	})
+	ensure.DeepEqual(t, q.Len(), 0)
+}
+
+func TestWaitQueueReservedOnly(t *testing.T) {
+	t.Parallel()
+	q := newWaitQueue(true, nil, SystemClass)
+	q.Push(testWaiter("a", DefaultClass))
+	ensure.True(t, q.Pop(true, false) == nil)
+	q.Push(testWaiter("b", SystemClass))
+	ensure.DeepEqual(t, q.Pop(true, false).key, "b")
+	ensure.DeepEqual(t, q.Pop(true, true).key, "a")
+}
+
+func TestWaitQueueRemove(t *testing.T) {
+	t.Parallel()
+	q := newWaitQueue(true, nil, "")
+	a := testWaiter("a", DefaultClass)
+	b := testWaiter("b", DefaultClass)
+	c := testWaiter("c", DefaultClass)
+	q.Push(a)
+	q.Push(b)
+	q.Push(c)
+	ensure.True(t, q.Remove(b))
+	ensure.False(t, q.Remove(b))
+	ensure.DeepEqual(t, q.Len(), 2)
+	ensure.DeepEqual(t, popKeys(q, 2), []string{"a", "c"})
+	ensure.False(t, q.Remove(a))
+
+	// removing the key being served moves on to the next one
+	q = newWaitQueue(true, map[string]uint{DefaultClass: 2}, "")
+	for _, key := range []string{"a", "a", "b", "c"} {
+		q.Push(testWaiter(key, DefaultClass))
+	}
+	a = testWaiter("a", DefaultClass)
+	q.Push(a)
+	ensure.DeepEqual(t, popKeys(q, 1), []string{"a"})
+	ensure.True(t, q.Remove(a))
+	ensure.True(t, q.Remove(q.keys["a"].waiters.Front().Value.(*waiter)))
+	ensure.DeepEqual(t, q.Len(), 2)
+	ensure.DeepEqual(t, popKeys(q, 2), []string{"b", "c"})
+}
+
+func TestPoolReserved(t *testing.T) {
+	t.Parallel()
+	statsDone := make(chan struct{})
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			if key == "acquire.waiting" {
+				close(statsDone)
+			}
+		},
+	}
+
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Stats:         hc,
+		Max:           2,
+		Reserved:      1,
+		ReservedClass: SystemClass,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+	r, err := p.Acquire()
+	ensure.Nil(t, err)
+
+	// the second resource is reserved
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r, err := p.Acquire()
+		ensure.Nil(t, err)
+		p.Release(r)
+	}()
+	<-statsDone
+
+	system := WithPoolClient(context.Background(), "127.0.0.1", SystemClass)
+	s, err := p.AcquireContext(system)
+	ensure.Nil(t, err)
+	p.Release(s)
+
+	p.Release(r)
+	<-done
+	ensure.Nil(t, p.Close())
+}
+
+func TestParseClientClasses(t *testing.T) {
+	t.Parallel()
+	classes, err := ParseClientClasses("batch=10.1.0.0/16, 10.2.0.0/16; system=127.0.0.1")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(classes), 2)
+
+	r := ReplicaSet{ClientClasses: classes}
+	ensure.DeepEqual(t, r.clientClass(net.ParseIP("10.2.3.4")), "batch")
+	ensure.DeepEqual(t, r.clientClass(net.ParseIP("127.0.0.1")), SystemClass)
+	ensure.DeepEqual(t, r.clientClass(net.ParseIP("10.3.0.1")), DefaultClass)
+
+	_, err = ParseClientClasses("10.1.0.0/16")
+	ensure.NotNil(t, err)
+}
+
+func TestParseClassWeights(t *testing.T) {
+	t.Parallel()
+	weights, err := ParseClassWeights("batch=1, default=4")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, weights, map[string]uint{"batch": 1, DefaultClass: 4})
+
+	_, err = ParseClassWeights("batch=0")
+	ensure.NotNil(t, err)
+}
+
+func TestSystemClients(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	defer l.Close()
+
+	var r ReplicaSet
+	system, err := r.dialSystem(l.Addr().String())
+	ensure.Nil(t, err)
+	accepted, err := l.Accept()
+	ensure.Nil(t, err)
+	defer accepted.Close()
+	other, err := net.Dial("tcp", l.Addr().String())
+	ensure.Nil(t, err)
+	defer other.Close()
+
+	ensure.True(t, r.isSystemClient(accepted.RemoteAddr()))
+	ensure.False(t, r.isSystemClient(other.LocalAddr()))
+	ensure.Nil(t, system.Close())
+	ensure.False(t, r.isSystemClient(accepted.RemoteAddr()))
+
+	ensure.DeepEqual(t, poolClientClass(withSystemClient(context.Background())), SystemClass)
+}